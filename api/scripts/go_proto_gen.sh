@@ -42,4 +42,12 @@ cp -f bazel-bin/api/envoy/http/backend_auth/*/config_go_proto%/github.com/Google
 # HTTP filter backend_routing
 bazel build //api/envoy/http/backend_routing:config_go_proto
 mkdir -p src/go/proto/api/envoy/http/backend_routing
-cp -f bazel-bin/api/envoy/http/backend_routing/*/config_go_proto%/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/backend_routing/* src/go/proto/api/envoy/http/backend_routing
\ No newline at end of file
+cp -f bazel-bin/api/envoy/http/backend_routing/*/config_go_proto%/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/backend_routing/* src/go/proto/api/envoy/http/backend_routing
+# HTTP filter local_rate_limit
+bazel build //api/envoy/http/local_rate_limit:config_go_proto
+mkdir -p src/go/proto/api/envoy/http/local_rate_limit
+cp -f bazel-bin/api/envoy/http/local_rate_limit/*/config_go_proto%/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/local_rate_limit/* src/go/proto/api/envoy/http/local_rate_limit
+# HTTP filter rate_limit_descriptors
+bazel build //api/envoy/http/rate_limit_descriptors:config_go_proto
+mkdir -p src/go/proto/api/envoy/http/rate_limit_descriptors
+cp -f bazel-bin/api/envoy/http/rate_limit_descriptors/*/config_go_proto%/github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/rate_limit_descriptors/* src/go/proto/api/envoy/http/rate_limit_descriptors
\ No newline at end of file
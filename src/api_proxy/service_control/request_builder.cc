@@ -935,6 +935,7 @@ constexpr char kLogFieldNameReferer[] = "referer";
 constexpr char kLogFieldNameRequestHeaders[] = "request_headers";
 constexpr char kLogFieldNameRequestLatency[] = "request_latency_in_ms";
 constexpr char kLogFieldNameRequestSize[] = "request_size_in_bytes";
+constexpr char kLogFieldNameResponseCodeDetail[] = "response_code_detail";
 constexpr char kLogFieldNameResponseHeaders[] = "response_headers";
 constexpr char kLogFieldNameResponseSize[] = "response_size_in_bytes";
 constexpr char kLogFieldNameServiceAgent[] = "service_agent";
@@ -1027,6 +1028,10 @@ void FillLogEntry(const ReportRequestInfo& info, const std::string& name,
   }
 
   (*fields)[kLogFieldNameHttpResponseCode].set_number_value(info.response_code);
+  if (!info.response_code_detail.empty()) {
+    (*fields)[kLogFieldNameResponseCodeDetail].set_string_value(
+        info.response_code_detail);
+  }
   if (info.request_size >= 0) {
     (*fields)[kLogFieldNameRequestSize].set_number_value(info.request_size);
   }
@@ -356,6 +356,26 @@ TEST_F(RequestBuilderTest, FillReportRequestFailedTest) {
   ASSERT_EQ(expected_text, text);
 }
 
+TEST_F(RequestBuilderTest, FillReportRequestOverflowTest) {
+  ReportRequestInfo info;
+  FillOperationInfo(&info);
+  FillReportRequestInfo(&info);
+
+  // The circuit breakers of the backend rejected the request.
+  info.response_code = 503;
+  info.response_code_detail =
+      "upstream_reset_before_response_started{overflow}";
+
+  gasv1::ReportRequest request;
+  ASSERT_TRUE(scp_.FillReportRequest(info, &request).ok());
+
+  const auto& fields =
+      request.operations(0).log_entries(0).struct_payload().fields();
+  ASSERT_EQ(fields.at("http_response_code").number_value(), 503);
+  ASSERT_EQ(fields.at("response_code_detail").string_value(),
+            "upstream_reset_before_response_started{overflow}");
+}
+
 TEST_F(RequestBuilderTest, FillReportRequestEmptyOptionalTest) {
   ReportRequestInfo info;
   FillOperationInfo(&info);
@@ -131,6 +131,10 @@ struct ReportRequestInfo : public OperationInfo {
   // The response status.
   ::google::protobuf::util::Status status;
 
+  // The response code detail of the requests rejected by the proxy itself,
+  // such as the overflows of the circuit breakers of the backend.
+  std::string response_code_detail;
+
   // Original request URL.
   std::string url;
 
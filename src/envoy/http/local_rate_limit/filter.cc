@@ -0,0 +1,148 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/local_rate_limit/filter.h"
+
+#include <string>
+
+#include "absl/strings/str_cat.h"
+#include "common/grpc/common.h"
+#include "common/http/headers.h"
+#include "src/envoy/http/service_control/handler_utils.h"
+#include "src/envoy/utils/filter_state_utils.h"
+
+namespace Envoy {
+namespace Extensions {
+namespace HttpFilters {
+namespace LocalRateLimit {
+
+using ::google::api::envoy::http::local_rate_limit::RateLimitKey;
+using Http::FilterHeadersStatus;
+
+namespace {
+
+struct RcDetailsValues {
+  // The request is over the local rate limit of its operation.
+  const std::string LocalRateLimited = "local_rate_limited";
+};
+typedef ConstSingleton<RcDetailsValues> RcDetails;
+
+// The claim of the JWT payload with its subject.
+const char kJwtSubjectClaim[] = "sub";
+
+}  // namespace
+
+Filter::Filter(FilterConfigSharedPtr config) : config_(config) {}
+
+FilterHeadersStatus Filter::decodeHeaders(Http::RequestHeaderMap& headers,
+                                          bool) {
+  absl::string_view operation = Utils::getStringFilterState(
+      *decoder_callbacks_->streamInfo().filterState(), Utils::kOperation);
+  // NOTE: this shouldn't happen in practice because Path Matcher filter would
+  // have already rejected the request.
+  if (operation.empty()) {
+    ENVOY_LOG(debug, "No operation found from DynamicMetadata");
+    return FilterHeadersStatus::Continue;
+  }
+
+  const auto* rule = config_->findRule(operation);
+  if (rule == nullptr) {
+    ENVOY_LOG(debug, "No rate limit found for operation {}", operation);
+    return FilterHeadersStatus::Continue;
+  }
+
+  // The operation and the key are separated by a character which cannot be
+  // in a selector, so that the keys of different operations never collide.
+  // The requests without the key share the bucket of the unknown key, which
+  // is the operation alone, so that it is not the one of any key value.
+  std::string key_value;
+  const std::string bucket_key =
+      extractKey(headers, rule->key(), key_value)
+          ? absl::StrCat(operation, "\n", key_value)
+          : std::string(operation);
+  if (!config_->consume(bucket_key, rule->token_bucket())) {
+    ENVOY_LOG(debug, "Over the rate limit of operation {}", operation);
+    rejectRequest(headers, operation);
+    return FilterHeadersStatus::StopIteration;
+  }
+
+  config_->stats().allowed_.inc();
+  return FilterHeadersStatus::Continue;
+}
+
+bool Filter::extractKey(const Http::RequestHeaderMap& headers,
+                        const RateLimitKey& key, std::string& value) {
+  switch (key.key_case()) {
+    case RateLimitKey::kApiKey:
+      return ServiceControl::extractAPIKey(headers, key.api_key().locations(),
+                                           value);
+    case RateLimitKey::kJwtSubject:
+      ServiceControl::fillJwtPayload(
+          decoder_callbacks_->streamInfo().dynamicMetadata(),
+          config_->config().jwt_payload_metadata_name(), kJwtSubjectClaim,
+          value);
+      return !value.empty();
+    case RateLimitKey::kClientIp: {
+      const auto& address =
+          decoder_callbacks_->streamInfo().downstreamRemoteAddress();
+      if (address == nullptr || address->ip() == nullptr) {
+        return false;
+      }
+      value = address->ip()->addressAsString();
+      return true;
+    }
+    case RateLimitKey::kHeader: {
+      const Http::HeaderEntry* entry =
+          headers.get(Http::LowerCaseString(key.header()));
+      if (entry == nullptr) {
+        return false;
+      }
+      value = std::string(entry->value().getStringView());
+      return true;
+    }
+    default:
+      return false;
+  }
+}
+
+void Filter::rejectRequest(const Http::RequestHeaderMap& headers,
+                           absl::string_view operation) {
+  config_->stats().denied_.inc();
+
+  const std::string message =
+      absl::StrCat("Too many requests for operation ", operation);
+  // gRPC clients get the message in the grpc-message trailer instead.
+  if (Grpc::Common::hasGrpcContentType(headers)) {
+    decoder_callbacks_->sendLocalReply(
+        Http::Code::TooManyRequests, message, nullptr,
+        Grpc::Status::WellKnownGrpcStatus::ResourceExhausted,
+        RcDetails::get().LocalRateLimited);
+  } else {
+    decoder_callbacks_->sendLocalReply(
+        Http::Code::TooManyRequests,
+        absl::StrCat("{\"code\":429,\"message\":\"", message, "\"}"),
+        [](Http::ResponseHeaderMap& response_headers) {
+          response_headers.setReferenceContentType(
+              Http::Headers::get().ContentTypeValues.Json);
+        },
+        absl::nullopt, RcDetails::get().LocalRateLimited);
+  }
+  decoder_callbacks_->streamInfo().setResponseFlag(
+      StreamInfo::ResponseFlag::RateLimited);
+}
+
+}  // namespace LocalRateLimit
+}  // namespace HttpFilters
+}  // namespace Extensions
+}  // namespace Envoy
@@ -0,0 +1,59 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+
+#include "common/common/logger.h"
+#include "envoy/http/filter.h"
+#include "envoy/http/header_map.h"
+#include "extensions/filters/http/common/pass_through_filter.h"
+#include "src/envoy/http/local_rate_limit/filter_config.h"
+
+namespace Envoy {
+namespace Extensions {
+namespace HttpFilters {
+namespace LocalRateLimit {
+
+// The Envoy filter for ESPv2 local rate limit. It takes a token from the
+// bucket of the operation and the key of each request whose operation has a
+// rate limit, and rejects the request with 429 if the bucket is empty.
+class Filter : public Http::PassThroughDecoderFilter,
+               public Logger::Loggable<Logger::Id::filter> {
+ public:
+  Filter(FilterConfigSharedPtr config);
+
+  // Http::StreamDecoderFilter
+  Http::FilterHeadersStatus decodeHeaders(Http::RequestHeaderMap& headers,
+                                          bool) override;
+
+ private:
+  // Extracts the value of the key of the request. Returns whether the key was
+  // found.
+  bool extractKey(
+      const Http::RequestHeaderMap& headers,
+      const ::google::api::envoy::http::local_rate_limit::RateLimitKey& key,
+      std::string& value);
+
+  void rejectRequest(const Http::RequestHeaderMap& headers,
+                     absl::string_view operation);
+
+  const FilterConfigSharedPtr config_;
+};
+
+}  // namespace LocalRateLimit
+}  // namespace HttpFilters
+}  // namespace Extensions
+}  // namespace Envoy
@@ -0,0 +1,135 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/local_rate_limit/filter_config.h"
+
+#include <algorithm>
+
+#include "common/protobuf/utility.h"
+
+namespace Envoy {
+namespace Extensions {
+namespace HttpFilters {
+namespace LocalRateLimit {
+
+using ::google::api::envoy::http::local_rate_limit::TokenBucket;
+
+namespace {
+
+// The interval to evict the full buckets.
+constexpr std::chrono::seconds kEvictionInterval(10);
+
+}  // namespace
+
+FilterConfig::FilterConfig(
+    const ::google::api::envoy::http::local_rate_limit::FilterConfig&
+        proto_config,
+    const std::string& stats_prefix,
+    Server::Configuration::FactoryContext& context)
+    : proto_config_(proto_config),
+      stats_(generateStats(stats_prefix, context.scope())),
+      time_source_(context.timeSource()) {
+  for (const auto& rule : proto_config_.rules()) {
+    rules_[rule.operation()] = &rule;
+  }
+
+  eviction_timer_ = context.dispatcher().createTimer([this]() {
+    evictFullBuckets();
+    eviction_timer_->enableTimer(kEvictionInterval);
+  });
+  eviction_timer_->enableTimer(kEvictionInterval);
+}
+
+bool FilterConfig::consume(const std::string& bucket_key,
+                           const TokenBucket& config) {
+  const MonotonicTime now = time_source_.monotonicTime();
+  Shard& bucket_shard = shard(bucket_key);
+  absl::MutexLock lock(&bucket_shard.mutex);
+
+  auto it = bucket_shard.buckets.find(bucket_key);
+  if (it == bucket_shard.buckets.end()) {
+    it = bucket_shard.buckets
+             .emplace(bucket_key, Bucket{config.max_tokens(), now})
+             .first;
+  }
+
+  Bucket& bucket = it->second;
+  bucket.max_tokens = config.max_tokens();
+  bucket.tokens_per_fill = config.tokens_per_fill();
+  bucket.fill_interval = std::chrono::milliseconds(
+      DurationUtil::durationToMilliseconds(config.fill_interval()));
+  fill(bucket, now);
+
+  if (bucket.tokens == 0) {
+    return false;
+  }
+  bucket.tokens--;
+  return true;
+}
+
+void FilterConfig::fill(Bucket& bucket, MonotonicTime now) {
+  if (bucket.tokens >= bucket.max_tokens) {
+    // A full bucket starts its next fill interval at its first request.
+    bucket.tokens = bucket.max_tokens;
+    bucket.last_fill = now;
+    return;
+  }
+
+  const uint64_t fills = (now - bucket.last_fill) / bucket.fill_interval;
+  if (fills == 0) {
+    return;
+  }
+  bucket.last_fill += fills * bucket.fill_interval;
+  // Each fill adds a token at least, so the bucket is full after max_tokens
+  // fills, which also keeps the product below from overflowing.
+  if (fills >= bucket.max_tokens) {
+    bucket.tokens = bucket.max_tokens;
+    return;
+  }
+  const uint64_t tokens = bucket.tokens + fills * bucket.tokens_per_fill;
+  bucket.tokens = static_cast<uint32_t>(
+      std::min(tokens, static_cast<uint64_t>(bucket.max_tokens)));
+}
+
+size_t FilterConfig::numBuckets() {
+  size_t num_buckets = 0;
+  for (Shard& s : shards_) {
+    absl::MutexLock lock(&s.mutex);
+    num_buckets += s.buckets.size();
+  }
+  return num_buckets;
+}
+
+void FilterConfig::evictFullBuckets() {
+  const MonotonicTime now = time_source_.monotonicTime();
+  for (Shard& s : shards_) {
+    absl::MutexLock lock(&s.mutex);
+    for (auto it = s.buckets.begin(); it != s.buckets.end();) {
+      fill(it->second, now);
+      if (it->second.tokens >= it->second.max_tokens) {
+        s.buckets.erase(it++);
+      } else {
+        ++it;
+      }
+    }
+  }
+
+  ENVOY_LOG(debug, "{} rate limit buckets in use after the eviction",
+            numBuckets());
+}
+
+}  // namespace LocalRateLimit
+}  // namespace HttpFilters
+}  // namespace Extensions
+}  // namespace Envoy
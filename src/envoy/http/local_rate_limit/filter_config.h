@@ -0,0 +1,148 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <array>
+#include <functional>
+#include <string>
+
+#include "absl/container/flat_hash_map.h"
+#include "absl/synchronization/mutex.h"
+#include "api/envoy/http/local_rate_limit/config.pb.h"
+#include "common/common/logger.h"
+#include "envoy/common/time.h"
+#include "envoy/event/timer.h"
+#include "envoy/server/filter_config.h"
+
+namespace Envoy {
+namespace Extensions {
+namespace HttpFilters {
+namespace LocalRateLimit {
+
+/**
+ * All stats for the local rate limit filter. @see stats_macros.h
+ */
+
+// clang-format off
+#define ALL_LOCAL_RATE_LIMIT_FILTER_STATS(COUNTER)     \
+  COUNTER(allowed)                                     \
+  COUNTER(denied)
+// clang-format on
+
+/**
+ * Wrapper struct for local rate limit filter stats. @see stats_macros.h
+ */
+struct FilterStats {
+  ALL_LOCAL_RATE_LIMIT_FILTER_STATS(GENERATE_COUNTER_STRUCT)
+};
+
+// The Envoy filter config for ESPv2 local rate limit filter. It holds the
+// token buckets, which are shared by the workers. The buckets are sharded by
+// key, and the full ones are evicted by a timer on the main thread.
+class FilterConfig : public Logger::Loggable<Logger::Id::filter> {
+ public:
+  FilterConfig(
+      const ::google::api::envoy::http::local_rate_limit::FilterConfig&
+          proto_config,
+      const std::string& stats_prefix,
+      Server::Configuration::FactoryContext& context);
+
+  const ::google::api::envoy::http::local_rate_limit::FilterConfig& config()
+      const {
+    return proto_config_;
+  }
+
+  const ::google::api::envoy::http::local_rate_limit::RateLimitRule* findRule(
+      absl::string_view operation) const {
+    const auto it = rules_.find(operation);
+    if (it == rules_.end()) {
+      return nullptr;
+    }
+    return it->second;
+  }
+
+  FilterStats& stats() { return stats_; }
+
+  // Takes a token from the bucket of the key, which is created full if it
+  // does not exist. Returns whether a token was available.
+  bool consume(
+      const std::string& bucket_key,
+      const ::google::api::envoy::http::local_rate_limit::TokenBucket& config);
+
+  // The number of the buckets that have not been evicted.
+  size_t numBuckets();
+
+ private:
+  struct Bucket {
+    uint32_t tokens;
+    // The time of the last fill, or of the creation of the bucket.
+    MonotonicTime last_fill;
+    // The config of the last request, to fill the bucket when evicting.
+    uint32_t max_tokens;
+    uint32_t tokens_per_fill;
+    std::chrono::nanoseconds fill_interval;
+  };
+
+  // The buckets of the keys with the same hash. Each shard has its own lock,
+  // so the requests of different keys seldom wait for each other.
+  struct Shard {
+    absl::Mutex mutex;
+    absl::flat_hash_map<std::string, Bucket> buckets ABSL_GUARDED_BY(mutex);
+  };
+
+  static constexpr size_t kNumShards = 16;
+
+  Shard& shard(const std::string& bucket_key) {
+    return shards_[std::hash<std::string>{}(bucket_key) % kNumShards];
+  }
+
+  // Adds the tokens of the fills since the last one to the bucket.
+  static void fill(Bucket& bucket, MonotonicTime now);
+
+  // Removes the buckets that are full, since they are the same as new ones.
+  // It locks one shard at a time, so it only delays the requests of that
+  // shard.
+  void evictFullBuckets();
+
+  FilterStats generateStats(const std::string& prefix, Stats::Scope& scope) {
+    const std::string final_prefix = prefix + "local_rate_limit.";
+    return {ALL_LOCAL_RATE_LIMIT_FILTER_STATS(
+        POOL_COUNTER_PREFIX(scope, final_prefix))};
+  }
+
+  // The config proto
+  const ::google::api::envoy::http::local_rate_limit::FilterConfig
+      proto_config_;
+  // The stats
+  FilterStats stats_;
+  // The map from operation to rule.
+  absl::flat_hash_map<
+      std::string,
+      const ::google::api::envoy::http::local_rate_limit::RateLimitRule*>
+      rules_;
+  TimeSource& time_source_;
+
+  // The buckets by operation and key.
+  std::array<Shard, kNumShards> shards_;
+  // The timer to evict the full buckets.
+  Event::TimerPtr eviction_timer_;
+};
+
+typedef std::shared_ptr<FilterConfig> FilterConfigSharedPtr;
+
+}  // namespace LocalRateLimit
+}  // namespace HttpFilters
+}  // namespace Extensions
+}  // namespace Envoy
@@ -0,0 +1,391 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/local_rate_limit/filter.h"
+
+#include "common/network/utility.h"
+#include "common/stream_info/filter_state_impl.h"
+#include "envoy/http/header_map.h"
+#include "gmock/gmock.h"
+#include "google/protobuf/text_format.h"
+#include "gtest/gtest.h"
+#include "src/envoy/utils/filter_state_utils.h"
+#include "test/mocks/event/mocks.h"
+#include "test/mocks/http/mocks.h"
+#include "test/mocks/server/mocks.h"
+#include "test/test_common/simulated_time_system.h"
+#include "test/test_common/utility.h"
+
+using ::testing::_;
+using ::testing::Invoke;
+using ::testing::ReturnRef;
+
+namespace Envoy {
+namespace Extensions {
+namespace HttpFilters {
+namespace LocalRateLimit {
+namespace {
+
+const char kFilterConfig[] = R"(
+rules {
+  operation: "get-books"
+  token_bucket {
+    max_tokens: 2
+    tokens_per_fill: 1
+    fill_interval { seconds: 1 }
+  }
+}
+rules {
+  operation: "get-shelves"
+  token_bucket {
+    max_tokens: 1
+    tokens_per_fill: 1
+    fill_interval { seconds: 1 }
+  }
+}
+rules {
+  operation: "by-api-key"
+  token_bucket {
+    max_tokens: 1
+    tokens_per_fill: 1
+    fill_interval { seconds: 1 }
+  }
+  key {
+    api_key {
+      locations { query: "key" }
+      locations { header: "x-api-key" }
+    }
+  }
+}
+rules {
+  operation: "by-jwt-subject"
+  token_bucket {
+    max_tokens: 1
+    tokens_per_fill: 1
+    fill_interval { seconds: 1 }
+  }
+  key { jwt_subject: true }
+}
+rules {
+  operation: "by-client-ip"
+  token_bucket {
+    max_tokens: 1
+    tokens_per_fill: 1
+    fill_interval { seconds: 1 }
+  }
+  key { client_ip: true }
+}
+rules {
+  operation: "by-header"
+  token_bucket {
+    max_tokens: 1
+    tokens_per_fill: 1
+    fill_interval { seconds: 1 }
+  }
+  key { header: "x-tenant" }
+}
+jwt_payload_metadata_name: "jwt_payloads"
+)";
+
+/**
+ * Base class for testing the Local Rate Limit filter. The requests of each
+ * test share the buckets.
+ */
+class LocalRateLimitFilterTest : public ::testing::Test {
+ protected:
+  LocalRateLimitFilterTest() = default;
+
+  void SetUp() override {
+    google::api::envoy::http::local_rate_limit::FilterConfig proto_config;
+    ASSERT_TRUE(google::protobuf::TextFormat::ParseFromString(
+        std::string(kFilterConfig), &proto_config));
+    ON_CALL(mock_factory_context_, timeSource())
+        .WillByDefault(ReturnRef(time_system_));
+    // The config takes the ownership of the timer.
+    eviction_timer_ = new testing::NiceMock<Event::MockTimer>(
+        &mock_factory_context_.dispatcher_);
+    config_ = std::make_shared<FilterConfig>(proto_config, "test-stats",
+                                             mock_factory_context_);
+    filter_ = std::make_unique<Filter>(config_);
+    filter_->setDecoderFilterCallbacks(mock_decoder_callbacks_);
+  }
+
+  Http::FilterHeadersStatus sendRequest(
+      absl::string_view operation, Http::TestRequestHeaderMapImpl headers) {
+    // Each request has its own filter state.
+    mock_decoder_callbacks_.stream_info_.filter_state_ =
+        std::make_shared<StreamInfo::FilterStateImpl>(
+            StreamInfo::FilterState::LifeSpan::FilterChain);
+    Utils::setStringFilterState(
+        *mock_decoder_callbacks_.stream_info_.filter_state_, Utils::kOperation,
+        operation);
+    return filter_->decodeHeaders(headers, true);
+  }
+
+  Event::SimulatedTimeSystem time_system_;
+  Event::MockTimer* eviction_timer_;
+  FilterConfigSharedPtr config_;
+  std::unique_ptr<Filter> filter_;
+  testing::NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks>
+      mock_decoder_callbacks_;
+  testing::NiceMock<Envoy::Server::Configuration::MockFactoryContext>
+      mock_factory_context_;
+};
+
+TEST_F(LocalRateLimitFilterTest, NoOperationName) {
+  Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                         {":path", "/books"}};
+
+  // Expect the filter to be a NOOP
+  for (int i = 0; i < 5; i++) {
+    EXPECT_EQ(filter_->decodeHeaders(headers, true),
+              Http::FilterHeadersStatus::Continue);
+  }
+  EXPECT_EQ(config_->stats().allowed_.value(), 0);
+}
+
+TEST_F(LocalRateLimitFilterTest, NoRateLimit) {
+  for (int i = 0; i < 5; i++) {
+    EXPECT_EQ(sendRequest("get-authors", {{":method", "GET"},
+                                          {":path", "/authors"}}),
+              Http::FilterHeadersStatus::Continue);
+  }
+  EXPECT_EQ(config_->stats().allowed_.value(), 0);
+}
+
+TEST_F(LocalRateLimitFilterTest, RejectOverBurst) {
+  EXPECT_CALL(mock_decoder_callbacks_,
+              sendLocalReply_(Http::Code::TooManyRequests,
+                              R"({"code":429,"message":"Too many requests )"
+                              R"(for operation get-books"})",
+                              _, _, "local_rate_limited"))
+      .WillOnce(Invoke([](Http::Code, absl::string_view,
+                          std::function<void(Http::ResponseHeaderMap&)>
+                              modify_headers,
+                          const absl::optional<Grpc::Status::GrpcStatus>,
+                          absl::string_view) {
+        Http::TestResponseHeaderMapImpl response_headers;
+        modify_headers(response_headers);
+        EXPECT_EQ(response_headers.get_("content-type"), "application/json");
+      }));
+  EXPECT_CALL(mock_decoder_callbacks_.stream_info_,
+              setResponseFlag(StreamInfo::ResponseFlag::RateLimited));
+
+  const Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                               {":path", "/books"}};
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::StopIteration);
+  EXPECT_EQ(config_->stats().allowed_.value(), 2);
+  EXPECT_EQ(config_->stats().denied_.value(), 1);
+}
+
+TEST_F(LocalRateLimitFilterTest, RejectGrpcWithResourceExhausted) {
+  EXPECT_CALL(mock_decoder_callbacks_,
+              sendLocalReply_(Http::Code::TooManyRequests,
+                              "Too many requests for operation get-books", _,
+                              absl::make_optional<Grpc::Status::GrpcStatus>(
+                                  Grpc::Status::WellKnownGrpcStatus::
+                                      ResourceExhausted),
+                              "local_rate_limited"));
+
+  const Http::TestRequestHeaderMapImpl headers{
+      {":method", "POST"},
+      {":path", "/books"},
+      {"content-type", "application/grpc"}};
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::StopIteration);
+}
+
+TEST_F(LocalRateLimitFilterTest, RefillOverTime) {
+  const Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                               {":path", "/books"}};
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::StopIteration);
+
+  // A fill adds one token.
+  time_system_.sleep(std::chrono::milliseconds(1500));
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::StopIteration);
+
+  // The second fill happens 1s after the first one, not after the request.
+  time_system_.sleep(std::chrono::milliseconds(500));
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::Continue);
+
+  // The bucket never has more than max_tokens.
+  time_system_.sleep(std::chrono::seconds(10));
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::StopIteration);
+}
+
+TEST_F(LocalRateLimitFilterTest, OperationsHaveTheirOwnBuckets) {
+  const Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                               {":path", "/books"}};
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("get-books", headers),
+            Http::FilterHeadersStatus::Continue);
+
+  EXPECT_EQ(sendRequest("get-shelves", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("get-shelves", headers),
+            Http::FilterHeadersStatus::StopIteration);
+}
+
+TEST_F(LocalRateLimitFilterTest, ApiKey) {
+  EXPECT_EQ(sendRequest("by-api-key",
+                        {{":method", "GET"}, {":path", "/books?key=key-1"}}),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("by-api-key", {{":method", "GET"},
+                                       {":path", "/books"},
+                                       {"x-api-key", "key-1"}}),
+            Http::FilterHeadersStatus::StopIteration);
+  EXPECT_EQ(sendRequest("by-api-key",
+                        {{":method", "GET"}, {":path", "/books?key=key-2"}}),
+            Http::FilterHeadersStatus::Continue);
+
+  // The requests without an API key share the bucket of the unknown key.
+  EXPECT_EQ(sendRequest("by-api-key",
+                        {{":method", "GET"}, {":path", "/books"}}),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("by-api-key",
+                        {{":method", "GET"}, {":path", "/books"}}),
+            Http::FilterHeadersStatus::StopIteration);
+}
+
+TEST_F(LocalRateLimitFilterTest, JwtSubject) {
+  auto setSubject = [this](const std::string& subject) {
+    ProtobufWkt::Struct payload;
+    (*payload.mutable_fields())["sub"].set_string_value(subject);
+    ProtobufWkt::Struct jwt_payloads;
+    *(*jwt_payloads.mutable_fields())["jwt_payloads"].mutable_struct_value() =
+        payload;
+    (*mock_decoder_callbacks_.stream_info_.metadata_.mutable_filter_metadata())
+        ["envoy.filters.http.jwt_authn"] = jwt_payloads;
+  };
+  const Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                               {":path", "/books"}};
+
+  setSubject("alice");
+  EXPECT_EQ(sendRequest("by-jwt-subject", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("by-jwt-subject", headers),
+            Http::FilterHeadersStatus::StopIteration);
+  setSubject("bob");
+  EXPECT_EQ(sendRequest("by-jwt-subject", headers),
+            Http::FilterHeadersStatus::Continue);
+}
+
+TEST_F(LocalRateLimitFilterTest, ClientIp) {
+  const Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                               {":path", "/books"}};
+
+  mock_decoder_callbacks_.stream_info_.downstream_remote_address_ =
+      Network::Utility::parseInternetAddress("10.0.0.1");
+  EXPECT_EQ(sendRequest("by-client-ip", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("by-client-ip", headers),
+            Http::FilterHeadersStatus::StopIteration);
+  mock_decoder_callbacks_.stream_info_.downstream_remote_address_ =
+      Network::Utility::parseInternetAddress("10.0.0.2");
+  EXPECT_EQ(sendRequest("by-client-ip", headers),
+            Http::FilterHeadersStatus::Continue);
+}
+
+TEST_F(LocalRateLimitFilterTest, Header) {
+  EXPECT_EQ(sendRequest("by-header", {{":method", "GET"},
+                                      {":path", "/books"},
+                                      {"x-tenant", "tenant-1"}}),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("by-header", {{":method", "GET"},
+                                      {":path", "/books"},
+                                      {"x-tenant", "tenant-1"}}),
+            Http::FilterHeadersStatus::StopIteration);
+  EXPECT_EQ(sendRequest("by-header", {{":method", "GET"},
+                                      {":path", "/books"},
+                                      {"x-tenant", "tenant-2"}}),
+            Http::FilterHeadersStatus::Continue);
+}
+
+TEST_F(LocalRateLimitFilterTest, RequestsWithoutKeyShareUnknownBucket) {
+  const Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                               {":path", "/books"}};
+  EXPECT_EQ(sendRequest("by-header", headers),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("by-header", headers),
+            Http::FilterHeadersStatus::StopIteration);
+
+  // The unknown key is neither an empty value nor any other value.
+  EXPECT_EQ(sendRequest("by-header", {{":method", "GET"},
+                                      {":path", "/books"},
+                                      {"x-tenant", ""}}),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(sendRequest("by-header", {{":method", "GET"},
+                                      {":path", "/books"},
+                                      {"x-tenant", "tenant-1"}}),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(config_->stats().denied_.value(), 1);
+}
+
+TEST_F(LocalRateLimitFilterTest, EvictFullBucketsOnTimer) {
+  EXPECT_TRUE(eviction_timer_->enabled());
+  EXPECT_EQ(sendRequest("by-header", {{":method", "GET"},
+                                      {":path", "/books"},
+                                      {"x-tenant", "tenant-1"}}),
+            Http::FilterHeadersStatus::Continue);
+  time_system_.sleep(std::chrono::seconds(1));
+  EXPECT_EQ(sendRequest("by-header", {{":method", "GET"},
+                                      {":path", "/books"},
+                                      {"x-tenant", "tenant-2"}}),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(config_->numBuckets(), 2);
+
+  // The bucket of tenant-1 is full again, the one of tenant-2 is empty.
+  eviction_timer_->invokeCallback();
+  EXPECT_EQ(config_->numBuckets(), 1);
+  EXPECT_TRUE(eviction_timer_->enabled());
+  EXPECT_EQ(sendRequest("by-header", {{":method", "GET"},
+                                      {":path", "/books"},
+                                      {"x-tenant", "tenant-2"}}),
+            Http::FilterHeadersStatus::StopIteration);
+  EXPECT_EQ(sendRequest("by-header", {{":method", "GET"},
+                                      {":path", "/books"},
+                                      {"x-tenant", "tenant-1"}}),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(config_->numBuckets(), 2);
+}
+
+}  // namespace
+}  // namespace LocalRateLimit
+}  // namespace HttpFilters
+}  // namespace Extensions
+}  // namespace Envoy
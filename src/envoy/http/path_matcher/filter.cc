@@ -16,6 +16,7 @@
 
 #include "src/envoy/http/path_matcher/filter.h"
 
+#include "common/config/metadata.h"
 #include "common/http/utility.h"
 #include "src/api_proxy/path_matcher/variable_binding_utils.h"
 #include "src/envoy/utils/filter_state_utils.h"
@@ -37,6 +38,11 @@ struct RcDetailsValues {
 };
 typedef ConstSingleton<RcDetailsValues> RcDetails;
 
+// The route metadata of this filter with the service of a virtual host, when
+// several services are served.
+const std::string kFilterName = "envoy.filters.http.path_matcher";
+const std::string kServiceNameKey = "service_name";
+
 }  // namespace
 
 Http::FilterHeadersStatus Filter::decodeHeaders(Http::RequestHeaderMap& headers,
@@ -44,7 +50,9 @@ Http::FilterHeadersStatus Filter::decodeHeaders(Http::RequestHeaderMap& headers,
   std::string method(Utils::getRequestHTTPMethodWithOverride(
       headers.Method()->value().getStringView(), headers));
   std::string path(headers.Path()->value().getStringView());
-  const std::string* operation = config_->findOperation(method, path);
+  const std::string service_name = getServiceName();
+  const std::string* operation =
+      config_->findOperation(service_name, method, path, nullptr);
   if (operation == nullptr) {
     rejectRequest(Http::Code(404),
                   "Path does not match any requirement URI template.");
@@ -58,7 +66,8 @@ Http::FilterHeadersStatus Filter::decodeHeaders(Http::RequestHeaderMap& headers,
 
   if (config_->needParameterExtraction(*operation)) {
     std::vector<VariableBinding> variable_bindings;
-    operation = config_->findOperation(method, path, &variable_bindings);
+    operation = config_->findOperation(service_name, method, path,
+                                       &variable_bindings);
     if (!variable_bindings.empty()) {
       const std::string query_params = VariableBindingsToQueryParameters(
           variable_bindings, config_->getSnakeToJsonMap());
@@ -71,6 +80,16 @@ Http::FilterHeadersStatus Filter::decodeHeaders(Http::RequestHeaderMap& headers,
   return Http::FilterHeadersStatus::Continue;
 }
 
+std::string Filter::getServiceName() {
+  const Router::RouteConstSharedPtr route = decoder_callbacks_->route();
+  if (route == nullptr || route->routeEntry() == nullptr) {
+    return EMPTY_STRING;
+  }
+  return Config::Metadata::metadataValue(&route->routeEntry()->metadata(),
+                                         kFilterName, kServiceNameKey)
+      .string_value();
+}
+
 void Filter::rejectRequest(Http::Code code, absl::string_view error_msg) {
   config_->stats().denied_.inc();
 
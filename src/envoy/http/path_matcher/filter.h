@@ -33,6 +33,10 @@ class Filter : public Http::PassThroughDecoderFilter,
                                           bool) override;
 
  private:
+  // Returns the service of the virtual host of the request from the route
+  // metadata, or empty if there is none.
+  std::string getServiceName();
+
   void rejectRequest(Http::Code code, absl::string_view error_msg);
 
   const FilterConfigSharedPtr config_;
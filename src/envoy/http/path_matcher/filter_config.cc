@@ -12,6 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+#include <map>
+
 #include "src/envoy/http/path_matcher/filter_config.h"
 #include "common/common/empty_string.h"
 
@@ -26,11 +28,16 @@ FilterConfig::FilterConfig(
     Server::Configuration::FactoryContext& context)
     : proto_config_(proto_config),
       stats_(generateStats(stats_prefix, context.scope())) {
-  ::google::api_proxy::path_matcher::PathMatcherBuilder<const std::string*> pmb;
+  // The rules of each service have their own path matcher, so that the
+  // services can have the same HTTP method and path. The builders are not
+  // movable, so they are kept in a node based map.
+  std::map<std::string, ::google::api_proxy::path_matcher::PathMatcherBuilder<
+                            const std::string*>>
+      builders;
   for (const auto& rule : proto_config_.rules()) {
-    if (!pmb.Register(rule.pattern().http_method(),
-                      rule.pattern().uri_template(),
-                      /*body_field_path=*/EMPTY_STRING, &rule.operation())) {
+    if (!builders[rule.service_name()].Register(
+            rule.pattern().http_method(), rule.pattern().uri_template(),
+            /*body_field_path=*/EMPTY_STRING, &rule.operation())) {
       throw ProtoValidationException("Duplicated pattern or invalid pattern",
                                      rule.pattern());
     }
@@ -38,7 +45,9 @@ FilterConfig::FilterConfig(
       path_params_operations_.insert(rule.operation());
     }
   }
-  path_matcher_ = pmb.Build();
+  for (auto& builder : builders) {
+    path_matchers_.emplace(builder.first, builder.second.Build());
+  }
 
   for (const auto& segment_name : proto_config_.segment_names()) {
     snake_to_json_map_.emplace(segment_name.snake_name(),
@@ -46,6 +55,29 @@ FilterConfig::FilterConfig(
   }
 }
 
+const std::string* FilterConfig::findOperation(
+    const std::string& service_name, const std::string& http_method,
+    const std::string& path,
+    std::vector<google::api_proxy::path_matcher::VariableBinding>*
+        variable_bindings) const {
+  if (!service_name.empty()) {
+    const auto it = path_matchers_.find(service_name);
+    if (it != path_matchers_.end()) {
+      const std::string* operation =
+          it->second->Lookup(http_method, path, variable_bindings);
+      if (operation != nullptr) {
+        return operation;
+      }
+    }
+  }
+
+  const auto it = path_matchers_.find(EMPTY_STRING);
+  if (it == path_matchers_.end()) {
+    return nullptr;
+  }
+  return it->second->Lookup(http_method, path, variable_bindings);
+}
+
 }  // namespace PathMatcher
 }  // namespace HttpFilters
 }  // namespace Extensions
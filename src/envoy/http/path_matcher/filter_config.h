@@ -17,6 +17,7 @@
 #include <unordered_map>
 
 #include "api/envoy/http/path_matcher/config.pb.h"
+#include "common/common/empty_string.h"
 #include "common/common/logger.h"
 #include "envoy/runtime/runtime.h"
 #include "envoy/server/filter_config.h"
@@ -54,16 +55,24 @@ class FilterConfig : public Logger::Loggable<Logger::Id::filter> {
 
   const std::string* findOperation(const std::string& http_method,
                                    const std::string& path) const {
-    return path_matcher_->Lookup(http_method, path);
+    return findOperation(EMPTY_STRING, http_method, path, nullptr);
   }
 
   const std::string* findOperation(
       const std::string& http_method, const std::string& path,
       std::vector<google::api_proxy::path_matcher::VariableBinding>*
           variable_bindings) const {
-    return path_matcher_->Lookup(http_method, path, variable_bindings);
+    return findOperation(EMPTY_STRING, http_method, path, variable_bindings);
   }
 
+  // Finds the operation of a request routed to the virtual host of a service,
+  // in the rules of the service first, then in the rules without service.
+  const std::string* findOperation(
+      const std::string& service_name, const std::string& http_method,
+      const std::string& path,
+      std::vector<google::api_proxy::path_matcher::VariableBinding>*
+          variable_bindings) const;
+
   // Returns whether an operation needs path parameter extraction.
   // NOTE: path parameter extraction is only needed when backend rule path
   // translation is CONSTANT_ADDRESS.
@@ -87,8 +96,11 @@ class FilterConfig : public Logger::Loggable<Logger::Id::filter> {
   }
 
   ::google::api::envoy::http::path_matcher::FilterConfig proto_config_;
-  ::google::api_proxy::path_matcher::PathMatcherPtr<const std::string*>
-      path_matcher_;
+  // The path matchers by the service name of the rules.
+  absl::flat_hash_map<
+      std::string,
+      ::google::api_proxy::path_matcher::PathMatcherPtr<const std::string*>>
+      path_matchers_;
   // Mapping between snake-case segment name to JSON name as specified in
   // `Service.types` (e.g. "foo_bar" -> "fooBar").
   absl::flat_hash_map<std::string, std::string> snake_to_json_map_;
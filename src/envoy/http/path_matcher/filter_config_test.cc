@@ -158,6 +158,55 @@ rules {
       ProtoValidationException, "Duplicated pattern");
 }
 
+TEST(FilterConfigTest, ServiceNames) {
+  const char kFilterConfig[] = R"(
+rules {
+  operation: "1.a_cloudesf_testing_cloud_goog.Bar"
+  service_name: "a.cloudesf-testing.cloud.goog"
+  pattern {
+    http_method: "GET"
+    uri_template: "/bar"
+  }
+}
+rules {
+  operation: "1.b_cloudesf_testing_cloud_goog.Bar"
+  service_name: "b.cloudesf-testing.cloud.goog"
+  pattern {
+    http_method: "GET"
+    uri_template: "/bar"
+  }
+}
+rules {
+  operation: "ESPv2.HealthCheck"
+  pattern {
+    http_method: "GET"
+    uri_template: "/healthz"
+  }
+})";
+
+  ::google::api::envoy::http::path_matcher::FilterConfig config_pb;
+  ASSERT_TRUE(TextFormat::ParseFromString(kFilterConfig, &config_pb));
+  ::testing::NiceMock<Server::Configuration::MockFactoryContext> mock_factory;
+  FilterConfig cfg(config_pb, EMPTY_STRING, mock_factory);
+
+  // The services can have the same pattern.
+  EXPECT_EQ("1.a_cloudesf_testing_cloud_goog.Bar",
+            *cfg.findOperation("a.cloudesf-testing.cloud.goog", "GET", "/bar",
+                               nullptr));
+  EXPECT_EQ("1.b_cloudesf_testing_cloud_goog.Bar",
+            *cfg.findOperation("b.cloudesf-testing.cloud.goog", "GET", "/bar",
+                               nullptr));
+  EXPECT_EQ(nullptr, cfg.findOperation("GET", "/bar"));
+  EXPECT_EQ(nullptr, cfg.findOperation("c.cloudesf-testing.cloud.goog", "GET",
+                                       "/bar", nullptr));
+
+  // The rules without service name match the requests of all the services.
+  EXPECT_EQ("ESPv2.HealthCheck",
+            *cfg.findOperation("a.cloudesf-testing.cloud.goog", "GET",
+                               "/healthz", nullptr));
+  EXPECT_EQ("ESPv2.HealthCheck", *cfg.findOperation("GET", "/healthz"));
+}
+
 TEST(FilterConfigTest, InvalidPattern) {
   const char kFilterConfig[] = R"(
 rules {
@@ -141,6 +141,47 @@ TEST_F(PathMatcherFilterTest, DecodeHeadersExtractParameters) {
                     ->value());
 }
 
+TEST_F(PathMatcherFilterTest, DecodeHeadersWithServiceName) {
+  // Test: the rules of the service in the route metadata match the request
+  ::google::api::envoy::http::path_matcher::FilterConfig config_pb;
+  ASSERT_TRUE(TextFormat::ParseFromString(R"(
+rules {
+  operation: "1.a_cloudesf_testing_cloud_goog.Bar"
+  service_name: "a.cloudesf-testing.cloud.goog"
+  pattern {
+    http_method: "GET"
+    uri_template: "/bar"
+  }
+}
+rules {
+  operation: "1.b_cloudesf_testing_cloud_goog.Bar"
+  service_name: "b.cloudesf-testing.cloud.goog"
+  pattern {
+    http_method: "GET"
+    uri_template: "/bar"
+  }
+})",
+                                          &config_pb));
+  config_ = std::make_shared<FilterConfig>(config_pb, EMPTY_STRING,
+                                           mock_factory_context_);
+  filter_ = std::make_unique<Filter>(config_);
+  filter_->setDecoderFilterCallbacks(mock_cb_);
+
+  auto& fields =
+      *(*mock_cb_.route_->route_entry_.metadata_.mutable_filter_metadata())
+           ["envoy.filters.http.path_matcher"]
+               .mutable_fields();
+  fields["service_name"].set_string_value("b.cloudesf-testing.cloud.goog");
+
+  Http::TestRequestHeaderMapImpl headers{{":method", "GET"}, {":path", "/bar"}};
+  EXPECT_EQ(Http::FilterHeadersStatus::Continue,
+            filter_->decodeHeaders(headers, true));
+
+  EXPECT_EQ(Utils::getStringFilterState(*mock_cb_.stream_info_.filter_state_,
+                                        Utils::kOperation),
+            "1.b_cloudesf_testing_cloud_goog.Bar");
+}
+
 TEST_F(PathMatcherFilterTest, DecodeHeadersNoMatch) {
   // Test: a request no match
   Http::TestRequestHeaderMapImpl headers{{":method", "POST"},
@@ -0,0 +1,88 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/rate_limit_descriptors/filter.h"
+
+#include <string>
+
+#include "src/envoy/http/service_control/handler_utils.h"
+#include "src/envoy/utils/filter_state_utils.h"
+
+namespace Envoy {
+namespace Extensions {
+namespace HttpFilters {
+namespace RateLimitDescriptors {
+
+using Http::FilterHeadersStatus;
+
+namespace {
+
+// The claims of the JWT payload with its issuer and subject.
+const std::string kJwtIssuerClaim = "iss";
+const std::string kJwtSubjectClaim = "sub";
+
+}  // namespace
+
+Filter::Filter(FilterConfigSharedPtr config) : config_(config) {}
+
+FilterHeadersStatus Filter::decodeHeaders(Http::RequestHeaderMap& headers,
+                                          bool) {
+  headers.remove(config_->operationHeader());
+  headers.remove(config_->apiKeyHeader());
+  headers.remove(config_->jwtIssuerHeader());
+  headers.remove(config_->jwtSubjectHeader());
+
+  absl::string_view operation = Utils::getStringFilterState(
+      *decoder_callbacks_->streamInfo().filterState(), Utils::kOperation);
+  // NOTE: this shouldn't happen in practice because Path Matcher filter would
+  // have already rejected the request.
+  if (operation.empty()) {
+    ENVOY_LOG(debug, "No operation found from DynamicMetadata");
+    return FilterHeadersStatus::Continue;
+  }
+
+  const auto* rule = config_->findRule(operation);
+  if (rule == nullptr) {
+    ENVOY_LOG(debug, "Operation {} is not rate limited", operation);
+    return FilterHeadersStatus::Continue;
+  }
+  headers.addCopy(config_->operationHeader(), std::string(operation));
+
+  std::string api_key;
+  if (ServiceControl::extractAPIKey(headers, rule->api_key_locations(),
+                                    api_key)) {
+    headers.addCopy(config_->apiKeyHeader(), api_key);
+  }
+
+  setJwtClaimHeader(headers, config_->jwtIssuerHeader(), kJwtIssuerClaim);
+  setJwtClaimHeader(headers, config_->jwtSubjectHeader(), kJwtSubjectClaim);
+  return FilterHeadersStatus::Continue;
+}
+
+void Filter::setJwtClaimHeader(Http::RequestHeaderMap& headers,
+                               const Http::LowerCaseString& header,
+                               const std::string& claim) {
+  std::string value;
+  ServiceControl::fillJwtPayload(
+      decoder_callbacks_->streamInfo().dynamicMetadata(),
+      config_->config().jwt_payload_metadata_name(), claim, value);
+  if (!value.empty()) {
+    headers.addCopy(header, value);
+  }
+}
+
+}  // namespace RateLimitDescriptors
+}  // namespace HttpFilters
+}  // namespace Extensions
+}  // namespace Envoy
@@ -0,0 +1,92 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#pragma once
+
+#include <string>
+
+#include "absl/container/flat_hash_map.h"
+#include "api/envoy/http/rate_limit_descriptors/config.pb.h"
+#include "common/common/logger.h"
+#include "envoy/http/header_map.h"
+#include "envoy/server/filter_config.h"
+
+namespace Envoy {
+namespace Extensions {
+namespace HttpFilters {
+namespace RateLimitDescriptors {
+
+// The Envoy filter config for ESPv2 rate limit descriptors filter.
+class FilterConfig : public Logger::Loggable<Logger::Id::filter> {
+ public:
+  FilterConfig(
+      const ::google::api::envoy::http::rate_limit_descriptors::FilterConfig&
+          proto_config)
+      : proto_config_(proto_config),
+        operation_header_(proto_config_.headers().operation()),
+        api_key_header_(proto_config_.headers().api_key()),
+        jwt_issuer_header_(proto_config_.headers().jwt_issuer()),
+        jwt_subject_header_(proto_config_.headers().jwt_subject()) {
+    for (const auto& rule : proto_config_.rules()) {
+      rules_[rule.operation()] = &rule;
+    }
+  }
+
+  const ::google::api::envoy::http::rate_limit_descriptors::FilterConfig&
+  config() const {
+    return proto_config_;
+  }
+
+  const ::google::api::envoy::http::rate_limit_descriptors::DescriptorRule*
+  findRule(absl::string_view operation) const {
+    const auto it = rules_.find(operation);
+    if (it == rules_.end()) {
+      return nullptr;
+    }
+    return it->second;
+  }
+
+  const Http::LowerCaseString& operationHeader() const {
+    return operation_header_;
+  }
+  const Http::LowerCaseString& apiKeyHeader() const { return api_key_header_; }
+  const Http::LowerCaseString& jwtIssuerHeader() const {
+    return jwt_issuer_header_;
+  }
+  const Http::LowerCaseString& jwtSubjectHeader() const {
+    return jwt_subject_header_;
+  }
+
+ private:
+  // The config proto
+  ::google::api::envoy::http::rate_limit_descriptors::FilterConfig
+      proto_config_;
+  // The map from operation to rule.
+  absl::flat_hash_map<
+      std::string,
+      const ::google::api::envoy::http::rate_limit_descriptors::DescriptorRule*>
+      rules_;
+  // The names of the descriptor headers.
+  const Http::LowerCaseString operation_header_;
+  const Http::LowerCaseString api_key_header_;
+  const Http::LowerCaseString jwt_issuer_header_;
+  const Http::LowerCaseString jwt_subject_header_;
+};
+
+typedef std::shared_ptr<FilterConfig> FilterConfigSharedPtr;
+
+}  // namespace RateLimitDescriptors
+}  // namespace HttpFilters
+}  // namespace Extensions
+}  // namespace Envoy
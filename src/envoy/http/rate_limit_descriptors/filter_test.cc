@@ -0,0 +1,193 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include "src/envoy/http/rate_limit_descriptors/filter.h"
+
+#include "common/stream_info/filter_state_impl.h"
+#include "envoy/http/header_map.h"
+#include "gmock/gmock.h"
+#include "google/protobuf/text_format.h"
+#include "gtest/gtest.h"
+#include "src/envoy/utils/filter_state_utils.h"
+#include "test/mocks/http/mocks.h"
+#include "test/test_common/utility.h"
+
+namespace Envoy {
+namespace Extensions {
+namespace HttpFilters {
+namespace RateLimitDescriptors {
+namespace {
+
+const char kFilterConfig[] = R"(
+rules {
+  operation: "get-books"
+  api_key_locations { query: "key" }
+  api_key_locations { header: "x-api-key" }
+}
+rules {
+  operation: "get-shelves"
+}
+headers {
+  operation: "x-endpoint-api-rate-limit-operation"
+  api_key: "x-endpoint-api-rate-limit-api-key"
+  jwt_issuer: "x-endpoint-api-rate-limit-jwt-issuer"
+  jwt_subject: "x-endpoint-api-rate-limit-jwt-subject"
+}
+jwt_payload_metadata_name: "jwt_payloads"
+)";
+
+const Http::LowerCaseString kOperationHeader(
+    "x-endpoint-api-rate-limit-operation");
+const Http::LowerCaseString kApiKeyHeader("x-endpoint-api-rate-limit-api-key");
+const Http::LowerCaseString kJwtIssuerHeader(
+    "x-endpoint-api-rate-limit-jwt-issuer");
+const Http::LowerCaseString kJwtSubjectHeader(
+    "x-endpoint-api-rate-limit-jwt-subject");
+
+/**
+ * Base class for testing the Rate Limit Descriptors filter.
+ */
+class RateLimitDescriptorsFilterTest : public ::testing::Test {
+ protected:
+  RateLimitDescriptorsFilterTest() = default;
+
+  void SetUp() override {
+    google::api::envoy::http::rate_limit_descriptors::FilterConfig
+        proto_config;
+    ASSERT_TRUE(google::protobuf::TextFormat::ParseFromString(
+        std::string(kFilterConfig), &proto_config));
+    config_ = std::make_shared<FilterConfig>(proto_config);
+    filter_ = std::make_unique<Filter>(config_);
+    filter_->setDecoderFilterCallbacks(mock_decoder_callbacks_);
+  }
+
+  void setOperation(absl::string_view operation) {
+    Utils::setStringFilterState(
+        *mock_decoder_callbacks_.stream_info_.filter_state_, Utils::kOperation,
+        operation);
+  }
+
+  void setJwtPayload(const std::string& issuer, const std::string& subject) {
+    ProtobufWkt::Struct payload;
+    (*payload.mutable_fields())["iss"].set_string_value(issuer);
+    (*payload.mutable_fields())["sub"].set_string_value(subject);
+    ProtobufWkt::Struct jwt_payloads;
+    *(*jwt_payloads.mutable_fields())["jwt_payloads"].mutable_struct_value() =
+        payload;
+    (*mock_decoder_callbacks_.stream_info_.metadata_.mutable_filter_metadata())
+        ["envoy.filters.http.jwt_authn"] = jwt_payloads;
+  }
+
+  FilterConfigSharedPtr config_;
+  std::unique_ptr<Filter> filter_;
+  testing::NiceMock<Envoy::Http::MockStreamDecoderFilterCallbacks>
+      mock_decoder_callbacks_;
+};
+
+TEST_F(RateLimitDescriptorsFilterTest, NoOperationName) {
+  Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                         {":path", "/books?key=key-1"}};
+
+  EXPECT_EQ(filter_->decodeHeaders(headers, true),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_FALSE(headers.has(kOperationHeader));
+  EXPECT_FALSE(headers.has(kApiKeyHeader));
+}
+
+TEST_F(RateLimitDescriptorsFilterTest, OperationNotRateLimited) {
+  Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                         {":path", "/books?key=key-1"}};
+  setOperation("list-books");
+  setJwtPayload("issuer-1", "subject-1");
+
+  EXPECT_EQ(filter_->decodeHeaders(headers, true),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_FALSE(headers.has(kOperationHeader));
+  EXPECT_FALSE(headers.has(kApiKeyHeader));
+  EXPECT_FALSE(headers.has(kJwtIssuerHeader));
+  EXPECT_FALSE(headers.has(kJwtSubjectHeader));
+}
+
+TEST_F(RateLimitDescriptorsFilterTest, OperationOnly) {
+  Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                         {":path", "/books?key=key-1"}};
+  setOperation("get-shelves");
+
+  EXPECT_EQ(filter_->decodeHeaders(headers, true),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(headers.get_(kOperationHeader), "get-shelves");
+  // The operation has no API key locations.
+  EXPECT_FALSE(headers.has(kApiKeyHeader));
+  EXPECT_FALSE(headers.has(kJwtIssuerHeader));
+  EXPECT_FALSE(headers.has(kJwtSubjectHeader));
+}
+
+TEST_F(RateLimitDescriptorsFilterTest, ApiKeyInQuery) {
+  Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                         {":path", "/books?key=key-1"}};
+  setOperation("get-books");
+
+  EXPECT_EQ(filter_->decodeHeaders(headers, true),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(headers.get_(kOperationHeader), "get-books");
+  EXPECT_EQ(headers.get_(kApiKeyHeader), "key-1");
+}
+
+TEST_F(RateLimitDescriptorsFilterTest, ApiKeyInHeader) {
+  Http::TestRequestHeaderMapImpl headers{
+      {":method", "GET"}, {":path", "/books"}, {"x-api-key", "key-2"}};
+  setOperation("get-books");
+
+  EXPECT_EQ(filter_->decodeHeaders(headers, true),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(headers.get_(kApiKeyHeader), "key-2");
+}
+
+TEST_F(RateLimitDescriptorsFilterTest, JwtIssuerAndSubject) {
+  Http::TestRequestHeaderMapImpl headers{{":method", "GET"},
+                                         {":path", "/books"}};
+  setOperation("get-books");
+  setJwtPayload("issuer-1", "subject-1");
+
+  EXPECT_EQ(filter_->decodeHeaders(headers, true),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(headers.get_(kOperationHeader), "get-books");
+  EXPECT_FALSE(headers.has(kApiKeyHeader));
+  EXPECT_EQ(headers.get_(kJwtIssuerHeader), "issuer-1");
+  EXPECT_EQ(headers.get_(kJwtSubjectHeader), "subject-1");
+}
+
+TEST_F(RateLimitDescriptorsFilterTest, RemoveClientHeaders) {
+  Http::TestRequestHeaderMapImpl headers{
+      {":method", "GET"},
+      {":path", "/books"},
+      {"x-endpoint-api-rate-limit-operation", "get-shelves"},
+      {"x-endpoint-api-rate-limit-api-key", "spoofed-key"},
+      {"x-endpoint-api-rate-limit-jwt-issuer", "spoofed-issuer"},
+      {"x-endpoint-api-rate-limit-jwt-subject", "spoofed-subject"}};
+  setOperation("get-books");
+
+  EXPECT_EQ(filter_->decodeHeaders(headers, true),
+            Http::FilterHeadersStatus::Continue);
+  EXPECT_EQ(headers.get_(kOperationHeader), "get-books");
+  EXPECT_FALSE(headers.has(kApiKeyHeader));
+  EXPECT_FALSE(headers.has(kJwtIssuerHeader));
+  EXPECT_FALSE(headers.has(kJwtSubjectHeader));
+}
+
+}  // namespace
+}  // namespace RateLimitDescriptors
+}  // namespace HttpFilters
+}  // namespace Extensions
+}  // namespace Envoy
@@ -37,13 +37,19 @@ FilterConfigParser::FilterConfigParser(const FilterConfig& config,
     if (first_srv_ctx == nullptr) {
       first_srv_ctx = srv_ctx;
     }
-    service_map_.emplace(service.service_name(), ServiceContextPtr(srv_ctx));
+    // The other service configs of a service in a traffic percent rollout
+    // are only selected by the route metadata.
+    service_map_.emplace(service.service_name(), srv_ctx);
+    service_config_map_.emplace(
+        std::make_pair(service.service_name(), service.service_config_id()),
+        ServiceContextPtr(srv_ctx));
   }
   if (first_srv_ctx == nullptr) {
     throw ProtoValidationException("Empty services", config_);
   }
 
-  if (service_map_.size() < static_cast<size_t>(config_.services_size())) {
+  if (service_config_map_.size() <
+      static_cast<size_t>(config_.services_size())) {
     throw ProtoValidationException("Duplicated service names", config_);
   }
 
@@ -115,6 +115,19 @@ class FilterConfigParser {
     return non_match_rqm_ctx_.get();
   }
 
+  // Find the ServiceContext of a service config in a traffic percent rollout.
+  const ServiceContext* FindServiceContext(
+      absl::string_view service_name,
+      absl::string_view service_config_id) const {
+    const auto service_it = service_config_map_.find(
+        std::make_pair(std::string(service_name),
+                       std::string(service_config_id)));
+    if (service_it == service_config_map_.end()) {
+      return nullptr;
+    }
+    return service_it->second.get();
+  }
+
  private:
   // The proto config.
   const ::google::api::envoy::http::service_control::FilterConfig& config_;
@@ -123,8 +136,11 @@ class FilterConfigParser {
   // The requirement for non matched requests for sending their reports.
   ::google::api::envoy::http::service_control::Requirement non_match_rqm_cfg_;
   RequirementContextPtr non_match_rqm_ctx_;
-  // Service name to ServiceContext map.
-  absl::flat_hash_map<std::string, ServiceContextPtr> service_map_;
+  // Service name and service config id to ServiceContext map.
+  absl::flat_hash_map<std::pair<std::string, std::string>, ServiceContextPtr>
+      service_config_map_;
+  // Service name to the ServiceContext of its first service config.
+  absl::flat_hash_map<std::string, const ServiceContext*> service_map_;
   // The default locations to extract api-key.
   ::google::api::envoy::http::service_control::ApiKeyRequirement
       default_api_keys_;
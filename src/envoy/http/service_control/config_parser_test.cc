@@ -89,6 +89,40 @@ services {
                           ProtoValidationException, "Duplicated service names");
 }
 
+TEST(ConfigParserTest, RolloutServiceConfigs) {
+  FilterConfig config;
+  const char kConfigWithRollout[] = R"(
+services {
+  service_name: "echo"
+  service_config_id: "2019-10-01r0"
+}
+services {
+  service_name: "echo"
+  service_config_id: "2019-10-01r1"
+}
+requirements {
+  service_name: "echo"
+  operation_name: "get_foo"
+})";
+  ASSERT_TRUE(TextFormat::ParseFromString(kConfigWithRollout, &config));
+  testing::NiceMock<MockServiceControlCallFactory> mock_factory;
+  FilterConfigParser parser(config, mock_factory);
+
+  // The requirements use the first service config of the service.
+  EXPECT_EQ(parser.FindRequirement("get_foo")
+                ->service_ctx()
+                .config()
+                .service_config_id(),
+            "2019-10-01r0");
+
+  EXPECT_EQ(parser.FindServiceContext("echo", "2019-10-01r1")
+                ->config()
+                .service_config_id(),
+            "2019-10-01r1");
+  EXPECT_FALSE(parser.FindServiceContext("echo", "2019-10-01r2"));
+  EXPECT_FALSE(parser.FindServiceContext("echo111", "2019-10-01r1"));
+}
+
 TEST(ConfigParserTest, DuplicatedOperationNames) {
   FilterConfig config;
   const char kConfigWithDupliacedService[] = R"(
@@ -15,6 +15,7 @@
 #include <chrono>
 
 #include "absl/strings/match.h"
+#include "common/config/metadata.h"
 #include "common/http/utility.h"
 #include "extensions/filters/http/grpc_stats/grpc_stats_filter.h"
 #include "src/envoy/http/service_control/handler_impl.h"
@@ -41,6 +42,15 @@ const Http::LowerCaseString kAndroidPackageHeader{"x-android-package"};
 const Http::LowerCaseString kAndroidCertHeader{"x-android-cert"};
 const Http::LowerCaseString kRefererHeader{"referer"};
 
+// The route metadata of this filter with the service config id of a traffic
+// percent rollout.
+const std::string kFilterName = "envoy.filters.http.service_control";
+const std::string kServiceConfigIdKey = "service_config_id";
+
+// The response code detail of the requests rejected by the circuit breakers
+// of the backend, if Envoy has none.
+constexpr char kUpstreamOverflowDetail[] = "upstream_overflow";
+
 constexpr char JwtPayloadIssuerPath[] = "iss";
 constexpr char JwtPayloadAuidencePath[] = "aud";
 
@@ -89,6 +99,25 @@ ServiceControlHandlerImpl::ServiceControlHandlerImpl(
     return;
   }
 
+  // In a traffic percent rollout, the route of the request decides which
+  // service config it is served by.
+  const Router::RouteEntry* route_entry = stream_info_.routeEntry();
+  if (route_entry != nullptr) {
+    const std::string& service_config_id =
+        Config::Metadata::metadataValue(&route_entry->metadata(), kFilterName,
+                                        kServiceConfigIdKey)
+            .string_value();
+    if (!service_config_id.empty()) {
+      service_ctx_ = cfg_parser_.FindServiceContext(
+          require_ctx_->service_ctx().config().service_name(),
+          service_config_id);
+      if (!service_ctx_) {
+        ENVOY_LOG(debug, "No service config matched the route: {}",
+                  service_config_id);
+      }
+    }
+  }
+
   if (require_ctx_->config().api_key().locations_size() > 0) {
     extractAPIKey(headers, require_ctx_->config().api_key().locations(),
                   api_key_);
@@ -111,8 +140,7 @@ void ServiceControlHandlerImpl::fillOperationInfo(
     ::google::api_proxy::service_control::OperationInfo& info) {
   info.operation_id = uuid_;
   info.operation_name = require_ctx_->config().operation_name();
-  info.producer_project_id =
-      require_ctx_->service_ctx().config().producer_project_id();
+  info.producer_project_id = serviceCtx().config().producer_project_id();
   info.current_time = time_source_.systemTime();
 
   if (stream_info_.downstreamRemoteAddress()->type() ==
@@ -184,7 +212,7 @@ void ServiceControlHandlerImpl::callCheck(Http::RequestHeaderMap& headers,
       std::string(Utils::extractHeader(headers, kAndroidCertHeader));
 
   on_check_done_called_ = false;
-  cancel_fn_ = require_ctx_->service_ctx().call().callCheck(
+  cancel_fn_ = serviceCtx().call().callCheck(
       info, parent_span,
       [this, &headers](const Status& status,
                        const CheckResponseInfo& response_info) {
@@ -214,7 +242,7 @@ void ServiceControlHandlerImpl::callQuota() {
   // transport, need to save its cancel function.
   // For now, quota cache is always enabled, in-flight transport
   // is not called.
-  require_ctx_->service_ctx().call().callQuota(
+  serviceCtx().call().callQuota(
       info, [this](const Status& status) {
         check_status_ = status;
         check_callback_->onCheckDone(status);
@@ -262,31 +290,25 @@ void ServiceControlHandlerImpl::callReport(
 
   ::google::api_proxy::service_control::ReportRequestInfo info;
   prepareReportRequest(info);
-  fillLoggedHeader(request_headers,
-                   require_ctx_->service_ctx().config().log_request_headers(),
+  fillLoggedHeader(request_headers, serviceCtx().config().log_request_headers(),
                    info.request_headers);
   fillLoggedHeader(response_headers,
-                   require_ctx_->service_ctx().config().log_response_headers(),
+                   serviceCtx().config().log_response_headers(),
                    info.response_headers);
-  fillJwtPayloads(
-      stream_info_.dynamicMetadata(),
-      require_ctx_->service_ctx().config().jwt_payload_metadata_name(),
-      require_ctx_->service_ctx().config().log_jwt_payloads(),
-      info.jwt_payloads);
-
-  fillJwtPayload(
-      stream_info_.dynamicMetadata(),
-      require_ctx_->service_ctx().config().jwt_payload_metadata_name(),
-      JwtPayloadIssuerPath, info.auth_issuer);
-
-  fillJwtPayload(
-      stream_info_.dynamicMetadata(),
-      require_ctx_->service_ctx().config().jwt_payload_metadata_name(),
-      JwtPayloadAuidencePath, info.auth_audience);
+  fillJwtPayloads(stream_info_.dynamicMetadata(),
+                  serviceCtx().config().jwt_payload_metadata_name(),
+                  serviceCtx().config().log_jwt_payloads(), info.jwt_payloads);
+
+  fillJwtPayload(stream_info_.dynamicMetadata(),
+                 serviceCtx().config().jwt_payload_metadata_name(),
+                 JwtPayloadIssuerPath, info.auth_issuer);
+
+  fillJwtPayload(stream_info_.dynamicMetadata(),
+                 serviceCtx().config().jwt_payload_metadata_name(),
+                 JwtPayloadAuidencePath, info.auth_audience);
 
   info.frontend_protocol = getFrontendProtocol(response_headers, stream_info_);
-  info.backend_protocol =
-      getBackendProtocol(require_ctx_->service_ctx().config());
+  info.backend_protocol = getBackendProtocol(serviceCtx().config());
 
   if (request_headers) {
     info.referer =
@@ -296,6 +318,13 @@ void ServiceControlHandlerImpl::callReport(
   fillLatency(stream_info_, info.latency);
 
   info.response_code = stream_info_.responseCode().value_or(500);
+  // The overflows of the circuit breakers are 503 as the backend errors, so
+  // they are told apart by their detail.
+  if (stream_info_.hasResponseFlag(
+          StreamInfo::ResponseFlag::UpstreamOverflow)) {
+    info.response_code_detail =
+        stream_info_.responseCodeDetails().value_or(kUpstreamOverflowDetail);
+  }
 
   info.request_size = stream_info_.bytesReceived() + request_header_size_;
   info.request_bytes = stream_info_.bytesReceived() + request_header_size_;
@@ -326,7 +355,7 @@ void ServiceControlHandlerImpl::callReport(
 
   info.is_first_report = is_first_report_;
 
-  require_ctx_->service_ctx().call().callReport(info);
+  serviceCtx().call().callReport(info);
 }
 
 void ServiceControlHandlerImpl::tryIntermediateReport() {
@@ -337,8 +366,7 @@ void ServiceControlHandlerImpl::tryIntermediateReport() {
   // Avoid reporting more frequently than the configured interval.
   if (std::chrono::duration_cast<std::chrono::milliseconds>(
           time_source_.systemTime() - last_reported_)
-          .count() <
-      require_ctx_->service_ctx().get_min_stream_report_interval_ms()) {
+          .count() < serviceCtx().get_min_stream_report_interval_ms()) {
     return;
   }
 
@@ -351,7 +379,7 @@ void ServiceControlHandlerImpl::tryIntermediateReport() {
   info.frontend_protocol = frontend_protocol_;
   info.is_first_report = is_first_report_;
   info.is_final_report = false;
-  require_ctx_->service_ctx().call().callReport(info);
+  serviceCtx().call().callReport(info);
   last_reported_ = time_source_.systemTime();
   is_first_report_ = false;
 }
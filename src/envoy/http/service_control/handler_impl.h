@@ -71,6 +71,12 @@ class ServiceControlHandlerImpl : public Logger::Loggable<Logger::Id::filter>,
 
   bool isConfigured() const { return require_ctx_ != nullptr; }
 
+  // The service config of the request, which is the one of the matched
+  // requirement unless the route selects another one.
+  const ServiceContext& serviceCtx() const {
+    return service_ctx_ ? *service_ctx_ : require_ctx_->service_ctx();
+  }
+
   bool isQuotaRequired() const {
     return !require_ctx_->config().skip_service_control() &&
            !require_ctx_->config().metric_costs().empty();
@@ -105,6 +111,9 @@ class ServiceControlHandlerImpl : public Logger::Loggable<Logger::Id::filter>,
   // The matched requirement
   const RequirementContext* require_ctx_{};
 
+  // The service config selected by the route in a traffic percent rollout.
+  const ServiceContext* service_ctx_{};
+
   std::string path_;
   std::string http_method_;
   std::string uuid_;
@@ -19,6 +19,7 @@
 #include "gmock/gmock.h"
 #include "google/protobuf/text_format.h"
 #include "gtest/gtest.h"
+#include "test/mocks/router/mocks.h"
 #include "test/mocks/server/mocks.h"
 #include "test/mocks/tracing/mocks.h"
 #include "test/test_common/test_time.h"
@@ -45,6 +46,7 @@ using ::testing::_;
 using ::testing::ByMove;
 using ::testing::MockFunction;
 using ::testing::Return;
+using ::testing::ReturnRef;
 
 namespace Envoy {
 namespace Extensions {
@@ -980,6 +982,80 @@ TEST_F(HandlerTest, HandlerReportWithoutCheck) {
   handler.callReport(&headers, &response_headers, &resp_trailer_);
 }
 
+TEST_F(HandlerTest, HandlerReportUpstreamOverflow) {
+  // Test: The requests rejected by the circuit breakers of the backend are
+  // reported with their response code detail.
+  Utils::setStringFilterState(*mock_stream_info_.filter_state_,
+                              Utils::kOperation, "get_no_key");
+  TestRequestHeaderMapImpl headers{{":method", "GET"}, {":path", "/echo"}};
+  TestResponseHeaderMapImpl response_headers{{":status", "503"}};
+  const absl::optional<std::string> details(
+      "upstream_reset_before_response_started{overflow}");
+  ON_CALL(mock_stream_info_,
+          hasResponseFlag(StreamInfo::ResponseFlag::UpstreamOverflow))
+      .WillByDefault(Return(true));
+  ON_CALL(mock_stream_info_, responseCodeDetails())
+      .WillByDefault(ReturnRef(details));
+  ServiceControlHandlerImpl handler(headers, mock_stream_info_, "test-uuid",
+                                    *cfg_parser_, test_time_);
+
+  ReportRequestInfo report_info;
+  EXPECT_CALL(*mock_call_, callReport(_))
+      .WillOnce(testing::SaveArg<0>(&report_info));
+  handler.callReport(&headers, &response_headers, &resp_trailer_);
+  EXPECT_EQ(report_info.response_code_detail,
+            "upstream_reset_before_response_started{overflow}");
+}
+
+TEST_F(HandlerTest, HandlerServiceConfigFromRouteMetadata) {
+  // Test: In a traffic percent rollout, the request is reported with the
+  // service config in the metadata of its route.
+  FilterConfig proto_config;
+  ASSERT_TRUE(TextFormat::ParseFromString(R"(
+services {
+  service_name: "echo"
+  service_config_id: "2019-10-01r0"
+  producer_project_id: "project-id"
+}
+services {
+  service_name: "echo"
+  service_config_id: "2019-10-01r1"
+  producer_project_id: "project-id"
+}
+requirements {
+  service_name: "echo"
+  operation_name: "get_no_key"
+  api_key: {
+    allow_without_api_key: true
+  }
+})",
+                                          &proto_config));
+  auto* main_call = new testing::NiceMock<MockServiceControlCall>();
+  auto* canary_call = new testing::NiceMock<MockServiceControlCall>();
+  testing::NiceMock<MockServiceControlCallFactory> call_factory;
+  EXPECT_CALL(call_factory, create(_))
+      .WillOnce(Return(ByMove(ServiceControlCallPtr(main_call))))
+      .WillOnce(Return(ByMove(ServiceControlCallPtr(canary_call))));
+  FilterConfigParser cfg_parser(proto_config, call_factory);
+
+  testing::NiceMock<Router::MockRouteEntry> route_entry;
+  auto& fields = *(*route_entry.metadata_.mutable_filter_metadata())
+                      ["envoy.filters.http.service_control"]
+                          .mutable_fields();
+  fields["service_config_id"].set_string_value("2019-10-01r1");
+  ON_CALL(mock_stream_info_, routeEntry())
+      .WillByDefault(Return(&route_entry));
+  Utils::setStringFilterState(*mock_stream_info_.filter_state_,
+                              Utils::kOperation, "get_no_key");
+  TestRequestHeaderMapImpl headers{{":method", "GET"}, {":path", "/echo"}};
+  ServiceControlHandlerImpl handler(headers, mock_stream_info_, "test-uuid",
+                                    cfg_parser, test_time_);
+
+  EXPECT_CALL(*main_call, callReport(_)).Times(0);
+  EXPECT_CALL(*canary_call, callReport(_));
+  handler.callReport(&headers, &resp_headers_, &resp_trailer_);
+}
+
 TEST_F(HandlerTest, TryIntermediateReport) {
   // CollectDecodeData test cases after the boilerplate
   Utils::setStringFilterState(*mock_stream_info_.filter_state_,
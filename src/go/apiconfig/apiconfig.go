@@ -0,0 +1,567 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apiconfig builds the service configs of gRPC services from their
+// API config YAML files and proto descriptor sets, the same way as Service
+// Management does when they are deployed, so that ESPv2 can serve a gRPC
+// service without deploying it first.
+package apiconfig
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+	apipb "google.golang.org/genproto/protobuf/api"
+	ptypepb "google.golang.org/genproto/protobuf/ptype"
+	sourcecontextpb "google.golang.org/genproto/protobuf/source_context"
+)
+
+const typeUrlPrefix = "type.googleapis.com/"
+
+// The last component of a versioned proto package, e.g. v1 or v2beta1.
+var versionRegexp = regexp.MustCompile(`^v\d+\w*$`)
+
+// ReadServiceConfig builds the service config from the API config YAML file
+// and the proto descriptor set file, and returns the checksum of their
+// contents as well.
+func ReadServiceConfig(apiConfigPath, descriptorPath string) (*confpb.Service, [sha256.Size]byte, error) {
+	apiConfig, err := ioutil.ReadFile(apiConfigPath)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, fmt.Errorf("fail to read API config file: %s, error: %s", apiConfigPath, err)
+	}
+	descriptorSet, err := ioutil.ReadFile(descriptorPath)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, fmt.Errorf("fail to read proto descriptor file: %s, error: %s", descriptorPath, err)
+	}
+	hash := contentHash(apiConfig, descriptorSet)
+
+	serviceConfig, err := ToServiceConfig(apiConfig, filepath.Base(apiConfigPath), descriptorSet, filepath.Base(descriptorPath))
+	if err != nil {
+		return nil, hash, fmt.Errorf("fail to build service config from API config file: %s and proto descriptor file: %s, error: %v", apiConfigPath, descriptorPath, err)
+	}
+	return serviceConfig, hash, nil
+}
+
+func contentHash(apiConfig, descriptorSet []byte) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00", len(apiConfig))
+	h.Write(apiConfig)
+	h.Write(descriptorSet)
+	var hash [sha256.Size]byte
+	copy(hash[:], h.Sum(nil))
+	return hash
+}
+
+// ToServiceConfig builds the service config from the API config in YAML and
+// the proto descriptor set, which must include the imports of the protos.
+//
+// The methods of the apis, the HTTP rules of their google.api.http
+// annotations and the types used by them come from the descriptor set. The
+// HTTP rules of the API config override the annotated ones of the same
+// methods. The selectors with wildcards are expanded into the methods they
+// match, the most specific one wins. Both files are kept in the source info,
+// the descriptor set is needed by gRPC transcoding.
+//
+// Unless the API config has one, the config id is derived from the contents
+// of the files, so that it changes with them. Service Control is not enabled
+// in the service config, unless the API config does so.
+func ToServiceConfig(apiConfig []byte, apiConfigName string, descriptorSet []byte, descriptorName string) (*confpb.Service, error) {
+	serviceConfig, err := util.UnmarshalServiceConfigYAML(apiConfig)
+	if err != nil {
+		return nil, fmt.Errorf("fail to unmarshal API config, %v", err)
+	}
+	if serviceConfig.GetName() == "" {
+		return nil, fmt.Errorf("name is required as the service name")
+	}
+	if len(serviceConfig.GetApis()) == 0 {
+		return nil, fmt.Errorf("apis is required, with the names of the gRPC services")
+	}
+
+	var fds descpb.FileDescriptorSet
+	if err := proto.Unmarshal(descriptorSet, &fds); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal proto descriptor set, %v", err)
+	}
+
+	if serviceConfig.Id == "" {
+		hash := contentHash(apiConfig, descriptorSet)
+		serviceConfig.Id = fmt.Sprintf("apiconfig-%x", hash[:8])
+	}
+	var sourceFiles []*anypb.Any
+	for _, file := range []*smpb.ConfigFile{
+		{
+			FilePath:     apiConfigName,
+			FileContents: apiConfig,
+			FileType:     smpb.ConfigFile_SERVICE_CONFIG_YAML,
+		},
+		{
+			FilePath:     descriptorName,
+			FileContents: descriptorSet,
+			FileType:     smpb.ConfigFile_FILE_DESCRIPTOR_SET_PROTO,
+		},
+	} {
+		sourceFile, err := ptypes.MarshalAny(file)
+		if err != nil {
+			return nil, err
+		}
+		sourceFiles = append(sourceFiles, sourceFile)
+	}
+	serviceConfig.SourceInfo = &confpb.SourceInfo{
+		SourceFiles: sourceFiles,
+	}
+
+	b := newBuilder(serviceConfig, &fds)
+	if err := b.build(); err != nil {
+		return nil, err
+	}
+	return serviceConfig, nil
+}
+
+type protoFile struct {
+	name   string
+	syntax ptypepb.Syntax
+}
+
+type messageDescriptor struct {
+	*descpb.DescriptorProto
+	file *protoFile
+}
+
+type enumDescriptor struct {
+	*descpb.EnumDescriptorProto
+	file *protoFile
+}
+
+type serviceDescriptor struct {
+	*descpb.ServiceDescriptorProto
+	file    *protoFile
+	version string
+}
+
+type builder struct {
+	serviceConfig *confpb.Service
+	// The descriptors by their full names, without the leading dot.
+	services map[string]*serviceDescriptor
+	messages map[string]*messageDescriptor
+	enums    map[string]*enumDescriptor
+	// The full names of the methods of the apis, in order.
+	methods []string
+}
+
+func newBuilder(serviceConfig *confpb.Service, fds *descpb.FileDescriptorSet) *builder {
+	b := &builder{
+		serviceConfig: serviceConfig,
+		services:      make(map[string]*serviceDescriptor),
+		messages:      make(map[string]*messageDescriptor),
+		enums:         make(map[string]*enumDescriptor),
+	}
+	for _, fd := range fds.GetFile() {
+		file := &protoFile{
+			name:   fd.GetName(),
+			syntax: ptypepb.Syntax_SYNTAX_PROTO2,
+		}
+		if fd.GetSyntax() == "proto3" {
+			file.syntax = ptypepb.Syntax_SYNTAX_PROTO3
+		}
+		prefix := ""
+		if fd.GetPackage() != "" {
+			prefix = fd.GetPackage() + "."
+		}
+		version := "v1"
+		if components := strings.Split(fd.GetPackage(), "."); versionRegexp.MatchString(components[len(components)-1]) {
+			version = components[len(components)-1]
+		}
+		for _, s := range fd.GetService() {
+			b.services[prefix+s.GetName()] = &serviceDescriptor{
+				ServiceDescriptorProto: s,
+				file:                   file,
+				version:                version,
+			}
+		}
+		b.addMessages(file, prefix, fd.GetMessageType())
+		for _, e := range fd.GetEnumType() {
+			b.enums[prefix+e.GetName()] = &enumDescriptor{e, file}
+		}
+	}
+	return b
+}
+
+func (b *builder) addMessages(file *protoFile, prefix string, messages []*descpb.DescriptorProto) {
+	for _, m := range messages {
+		name := prefix + m.GetName()
+		b.messages[name] = &messageDescriptor{m, file}
+		for _, e := range m.GetEnumType() {
+			b.enums[name+"."+e.GetName()] = &enumDescriptor{e, file}
+		}
+		b.addMessages(file, name+".", m.GetNestedType())
+	}
+}
+
+func (b *builder) build() error {
+	var annotatedRules []*annotationspb.HttpRule
+	var messageNames []string
+	for _, api := range b.serviceConfig.GetApis() {
+		service, ok := b.services[api.GetName()]
+		if !ok {
+			return fmt.Errorf("api %s is not found in the proto descriptor set", api.GetName())
+		}
+		if api.Version == "" {
+			api.Version = service.version
+		}
+		api.SourceContext = &sourcecontextpb.SourceContext{
+			FileName: service.file.name,
+		}
+		api.Syntax = service.file.syntax
+		api.Methods = nil
+		for _, m := range service.GetMethod() {
+			selector := api.GetName() + "." + m.GetName()
+			b.methods = append(b.methods, selector)
+			inputType := strings.TrimPrefix(m.GetInputType(), ".")
+			outputType := strings.TrimPrefix(m.GetOutputType(), ".")
+			messageNames = append(messageNames, inputType, outputType)
+			api.Methods = append(api.Methods, &apipb.Method{
+				Name:              m.GetName(),
+				RequestTypeUrl:    typeUrlPrefix + inputType,
+				RequestStreaming:  m.GetClientStreaming(),
+				ResponseTypeUrl:   typeUrlPrefix + outputType,
+				ResponseStreaming: m.GetServerStreaming(),
+				Syntax:            service.file.syntax,
+			})
+
+			if m.GetOptions() == nil || !proto.HasExtension(m.GetOptions(), annotationspb.E_Http) {
+				continue
+			}
+			ext, err := proto.GetExtension(m.GetOptions(), annotationspb.E_Http)
+			if err != nil {
+				return fmt.Errorf("fail to get google.api.http annotation of method %s, %v", selector, err)
+			}
+			rule := proto.Clone(ext.(*annotationspb.HttpRule)).(*annotationspb.HttpRule)
+			rule.Selector = selector
+			annotatedRules = append(annotatedRules, rule)
+		}
+	}
+
+	if err := b.buildHttpRules(annotatedRules); err != nil {
+		return err
+	}
+	if err := b.buildTypes(messageNames); err != nil {
+		return err
+	}
+	return b.expandSelectors()
+}
+
+// buildHttpRules merges the HTTP rules of the API config into the annotated
+// ones, in the order of the methods.
+func (b *builder) buildHttpRules(annotatedRules []*annotationspb.HttpRule) error {
+	configRules := make(map[string]*annotationspb.HttpRule)
+	for _, rule := range b.serviceConfig.GetHttp().GetRules() {
+		if !b.hasMethod(rule.GetSelector()) {
+			return fmt.Errorf("selector %q of the http rules does not match any method", rule.GetSelector())
+		}
+		if configRules[rule.GetSelector()] != nil {
+			return fmt.Errorf("duplicate http rules of selector %q", rule.GetSelector())
+		}
+		configRules[rule.GetSelector()] = rule
+	}
+
+	rulesByMethod := make(map[string][]*annotationspb.HttpRule)
+	for _, rule := range annotatedRules {
+		if configRules[rule.GetSelector()] == nil {
+			rulesByMethod[rule.GetSelector()] = append(rulesByMethod[rule.GetSelector()], rule)
+		}
+	}
+	for selector, rule := range configRules {
+		rulesByMethod[selector] = append(rulesByMethod[selector], rule)
+	}
+	var sortedRules []*annotationspb.HttpRule
+	for _, method := range b.methods {
+		sortedRules = append(sortedRules, rulesByMethod[method]...)
+	}
+	if len(sortedRules) == 0 {
+		return nil
+	}
+	if b.serviceConfig.Http == nil {
+		b.serviceConfig.Http = &annotationspb.Http{}
+	}
+	b.serviceConfig.Http.Rules = sortedRules
+	return nil
+}
+
+func (b *builder) hasMethod(selector string) bool {
+	for _, method := range b.methods {
+		if method == selector {
+			return true
+		}
+	}
+	return false
+}
+
+// buildTypes adds the messages used by the methods to the types, and the
+// enums used by them to the enums, including the ones used by their fields.
+func (b *builder) buildTypes(messageNames []string) error {
+	b.serviceConfig.Types = nil
+	b.serviceConfig.Enums = nil
+	seen := make(map[string]bool)
+	for len(messageNames) > 0 {
+		name := messageNames[0]
+		messageNames = messageNames[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		m, ok := b.messages[name]
+		if !ok {
+			return fmt.Errorf("message %s is not found in the proto descriptor set, which must include the imports", name)
+		}
+
+		t := &ptypepb.Type{
+			Name: name,
+			SourceContext: &sourcecontextpb.SourceContext{
+				FileName: m.file.name,
+			},
+			Syntax: m.file.syntax,
+		}
+		for _, o := range m.GetOneofDecl() {
+			t.Oneofs = append(t.Oneofs, o.GetName())
+		}
+		if m.GetOptions().GetMapEntry() {
+			mapEntry, err := ptypes.MarshalAny(&wrapperspb.BoolValue{Value: true})
+			if err != nil {
+				return err
+			}
+			t.Options = append(t.Options, &ptypepb.Option{
+				Name:  "proto2.MessageOptions.map_entry",
+				Value: mapEntry,
+			})
+		}
+		for _, f := range m.GetField() {
+			field := &ptypepb.Field{
+				Kind:        ptypepb.Field_Kind(f.GetType()),
+				Cardinality: ptypepb.Field_Cardinality(f.GetLabel()),
+				Number:      f.GetNumber(),
+				Name:        f.GetName(),
+				JsonName:    f.GetJsonName(),
+				Packed:      isPacked(f, m.file.syntax),
+			}
+			if field.JsonName == "" {
+				field.JsonName = jsonName(f.GetName())
+			}
+			if f.OneofIndex != nil {
+				// The oneof index of the type starts from 1.
+				field.OneofIndex = f.GetOneofIndex() + 1
+			}
+			typeName := strings.TrimPrefix(f.GetTypeName(), ".")
+			switch f.GetType() {
+			case descpb.FieldDescriptorProto_TYPE_MESSAGE, descpb.FieldDescriptorProto_TYPE_GROUP:
+				field.TypeUrl = typeUrlPrefix + typeName
+				messageNames = append(messageNames, typeName)
+			case descpb.FieldDescriptorProto_TYPE_ENUM:
+				field.TypeUrl = typeUrlPrefix + typeName
+				if err := b.addEnum(typeName, seen); err != nil {
+					return err
+				}
+			}
+			t.Fields = append(t.Fields, field)
+		}
+		b.serviceConfig.Types = append(b.serviceConfig.Types, t)
+	}
+	return nil
+}
+
+// isPacked returns whether a field is packed, repeated scalar fields are
+// packed by default in proto3.
+func isPacked(f *descpb.FieldDescriptorProto, syntax ptypepb.Syntax) bool {
+	if f.GetLabel() != descpb.FieldDescriptorProto_LABEL_REPEATED {
+		return false
+	}
+	switch f.GetType() {
+	case descpb.FieldDescriptorProto_TYPE_STRING, descpb.FieldDescriptorProto_TYPE_BYTES,
+		descpb.FieldDescriptorProto_TYPE_MESSAGE, descpb.FieldDescriptorProto_TYPE_GROUP:
+		return false
+	}
+	if f.GetOptions() != nil && f.GetOptions().Packed != nil {
+		return f.GetOptions().GetPacked()
+	}
+	return syntax == ptypepb.Syntax_SYNTAX_PROTO3
+}
+
+func (b *builder) addEnum(name string, seen map[string]bool) error {
+	if seen[name] {
+		return nil
+	}
+	seen[name] = true
+	e, ok := b.enums[name]
+	if !ok {
+		return fmt.Errorf("enum %s is not found in the proto descriptor set, which must include the imports", name)
+	}
+	enum := &ptypepb.Enum{
+		Name: name,
+		SourceContext: &sourcecontextpb.SourceContext{
+			FileName: e.file.name,
+		},
+		Syntax: e.file.syntax,
+	}
+	for _, v := range e.GetValue() {
+		enum.Enumvalue = append(enum.Enumvalue, &ptypepb.EnumValue{
+			Name:   v.GetName(),
+			Number: v.GetNumber(),
+		})
+	}
+	b.serviceConfig.Enums = append(b.serviceConfig.Enums, enum)
+	return nil
+}
+
+// jsonName returns the lowerCamelCase JSON name of a field, the same way as
+// protoc does.
+func jsonName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, c := range name {
+		switch {
+		case c == '_':
+			upper = true
+		case upper && 'a' <= c && c <= 'z':
+			b.WriteRune(c - 'a' + 'A')
+			upper = false
+		default:
+			b.WriteRune(c)
+			upper = false
+		}
+	}
+	return b.String()
+}
+
+// expandSelectors replaces the rules of the selectors with wildcards by the
+// rules of the methods they match.
+func (b *builder) expandSelectors() error {
+	sc := b.serviceConfig
+	if backend := sc.GetBackend(); backend != nil {
+		rules := backend.Rules
+		backend.Rules = nil
+		if err := b.expandRules("backend", len(rules), func(i int) string { return rules[i].GetSelector() }, func(i int, method string) {
+			rule := proto.Clone(rules[i]).(*confpb.BackendRule)
+			rule.Selector = method
+			backend.Rules = append(backend.Rules, rule)
+		}); err != nil {
+			return err
+		}
+	}
+	if usage := sc.GetUsage(); usage != nil {
+		rules := usage.Rules
+		usage.Rules = nil
+		if err := b.expandRules("usage", len(rules), func(i int) string { return rules[i].GetSelector() }, func(i int, method string) {
+			rule := proto.Clone(rules[i]).(*confpb.UsageRule)
+			rule.Selector = method
+			usage.Rules = append(usage.Rules, rule)
+		}); err != nil {
+			return err
+		}
+	}
+	if authn := sc.GetAuthentication(); authn != nil {
+		rules := authn.Rules
+		authn.Rules = nil
+		if err := b.expandRules("authentication", len(rules), func(i int) string { return rules[i].GetSelector() }, func(i int, method string) {
+			rule := proto.Clone(rules[i]).(*confpb.AuthenticationRule)
+			rule.Selector = method
+			authn.Rules = append(authn.Rules, rule)
+		}); err != nil {
+			return err
+		}
+	}
+	if params := sc.GetSystemParameters(); params != nil {
+		rules := params.Rules
+		params.Rules = nil
+		if err := b.expandRules("system parameter", len(rules), func(i int) string { return rules[i].GetSelector() }, func(i int, method string) {
+			rule := proto.Clone(rules[i]).(*confpb.SystemParameterRule)
+			rule.Selector = method
+			params.Rules = append(params.Rules, rule)
+		}); err != nil {
+			return err
+		}
+	}
+	if quota := sc.GetQuota(); quota != nil {
+		rules := quota.MetricRules
+		quota.MetricRules = nil
+		if err := b.expandRules("quota metric", len(rules), func(i int) string { return rules[i].GetSelector() }, func(i int, method string) {
+			rule := proto.Clone(rules[i]).(*confpb.MetricRule)
+			rule.Selector = method
+			quota.MetricRules = append(quota.MetricRules, rule)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandRules calls add with each method and the most specific one of the n
+// rules matching it, in the order of the methods. A selector without
+// wildcards is more specific than the ones with wildcards, and a longer
+// prefix is more specific than a shorter one. The later one of equally
+// specific rules wins.
+func (b *builder) expandRules(kind string, n int, selector func(i int) string, add func(i int, method string)) error {
+	best := make([]int, len(b.methods))
+	bestScore := make([]int, len(b.methods))
+	for j := range best {
+		best[j] = -1
+	}
+	for i := 0; i < n; i++ {
+		sel := selector(i)
+		prefix, wildcard := sel, false
+		switch {
+		case sel == "*":
+			prefix, wildcard = "", true
+		case strings.HasSuffix(sel, ".*"):
+			prefix, wildcard = strings.TrimSuffix(sel, "*"), true
+		case strings.Contains(sel, "*"):
+			return fmt.Errorf("invalid selector %q of the %s rules, a wildcard is only allowed as the last component", sel, kind)
+		}
+		score := len(prefix)
+		if !wildcard {
+			score++
+		}
+
+		matched := false
+		for j, method := range b.methods {
+			if wildcard && !strings.HasPrefix(method, prefix) || !wildcard && method != sel {
+				continue
+			}
+			matched = true
+			if best[j] < 0 || score >= bestScore[j] {
+				best[j], bestScore[j] = i, score
+			}
+		}
+		if !matched && !wildcard {
+			return fmt.Errorf("selector %q of the %s rules does not match any method", sel, kind)
+		}
+	}
+	for j, method := range b.methods {
+		if best[j] >= 0 {
+			add(best[j], method)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,549 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+	ptypepb "google.golang.org/genproto/protobuf/ptype"
+)
+
+// The service config generated by Service Management from the API config and
+// the descriptor set of the gRPC echo service.
+func TestReadServiceConfigLikeServiceManagement(t *testing.T) {
+	descriptorPath := "../../../tests/endpoints/grpc_echo/proto/api_descriptor.pb"
+	got, _, err := ReadServiceConfig("../../../examples/grpc_dynamic_routing/grpc-test.yaml", descriptorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open("../../../examples/grpc_dynamic_routing/service_config_generated.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := util.UnmarshalServiceConfig(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.GetName() != want.GetName() || got.GetTitle() != want.GetTitle() || got.GetConfigVersion().GetValue() != 3 {
+		t.Errorf("got service %s titled %q of config version %v, want: %s titled %q of config version 3",
+			got.GetName(), got.GetTitle(), got.GetConfigVersion(), want.GetName(), want.GetTitle())
+	}
+	// The annotations are not kept in the method options.
+	for _, method := range want.GetApis()[0].GetMethods() {
+		method.Options = nil
+		method.Syntax = want.GetApis()[0].GetSyntax()
+	}
+	checks := []struct {
+		field     string
+		got, want proto.Message
+	}{
+		{"apis", got.GetApis()[0], want.GetApis()[0]},
+		{"http", got.GetHttp(), want.GetHttp()},
+		{"backend", got.GetBackend(), want.GetBackend()},
+		{"authentication", got.GetAuthentication(), want.GetAuthentication()},
+		{"usage", got.GetUsage(), want.GetUsage()},
+	}
+	for _, c := range checks {
+		if !proto.Equal(c.got, c.want) {
+			t.Errorf("got %s: %v, want: %v", c.field, c.got, c.want)
+		}
+	}
+
+	// The echo messages have new fields since the service config was
+	// generated, the other types are the same.
+	gotTypes := make(map[string]*ptypepb.Type)
+	for _, typ := range got.GetTypes() {
+		gotTypes[typ.GetName()] = typ
+	}
+	for _, typ := range want.GetTypes() {
+		gotType, ok := gotTypes[typ.GetName()]
+		if !ok {
+			t.Errorf("type %s is not found", typ.GetName())
+		} else if !strings.HasPrefix(typ.GetName(), "test.grpc.") && !proto.Equal(gotType, typ) {
+			t.Errorf("got type: %v, want: %v", gotType, typ)
+		}
+	}
+	if len(got.GetTypes()) != len(want.GetTypes()) {
+		t.Errorf("got %d types, want: %d", len(got.GetTypes()), len(want.GetTypes()))
+	}
+	if len(got.GetEnums()) != len(want.GetEnums()) {
+		t.Errorf("got enums: %v, want: %v", got.GetEnums(), want.GetEnums())
+	}
+
+	// The descriptor set is kept for gRPC transcoding.
+	descriptorSet, err := ioutil.ReadFile(descriptorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceFiles := got.GetSourceInfo().GetSourceFiles()
+	if len(sourceFiles) != 2 {
+		t.Fatalf("got source files: %v, want the API config and the descriptor set", sourceFiles)
+	}
+	configFile := &smpb.ConfigFile{}
+	if err := ptypes.UnmarshalAny(sourceFiles[1], configFile); err != nil {
+		t.Fatal(err)
+	}
+	if configFile.GetFileType() != smpb.ConfigFile_FILE_DESCRIPTOR_SET_PROTO || configFile.GetFilePath() != "api_descriptor.pb" ||
+		string(configFile.GetFileContents()) != string(descriptorSet) {
+		t.Errorf("got source file %s of type %v, want the descriptor set api_descriptor.pb", configFile.GetFilePath(), configFile.GetFileType())
+	}
+}
+
+// fakeDescriptorSet has the service test.Library, with the methods GetBook,
+// ListBooks and WatchBooks, which streams the responses.
+func fakeDescriptorSet(t *testing.T) []byte {
+	getBookOptions := &descpb.MethodOptions{}
+	if err := proto.SetExtension(getBookOptions, annotationspb.E_Http, &annotationspb.HttpRule{
+		Pattern: &annotationspb.HttpRule_Get{
+			Get: "/v1/books/{book_id}",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	listBooksOptions := &descpb.MethodOptions{}
+	if err := proto.SetExtension(listBooksOptions, annotationspb.E_Http, &annotationspb.HttpRule{
+		Pattern: &annotationspb.HttpRule_Get{
+			Get: "/v1/books",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	fds := &descpb.FileDescriptorSet{
+		File: []*descpb.FileDescriptorProto{
+			{
+				Name:    proto.String("library.proto"),
+				Package: proto.String("test"),
+				Syntax:  proto.String("proto3"),
+				MessageType: []*descpb.DescriptorProto{
+					{
+						Name: proto.String("BookRequest"),
+						Field: []*descpb.FieldDescriptorProto{
+							{
+								Name:   proto.String("book_id"),
+								Number: proto.Int32(1),
+								Label:  descpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+								Type:   descpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+							},
+						},
+					},
+					{
+						Name: proto.String("Book"),
+						Field: []*descpb.FieldDescriptorProto{
+							{
+								Name:     proto.String("genre"),
+								Number:   proto.Int32(1),
+								Label:    descpb.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+								Type:     descpb.FieldDescriptorProto_TYPE_ENUM.Enum(),
+								TypeName: proto.String(".test.Book.Genre"),
+								JsonName: proto.String("genre"),
+							},
+						},
+						EnumType: []*descpb.EnumDescriptorProto{
+							{
+								Name: proto.String("Genre"),
+								Value: []*descpb.EnumValueDescriptorProto{
+									{Name: proto.String("CLASSIC"), Number: proto.Int32(0)},
+									{Name: proto.String("COMIC"), Number: proto.Int32(1)},
+								},
+							},
+						},
+					},
+				},
+				Service: []*descpb.ServiceDescriptorProto{
+					{
+						Name: proto.String("Library"),
+						Method: []*descpb.MethodDescriptorProto{
+							{
+								Name:       proto.String("GetBook"),
+								InputType:  proto.String(".test.BookRequest"),
+								OutputType: proto.String(".test.Book"),
+								Options:    getBookOptions,
+							},
+							{
+								Name:       proto.String("ListBooks"),
+								InputType:  proto.String(".test.BookRequest"),
+								OutputType: proto.String(".test.Book"),
+								Options:    listBooksOptions,
+							},
+							{
+								Name:            proto.String("WatchBooks"),
+								InputType:       proto.String(".test.BookRequest"),
+								OutputType:      proto.String(".test.Book"),
+								ServerStreaming: proto.Bool(true),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	descriptorSet, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return descriptorSet
+}
+
+func TestToServiceConfig(t *testing.T) {
+	testData := []struct {
+		desc      string
+		apiConfig string
+		// The fields of the service config to check, the source info is not.
+		want      string
+		wantError string
+	}{
+		{
+			desc: "methods, types and annotated http rules",
+			apiConfig: `
+type: google.api.Service
+config_version: 3
+name: library.endpoints.project123.cloud.goog
+apis:
+- name: test.Library
+`,
+			want: `{
+  "name": "library.endpoints.project123.cloud.goog",
+  "configVersion": 3,
+  "apis": [
+    {
+      "name": "test.Library",
+      "methods": [
+        {
+          "name": "GetBook",
+          "requestTypeUrl": "type.googleapis.com/test.BookRequest",
+          "responseTypeUrl": "type.googleapis.com/test.Book",
+          "syntax": "SYNTAX_PROTO3"
+        },
+        {
+          "name": "ListBooks",
+          "requestTypeUrl": "type.googleapis.com/test.BookRequest",
+          "responseTypeUrl": "type.googleapis.com/test.Book",
+          "syntax": "SYNTAX_PROTO3"
+        },
+        {
+          "name": "WatchBooks",
+          "requestTypeUrl": "type.googleapis.com/test.BookRequest",
+          "responseTypeUrl": "type.googleapis.com/test.Book",
+          "responseStreaming": true,
+          "syntax": "SYNTAX_PROTO3"
+        }
+      ],
+      "version": "v1",
+      "sourceContext": {
+        "fileName": "library.proto"
+      },
+      "syntax": "SYNTAX_PROTO3"
+    }
+  ],
+  "types": [
+    {
+      "name": "test.BookRequest",
+      "fields": [
+        {
+          "kind": "TYPE_STRING",
+          "cardinality": "CARDINALITY_OPTIONAL",
+          "number": 1,
+          "name": "book_id",
+          "jsonName": "bookId"
+        }
+      ],
+      "sourceContext": {
+        "fileName": "library.proto"
+      },
+      "syntax": "SYNTAX_PROTO3"
+    },
+    {
+      "name": "test.Book",
+      "fields": [
+        {
+          "kind": "TYPE_ENUM",
+          "cardinality": "CARDINALITY_REPEATED",
+          "number": 1,
+          "name": "genre",
+          "typeUrl": "type.googleapis.com/test.Book.Genre",
+          "packed": true,
+          "jsonName": "genre"
+        }
+      ],
+      "sourceContext": {
+        "fileName": "library.proto"
+      },
+      "syntax": "SYNTAX_PROTO3"
+    }
+  ],
+  "enums": [
+    {
+      "name": "test.Book.Genre",
+      "enumvalue": [
+        {
+          "name": "CLASSIC"
+        },
+        {
+          "name": "COMIC",
+          "number": 1
+        }
+      ],
+      "sourceContext": {
+        "fileName": "library.proto"
+      },
+      "syntax": "SYNTAX_PROTO3"
+    }
+  ],
+  "http": {
+    "rules": [
+      {
+        "selector": "test.Library.GetBook",
+        "get": "/v1/books/{book_id}"
+      },
+      {
+        "selector": "test.Library.ListBooks",
+        "get": "/v1/books"
+      }
+    ]
+  }
+}`,
+		},
+		{
+			desc: "http rules of the API config override the annotated ones",
+			apiConfig: `
+name: library.endpoints.project123.cloud.goog
+apis:
+- name: test.Library
+http:
+  rules:
+  - selector: test.Library.WatchBooks
+    get: /v1/books:watch
+  - selector: test.Library.GetBook
+    get: /v2/books/{book_id}
+    additional_bindings:
+    - get: /v1/books/{book_id}
+`,
+			want: `{
+  "http": {
+    "rules": [
+      {
+        "selector": "test.Library.GetBook",
+        "get": "/v2/books/{book_id}",
+        "additionalBindings": [
+          {
+            "get": "/v1/books/{book_id}"
+          }
+        ]
+      },
+      {
+        "selector": "test.Library.ListBooks",
+        "get": "/v1/books"
+      },
+      {
+        "selector": "test.Library.WatchBooks",
+        "get": "/v1/books:watch"
+      }
+    ]
+  }
+}`,
+		},
+		{
+			desc: "selectors with wildcards are expanded, the most specific one wins",
+			apiConfig: `
+name: library.endpoints.project123.cloud.goog
+apis:
+- name: test.Library
+usage:
+  rules:
+  - selector: test.Library.GetBook
+    allow_unregistered_calls: true
+  - selector: "test.Library.*"
+    allow_unregistered_calls: false
+backend:
+  rules:
+  - selector: "*"
+    address: grpc://127.0.0.1:8081
+    deadline: 10
+  - selector: test.Library.WatchBooks
+    address: grpc://127.0.0.1:8081
+    deadline: 3600
+`,
+			want: `{
+  "usage": {
+    "rules": [
+      {
+        "selector": "test.Library.GetBook",
+        "allowUnregisteredCalls": true
+      },
+      {
+        "selector": "test.Library.ListBooks"
+      },
+      {
+        "selector": "test.Library.WatchBooks"
+      }
+    ]
+  },
+  "backend": {
+    "rules": [
+      {
+        "selector": "test.Library.GetBook",
+        "address": "grpc://127.0.0.1:8081",
+        "deadline": 10
+      },
+      {
+        "selector": "test.Library.ListBooks",
+        "address": "grpc://127.0.0.1:8081",
+        "deadline": 10
+      },
+      {
+        "selector": "test.Library.WatchBooks",
+        "address": "grpc://127.0.0.1:8081",
+        "deadline": 3600
+      }
+    ]
+  }
+}`,
+		},
+		{
+			desc: "api not in the descriptor set",
+			apiConfig: `
+name: library.endpoints.project123.cloud.goog
+apis:
+- name: test.Bookstore
+`,
+			wantError: "api test.Bookstore is not found in the proto descriptor set",
+		},
+		{
+			desc: "selector of an unknown method",
+			apiConfig: `
+name: library.endpoints.project123.cloud.goog
+apis:
+- name: test.Library
+authentication:
+  rules:
+  - selector: test.Library.DeleteBook
+`,
+			wantError: `selector "test.Library.DeleteBook" of the authentication rules does not match any method`,
+		},
+		{
+			desc: "wildcard in the middle of a selector",
+			apiConfig: `
+name: library.endpoints.project123.cloud.goog
+apis:
+- name: test.Library
+usage:
+  rules:
+  - selector: "test.*.GetBook"
+`,
+			wantError: `invalid selector "test.*.GetBook" of the usage rules`,
+		},
+		{
+			desc: "no service name",
+			apiConfig: `
+apis:
+- name: test.Library
+`,
+			wantError: "name is required",
+		},
+		{
+			desc: "invalid YAML",
+			apiConfig: `
+name: library.endpoints.project123.cloud.goog
+apis:
+- name: test.Library
+  version: "v1
+`,
+			wantError: "yaml: line 5: found unexpected end of stream",
+		},
+	}
+
+	descriptorSet := fakeDescriptorSet(t)
+	for _, tc := range testData {
+		got, err := ToServiceConfig([]byte(tc.apiConfig), "api_config.yaml", descriptorSet, "api_descriptor.pb")
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want: %v", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got error: %v", tc.desc, err)
+			continue
+		}
+		if !strings.HasPrefix(got.GetId(), "apiconfig-") || len(got.GetSourceInfo().GetSourceFiles()) != 2 {
+			t.Errorf("Test (%s): got config id %q and source info %v, want the ones of the files", tc.desc, got.GetId(), got.GetSourceInfo())
+		}
+
+		want, err := util.UnmarshalServiceConfig(strings.NewReader(tc.want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only the fields in the wanted service config are compared.
+		checked := proto.Clone(want).(*confpb.Service)
+		if want.Name != "" {
+			checked.Name = got.Name
+			checked.ConfigVersion = got.ConfigVersion
+			checked.Apis = got.Apis
+			checked.Types = got.Types
+			checked.Enums = got.Enums
+		}
+		if want.Http != nil {
+			checked.Http = got.Http
+		}
+		if want.Usage != nil {
+			checked.Usage = got.Usage
+		}
+		if want.Backend != nil {
+			checked.Backend = got.Backend
+		}
+		if !proto.Equal(checked, want) {
+			gotJson, _ := util.ProtoToJson(checked)
+			t.Errorf("Test (%s): got: %s, want: %s", tc.desc, gotJson, tc.want)
+		}
+	}
+}
+
+func TestConfigIdChangesWithFiles(t *testing.T) {
+	apiConfig := []byte("name: library.endpoints.project123.cloud.goog\napis:\n- name: test.Library\n")
+	descriptorSet := fakeDescriptorSet(t)
+	first, err := ToServiceConfig(apiConfig, "api_config.yaml", descriptorSet, "api_descriptor.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ToServiceConfig(append(apiConfig, "title: Library\n"...), "api_config.yaml", descriptorSet, "api_descriptor.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.GetId() == second.GetId() {
+		t.Errorf("got the same config id %s for different API configs", first.GetId())
+	}
+
+	withId, err := ToServiceConfig(append(apiConfig, "id: 2017-05-01r0\n"...), "api_config.yaml", descriptorSet, "api_descriptor.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withId.GetId() != "2017-05-01r0" {
+		t.Errorf("got config id %s, want the one of the API config: 2017-05-01r0", withId.GetId())
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/bootstrap"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/openapi"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 
 	gen "github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
@@ -61,3 +62,14 @@ func ServiceToBootstrapConfig(serviceConfig *confpb.Service, id string, opts opt
 	}
 	return bt, nil
 }
+
+// OpenAPIToBootstrapConfig outputs envoy bootstrap config from the OpenAPI 2.0
+// document in the file, which is translated into the service config the same
+// way as Service Management does.
+func OpenAPIToBootstrapConfig(openapiPath string, opts options.ConfigGeneratorOptions) (*bootstrappb.Bootstrap, error) {
+	serviceConfig, _, err := openapi.ReadServiceConfig(openapiPath)
+	if err != nil {
+		return nil, err
+	}
+	return ServiceToBootstrapConfig(serviceConfig, serviceConfig.GetId(), opts)
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/tests/env/platform"
 	"github.com/golang/protobuf/jsonpb"
 
+	v2pb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	bootstrappb "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v2"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 )
@@ -153,6 +154,54 @@ func TestServiceToBootstrapConfig(t *testing.T) {
 	}
 }
 
+func TestOpenAPIToBootstrapConfig(t *testing.T) {
+	opts := flags.EnvoyConfigOptionsFromFlags()
+	opts.AdminPort = 0
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.DisableTracing = true
+	opts.SkipServiceControlFilter = true
+
+	// Function under test
+	gotBootstrap, err := OpenAPIToBootstrapConfig("testdata/path_matcher/openapi_swagger.json", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same as the one from the service config generated by Service
+	// Management, except that Service Control is not used.
+	envoyConfig, err := ioutil.ReadFile(platform.GetFilePath(platform.PmEnvoyConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshaler := &jsonpb.Unmarshaler{
+		AnyResolver:        util.Resolver,
+		AllowUnknownFields: true,
+	}
+	var expectedBootstrap bootstrappb.Bootstrap
+	if err := unmarshaler.Unmarshal(bytes.NewBuffer(envoyConfig), &expectedBootstrap); err != nil {
+		t.Fatal(err)
+	}
+	var clusters []*v2pb.Cluster
+	for _, cluster := range expectedBootstrap.StaticResources.Clusters {
+		if cluster.Name != util.ServiceControlClusterName {
+			clusters = append(clusters, cluster)
+		}
+	}
+	expectedBootstrap.StaticResources.Clusters = clusters
+
+	gotString, err := bootstrapToJson(gotBootstrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantString, err := bootstrapToJson(&expectedBootstrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotString != wantString {
+		t.Errorf("got : %v, \nwant: %v", gotString, wantString)
+	}
+}
+
 func bootstrapToJson(protoMsg *bootstrappb.Bootstrap) (string, error) {
 	// Marshal both protos back to json-strings to pretty print them
 	marshaler := &jsonpb.Marshaler{
@@ -21,16 +21,47 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 
 	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	v2pb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpointpb "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 )
 
 // MakeClusters provides dynamic cluster settings for Envoy
 // This must be called before MakeListeners.
-func MakeClusters(serviceInfo *sc.ServiceInfo) ([]*v2pb.Cluster, error) {
+// Clusters shared by multiple services, such as the metadata cluster, are only
+// generated once. So are the clusters shared by the service configs of a
+// traffic percent rollout. The clusters with the same name must have the same
+// settings.
+func MakeClusters(serviceInfos ...*sc.ServiceInfo) ([]*v2pb.Cluster, error) {
+	var clusters []*v2pb.Cluster
+	clustersByName := make(map[string]*v2pb.Cluster)
+	for _, serviceInfo := range serviceInfos {
+		for _, info := range append([]*sc.ServiceInfo{serviceInfo}, serviceInfo.Canaries...) {
+			serviceClusters, err := makeServiceClusters(info)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range serviceClusters {
+				if existing, ok := clustersByName[c.Name]; ok {
+					if !proto.Equal(existing, c) {
+						return nil, fmt.Errorf("cluster %s of service %s, config %s, has different settings from another cluster of the same name", c.Name, info.Name, info.ConfigID)
+					}
+					continue
+				}
+				clustersByName[c.Name] = c
+				clusters = append(clusters, c)
+			}
+		}
+	}
+	return clusters, nil
+}
+
+func makeServiceClusters(serviceInfo *sc.ServiceInfo) ([]*v2pb.Cluster, error) {
 	var clusters []*v2pb.Cluster
 	backendCluster, err := makeCatchAllBackendCluster(serviceInfo)
 	if err != nil {
@@ -67,6 +98,14 @@ func MakeClusters(serviceInfo *sc.ServiceInfo) ([]*v2pb.Cluster, error) {
 		clusters = append(clusters, scCluster)
 	}
 
+	rlsCluster, err := makeRateLimitServiceCluster(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	if rlsCluster != nil {
+		clusters = append(clusters, rlsCluster)
+	}
+
 	brClusters, err := makeBackendRoutingClusters(serviceInfo)
 	if err != nil {
 		return nil, err
@@ -103,7 +142,7 @@ func makeMetadataCluster(serviceInfo *sc.ServiceInfo) (*v2pb.Cluster, error) {
 	}
 
 	if scheme == "https" {
-		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.RootCertsPath, "", nil)
+		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.RootCertsPath, "", nil, false)
 		if err != nil {
 			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
 				c.Name, err)
@@ -136,7 +175,7 @@ func makeIamCluster(serviceInfo *sc.ServiceInfo) (*v2pb.Cluster, error) {
 	}
 
 	if scheme == "https" {
-		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.RootCertsPath, "", nil)
+		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.RootCertsPath, "", nil, false)
 		if err != nil {
 			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
 				c.Name, err)
@@ -181,7 +220,7 @@ func makeJwtProviderClusters(serviceInfo *sc.ServiceInfo) ([]*v2pb.Cluster, erro
 			LoadAssignment:       util.CreateLoadAssignment(hostname, port),
 		}
 		if scheme == "https" {
-			transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.RootCertsPath, "", nil)
+			transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.RootCertsPath, "", nil, false)
 			if err != nil {
 				return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
 					c.Name, err)
@@ -199,12 +238,34 @@ func makeJwtProviderClusters(serviceInfo *sc.ServiceInfo) ([]*v2pb.Cluster, erro
 func makeBackendCluster(opt *options.ConfigGeneratorOptions, brc *sc.BackendRoutingCluster) (*v2pb.Cluster, error) {
 	c := &v2pb.Cluster{
 		Name:                 brc.ClusterName,
-		LbPolicy:             v2pb.Cluster_ROUND_ROBIN,
+		LbPolicy:             sc.BackendLbPolicies[opt.BackendLbPolicy],
 		ConnectTimeout:       ptypes.DurationProto(opt.ClusterConnectTimeout),
 		ClusterDiscoveryType: &v2pb.Cluster_Type{Type: v2pb.Cluster_LOGICAL_DNS},
 		LoadAssignment:       util.CreateLoadAssignment(brc.Hostname, brc.Port),
 	}
 
+	// LOGICAL_DNS only connects to the first host resolved of a single
+	// endpoint, STRICT_DNS balances the requests among all of them.
+	if opt.BackendStrictDns || len(brc.Endpoints) > 0 {
+		c.ClusterDiscoveryType = &v2pb.Cluster_Type{Type: v2pb.Cluster_STRICT_DNS}
+	}
+	if len(brc.Endpoints) > 0 {
+		var lbEndpoints []*endpointpb.LbEndpoint
+		for _, e := range brc.Endpoints {
+			lbEndpoints = append(lbEndpoints, util.CreateLbEndpoint(e.Hostname, e.Port))
+		}
+		c.LoadAssignment = util.CreateMultiEndpointLoadAssignment(brc.ClusterName, lbEndpoints)
+	}
+
+	if brc.HealthCheck != nil {
+		c.HealthChecks = []*corepb.HealthCheck{brc.HealthCheck}
+	}
+	c.OutlierDetection = brc.OutlierDetection
+	c.CircuitBreakers = brc.CircuitBreakers
+	if brc.MaxRequestsPerConnection > 0 {
+		c.MaxRequestsPerConnection = &wrapperspb.UInt32Value{Value: brc.MaxRequestsPerConnection}
+	}
+
 	isHttp2 := brc.Protocol == util.GRPC || brc.Protocol == util.HTTP2
 
 	if brc.UseTLS {
@@ -212,7 +273,7 @@ func makeBackendCluster(opt *options.ConfigGeneratorOptions, brc *sc.BackendRout
 		if isHttp2 {
 			alpnProtocols = []string{"h2"}
 		}
-		transportSocket, err := util.CreateUpstreamTransportSocket(brc.Hostname, opt.RootCertsPath, opt.SslClientCertPath, alpnProtocols)
+		transportSocket, err := util.CreateUpstreamTransportSocket(brc.Hostname, opt.RootCertsPath, opt.SslClientCertPath, alpnProtocols, opt.UseSdsForSslCerts)
 		if err != nil {
 			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
 				brc.ClusterName, err)
@@ -277,7 +338,7 @@ func makeServiceControlCluster(serviceInfo *sc.ServiceInfo) (*v2pb.Cluster, erro
 	}
 
 	if scheme == "https" {
-		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.RootCertsPath, "", nil)
+		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.RootCertsPath, "", nil, false)
 		if err != nil {
 			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
 				c.Name, err)
@@ -288,6 +349,45 @@ func makeServiceControlCluster(serviceInfo *sc.ServiceInfo) (*v2pb.Cluster, erro
 	return c, nil
 }
 
+// makeRateLimitServiceCluster makes the cluster of the rate limit service
+// called by the Envoy Rate Limit filter over gRPC, or nil if it is not used.
+func makeRateLimitServiceCluster(serviceInfo *sc.ServiceInfo) (*v2pb.Cluster, error) {
+	address := serviceInfo.Options.RateLimitServiceAddress
+	if address == "" {
+		return nil, nil
+	}
+	scheme, hostname, port, path, err := util.ParseURI(address)
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse rate_limit_service_address %s, %v", address, err)
+	}
+	if scheme != "grpc" && scheme != "grpcs" {
+		return nil, fmt.Errorf(`invalid rate_limit_service_address %s, its scheme must be "grpc" or "grpcs"`, address)
+	}
+	if path != "" {
+		return nil, fmt.Errorf("invalid rate_limit_service_address %s, it should not have path part: %s", address, path)
+	}
+
+	c := &v2pb.Cluster{
+		Name:                 util.RateLimitServiceClusterName,
+		LbPolicy:             v2pb.Cluster_ROUND_ROBIN,
+		ConnectTimeout:       ptypes.DurationProto(serviceInfo.Options.ClusterConnectTimeout),
+		ClusterDiscoveryType: &v2pb.Cluster_Type{Type: v2pb.Cluster_STRICT_DNS},
+		LoadAssignment:       util.CreateLoadAssignment(hostname, port),
+		Http2ProtocolOptions: &corepb.Http2ProtocolOptions{},
+	}
+
+	if scheme == "grpcs" {
+		transportSocket, err := util.CreateUpstreamTransportSocket(hostname, serviceInfo.Options.RootCertsPath, "", []string{"h2"}, false)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling tls context to transport_socket config for cluster %s, err=%v",
+				c.Name, err)
+		}
+		c.TransportSocket = transportSocket
+	}
+	glog.Infof("adding cluster Configuration for rate limit service: %s: %v", address, c)
+	return c, nil
+}
+
 func makeBackendRoutingClusters(serviceInfo *sc.ServiceInfo) ([]*v2pb.Cluster, error) {
 	var brClusters []*v2pb.Cluster
 
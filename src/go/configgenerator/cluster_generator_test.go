@@ -27,7 +27,10 @@ import (
 	"github.com/google/go-cmp/cmp"
 
 	v2pb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	clusterpb "github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpointpb "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	apipb "google.golang.org/genproto/protobuf/api"
@@ -41,12 +44,12 @@ var (
 )
 
 func createTransportSocket(hostname string) *corepb.TransportSocket {
-	transportSocket, _ := util.CreateUpstreamTransportSocket(hostname, util.DefaultRootCAPaths, "", nil)
+	transportSocket, _ := util.CreateUpstreamTransportSocket(hostname, util.DefaultRootCAPaths, "", nil, false)
 	return transportSocket
 }
 
 func createH2TransportSocket(hostname string) *corepb.TransportSocket {
-	transportSocket, _ := util.CreateUpstreamTransportSocket(hostname, util.DefaultRootCAPaths, "", []string{"h2"})
+	transportSocket, _ := util.CreateUpstreamTransportSocket(hostname, util.DefaultRootCAPaths, "", []string{"h2"}, false)
 	return transportSocket
 }
 
@@ -783,3 +786,280 @@ func TestMakeIamCluster(t *testing.T) {
 		}
 	}
 }
+
+func TestMakeRateLimitServiceCluster(t *testing.T) {
+	testData := []struct {
+		desc                    string
+		rateLimitServiceAddress string
+		wantedCluster           *v2pb.Cluster
+		wantedError             string
+	}{
+		{
+			desc:          "Success, not generate a rate limit service cluster without the address",
+			wantedCluster: nil,
+		},
+		{
+			desc:                    "Success, generate rate limit service cluster for grpc",
+			rateLimitServiceAddress: "grpc://127.0.0.1:8081",
+			wantedCluster: &v2pb.Cluster{
+				Name:                 util.RateLimitServiceClusterName,
+				LbPolicy:             v2pb.Cluster_ROUND_ROBIN,
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &v2pb.Cluster_Type{v2pb.Cluster_STRICT_DNS},
+				LoadAssignment:       util.CreateLoadAssignment("127.0.0.1", 8081),
+				Http2ProtocolOptions: &corepb.Http2ProtocolOptions{},
+			},
+		},
+		{
+			desc:                    "Success, generate rate limit service cluster for grpcs with the default port",
+			rateLimitServiceAddress: "grpcs://ratelimit.example.com",
+			wantedCluster: &v2pb.Cluster{
+				Name:                 util.RateLimitServiceClusterName,
+				LbPolicy:             v2pb.Cluster_ROUND_ROBIN,
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &v2pb.Cluster_Type{v2pb.Cluster_STRICT_DNS},
+				LoadAssignment:       util.CreateLoadAssignment("ratelimit.example.com", 443),
+				Http2ProtocolOptions: &corepb.Http2ProtocolOptions{},
+				TransportSocket:      createH2TransportSocket("ratelimit.example.com"),
+			},
+		},
+		{
+			desc:                    "Fail, the scheme is not grpc",
+			rateLimitServiceAddress: "http://127.0.0.1:8081",
+			wantedError:             `its scheme must be "grpc" or "grpcs"`,
+		},
+		{
+			desc:                    "Fail, the address has a path",
+			rateLimitServiceAddress: "grpc://127.0.0.1:8081/ratelimit",
+			wantedError:             "it should not have path part: /ratelimit",
+		},
+	}
+
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: "1.cloudesf_testing_cloud_goog",
+			},
+		},
+	}
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "grpc://127.0.0.1:80"
+		opts.RateLimitServiceAddress = tc.rateLimitServiceAddress
+
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cluster, err := makeRateLimitServiceCluster(fakeServiceInfo)
+		if tc.wantedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantedError) {
+				t.Errorf("Test Desc(%d): %s, got error: %v, want: %v", i, tc.desc, err, tc.wantedError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !proto.Equal(cluster, tc.wantedCluster) {
+			t.Errorf("Test Desc(%d): %s, makeRateLimitServiceCluster\ngot: %v,\nwant: %v", i, tc.desc, cluster, tc.wantedCluster)
+		}
+	}
+}
+
+func TestMakeCatchAllBackendCluster(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+			},
+		},
+	}
+
+	testData := []struct {
+		desc             string
+		backendAddress   string
+		backendLbPolicy  string
+		backendStrictDns bool
+		healthCheck      string
+		consecutive5xx   int
+		maxRequests      int
+		maxRequestsConn  int
+		wantedCluster    *v2pb.Cluster
+		wantedError      string
+	}{
+		{
+			desc:           "Single endpoint with the default lb policy",
+			backendAddress: "http://127.0.0.1:8082",
+			wantedCluster: &v2pb.Cluster{
+				Name:                 "bookstore.endpoints.project123.cloud.goog_local",
+				LbPolicy:             v2pb.Cluster_ROUND_ROBIN,
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &v2pb.Cluster_Type{v2pb.Cluster_LOGICAL_DNS},
+				LoadAssignment:       util.CreateLoadAssignment("127.0.0.1", 8082),
+			},
+		},
+		{
+			desc:             "Single endpoint with STRICT_DNS and least_request",
+			backendAddress:   "grpc://backend.internal:8082",
+			backendLbPolicy:  "least_request",
+			backendStrictDns: true,
+			wantedCluster: &v2pb.Cluster{
+				Name:                 "bookstore.endpoints.project123.cloud.goog_local",
+				LbPolicy:             v2pb.Cluster_LEAST_REQUEST,
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &v2pb.Cluster_Type{v2pb.Cluster_STRICT_DNS},
+				LoadAssignment:       util.CreateLoadAssignment("backend.internal", 8082),
+				Http2ProtocolOptions: &corepb.Http2ProtocolOptions{},
+			},
+		},
+		{
+			desc:            "Several endpoints with ring_hash",
+			backendAddress:  "http://127.0.0.1:8082,http://127.0.0.2:8083",
+			backendLbPolicy: "ring_hash",
+			wantedCluster: &v2pb.Cluster{
+				Name:                 "bookstore.endpoints.project123.cloud.goog_local",
+				LbPolicy:             v2pb.Cluster_RING_HASH,
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &v2pb.Cluster_Type{v2pb.Cluster_STRICT_DNS},
+				LoadAssignment: util.CreateMultiEndpointLoadAssignment(
+					"bookstore.endpoints.project123.cloud.goog_local",
+					[]*endpointpb.LbEndpoint{
+						util.CreateLbEndpoint("127.0.0.1", 8082),
+						util.CreateLbEndpoint("127.0.0.2", 8083),
+					}),
+			},
+		},
+		{
+			desc:           "Health check and outlier detection",
+			backendAddress: "grpc://127.0.0.1:8082",
+			healthCheck:    "grpc",
+			consecutive5xx: 5,
+			wantedCluster: &v2pb.Cluster{
+				Name:                 "bookstore.endpoints.project123.cloud.goog_local",
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &v2pb.Cluster_Type{v2pb.Cluster_LOGICAL_DNS},
+				LoadAssignment:       util.CreateLoadAssignment("127.0.0.1", 8082),
+				HealthChecks: []*corepb.HealthCheck{
+					{
+						Timeout:            ptypes.DurationProto(time.Second),
+						Interval:           ptypes.DurationProto(5 * time.Second),
+						HealthyThreshold:   &wrapperspb.UInt32Value{Value: 2},
+						UnhealthyThreshold: &wrapperspb.UInt32Value{Value: 3},
+						HealthChecker: &corepb.HealthCheck_GrpcHealthCheck_{
+							GrpcHealthCheck: &corepb.HealthCheck_GrpcHealthCheck{},
+						},
+					},
+				},
+				OutlierDetection: &clusterpb.OutlierDetection{
+					Consecutive_5Xx:  &wrapperspb.UInt32Value{Value: 5},
+					BaseEjectionTime: ptypes.DurationProto(30 * time.Second),
+				},
+				Http2ProtocolOptions: &corepb.Http2ProtocolOptions{},
+			},
+		},
+		{
+			desc:            "Circuit breakers and max requests per connection",
+			backendAddress:  "http://127.0.0.1:8082",
+			maxRequests:     100,
+			maxRequestsConn: 10,
+			wantedCluster: &v2pb.Cluster{
+				Name:                 "bookstore.endpoints.project123.cloud.goog_local",
+				ConnectTimeout:       ptypes.DurationProto(20 * time.Second),
+				ClusterDiscoveryType: &v2pb.Cluster_Type{v2pb.Cluster_LOGICAL_DNS},
+				LoadAssignment:       util.CreateLoadAssignment("127.0.0.1", 8082),
+				CircuitBreakers: &clusterpb.CircuitBreakers{
+					Thresholds: []*clusterpb.CircuitBreakers_Thresholds{
+						{
+							MaxRequests: &wrapperspb.UInt32Value{Value: 100},
+						},
+					},
+				},
+				MaxRequestsPerConnection: &wrapperspb.UInt32Value{Value: 10},
+			},
+		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = tc.backendAddress
+		opts.BackendStrictDns = tc.backendStrictDns
+		opts.BackendHealthCheckProtocol = tc.healthCheck
+		opts.BackendOutlierDetectionConsecutive5xx = tc.consecutive5xx
+		opts.BackendMaxRequests = tc.maxRequests
+		opts.BackendMaxRequestsPerConnection = tc.maxRequestsConn
+		if tc.backendLbPolicy != "" {
+			opts.BackendLbPolicy = tc.backendLbPolicy
+		}
+
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cluster, err := makeCatchAllBackendCluster(fakeServiceInfo)
+		if tc.wantedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantedError) {
+				t.Errorf("Test Desc(%d): %s, got error: %v, want: %v", i, tc.desc, err, tc.wantedError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test Desc(%d): %s, got error: %v", i, tc.desc, err)
+			continue
+		}
+
+		if !proto.Equal(cluster, tc.wantedCluster) {
+			t.Errorf("Test Desc(%d): %s, makeCatchAllBackendCluster\ngot: %v,\nwant: %v", i, tc.desc, cluster, tc.wantedCluster)
+		}
+	}
+}
+
+func TestMakeClustersForMultipleServices(t *testing.T) {
+	makeServiceInfo := func(name, environment string) *configinfo.ServiceInfo {
+		fakeServiceConfig := &confpb.Service{
+			Name: name,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+			Control: &confpb.Control{
+				Environment: environment,
+			},
+		}
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "http://127.0.0.1:8082"
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serviceInfo
+	}
+
+	a := makeServiceInfo("a.cloudesf-testing.cloud.goog", testServiceControlEnv)
+	b := makeServiceInfo("b.cloudesf-testing.cloud.goog", testServiceControlEnv)
+	clusters, err := MakeClusters(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, c := range clusters {
+		if c.Name == util.ServiceControlClusterName {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("MakeClusters got %d clusters named %s, want 1", count, util.ServiceControlClusterName)
+	}
+
+	c := makeServiceInfo("c.cloudesf-testing.cloud.goog", "staging-servicecontrol.sandbox.googleapis.com")
+	wantErr := "cluster service-control-cluster of service c.cloudesf-testing.cloud.goog, config 2019-03-02r0, has different settings from another cluster of the same name"
+	if _, err := MakeClusters(a, c); err == nil || err.Error() != wantErr {
+		t.Errorf("MakeClusters got error: %v, want: %s", err, wantErr)
+	}
+}
@@ -22,13 +22,16 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 
 	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	bapb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/backend_auth"
 	brpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/backend_routing"
 	commonpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/common"
+	lrlpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/local_rate_limit"
 	pmpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/path_matcher"
+	rldpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/rate_limit_descriptors"
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/service_control"
 	v2pb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
@@ -37,9 +40,11 @@ import (
 	gspb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/grpc_stats/v2alpha"
 	hcpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/health_check/v2"
 	jwtpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/jwt_authn/v2alpha"
+	ratelimitpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/rate_limit/v2"
 	routerpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/router/v2"
 	transcoderpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/transcoder/v2"
 	hcmpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	rlspb "github.com/envoyproxy/go-control-plane/envoy/config/ratelimit/v2"
 	anypb "github.com/golang/protobuf/ptypes/any"
 	durationpb "github.com/golang/protobuf/ptypes/duration"
 	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
@@ -51,9 +56,26 @@ const (
 	statPrefix = "ingress_http"
 )
 
-// MakeListeners provides dynamic listeners for Envoy
-func MakeListeners(serviceInfo *sc.ServiceInfo) ([]*v2pb.Listener, error) {
-	listener, err := makeListener(serviceInfo)
+// MakeListeners provides listeners for Envoy, with the route configuration
+// inlined in the Http Connection Manager.
+// Multiple services share a single listener, all of them must be generated
+// with the same options.
+func MakeListeners(serviceInfos ...*sc.ServiceInfo) ([]*v2pb.Listener, error) {
+	return makeListeners(serviceInfos, false)
+}
+
+// MakeRdsListeners provides dynamic listeners for Envoy, whose Http Connection
+// Manager fetches the route configuration from MakeRouteConfig over ADS.
+// Route only changes can then be applied without draining the listener.
+func MakeRdsListeners(serviceInfos ...*sc.ServiceInfo) ([]*v2pb.Listener, error) {
+	return makeListeners(serviceInfos, true)
+}
+
+func makeListeners(serviceInfos []*sc.ServiceInfo, useRds bool) ([]*v2pb.Listener, error) {
+	if len(serviceInfos) == 0 {
+		return nil, fmt.Errorf("at least one service is required to make listeners")
+	}
+	listener, err := makeListener(serviceInfos, useRds)
 	if err != nil {
 		return nil, err
 	}
@@ -61,10 +83,20 @@ func MakeListeners(serviceInfo *sc.ServiceInfo) ([]*v2pb.Listener, error) {
 }
 
 // makeListener provides a dynamic listener for Envoy
-func makeListener(serviceInfo *sc.ServiceInfo) (*v2pb.Listener, error) {
+func makeListener(serviceInfos []*sc.ServiceInfo, useRds bool) (*v2pb.Listener, error) {
+	if err := checkServiceOperations(serviceInfos); err != nil {
+		return nil, err
+	}
+	for _, serviceInfo := range serviceInfos {
+		if err := checkCanaries(serviceInfo); err != nil {
+			return nil, err
+		}
+	}
+
 	httpFilters := []*hcmpb.HttpFilter{}
+	opts := serviceInfos[0].Options
 
-	if serviceInfo.Options.CorsPreset == "basic" || serviceInfo.Options.CorsPreset == "cors_with_regex" {
+	if opts.CorsPreset == "basic" || opts.CorsPreset == "cors_with_regex" {
 		corsFilter := &hcmpb.HttpFilter{
 			Name: util.CORS,
 		}
@@ -79,7 +111,7 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*v2pb.Listener, error) {
 	// * Service Control filter
 	// * Backend Authentication filter
 	// * Backend Routing filter
-	pathMathcherFilter := makePathMatcherFilter(serviceInfo)
+	pathMathcherFilter := makePathMatcherFilter(serviceInfos...)
 	if pathMathcherFilter != nil {
 		httpFilters = append(httpFilters, pathMathcherFilter)
 		jsonStr, _ := util.ProtoToJson(pathMathcherFilter)
@@ -88,8 +120,8 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*v2pb.Listener, error) {
 
 	// Add Health Check filter if needed. It must behind Path Matcher filter, since Service Control
 	// filter needs to get the corresponding rule for health check calls, in order to skip Report
-	if serviceInfo.Options.Healthz != "" {
-		hcFilter, err := makeHealthCheckFilter(serviceInfo)
+	if opts.Healthz != "" {
+		hcFilter, err := makeHealthCheckFilter(serviceInfos...)
 		if err != nil {
 			return nil, err
 		}
@@ -99,8 +131,11 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*v2pb.Listener, error) {
 	}
 
 	// Add JWT Authn filter if needed.
-	if !serviceInfo.Options.SkipJwtAuthnFilter {
-		jwtAuthnFilter := makeJwtAuthnFilter(serviceInfo)
+	if !opts.SkipJwtAuthnFilter {
+		jwtAuthnFilter, err := makeJwtAuthnFilter(serviceInfos...)
+		if err != nil {
+			return nil, err
+		}
 		if jwtAuthnFilter != nil {
 			httpFilters = append(httpFilters, jwtAuthnFilter)
 			jsonStr, _ := util.ProtoToJson(jwtAuthnFilter)
@@ -108,9 +143,45 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*v2pb.Listener, error) {
 		}
 	}
 
+	// Add Local Rate Limit filter if needed. It must be behind JWT Authn
+	// filter to limit the requests by the subject of their JWT, and it is in
+	// front of Service Control filter so that the rejected requests are not
+	// checked.
+	localRateLimitFilter, err := makeLocalRateLimitFilter(serviceInfos...)
+	if err != nil {
+		return nil, err
+	}
+	if localRateLimitFilter != nil {
+		httpFilters = append(httpFilters, localRateLimitFilter)
+		jsonStr, _ := util.ProtoToJson(localRateLimitFilter)
+		glog.Infof("adding Local Rate Limit Filter config: %v", jsonStr)
+	}
+
+	// Add Rate Limit Descriptors filter and Envoy Rate Limit filter if the
+	// rate limit service is used. The former sets the headers of the
+	// descriptors read by the rate limits of the routes, so it must be in
+	// front of the latter.
+	if opts.RateLimitServiceAddress != "" {
+		rateLimitDescriptorsFilter, err := makeRateLimitDescriptorsFilter(serviceInfos...)
+		if err != nil {
+			return nil, err
+		}
+		httpFilters = append(httpFilters, rateLimitDescriptorsFilter)
+		jsonStr, _ := util.ProtoToJson(rateLimitDescriptorsFilter)
+		glog.Infof("adding Rate Limit Descriptors Filter config: %v", jsonStr)
+
+		rateLimitFilter, err := makeRateLimitFilter(serviceInfos...)
+		if err != nil {
+			return nil, err
+		}
+		httpFilters = append(httpFilters, rateLimitFilter)
+		jsonStr, _ = util.ProtoToJson(rateLimitFilter)
+		glog.Infof("adding Rate Limit Filter config: %v", jsonStr)
+	}
+
 	// Add Service Control filter if needed.
-	if !serviceInfo.Options.SkipServiceControlFilter {
-		serviceControlFilter := makeServiceControlFilter(serviceInfo)
+	if !opts.SkipServiceControlFilter {
+		serviceControlFilter := makeServiceControlFilter(serviceInfos...)
 		if serviceControlFilter != nil {
 			httpFilters = append(httpFilters, serviceControlFilter)
 			jsonStr, _ := util.ProtoToJson(serviceControlFilter)
@@ -119,14 +190,22 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*v2pb.Listener, error) {
 	}
 
 	// Add gRPC Transcoder filter and gRPCWeb filter configs for gRPC backend.
-	if serviceInfo.GrpcSupportRequired {
+	// Each service has its own descriptor, so it needs its own Transcoder filter.
+	grpcSupportRequired := false
+	for _, serviceInfo := range serviceInfos {
+		if !serviceInfo.GrpcSupportRequired {
+			continue
+		}
+		grpcSupportRequired = true
 		transcoderFilter := makeTranscoderFilter(serviceInfo)
 		if transcoderFilter != nil {
 			httpFilters = append(httpFilters, transcoderFilter)
 			jsonStr, _ := util.ProtoToJson(transcoderFilter)
 			glog.Infof("adding Transcoder Filter config: %v", jsonStr)
 		}
+	}
 
+	if grpcSupportRequired {
 		grpcWebFilter := &hcmpb.HttpFilter{
 			Name: util.GRPCWeb,
 		}
@@ -139,14 +218,14 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*v2pb.Listener, error) {
 	}
 
 	// Add Backend Auth filter and Backend Routing if needed.
-	backendAuthFilter := makeBackendAuthFilter(serviceInfo)
+	backendAuthFilter := makeBackendAuthFilter(serviceInfos...)
 	if backendAuthFilter != nil {
 		httpFilters = append(httpFilters, backendAuthFilter)
 		jsonStr, _ := util.ProtoToJson(backendAuthFilter)
 		glog.Infof("adding Backend Auth Filter config: %v", jsonStr)
 	}
 
-	backendRoutingFilter, err := makeBackendRoutingFilter(serviceInfo)
+	backendRoutingFilter, err := makeBackendRoutingFilter(serviceInfos...)
 	if err != nil {
 		return nil, err
 	}
@@ -159,26 +238,39 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*v2pb.Listener, error) {
 
 	// Add Envoy Router filter so requests are routed upstream.
 	// Router filter should be the last.
-	routerFilter := makeRouterFilter(serviceInfo.Options)
+	routerFilter := makeRouterFilter(opts)
 	httpFilters = append(httpFilters, routerFilter)
 
-	route, err := MakeRouteConfig(serviceInfo)
-
-	if err != nil {
-		return nil, fmt.Errorf("makeHttpConnectionManagerRouteConfig got err: %s", err)
-	}
-
 	httpConMgr := &hcmpb.HttpConnectionManager{
 		CodecType:  hcmpb.HttpConnectionManager_AUTO,
 		StatPrefix: statPrefix,
-		RouteSpecifier: &hcmpb.HttpConnectionManager_RouteConfig{
-			RouteConfig: route,
-		},
 
-		UseRemoteAddress:  &wrapperspb.BoolValue{Value: serviceInfo.Options.EnvoyUseRemoteAddress},
-		XffNumTrustedHops: uint32(serviceInfo.Options.EnvoyXffNumTrustedHops),
+		UseRemoteAddress:  &wrapperspb.BoolValue{Value: opts.EnvoyUseRemoteAddress},
+		XffNumTrustedHops: uint32(opts.EnvoyXffNumTrustedHops),
+	}
+
+	if useRds {
+		// The route configuration is served by RDS over ADS, see MakeRouteConfig.
+		httpConMgr.RouteSpecifier = &hcmpb.HttpConnectionManager_Rds{
+			Rds: &hcmpb.Rds{
+				ConfigSource: &corepb.ConfigSource{
+					ConfigSourceSpecifier: &corepb.ConfigSource_Ads{
+						Ads: &corepb.AggregatedConfigSource{},
+					},
+				},
+				RouteConfigName: routeName,
+			},
+		}
+	} else {
+		route, err := MakeRouteConfig(serviceInfos...)
+		if err != nil {
+			return nil, fmt.Errorf("makeHttpConnectionManagerRouteConfig got err: %s", err)
+		}
+		httpConMgr.RouteSpecifier = &hcmpb.HttpConnectionManager_RouteConfig{
+			RouteConfig: route,
+		}
 	}
-	if !serviceInfo.Options.DisableTracing {
+	if !opts.DisableTracing {
 		httpConMgr.Tracing = &hcmpb.HttpConnectionManager_Tracing{}
 	}
 
@@ -203,12 +295,13 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*v2pb.Listener, error) {
 
 	listenerName := "http_listener"
 
-	if serviceInfo.Options.SslServerCertPath != "" {
+	if opts.SslServerCertPath != "" {
 		listenerName = "https_listener"
 		transportSocket, err := util.CreateDownstreamTransportSocket(
-			serviceInfo.Options.SslServerCertPath,
-			serviceInfo.Options.SslMinimumProtocol,
-			serviceInfo.Options.SslMaximumProtocol,
+			opts.SslServerCertPath,
+			opts.SslMinimumProtocol,
+			opts.SslMaximumProtocol,
+			opts.UseSdsForSslCerts,
 		)
 		if err != nil {
 			return nil, err
@@ -221,9 +314,9 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*v2pb.Listener, error) {
 		Address: &corepb.Address{
 			Address: &corepb.Address_SocketAddress{
 				SocketAddress: &corepb.SocketAddress{
-					Address: serviceInfo.Options.ListenerAddress,
+					Address: opts.ListenerAddress,
 					PortSpecifier: &corepb.SocketAddress_PortValue{
-						PortValue: uint32(serviceInfo.Options.ListenerPort),
+						PortValue: uint32(opts.ListenerPort),
 					},
 				},
 			},
@@ -232,23 +325,143 @@ func makeListener(serviceInfo *sc.ServiceInfo) (*v2pb.Listener, error) {
 	}, nil
 }
 
-func makePathMatcherFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
+// checkServiceOperations checks that the services served by one listener
+// have distinct operations, as the filters find the rules of a request by the
+// operation matched by Path Matcher. Only the generated health check method
+// is shared by all the services.
+func checkServiceOperations(serviceInfos []*sc.ServiceInfo) error {
+	owners := make(map[string]string)
+	for _, serviceInfo := range serviceInfos {
+		for _, operation := range serviceInfo.Operations {
+			if operation == util.HealthCheckOperation {
+				continue
+			}
+			if owner, ok := owners[operation]; ok {
+				return fmt.Errorf("operation %s is defined by both service %s and service %s", operation, owner, serviceInfo.Name)
+			}
+			owners[operation] = serviceInfo.Name
+		}
+	}
+	return nil
+}
+
+// checkCanaries checks that the service configs of a traffic percent rollout
+// only differ in their routes and their Service Control settings, which are
+// selected by the route of a request. The other filters use the rules of the
+// main service config for all the requests.
+func checkCanaries(serviceInfo *sc.ServiceInfo) error {
+	if len(serviceInfo.Canaries) == 0 {
+		return nil
+	}
+	want, err := makeRolloutFilters(serviceInfo)
+	if err != nil {
+		return err
+	}
+	wantRequirements := &scpb.FilterConfig{Requirements: makeServiceControlRequirements(serviceInfo)}
+	for _, canary := range serviceInfo.Canaries {
+		got, err := makeRolloutFilters(canary)
+		if err != nil {
+			return err
+		}
+		for i := range want {
+			if !filterConfigEqual(want[i], got[i]) {
+				name := want[i].GetName()
+				if name == "" {
+					name = got[i].GetName()
+				}
+				return fmt.Errorf("service config %s of the rollout has different %s settings from the main service config %s, only the routes and the Service Control settings can be different", canary.ConfigID, name, serviceInfo.ConfigID)
+			}
+		}
+		if !proto.Equal(wantRequirements, &scpb.FilterConfig{Requirements: makeServiceControlRequirements(canary)}) {
+			return fmt.Errorf("service config %s of the rollout has different %s requirements from the main service config %s, only the routes and the Service Control settings can be different", canary.ConfigID, util.ServiceControl, serviceInfo.ConfigID)
+		}
+	}
+	return nil
+}
+
+// makeRolloutFilters makes the filters which use the rules of the main
+// service config of a traffic percent rollout, in a fixed order.
+func makeRolloutFilters(serviceInfo *sc.ServiceInfo) ([]*hcmpb.HttpFilter, error) {
+	backendRoutingFilter, err := makeBackendRoutingFilter(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	localRateLimitFilter, err := makeLocalRateLimitFilter(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitDescriptorsFilter, err := makeRateLimitDescriptorsFilter(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	jwtAuthnFilter, err := makeJwtAuthnFilter(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	return []*hcmpb.HttpFilter{
+		makePathMatcherFilter(serviceInfo),
+		jwtAuthnFilter,
+		localRateLimitFilter,
+		rateLimitDescriptorsFilter,
+		makeTranscoderFilter(serviceInfo),
+		makeBackendAuthFilter(serviceInfo),
+		backendRoutingFilter,
+	}, nil
+}
+
+// filterConfigEqual compares the typed configs of two filters, either of which
+// can be nil. The configs are unmarshaled, as the serialized maps are not
+// ordered.
+func filterConfigEqual(a, b *hcmpb.HttpFilter) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	var configA, configB ptypes.DynamicAny
+	if err := ptypes.UnmarshalAny(a.GetTypedConfig(), &configA); err != nil {
+		return false
+	}
+	if err := ptypes.UnmarshalAny(b.GetTypedConfig(), &configB); err != nil {
+		return false
+	}
+	return a.Name == b.Name && proto.Equal(configA.Message, configB.Message)
+}
+
+// makePathMatcherFilter makes the Path Matcher filter. When multiple services
+// are served, the rules of each service only match the requests routed to its
+// virtual host, so that the services can have the same HTTP method and path.
+// The health check method is generated once for all of them.
+func makePathMatcherFilter(serviceInfos ...*sc.ServiceInfo) *hcmpb.HttpFilter {
 	rules := []*pmpb.PathMatcherRule{}
-	for _, operation := range serviceInfo.Operations {
-		method := serviceInfo.Methods[operation]
-		// Adds PathMatcherRule for HTTP method, whose HttpRule is not empty.
-		for _, httpRule := range method.HttpRule {
-			if httpRule.UriTemplate != "" && httpRule.HttpMethod != "" {
-				newHttpRule := &pmpb.PathMatcherRule{
-					Operation: operation,
-					Pattern:   httpRule,
+	var segmentNames []*pmpb.SegmentName
+	hasHealthCheck := false
+	for _, serviceInfo := range serviceInfos {
+		for _, operation := range serviceInfo.Operations {
+			method := serviceInfo.Methods[operation]
+			serviceName := ""
+			if operation == util.HealthCheckOperation {
+				if hasHealthCheck {
+					continue
 				}
-				if method.BackendInfo != nil && method.BackendInfo.TranslationType == confpb.BackendRule_CONSTANT_ADDRESS && hasPathParameter(newHttpRule.Pattern.UriTemplate) {
-					newHttpRule.ExtractPathParameters = true
+				hasHealthCheck = true
+			} else if len(serviceInfos) > 1 {
+				serviceName = serviceInfo.Name
+			}
+			// Adds PathMatcherRule for HTTP method, whose HttpRule is not empty.
+			for _, httpRule := range method.HttpRule {
+				if httpRule.UriTemplate != "" && httpRule.HttpMethod != "" {
+					newHttpRule := &pmpb.PathMatcherRule{
+						Operation:   operation,
+						Pattern:     httpRule,
+						ServiceName: serviceName,
+					}
+					if method.BackendInfo != nil && method.BackendInfo.TranslationType == confpb.BackendRule_CONSTANT_ADDRESS && hasPathParameter(newHttpRule.Pattern.UriTemplate) {
+						newHttpRule.ExtractPathParameters = true
+					}
+					rules = append(rules, newHttpRule)
 				}
-				rules = append(rules, newHttpRule)
 			}
 		}
+		segmentNames = append(segmentNames, serviceInfo.SegmentNames...)
 	}
 
 	if len(rules) == 0 {
@@ -256,8 +469,8 @@ func makePathMatcherFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
 	}
 
 	pathMathcherConfig := &pmpb.FilterConfig{Rules: rules}
-	if len(serviceInfo.SegmentNames) > 0 {
-		pathMathcherConfig.SegmentNames = serviceInfo.SegmentNames
+	if len(segmentNames) > 0 {
+		pathMathcherConfig.SegmentNames = segmentNames
 	}
 
 	pathMathcherConfigStruct, _ := ptypes.MarshalAny(pathMathcherConfig)
@@ -322,16 +535,63 @@ func processJwtLocations(provider *confpb.AuthProvider) ([]*jwtpb.JwtHeader, []s
 	return jwtHeaders, jwtParams
 }
 
-func makeJwtAuthnFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
-	auth := serviceInfo.ServiceConfig().GetAuthentication()
-	if len(auth.GetProviders()) == 0 {
-		return nil
+func makeJwtAuthnFilter(serviceInfos ...*sc.ServiceInfo) (*hcmpb.HttpFilter, error) {
+	providers := make(map[string]*jwtpb.JwtProvider)
+	requirements := make(map[string]*jwtpb.JwtRequirement)
+	for _, serviceInfo := range serviceInfos {
+		auth := serviceInfo.ServiceConfig().GetAuthentication()
+		if len(auth.GetProviders()) == 0 {
+			continue
+		}
+		serviceProviders, err := makeJwtProviders(serviceInfo)
+		if err != nil {
+			return nil, err
+		}
+		for id, jp := range serviceProviders {
+			// The requirements refer to the providers by id, so a provider
+			// must be the same in all the services that use its id.
+			if existing, ok := providers[id]; ok && !proto.Equal(existing, jp) {
+				return nil, fmt.Errorf("jwt provider %s of service %s conflicts with the one of another service", id, serviceInfo.Name)
+			}
+			providers[id] = jp
+		}
+
+		for _, rule := range auth.GetRules() {
+			if len(rule.GetRequirements()) > 0 {
+				requirements[rule.GetSelector()] = makeJwtRequirement(rule.GetRequirements())
+			}
+		}
+	}
+
+	if len(providers) == 0 {
+		return nil, nil
 	}
+
+	jwtAuthentication := &jwtpb.JwtAuthentication{
+		Providers: providers,
+		FilterStateRules: &jwtpb.FilterStateRule{
+			Name:     "envoy.filters.http.path_matcher.operation",
+			Requires: requirements,
+		},
+	}
+
+	jas, _ := ptypes.MarshalAny(jwtAuthentication)
+	jwtAuthnFilter := &hcmpb.HttpFilter{
+		Name:       util.JwtAuthn,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{jas},
+	}
+	return jwtAuthnFilter, nil
+}
+
+// makeJwtProviders returns the jwt providers of a service keyed by provider
+// id, or an error if any of the providers has an invalid jwks_uri.
+func makeJwtProviders(serviceInfo *sc.ServiceInfo) (map[string]*jwtpb.JwtProvider, error) {
+	auth := serviceInfo.ServiceConfig().GetAuthentication()
 	providers := make(map[string]*jwtpb.JwtProvider)
 	for _, provider := range auth.GetProviders() {
 		clusterName, err := util.ExtraAddressFromURI(provider.GetJwksUri())
 		if err != nil {
-			return nil
+			return nil, fmt.Errorf("fail to make jwt provider %s of service %s, %v", provider.GetId(), serviceInfo.Name, err)
 		}
 
 		fromHeaders, fromParams := processJwtLocations(provider)
@@ -375,32 +635,7 @@ func makeJwtAuthnFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
 		jp.PayloadInMetadata = util.JwtPayloadMetadataName
 		providers[provider.GetId()] = jp
 	}
-
-	if len(providers) == 0 {
-		return nil
-	}
-
-	requirements := make(map[string]*jwtpb.JwtRequirement)
-	for _, rule := range auth.GetRules() {
-		if len(rule.GetRequirements()) > 0 {
-			requirements[rule.GetSelector()] = makeJwtRequirement(rule.GetRequirements())
-		}
-	}
-
-	jwtAuthentication := &jwtpb.JwtAuthentication{
-		Providers: providers,
-		FilterStateRules: &jwtpb.FilterStateRule{
-			Name:     "envoy.filters.http.path_matcher.operation",
-			Requires: requirements,
-		},
-	}
-
-	jas, _ := ptypes.MarshalAny(jwtAuthentication)
-	jwtAuthnFilter := &hcmpb.HttpFilter{
-		Name:       util.JwtAuthn,
-		ConfigType: &hcmpb.HttpFilter_TypedConfig{jas},
-	}
-	return jwtAuthnFilter
+	return providers, nil
 }
 
 func makeJwtRequirement(requirements []*confpb.AuthRequirement) *jwtpb.JwtRequirement {
@@ -471,11 +706,49 @@ func makeServiceControlCallingConfig(opts options.ConfigGeneratorOptions) *scpb.
 	return setting
 }
 
-func makeServiceControlFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
-	if serviceInfo == nil || serviceInfo.ServiceConfig().GetControl().GetEnvironment() == "" {
+func makeServiceControlFilter(serviceInfos ...*sc.ServiceInfo) *hcmpb.HttpFilter {
+	var filterConfig *scpb.FilterConfig
+	hasHealthCheck := false
+	for _, serviceInfo := range serviceInfos {
+		if serviceInfo == nil || serviceInfo.ServiceConfig().GetControl().GetEnvironment() == "" {
+			continue
+		}
+		// The calling config and the credentials are shared by all services,
+		// take them from the first service using Service Control.
+		if filterConfig == nil {
+			filterConfig = makeServiceControlFilterConfig(serviceInfo)
+		}
+		filterConfig.Services = append(filterConfig.Services, makeServiceControlService(serviceInfo))
+		// The service configs of a traffic percent rollout are selected by
+		// the route metadata, so that each of them reports its own config id.
+		for _, canary := range serviceInfo.Canaries {
+			filterConfig.Services = append(filterConfig.Services, makeServiceControlService(canary))
+		}
+		for _, requirement := range makeServiceControlRequirements(serviceInfo) {
+			// The health check method is shared by all the services.
+			if requirement.OperationName == util.HealthCheckOperation && hasHealthCheck {
+				continue
+			}
+			hasHealthCheck = hasHealthCheck || requirement.OperationName == util.HealthCheckOperation
+			filterConfig.Requirements = append(filterConfig.Requirements, requirement)
+		}
+	}
+	if filterConfig == nil {
 		return nil
 	}
 
+	scs, err := ptypes.MarshalAny(filterConfig)
+	if err != nil {
+		glog.Warningf("failed to convert message to struct: %v", err)
+	}
+	filter := &hcmpb.HttpFilter{
+		Name:       util.ServiceControl,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{scs},
+	}
+	return filter
+}
+
+func makeServiceControlService(serviceInfo *sc.ServiceInfo) *scpb.Service {
 	// TODO(b/148638212): Clean up this hacky way of specifying the protocol for Service Control report.
 	// This is safe (for now) as our Service Control filter only differentiates between gRPC or non-gRPC.
 	var protocol string
@@ -486,9 +759,8 @@ func makeServiceControlFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
 		protocol = "http1"
 	}
 
-	serviceName := serviceInfo.ServiceConfig().GetName()
 	service := &scpb.Service{
-		ServiceName:       serviceName,
+		ServiceName:       serviceInfo.ServiceConfig().GetName(),
 		ServiceConfigId:   serviceInfo.ConfigID,
 		ProducerProjectId: serviceInfo.ServiceConfig().GetProducerProjectId(),
 		ServiceConfig:     copyServiceConfigForReportMetrics(serviceInfo.ServiceConfig()),
@@ -517,9 +789,11 @@ func makeServiceControlFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
 		service.MinStreamReportIntervalMs = serviceInfo.Options.MinStreamReportIntervalMs
 	}
 	service.JwtPayloadMetadataName = util.JwtPayloadMetadataName
+	return service
+}
 
+func makeServiceControlFilterConfig(serviceInfo *sc.ServiceInfo) *scpb.FilterConfig {
 	filterConfig := &scpb.FilterConfig{
-		Services:        []*scpb.Service{service},
 		ScCallingConfig: makeServiceControlCallingConfig(serviceInfo.Options),
 		ServiceControlUri: &commonpb.HttpUri{
 			Uri:     serviceInfo.ServiceControlURI,
@@ -569,11 +843,15 @@ func makeServiceControlFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
 		}
 		filterConfig.GcpAttributes.Platform = serviceInfo.Options.ComputePlatformOverride
 	}
+	return filterConfig
+}
 
+func makeServiceControlRequirements(serviceInfo *sc.ServiceInfo) []*scpb.Requirement {
+	var requirements []*scpb.Requirement
 	for _, operation := range serviceInfo.Operations {
 		method := serviceInfo.Methods[operation]
 		requirement := &scpb.Requirement{
-			ServiceName:        serviceName,
+			ServiceName:        serviceInfo.ServiceConfig().GetName(),
 			OperationName:      operation,
 			ApiName:            method.ApiName,
 			ApiVersion:         method.ApiVersion,
@@ -596,18 +874,9 @@ func makeServiceControlFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
 			requirement.ApiKey.Locations = method.ApiKeyLocations
 		}
 
-		filterConfig.Requirements = append(filterConfig.Requirements, requirement)
-	}
-
-	scs, err := ptypes.MarshalAny(filterConfig)
-	if err != nil {
-		glog.Warningf("failed to convert message to struct: %v", err)
-	}
-	filter := &hcmpb.HttpFilter{
-		Name:       util.ServiceControl,
-		ConfigType: &hcmpb.HttpFilter_TypedConfig{scs},
+		requirements = append(requirements, requirement)
 	}
-	return filter
+	return requirements
 }
 
 func copyServiceConfigForReportMetrics(src *confpb.Service) *anypb.Any {
@@ -677,24 +946,29 @@ func makeTranscoderFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
 	return nil
 }
 
-func makeBackendAuthFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
+func makeBackendAuthFilter(serviceInfos ...*sc.ServiceInfo) *hcmpb.HttpFilter {
 	var rules []*bapb.BackendAuthRule
-	for _, operation := range serviceInfo.Operations {
-		method := serviceInfo.Methods[operation]
-		if method.BackendInfo == nil || method.BackendInfo.JwtAudience == "" {
-			continue
+	for _, serviceInfo := range serviceInfos {
+		for _, operation := range serviceInfo.Operations {
+			method := serviceInfo.Methods[operation]
+			if method.BackendInfo == nil || method.BackendInfo.JwtAudience == "" {
+				continue
+			}
+			rules = append(rules,
+				&bapb.BackendAuthRule{
+					Operation:   operation,
+					JwtAudience: method.BackendInfo.JwtAudience,
+				})
 		}
-		rules = append(rules,
-			&bapb.BackendAuthRule{
-				Operation:   operation,
-				JwtAudience: method.BackendInfo.JwtAudience,
-			})
 	}
 	// If none of BackendRules need auth, rules will be empty, not need to add the filter.
 	if len(rules) == 0 {
 		return nil
 	}
 
+	// The token settings come from the options, which are shared by all services.
+	serviceInfo := serviceInfos[0]
+
 	backendAuthConfig := &bapb.FilterConfig{
 		Rules: rules,
 	}
@@ -729,19 +1003,21 @@ func makeBackendAuthFilter(serviceInfo *sc.ServiceInfo) *hcmpb.HttpFilter {
 	return backendAuthFilter
 }
 
-func makeBackendRoutingFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, error) {
+func makeBackendRoutingFilter(serviceInfos ...*sc.ServiceInfo) (*hcmpb.HttpFilter, error) {
 	rules := []*brpb.BackendRoutingRule{}
-	for _, operation := range serviceInfo.Operations {
-		method := serviceInfo.Methods[operation]
-		if method.BackendInfo != nil && method.BackendInfo.TranslationType != confpb.BackendRule_PATH_TRANSLATION_UNSPECIFIED {
-			newRule := &brpb.BackendRoutingRule{
-				Operation:      operation,
-				IsConstAddress: method.BackendInfo.TranslationType == confpb.BackendRule_CONSTANT_ADDRESS,
-			}
-			if method.BackendInfo != nil {
-				newRule.PathPrefix = method.BackendInfo.Uri
+	for _, serviceInfo := range serviceInfos {
+		for _, operation := range serviceInfo.Operations {
+			method := serviceInfo.Methods[operation]
+			if method.BackendInfo != nil && method.BackendInfo.TranslationType != confpb.BackendRule_PATH_TRANSLATION_UNSPECIFIED {
+				newRule := &brpb.BackendRoutingRule{
+					Operation:      operation,
+					IsConstAddress: method.BackendInfo.TranslationType == confpb.BackendRule_CONSTANT_ADDRESS,
+				}
+				if method.BackendInfo != nil {
+					newRule.PathPrefix = method.BackendInfo.Uri
+				}
+				rules = append(rules, newRule)
 			}
-			rules = append(rules, newRule)
 		}
 	}
 	// If none of BackendRules need path translation, rules will be empty, not need to add the filter.
@@ -760,7 +1036,107 @@ func makeBackendRoutingFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, e
 	}, nil
 }
 
-func makeHealthCheckFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, error) {
+func makeLocalRateLimitFilter(serviceInfos ...*sc.ServiceInfo) (*hcmpb.HttpFilter, error) {
+	var rules []*lrlpb.RateLimitRule
+	for _, serviceInfo := range serviceInfos {
+		for _, operation := range serviceInfo.Operations {
+			if method := serviceInfo.Methods[operation]; method.RateLimit != nil {
+				rules = append(rules, method.RateLimit)
+			}
+		}
+	}
+	// If none of the methods has a rate limit, not need to add the filter.
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	localRateLimitConfigStruct, err := ptypes.MarshalAny(&lrlpb.FilterConfig{
+		Rules:                  rules,
+		JwtPayloadMetadataName: util.JwtPayloadMetadataName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &hcmpb.HttpFilter{
+		Name:       util.LocalRateLimit,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{localRateLimitConfigStruct},
+	}, nil
+}
+
+func makeRateLimitDescriptorsFilter(serviceInfos ...*sc.ServiceInfo) (*hcmpb.HttpFilter, error) {
+	var rules []*rldpb.DescriptorRule
+	for _, serviceInfo := range serviceInfos {
+		for _, operation := range serviceInfo.Operations {
+			if method := serviceInfo.Methods[operation]; method.RateLimitDescriptor != nil {
+				rules = append(rules, method.RateLimitDescriptor)
+			}
+		}
+	}
+
+	rateLimitDescriptorsConfigStruct, err := ptypes.MarshalAny(&rldpb.FilterConfig{
+		Rules: rules,
+		Headers: &rldpb.DescriptorHeaders{
+			Operation:  util.RateLimitOperationHeader,
+			ApiKey:     util.RateLimitApiKeyHeader,
+			JwtIssuer:  util.RateLimitJwtIssuerHeader,
+			JwtSubject: util.RateLimitJwtSubjectHeader,
+		},
+		JwtPayloadMetadataName: util.JwtPayloadMetadataName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &hcmpb.HttpFilter{
+		Name:       util.RateLimitDescriptors,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{rateLimitDescriptorsConfigStruct},
+	}, nil
+}
+
+// makeRateLimitFilter makes the Envoy Rate Limit filter, which calls the rate
+// limit service with the descriptors of the rate limits of the routes. The
+// domain of the descriptors is the name of the first service by default.
+func makeRateLimitFilter(serviceInfos ...*sc.ServiceInfo) (*hcmpb.HttpFilter, error) {
+	opts := serviceInfos[0].Options
+	domain := opts.RateLimitDomain
+	if domain == "" {
+		domain = serviceInfos[0].Name
+	}
+
+	rateLimitConfigStruct, err := ptypes.MarshalAny(&ratelimitpb.RateLimit{
+		Domain:          domain,
+		Timeout:         ptypes.DurationProto(opts.RateLimitTimeout),
+		FailureModeDeny: opts.RateLimitFailureModeDeny,
+		// Same as the local rate limit.
+		RateLimitedAsResourceExhausted: true,
+		RateLimitService: &rlspb.RateLimitServiceConfig{
+			GrpcService: &corepb.GrpcService{
+				TargetSpecifier: &corepb.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &corepb.GrpcService_EnvoyGrpc{
+						ClusterName: util.RateLimitServiceClusterName,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &hcmpb.HttpFilter{
+		Name:       util.RateLimit,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{rateLimitConfigStruct},
+	}, nil
+}
+
+// makeHealthCheckFilter makes the Health Check filter, which answers the
+// health check requests of all the services.
+func makeHealthCheckFilter(serviceInfos ...*sc.ServiceInfo) (*hcmpb.HttpFilter, error) {
+	healthz := serviceInfos[0].Options.Healthz
+	for _, serviceInfo := range serviceInfos[1:] {
+		if serviceInfo.Options.Healthz != healthz {
+			return nil, fmt.Errorf("healthz path %s of service %s is different from the healthz path %s of service %s", serviceInfo.Options.Healthz, serviceInfo.Name, healthz, serviceInfos[0].Name)
+		}
+	}
+
 	hcFilterConfig := &hcpb.HealthCheck{
 		PassThroughMode: &wrapperspb.BoolValue{Value: false},
 
@@ -768,7 +1144,7 @@ func makeHealthCheckFilter(serviceInfo *sc.ServiceInfo) (*hcmpb.HttpFilter, erro
 			{
 				Name: ":path",
 				HeaderMatchSpecifier: &routepb.HeaderMatcher_ExactMatch{
-					ExactMatch: serviceInfo.Options.Healthz,
+					ExactMatch: healthz,
 				},
 			},
 		},
@@ -17,14 +17,20 @@ package configgenerator
 import (
 	"encoding/base64"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 
+	pmpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/path_matcher"
+	jwtpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/jwt_authn/v2alpha"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
 	anypb "github.com/golang/protobuf/ptypes/any"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
@@ -406,8 +412,12 @@ func TestJwtAuthnFilter(t *testing.T) {
 			t.Fatal(err)
 		}
 
+		filter, err := makeJwtAuthnFilter(fakeServiceInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
 		marshaler := &jsonpb.Marshaler{}
-		gotFilter, err := marshaler.MarshalToString(makeJwtAuthnFilter(fakeServiceInfo))
+		gotFilter, err := marshaler.MarshalToString(filter)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -418,6 +428,102 @@ func TestJwtAuthnFilter(t *testing.T) {
 	}
 }
 
+func TestJwtAuthnFilterForMultipleServices(t *testing.T) {
+	makeServiceInfo := func(name, apiName string, providers ...*confpb.AuthProvider) *configinfo.ServiceInfo {
+		fakeServiceConfig := &confpb.Service{
+			Name: name,
+			Apis: []*apipb.Api{
+				{
+					Name: apiName,
+					Methods: []*apipb.Method{
+						{
+							Name: "Foo",
+						},
+					},
+				},
+			},
+			Authentication: &confpb.Authentication{
+				Providers: providers,
+				Rules: []*confpb.AuthenticationRule{
+					{
+						Selector: apiName + ".Foo",
+						Requirements: []*confpb.AuthRequirement{
+							{
+								ProviderId: providers[0].Id,
+							},
+						},
+					},
+				},
+			},
+		}
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "http://127.0.0.1:80"
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serviceInfo
+	}
+
+	serviceA := makeServiceInfo("a.cloudesf-testing.cloud.goog", "1.a_cloudesf_testing_cloud_goog", &confpb.AuthProvider{
+		Id:      "auth_provider",
+		Issuer:  "issuer-a",
+		JwksUri: "https://jwks-a.com",
+	})
+	serviceB := makeServiceInfo("b.cloudesf-testing.cloud.goog", "1.b_cloudesf_testing_cloud_goog", &confpb.AuthProvider{
+		Id:      "auth_provider_b",
+		Issuer:  "issuer-b",
+		JwksUri: "https://jwks-b.com",
+	})
+	filter, err := makeJwtAuthnFilter(serviceA, serviceB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtAuthentication := &jwtpb.JwtAuthentication{}
+	if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), jwtAuthentication); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(jwtAuthentication.GetProviders()); got != 2 {
+		t.Errorf("makeJwtAuthnFilter got %d providers, want 2", got)
+	}
+	if got := len(jwtAuthentication.GetFilterStateRules().GetRequires()); got != 2 {
+		t.Errorf("makeJwtAuthnFilter got %d requirements, want 2", got)
+	}
+
+	testData := []struct {
+		desc    string
+		service *configinfo.ServiceInfo
+		wantErr string
+	}{
+		{
+			desc: "Fail with an invalid jwks_uri in one of the services",
+			service: makeServiceInfo("c.cloudesf-testing.cloud.goog", "1.c_cloudesf_testing_cloud_goog", &confpb.AuthProvider{
+				Id:      "auth_provider_c",
+				Issuer:  "issuer-c",
+				JwksUri: "https://jwks-c.com:port",
+			}),
+			wantErr: "fail to make jwt provider auth_provider_c of service c.cloudesf-testing.cloud.goog",
+		},
+		{
+			desc: "Fail with the same provider id for different providers",
+			service: makeServiceInfo("c.cloudesf-testing.cloud.goog", "1.c_cloudesf_testing_cloud_goog", &confpb.AuthProvider{
+				Id:      "auth_provider",
+				Issuer:  "issuer-c",
+				JwksUri: "https://jwks-c.com",
+			}),
+			wantErr: "jwt provider auth_provider of service c.cloudesf-testing.cloud.goog conflicts with the one of another service",
+		},
+	}
+	for i, tc := range testData {
+		if _, err := makeJwtAuthnFilter(serviceA, serviceB, tc.service); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("Test Desc(%d): %s, makeJwtAuthnFilter got error: %v, want: %s", i, tc.desc, err, tc.wantErr)
+		}
+		if _, err := MakeListeners(serviceA, serviceB, tc.service); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("Test Desc(%d): %s, MakeListeners got error: %v, want: %s", i, tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
 func TestBackendRoutingFilter(t *testing.T) {
 	testdata := []struct {
 		desc                     string
@@ -519,13 +625,13 @@ func TestBackendRoutingFilter(t *testing.T) {
 						{
 							Selector: "testapi.foo",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "foo",
+								Get: "/foo",
 							},
 						},
 						{
 							Selector: "testapi.bar",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "bar",
+								Get: "/bar",
 							},
 						},
 					},
@@ -601,13 +707,13 @@ func TestBackendRoutingFilter(t *testing.T) {
 						{
 							Selector: "testapi.foo",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "foo",
+								Get: "/foo",
 							},
 						},
 						{
 							Selector: "testapi.bar",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "bar",
+								Get: "/bar",
 							},
 						},
 					},
@@ -790,13 +896,13 @@ func TestBackendAuthFilter(t *testing.T) {
 						{
 							Selector: "get_testapi.foo",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "foo",
+								Get: "/foo",
 							},
 						},
 						{
 							Selector: "get_testapi.bar",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "bar",
+								Get: "/bar",
 							},
 						},
 					},
@@ -1110,13 +1216,13 @@ func TestPathMatcherFilter(t *testing.T) {
 						{
 							Selector: "1.cloudesf_testing_cloud_goog.Foo",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "foo/{id}",
+								Get: "/foo/{id}",
 							},
 						},
 						{
 							Selector: "1.cloudesf_testing_cloud_goog.Bar",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "foo",
+								Get: "/foo",
 							},
 						},
 					},
@@ -1133,7 +1239,7 @@ func TestPathMatcherFilter(t *testing.T) {
             "operation":"1.cloudesf_testing_cloud_goog.Bar",
             "pattern":{
                "httpMethod":"GET",
-               "uriTemplate":"foo"
+               "uriTemplate":"/foo"
             }
          },
          {
@@ -1141,7 +1247,7 @@ func TestPathMatcherFilter(t *testing.T) {
             "operation":"1.cloudesf_testing_cloud_goog.Foo",
             "pattern":{
                "httpMethod":"GET",
-               "uriTemplate":"foo/{id}"
+               "uriTemplate":"/foo/{id}"
             }
          }
       ]
@@ -1174,7 +1280,7 @@ func TestPathMatcherFilter(t *testing.T) {
 						{
 							Selector: "1.cloudesf_testing_cloud_goog.Foo",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "foo",
+								Get: "/foo",
 							},
 						},
 					},
@@ -1191,14 +1297,14 @@ func TestPathMatcherFilter(t *testing.T) {
             "operation":"1.cloudesf_testing_cloud_goog.CORS_foo",
             "pattern":{
                "httpMethod":"OPTIONS",
-               "uriTemplate":"foo"
+               "uriTemplate":"/foo"
             }
          },
          {
             "operation":"1.cloudesf_testing_cloud_goog.Foo",
             "pattern":{
                "httpMethod":"GET",
-               "uriTemplate":"foo"
+               "uriTemplate":"/foo"
             }
          }
       ]
@@ -1247,7 +1353,7 @@ func TestPathMatcherFilter(t *testing.T) {
 						{
 							Selector: "1.cloudesf_testing_cloud_goog.Foo",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "foo/{foo_bar}",
+								Get: "/foo/{foo_bar}",
 							},
 						},
 					},
@@ -1265,7 +1371,7 @@ func TestPathMatcherFilter(t *testing.T) {
             "operation":"1.cloudesf_testing_cloud_goog.Foo",
             "pattern":{
                "httpMethod":"GET",
-               "uriTemplate":"foo/{foo_bar}"
+               "uriTemplate":"/foo/{foo_bar}"
             }
          }
       ],
@@ -1298,6 +1404,172 @@ func TestPathMatcherFilter(t *testing.T) {
 	}
 }
 
+func TestPathMatcherFilterForMultipleServices(t *testing.T) {
+	makeServiceInfo := func(name, apiName string) *configinfo.ServiceInfo {
+		fakeServiceConfig := &confpb.Service{
+			Name: name,
+			Apis: []*apipb.Api{
+				{
+					Name: apiName,
+					Methods: []*apipb.Method{
+						{
+							Name: "Foo",
+						},
+					},
+				},
+			},
+			Http: &annotationspb.Http{
+				Rules: []*annotationspb.HttpRule{
+					{
+						Selector: apiName + ".Foo",
+						Pattern: &annotationspb.HttpRule_Get{
+							Get: "/foo",
+						},
+					},
+				},
+			},
+		}
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "http://127.0.0.1:80"
+		opts.Healthz = "healthz"
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serviceInfo
+	}
+
+	serviceInfos := []*configinfo.ServiceInfo{
+		makeServiceInfo("a.cloudesf-testing.cloud.goog", "1.a_cloudesf_testing_cloud_goog"),
+		makeServiceInfo("b.cloudesf-testing.cloud.goog", "1.b_cloudesf_testing_cloud_goog"),
+	}
+	wantPathMatcherFilter := `{
+   "name":"envoy.filters.http.path_matcher",
+   "typedConfig":{
+      "@type":"type.googleapis.com/google.api.envoy.http.path_matcher.FilterConfig",
+      "rules":[
+         {
+            "operation":"1.a_cloudesf_testing_cloud_goog.Foo",
+            "pattern":{
+               "httpMethod":"GET",
+               "uriTemplate":"/foo"
+            },
+            "serviceName":"a.cloudesf-testing.cloud.goog"
+         },
+         {
+            "operation":"ESPv2.HealthCheck",
+            "pattern":{
+               "httpMethod":"GET",
+               "uriTemplate":"/healthz"
+            }
+         },
+         {
+            "operation":"1.b_cloudesf_testing_cloud_goog.Foo",
+            "pattern":{
+               "httpMethod":"GET",
+               "uriTemplate":"/foo"
+            },
+            "serviceName":"b.cloudesf-testing.cloud.goog"
+         }
+      ]
+   }
+}`
+	marshaler := &jsonpb.Marshaler{}
+	gotFilter, err := marshaler.MarshalToString(makePathMatcherFilter(serviceInfos...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.JsonEqual(wantPathMatcherFilter, gotFilter); err != nil {
+		t.Errorf("makePathMatcherFilter failed, \n %v", err)
+	}
+
+	if _, err := MakeListeners(serviceInfos...); err != nil {
+		t.Errorf("MakeListeners failed for services sharing the healthz path, %v", err)
+	}
+
+	duplicated := makeServiceInfo("c.cloudesf-testing.cloud.goog", "1.a_cloudesf_testing_cloud_goog")
+	wantErr := "operation 1.a_cloudesf_testing_cloud_goog.Foo is defined by both service a.cloudesf-testing.cloud.goog and service c.cloudesf-testing.cloud.goog"
+	if _, err := MakeListeners(serviceInfos[0], duplicated); err == nil || err.Error() != wantErr {
+		t.Errorf("MakeListeners got error: %v, want: %s", err, wantErr)
+	}
+}
+
+func TestPathMatcherFilterWithConflictingHttpRules(t *testing.T) {
+	makeServiceInfo := func(httpRules map[string]string) *configinfo.ServiceInfo {
+		fakeServiceConfig := &confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+			Http: &annotationspb.Http{},
+		}
+		for _, name := range []string{"GetBook", "GetShelf", "ListShelves"} {
+			if path, ok := httpRules[name]; ok {
+				fakeServiceConfig.Apis[0].Methods = append(fakeServiceConfig.Apis[0].Methods, &apipb.Method{Name: name})
+				fakeServiceConfig.Http.Rules = append(fakeServiceConfig.Http.Rules, &annotationspb.HttpRule{
+					Selector: testApiName + "." + name,
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: path,
+					},
+				})
+			}
+		}
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "http://127.0.0.1:80"
+		opts.AllowConflictingHttpRules = true
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serviceInfo
+	}
+
+	// GetBook comes first in the order of the operations, so the HTTP rule
+	// of GetShelf is dropped.
+	serviceInfo := makeServiceInfo(map[string]string{
+		"GetBook":     "/v1/shelves/{book}",
+		"GetShelf":    "/v1/shelves/{shelf}",
+		"ListShelves": "/v1/shelves",
+	})
+	var pathMatcherConfig pmpb.FilterConfig
+	if err := ptypes.UnmarshalAny(makePathMatcherFilter(serviceInfo).GetTypedConfig(), &pathMatcherConfig); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]string)
+	for _, rule := range pathMatcherConfig.GetRules() {
+		template, err := util.ParseUriTemplate(rule.GetPattern().GetUriTemplate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := rule.GetPattern().GetHttpMethod() + " " + template.String()
+		if prev, ok := seen[key]; ok {
+			t.Errorf("path matcher has %s for both %s and %s", key, prev, rule.GetOperation())
+		}
+		seen[key] = rule.GetOperation()
+	}
+	if got, want := seen["GET /v1/shelves/*"], testApiName+".GetBook"; got != want {
+		t.Errorf("path matcher got operation %s for the conflicting HTTP rule, want: %s", got, want)
+	}
+
+	// The routes are the same as without the dropped HTTP rule.
+	gotRoutes, err := MakeRouteConfig(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRoutes, err := MakeRouteConfig(makeServiceInfo(map[string]string{
+		"GetBook":     "/v1/shelves/{book}",
+		"ListShelves": "/v1/shelves",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(gotRoutes, wantRoutes) {
+		t.Errorf("got routes: %v, want: %v", gotRoutes, wantRoutes)
+	}
+}
+
 func TestHealthCheckFilter(t *testing.T) {
 	testdata := []struct {
 		desc                  string
@@ -1358,7 +1630,7 @@ func TestHealthCheckFilter(t *testing.T) {
 						{
 							Selector: "1.cloudesf_testing_cloud_goog.Foo",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "foo/{id}",
+								Get: "/foo/{id}",
 							},
 						},
 					},
@@ -1406,6 +1678,238 @@ func TestHealthCheckFilter(t *testing.T) {
 	}
 }
 
+func TestLocalRateLimitFilter(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: "endpoints.examples.bookstore.Bookstore",
+				Methods: []*apipb.Method{
+					{
+						Name: "CreateShelf",
+					},
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+		},
+	}
+
+	testdata := []struct {
+		desc                     string
+		maxTokens                int
+		key                      string
+		wantLocalRateLimitFilter string
+	}{
+		{
+			desc: "No filter without any rate limit",
+		},
+		{
+			desc:      "Success, generate local rate limit filter without the health check",
+			maxTokens: 5,
+			key:       "jwt_subject",
+			wantLocalRateLimitFilter: `{
+        "name": "envoy.filters.http.local_rate_limit",
+        "typedConfig": {
+          "@type": "type.googleapis.com/google.api.envoy.http.local_rate_limit.FilterConfig",
+          "rules": [
+            {
+              "operation": "endpoints.examples.bookstore.Bookstore.CreateShelf",
+              "tokenBucket": {"maxTokens": 5, "tokensPerFill": 5, "fillInterval": "1s"},
+              "key": {"jwtSubject": true}
+            },
+            {
+              "operation": "endpoints.examples.bookstore.Bookstore.ListShelves",
+              "tokenBucket": {"maxTokens": 5, "tokensPerFill": 5, "fillInterval": "1s"},
+              "key": {"jwtSubject": true}
+            }
+          ],
+          "jwtPayloadMetadataName": "jwt_payloads"
+        }
+      }`,
+		},
+	}
+
+	for i, tc := range testdata {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "grpc://127.0.0.1:80"
+		opts.Healthz = "healthz"
+		opts.LocalRateLimitMaxTokens = tc.maxTokens
+		opts.LocalRateLimitKey = tc.key
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filter, err := makeLocalRateLimitFilter(fakeServiceInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.wantLocalRateLimitFilter == "" {
+			if filter != nil {
+				t.Errorf("Test Desc(%d): %s, got filter: %v, want nil", i, tc.desc, filter)
+			}
+			continue
+		}
+
+		marshaler := &jsonpb.Marshaler{}
+		gotFilter, err := marshaler.MarshalToString(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(tc.wantLocalRateLimitFilter, gotFilter); err != nil {
+			t.Errorf("Test Desc(%d): %s, makeLocalRateLimitFilter failed,\n%v", i, tc.desc, err)
+		}
+	}
+}
+
+func TestRateLimitFilters(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: "endpoints.examples.bookstore.Bookstore",
+				Methods: []*apipb.Method{
+					{
+						Name: "CreateShelf",
+					},
+					{
+						Name: "ListShelves",
+					},
+				},
+			},
+		},
+		SystemParameters: &confpb.SystemParameters{
+			Rules: []*confpb.SystemParameterRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Parameters: []*confpb.SystemParameter{
+						{
+							Name:       "api_key",
+							HttpHeader: "x-custom-key",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	testdata := []struct {
+		desc                           string
+		domain                         string
+		timeout                        time.Duration
+		failureModeDeny                bool
+		wantRateLimitDescriptorsFilter string
+		wantRateLimitFilter            string
+	}{
+		{
+			desc: "Success, generate rate limit filters with the default domain without the health check",
+			wantRateLimitDescriptorsFilter: `{
+        "name": "envoy.filters.http.rate_limit_descriptors",
+        "typedConfig": {
+          "@type": "type.googleapis.com/google.api.envoy.http.rate_limit_descriptors.FilterConfig",
+          "rules": [
+            {
+              "operation": "endpoints.examples.bookstore.Bookstore.CreateShelf",
+              "apiKeyLocations": [{"query": "key"}, {"query": "api_key"}, {"header": "x-api-key"}]
+            },
+            {
+              "operation": "endpoints.examples.bookstore.Bookstore.ListShelves",
+              "apiKeyLocations": [{"header": "x-custom-key"}]
+            }
+          ],
+          "headers": {
+            "operation": "x-endpoint-api-rate-limit-operation",
+            "apiKey": "x-endpoint-api-rate-limit-api-key",
+            "jwtIssuer": "x-endpoint-api-rate-limit-jwt-issuer",
+            "jwtSubject": "x-endpoint-api-rate-limit-jwt-subject"
+          },
+          "jwtPayloadMetadataName": "jwt_payloads"
+        }
+      }`,
+			wantRateLimitFilter: `{
+        "name": "envoy.rate_limit",
+        "typedConfig": {
+          "@type": "type.googleapis.com/envoy.config.filter.http.rate_limit.v2.RateLimit",
+          "domain": "bookstore.endpoints.project123.cloud.goog",
+          "timeout": "0.020s",
+          "rateLimitedAsResourceExhausted": true,
+          "rateLimitService": {
+            "grpcService": {
+              "envoyGrpc": {"clusterName": "rate-limit-service-cluster"}
+            }
+          }
+        }
+      }`,
+		},
+		{
+			desc:            "Success, generate rate limit filter with the domain, the timeout and the failure mode",
+			domain:          "bookstore-domain",
+			timeout:         100 * time.Millisecond,
+			failureModeDeny: true,
+			wantRateLimitFilter: `{
+        "name": "envoy.rate_limit",
+        "typedConfig": {
+          "@type": "type.googleapis.com/envoy.config.filter.http.rate_limit.v2.RateLimit",
+          "domain": "bookstore-domain",
+          "timeout": "0.100s",
+          "failureModeDeny": true,
+          "rateLimitedAsResourceExhausted": true,
+          "rateLimitService": {
+            "grpcService": {
+              "envoyGrpc": {"clusterName": "rate-limit-service-cluster"}
+            }
+          }
+        }
+      }`,
+		},
+	}
+
+	for i, tc := range testdata {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "grpc://127.0.0.1:80"
+		opts.Healthz = "healthz"
+		opts.RateLimitServiceAddress = "grpc://127.0.0.1:8081"
+		opts.RateLimitDomain = tc.domain
+		if tc.timeout != 0 {
+			opts.RateLimitTimeout = tc.timeout
+		}
+		opts.RateLimitFailureModeDeny = tc.failureModeDeny
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		marshaler := &jsonpb.Marshaler{}
+		if tc.wantRateLimitDescriptorsFilter != "" {
+			filter, err := makeRateLimitDescriptorsFilter(fakeServiceInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotFilter, err := marshaler.MarshalToString(filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.JsonEqual(tc.wantRateLimitDescriptorsFilter, gotFilter); err != nil {
+				t.Errorf("Test Desc(%d): %s, makeRateLimitDescriptorsFilter failed,\n%v", i, tc.desc, err)
+			}
+		}
+
+		filter, err := makeRateLimitFilter(fakeServiceInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotFilter, err := marshaler.MarshalToString(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(tc.wantRateLimitFilter, gotFilter); err != nil {
+			t.Errorf("Test Desc(%d): %s, makeRateLimitFilter failed,\n%v", i, tc.desc, err)
+		}
+	}
+}
+
 func TestMakeListeners(t *testing.T) {
 	testdata := []struct {
 		desc              string
@@ -1538,3 +2042,157 @@ func TestMakeListeners(t *testing.T) {
 		}
 	}
 }
+
+func TestMakeListenersForTrafficPercentRollout(t *testing.T) {
+	makeServiceInfo := func(configId, path string, deadline float64) *configinfo.ServiceInfo {
+		fakeServiceConfig := &confpb.Service{
+			Name: testProjectName,
+			Id:   configId,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+					Methods: []*apipb.Method{
+						{
+							Name: "Foo",
+						},
+					},
+				},
+			},
+			Http: &annotationspb.Http{
+				Rules: []*annotationspb.HttpRule{
+					{
+						Selector: "endpoints.examples.bookstore.Bookstore.Foo",
+						Pattern: &annotationspb.HttpRule_Get{
+							Get: path,
+						},
+					},
+				},
+			},
+			Backend: &confpb.Backend{
+				Rules: []*confpb.BackendRule{
+					{
+						Selector: "endpoints.examples.bookstore.Bookstore.Foo",
+						Deadline: deadline,
+					},
+				},
+			},
+			Control: &confpb.Control{
+				Environment: testServiceControlEnv,
+			},
+		}
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "http://127.0.0.1:80"
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, configId, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serviceInfo
+	}
+
+	testData := []struct {
+		desc      string
+		canary    *configinfo.ServiceInfo
+		wantError string
+	}{
+		{
+			desc:   "Success, the canary only has a different deadline of its routes",
+			canary: makeServiceInfo("2019-10-01r1", "/foo", 10),
+		},
+		{
+			desc:      "Failure, the canary has a different path, which is matched by Path Matcher",
+			canary:    makeServiceInfo("2019-10-01r1", "/bar", 5),
+			wantError: "service config 2019-10-01r1 of the rollout has different envoy.filters.http.path_matcher settings from the main service config 2019-10-01r0",
+		},
+	}
+	for i, tc := range testData {
+		serviceInfo := makeServiceInfo("2019-10-01r0", "/foo", 5)
+		serviceInfo.Canaries = []*configinfo.ServiceInfo{tc.canary}
+		_, err := MakeListeners(serviceInfo)
+		if tc.wantError == "" {
+			if err != nil {
+				t.Errorf("Test Desc(%d): %s, MakeListeners got error: %v", i, tc.desc, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+			t.Errorf("Test Desc(%d): %s, MakeListeners got error: %v, want: %s", i, tc.desc, err, tc.wantError)
+		}
+	}
+}
+
+func TestMakeRdsListeners(t *testing.T) {
+	makeServiceInfo := func(deadline float64) *configinfo.ServiceInfo {
+		fakeServiceConfig := &confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+			Backend: &confpb.Backend{
+				Rules: []*confpb.BackendRule{
+					{
+						Selector:        "endpoints.examples.bookstore.Bookstore.Foo",
+						Address:         "https://testapipb.com/foo",
+						PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
+						Deadline:        deadline,
+					},
+				},
+			},
+			Http: &annotationspb.Http{
+				Rules: []*annotationspb.HttpRule{
+					{
+						Selector: "endpoints.examples.bookstore.Bookstore.Foo",
+						Pattern: &annotationspb.HttpRule_Get{
+							Get: "/foo",
+						},
+					},
+				},
+			},
+		}
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, options.DefaultConfigGeneratorOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serviceInfo
+	}
+
+	oldServiceInfo := makeServiceInfo(10)
+	newServiceInfo := makeServiceInfo(20)
+
+	oldListeners, err := MakeRdsListeners(oldServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newListeners, err := MakeRdsListeners(newServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A deadline change only updates the route configuration, so the listener
+	// must stay the same to avoid draining it.
+	if !proto.Equal(oldListeners[0], newListeners[0]) {
+		t.Errorf("MakeRdsListeners changed the listener for a route only change,\ngot: %v, \nwant: %v", newListeners[0], oldListeners[0])
+	}
+
+	hcm := &hcmpb.HttpConnectionManager{}
+	if err := ptypes.UnmarshalAny(newListeners[0].FilterChains[0].Filters[0].GetTypedConfig(), hcm); err != nil {
+		t.Fatal(err)
+	}
+	if got := hcm.GetRds().GetRouteConfigName(); got != routeName {
+		t.Errorf("MakeRdsListeners got route config name: %v, want: %v", got, routeName)
+	}
+	if hcm.GetRds().GetConfigSource().GetAds() == nil {
+		t.Errorf("MakeRdsListeners should fetch routes over ADS, got config source: %v", hcm.GetRds().GetConfigSource())
+	}
+
+	oldRoute, err := MakeRouteConfig(oldServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRoute, err := MakeRouteConfig(newServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto.Equal(oldRoute, newRoute) {
+		t.Errorf("MakeRouteConfig should reflect the deadline change, got: %v", newRoute)
+	}
+}
@@ -16,7 +16,9 @@ package configgenerator
 
 import (
 	"fmt"
-	"regexp"
+	"math"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
@@ -28,7 +30,9 @@ import (
 	v2pb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	routepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	typepb "github.com/envoyproxy/go-control-plane/envoy/type"
 	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher"
+	structpb "github.com/golang/protobuf/ptypes/struct"
 	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 )
 
@@ -37,62 +41,117 @@ const (
 	virtualHostName = "backend"
 )
 
-func MakeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*v2pb.RouteConfiguration, error) {
+// MakeRouteConfig provides the route configuration for Envoy.
+// A single service is served by a catch-all virtual host. When multiple
+// services are given, each of them gets its own virtual host matched by the
+// service name and its endpoint aliases.
+func MakeRouteConfig(serviceInfos ...*configinfo.ServiceInfo) (*v2pb.RouteConfiguration, error) {
+	if len(serviceInfos) == 0 {
+		return nil, fmt.Errorf("at least one service is required to make route config")
+	}
+
 	var virtualHosts []*routepb.VirtualHost
-	host := routepb.VirtualHost{
-		Name:    virtualHostName,
-		Domains: []string{"*"},
+	domainOwners := make(map[string]string)
+	for _, serviceInfo := range serviceInfos {
+		host := &routepb.VirtualHost{
+			Name:    virtualHostName,
+			Domains: []string{"*"},
+		}
+		if len(serviceInfos) > 1 {
+			host.Name = serviceInfo.Name
+			host.Domains = makeServiceDomains(serviceInfo)
+			for _, domain := range host.Domains {
+				if owner, ok := domainOwners[domain]; ok {
+					return nil, fmt.Errorf("domain %s is used by both service %s and service %s", domain, owner, serviceInfo.Name)
+				}
+				domainOwners[domain] = serviceInfo.Name
+			}
+		}
+
+		if err := makeVirtualHostRoutes(serviceInfo, host); err != nil {
+			return nil, err
+		}
+		if len(serviceInfos) > 1 {
+			for _, r := range host.Routes {
+				setRouteMetadata(r, util.PathMatcher, "service_name", serviceInfo.Name)
+			}
+		}
+		virtualHosts = append(virtualHosts, host)
 	}
 
-	// Per-selector routes for dynamic routing.
-	brRoutes, err := makeDynamicRoutingConfig(serviceInfo)
-	if err != nil {
-		return nil, err
+	routeConfig := &v2pb.RouteConfiguration{
+		Name:         routeName,
+		VirtualHosts: virtualHosts,
 	}
-	host.Routes = brRoutes
+	if serviceInfos[0].Options.RateLimitServiceAddress != "" {
+		// The headers of the rate limit descriptors are not sent to the backends.
+		routeConfig.RequestHeadersToRemove = []string{
+			util.RateLimitOperationHeader,
+			util.RateLimitApiKeyHeader,
+			util.RateLimitJwtIssuerHeader,
+			util.RateLimitJwtSubjectHeader,
+		}
+	}
+	return routeConfig, nil
+}
 
-	if len(host.Routes) == 0 {
-		// Catch-all route if dynamic routing is not enabled.
-		catchAllRt := &routepb.Route{
-			Match: &routepb.RouteMatch{
-				PathSpecifier: &routepb.RouteMatch_Prefix{
-					Prefix: "/",
-				},
-			},
-			Action: &routepb.Route_Route{
-				Route: &routepb.RouteAction{
-					ClusterSpecifier: &routepb.RouteAction_Cluster{
-						Cluster: serviceInfo.BackendClusterName(),
-					},
-					// Use the default deadline for the catch-all route.
-					// If a customer needs to override this, dynamic routing must be used.
-					// This is the intended design of the feature (b/147813008).
-					Timeout: ptypes.DurationProto(util.DefaultResponseDeadline),
-				},
-			},
+// makeServiceDomains returns the domains of the virtual host for a service:
+// the service name and the aliases of its endpoint, with or without a port.
+func makeServiceDomains(serviceInfo *configinfo.ServiceInfo) []string {
+	hostnames := []string{serviceInfo.Name}
+	for _, endpoint := range serviceInfo.ServiceConfig().GetEndpoints() {
+		if endpoint.GetName() == serviceInfo.Name {
+			hostnames = append(hostnames, endpoint.GetAliases()...)
 		}
-		if serviceInfo.Options.EnableHSTS {
-			catchAllRt.ResponseHeadersToAdd = []*corepb.HeaderValueOption{
-				{
-					Header: &corepb.HeaderValue{
-						Key:   util.HSTSHeaderKey,
-						Value: util.HSTSHeaderValue,
-					},
+	}
+
+	var domains []string
+	for _, hostname := range hostnames {
+		domains = append(domains, hostname, fmt.Sprintf("%s:*", hostname))
+	}
+	return domains
+}
+
+// makeVirtualHostRoutes adds the routes and the CORS policy of a service to its virtual host.
+func makeVirtualHostRoutes(serviceInfo *configinfo.ServiceInfo, host *routepb.VirtualHost) error {
+	// In a traffic percent rollout, the routes of each canary service config
+	// go first and match its share of the requests, the rest fall through to
+	// the routes of the main service config. Envoy uses the same random value
+	// for all the routes of a request, so the fractions are cumulative.
+	totalPercent := serviceInfo.TrafficPercent
+	for _, canary := range serviceInfo.Canaries {
+		totalPercent += canary.TrafficPercent
+	}
+	var cumulativePercent float64
+	for _, canary := range serviceInfo.Canaries {
+		canaryRoutes, err := makeServiceRoutes(canary)
+		if err != nil {
+			return fmt.Errorf("fail to make routes for service config %s, %v", canary.ConfigID, err)
+		}
+		cumulativePercent += canary.TrafficPercent
+		for _, r := range canaryRoutes {
+			r.Match.RuntimeFraction = &corepb.RuntimeFractionalPercent{
+				DefaultValue: &typepb.FractionalPercent{
+					Numerator:   uint32(math.Round(cumulativePercent / totalPercent * 10000)),
+					Denominator: typepb.FractionalPercent_TEN_THOUSAND,
 				},
 			}
+			setRouteMetadata(r, util.ServiceControl, "service_config_id", canary.ConfigID)
 		}
+		host.Routes = append(host.Routes, canaryRoutes...)
+	}
 
-		host.Routes = append(host.Routes, catchAllRt)
-
-		jsonStr, _ := util.ProtoToJson(catchAllRt)
-		glog.Infof("adding catch-all routing configuration: %v", jsonStr)
+	routes, err := makeServiceRoutes(serviceInfo)
+	if err != nil {
+		return err
 	}
+	host.Routes = append(host.Routes, routes...)
 
 	switch serviceInfo.Options.CorsPreset {
 	case "basic":
 		org := serviceInfo.Options.CorsAllowOrigin
 		if org == "" {
-			return nil, fmt.Errorf("cors_allow_origin cannot be empty when cors_preset=basic")
+			return fmt.Errorf("cors_allow_origin cannot be empty when cors_preset=basic")
 		}
 		host.Cors = &routepb.CorsPolicy{
 			AllowOriginStringMatch: []*matcher.StringMatcher{
@@ -106,7 +165,7 @@ func MakeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*v2pb.RouteConfigurat
 	case "cors_with_regex":
 		orgReg := serviceInfo.Options.CorsAllowOriginRegex
 		if orgReg == "" {
-			return nil, fmt.Errorf("cors_allow_origin_regex cannot be empty when cors_preset=cors_with_regex")
+			return fmt.Errorf("cors_allow_origin_regex cannot be empty when cors_preset=cors_with_regex")
 		}
 		host.Cors = &routepb.CorsPolicy{
 			AllowOriginStringMatch: []*matcher.StringMatcher{
@@ -129,10 +188,10 @@ func MakeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*v2pb.RouteConfigurat
 	case "":
 		if serviceInfo.Options.CorsAllowMethods != "" || serviceInfo.Options.CorsAllowHeaders != "" ||
 			serviceInfo.Options.CorsExposeHeaders != "" || serviceInfo.Options.CorsAllowCredentials {
-			return nil, fmt.Errorf("cors_preset must be set in order to enable CORS support")
+			return fmt.Errorf("cors_preset must be set in order to enable CORS support")
 		}
 	default:
-		return nil, fmt.Errorf(`cors_preset must be either "basic" or "cors_with_regex"`)
+		return fmt.Errorf(`cors_preset must be either "basic" or "cors_with_regex"`)
 	}
 
 	if host.GetCors() != nil {
@@ -171,18 +230,95 @@ func MakeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*v2pb.RouteConfigurat
 		glog.Infof("adding cors route configuration: %v", jsonStr)
 	}
 
-	virtualHosts = append(virtualHosts, &host)
-	return &v2pb.RouteConfiguration{
-		Name:         routeName,
-		VirtualHosts: virtualHosts,
-	}, nil
+	return nil
+}
+
+// makeServiceRoutes returns the per-selector routes of a service config for
+// dynamic routing, or the catch-all route if dynamic routing is not enabled.
+func makeServiceRoutes(serviceInfo *configinfo.ServiceInfo) ([]*routepb.Route, error) {
+	routes, err := makeDynamicRoutingConfig(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(routes) == 0 {
+		// Catch-all route if dynamic routing is not enabled.
+		catchAllRt := &routepb.Route{
+			Match: &routepb.RouteMatch{
+				PathSpecifier: &routepb.RouteMatch_Prefix{
+					Prefix: "/",
+				},
+			},
+			Action: &routepb.Route_Route{
+				Route: &routepb.RouteAction{
+					ClusterSpecifier: &routepb.RouteAction_Cluster{
+						Cluster: serviceInfo.BackendClusterName(),
+					},
+					// Use the default deadline for the catch-all route.
+					// If a customer needs to override this, dynamic routing must be used.
+					// This is the intended design of the feature (b/147813008).
+					Timeout:     ptypes.DurationProto(util.DefaultResponseDeadline),
+					RetryPolicy: serviceInfo.CatchAllRetryPolicy,
+					HashPolicy:  makeBackendHashPolicy(serviceInfo),
+					RateLimits:  makeRateLimits(serviceInfo),
+				},
+			},
+		}
+		if serviceInfo.Options.EnableHSTS {
+			catchAllRt.ResponseHeadersToAdd = []*corepb.HeaderValueOption{
+				{
+					Header: &corepb.HeaderValue{
+						Key:   util.HSTSHeaderKey,
+						Value: util.HSTSHeaderValue,
+					},
+				},
+			}
+		}
+
+		routes = append(routes, catchAllRt)
+
+		jsonStr, _ := util.ProtoToJson(catchAllRt)
+		glog.Infof("adding catch-all routing configuration: %v", jsonStr)
+	}
+	return routes, nil
+}
+
+// setRouteMetadata sets a string value in the route metadata of a filter.
+// The Service Control filter selects the service config of a traffic percent
+// rollout with it, and the Path Matcher filter the service of the virtual
+// host when multiple services are served.
+func setRouteMetadata(r *routepb.Route, filterName, key, value string) {
+	if r.Metadata == nil {
+		r.Metadata = &corepb.Metadata{}
+	}
+	if r.Metadata.FilterMetadata == nil {
+		r.Metadata.FilterMetadata = make(map[string]*structpb.Struct)
+	}
+	fields := r.Metadata.FilterMetadata[filterName]
+	if fields == nil {
+		fields = &structpb.Struct{Fields: make(map[string]*structpb.Value)}
+		r.Metadata.FilterMetadata[filterName] = fields
+	}
+	fields.Fields[key] = &structpb.Value{
+		Kind: &structpb.Value_StringValue{
+			StringValue: value,
+		},
+	}
+}
+
+// dynamicRoute is a route of an HTTP rule of a method, with its parsed path
+// template to order the routes.
+type dynamicRoute struct {
+	route     *routepb.Route
+	operation string
+	httpRule  *commonpb.Pattern
+	template  *util.UriTemplate
 }
 
 func makeDynamicRoutingConfig(serviceInfo *configinfo.ServiceInfo) ([]*routepb.Route, error) {
-	var backendRoutes []*routepb.Route
+	var dynamicRoutes []*dynamicRoute
 	for _, operation := range serviceInfo.Operations {
 		method := serviceInfo.Methods[operation]
-		var routeMatcher *routepb.RouteMatch
 		if method.BackendInfo == nil {
 			continue
 		}
@@ -198,22 +334,42 @@ func makeDynamicRoutingConfig(serviceInfo *configinfo.ServiceInfo) ([]*routepb.R
 		}
 
 		for _, httpRule := range method.HttpRule {
-			if routeMatcher = makeHttpRouteMatcher(httpRule); routeMatcher == nil {
-				return nil, fmt.Errorf("error making HTTP route matcher for selector: %v", operation)
+			template, err := util.ParseUriTemplate(httpRule.UriTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("error making HTTP route matcher for selector: %v, %v", operation, err)
+			}
+			routeMatcher := makeHttpRouteMatcher(httpRule, template)
+
+			// The GET methods are idempotent, so they are retried by default.
+			retryPolicy := method.RetryPolicy
+			if retryPolicy == nil && httpRule.HttpMethod == util.GET && serviceInfo.Options.BackendRetryGetMethods {
+				retryPolicy = configinfo.DefaultGetRetryPolicy
+			}
+
+			routeAction := &routepb.RouteAction{
+				ClusterSpecifier: &routepb.RouteAction_Cluster{
+					Cluster: method.BackendInfo.ClusterName,
+				},
+				HostRewriteSpecifier: &routepb.RouteAction_HostRewrite{
+					HostRewrite: method.BackendInfo.Hostname,
+				},
+				Timeout:     ptypes.DurationProto(respTimeout),
+				RetryPolicy: retryPolicy,
+				HashPolicy:  makeBackendHashPolicy(serviceInfo),
+				RateLimits:  makeRateLimits(serviceInfo),
+			}
+			if len(method.BackendInfo.WeightedClusters) > 0 {
+				routeAction.ClusterSpecifier = makeWeightedClusters(method.BackendInfo.WeightedClusters)
+				// Each of the backends gets the host of its own cluster.
+				routeAction.HostRewriteSpecifier = &routepb.RouteAction_AutoHostRewrite{
+					AutoHostRewrite: &wrapperspb.BoolValue{Value: true},
+				}
 			}
 
 			r := routepb.Route{
 				Match: routeMatcher,
 				Action: &routepb.Route_Route{
-					Route: &routepb.RouteAction{
-						ClusterSpecifier: &routepb.RouteAction_Cluster{
-							Cluster: method.BackendInfo.ClusterName,
-						},
-						HostRewriteSpecifier: &routepb.RouteAction_HostRewrite{
-							HostRewrite: method.BackendInfo.Hostname,
-						},
-						Timeout: ptypes.DurationProto(respTimeout),
-					},
+					Route: routeAction,
 				},
 			}
 			if serviceInfo.Options.EnableHSTS {
@@ -226,25 +382,180 @@ func makeDynamicRoutingConfig(serviceInfo *configinfo.ServiceInfo) ([]*routepb.R
 					},
 				}
 			}
-			backendRoutes = append(backendRoutes, &r)
-
-			jsonStr, _ := util.ProtoToJson(&r)
-			glog.Infof("adding Dynamic Routing configuration: %v", jsonStr)
+			dynamicRoutes = append(dynamicRoutes, &dynamicRoute{
+				route:     &r,
+				operation: operation,
+				httpRule:  httpRule,
+				template:  template,
+			})
 		}
 	}
+
+	// Envoy uses the first matching route, so the most specific ones go first.
+	sortRoutesBySpecificity(dynamicRoutes)
+	for _, shadowed := range findShadowedRoutes(dynamicRoutes) {
+		glog.Warningf("route %s %s of selector %s is shadowed by route %s %s of selector %s, it will never be matched",
+			shadowed[1].httpRule.HttpMethod, shadowed[1].httpRule.UriTemplate, shadowed[1].operation,
+			shadowed[0].httpRule.HttpMethod, shadowed[0].httpRule.UriTemplate, shadowed[0].operation)
+	}
+
+	var backendRoutes []*routepb.Route
+	for _, r := range dynamicRoutes {
+		backendRoutes = append(backendRoutes, r.route)
+
+		jsonStr, _ := util.ProtoToJson(r.route)
+		glog.Infof("adding Dynamic Routing configuration: %v", jsonStr)
+	}
 	return backendRoutes, nil
 }
 
-func makeHttpRouteMatcher(httpRule *commonpb.Pattern) *routepb.RouteMatch {
-	if httpRule == nil {
+// makeBackendHashPolicy returns the hash policy of the routes to the backends,
+// which hashes the client IP for the ring hash load balancing of their
+// clusters, or nil for the other load balancing policies.
+func makeBackendHashPolicy(serviceInfo *configinfo.ServiceInfo) []*routepb.RouteAction_HashPolicy {
+	if serviceInfo.Options.BackendLbPolicy != "ring_hash" {
 		return nil
 	}
-	var routeMatcher routepb.RouteMatch
-	re := regexp.MustCompile(`{[^{}]+}`)
+	return []*routepb.RouteAction_HashPolicy{
+		{
+			PolicySpecifier: &routepb.RouteAction_HashPolicy_ConnectionProperties_{
+				ConnectionProperties: &routepb.RouteAction_HashPolicy_ConnectionProperties{
+					SourceIp: true,
+				},
+			},
+		},
+	}
+}
 
-	// Replace path templates inside "{}" by regex "[^\/]+", which means
-	// any character except `/`, also adds `$` to match to the end of the string.
-	if re.MatchString(httpRule.UriTemplate) {
+// makeRateLimits returns the rate limits of the routes to the backends, or nil
+// if the rate limit service is not used. Each of them makes a descriptor of
+// the operation from the headers set by the Rate Limit Descriptors filter: the
+// operation alone, with the API key, with the JWT issuer and subject, and with
+// each of the custom headers. A descriptor is not sent if any of its headers
+// is missing, so the requests without an API key have no descriptor of it,
+// and the operations which are not rate limited have none at all.
+func makeRateLimits(serviceInfo *configinfo.ServiceInfo) []*routepb.RateLimit {
+	if serviceInfo.Options.RateLimitServiceAddress == "" {
+		return nil
+	}
+	operation := makeRequestHeadersAction(util.RateLimitOperationHeader, "operation")
+	rateLimits := []*routepb.RateLimit{
+		{
+			Actions: []*routepb.RateLimit_Action{operation},
+		},
+		{
+			Actions: []*routepb.RateLimit_Action{
+				operation,
+				makeRequestHeadersAction(util.RateLimitApiKeyHeader, "api_key"),
+			},
+		},
+		{
+			Actions: []*routepb.RateLimit_Action{
+				operation,
+				makeRequestHeadersAction(util.RateLimitJwtIssuerHeader, "jwt_issuer"),
+				makeRequestHeadersAction(util.RateLimitJwtSubjectHeader, "jwt_subject"),
+			},
+		},
+	}
+	for _, header := range strings.Split(serviceInfo.Options.RateLimitDescriptorHeaders, ",") {
+		if header = strings.TrimSpace(header); header == "" {
+			continue
+		}
+		rateLimits = append(rateLimits, &routepb.RateLimit{
+			Actions: []*routepb.RateLimit_Action{
+				operation,
+				makeRequestHeadersAction(header, header),
+			},
+		})
+	}
+	return rateLimits
+}
+
+func makeRequestHeadersAction(headerName, descriptorKey string) *routepb.RateLimit_Action {
+	return &routepb.RateLimit_Action{
+		ActionSpecifier: &routepb.RateLimit_Action_RequestHeaders_{
+			RequestHeaders: &routepb.RateLimit_Action_RequestHeaders{
+				HeaderName:    headerName,
+				DescriptorKey: descriptorKey,
+			},
+		},
+	}
+}
+
+// makeWeightedClusters splits the requests of a route among the clusters of
+// the weighted backends by their weights.
+func makeWeightedClusters(weightedClusters []*configinfo.WeightedCluster) *routepb.RouteAction_WeightedClusters {
+	var totalWeight uint32
+	var clusters []*routepb.WeightedCluster_ClusterWeight
+	for _, c := range weightedClusters {
+		clusters = append(clusters, &routepb.WeightedCluster_ClusterWeight{
+			Name:   c.ClusterName,
+			Weight: &wrapperspb.UInt32Value{Value: c.Weight},
+		})
+		totalWeight += c.Weight
+	}
+	return &routepb.RouteAction_WeightedClusters{
+		WeightedClusters: &routepb.WeightedCluster{
+			Clusters:    clusters,
+			TotalWeight: &wrapperspb.UInt32Value{Value: totalWeight},
+		},
+	}
+}
+
+// routeWildcardRank ranks the path templates: exact paths first, then the
+// ones with single segment wildcards, then the ones with "**".
+func routeWildcardRank(t *util.UriTemplate) int {
+	if !t.HasWildcard() {
+		return 0
+	}
+	if n := len(t.Segments); t.Segments[n-1] == "**" {
+		return 2
+	}
+	return 1
+}
+
+// sortRoutesBySpecificity orders the routes by the rank of their wildcards,
+// then the templates by the number of literal segments, then by the number of
+// segments, all descending in specificity. Exact paths cannot shadow each
+// other, so they are not reordered. The ties keep the order of the operations,
+// which is sorted by selector, and of the HTTP rules of each method.
+func sortRoutesBySpecificity(routes []*dynamicRoute) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		ti, tj := routes[i].template, routes[j].template
+		ri, rj := routeWildcardRank(ti), routeWildcardRank(tj)
+		if ri != rj {
+			return ri < rj
+		}
+		if ri == 0 {
+			return false
+		}
+		if li, lj := ti.LiteralCount(), tj.LiteralCount(); li != lj {
+			return li > lj
+		}
+		return len(ti.Segments) > len(tj.Segments)
+	})
+}
+
+// findShadowedRoutes returns the pairs of routes where the first one matches
+// all the requests of the second one, which comes after it.
+func findShadowedRoutes(routes []*dynamicRoute) [][2]*dynamicRoute {
+	var shadowed [][2]*dynamicRoute
+	for j, r := range routes {
+		for _, prev := range routes[:j] {
+			if prev.httpRule.HttpMethod == r.httpRule.HttpMethod && prev.template.Covers(r.template) {
+				shadowed = append(shadowed, [2]*dynamicRoute{prev, r})
+				break
+			}
+		}
+	}
+	return shadowed
+}
+
+// makeHttpRouteMatcher matches the path template of an HTTP rule exactly if it
+// has no wildcard, or with its regular expression otherwise, and the method.
+func makeHttpRouteMatcher(httpRule *commonpb.Pattern, template *util.UriTemplate) *routepb.RouteMatch {
+	var routeMatcher routepb.RouteMatch
+	if template.HasWildcard() {
 		routeMatcher = routepb.RouteMatch{
 			PathSpecifier: &routepb.RouteMatch_SafeRegex{
 				SafeRegex: &matcher.RegexMatcher{
@@ -255,7 +566,7 @@ func makeHttpRouteMatcher(httpRule *commonpb.Pattern) *routepb.RouteMatch {
 							},
 						},
 					},
-					Regex: re.ReplaceAllString(httpRule.UriTemplate, `[^\/]+`) + `$`,
+					Regex: template.Regex(),
 				},
 			},
 		}
@@ -15,8 +15,14 @@
 package configgenerator
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
@@ -24,6 +30,7 @@ import (
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 
+	commonpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/common"
 	routepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
 	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher"
 	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
@@ -36,6 +43,7 @@ func TestMakeRouteConfig(t *testing.T) {
 	testData := []struct {
 		desc                          string
 		enableStrictTransportSecurity bool
+		backendLbPolicy               string
 		fakeServiceConfig             *confpb.Service
 		wantedError                   string
 		wantRouteConfig               string
@@ -109,7 +117,7 @@ func TestMakeRouteConfig(t *testing.T) {
 						{
 							Selector: "endpoints.examples.bookstore.Bookstore.Foo",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "foo",
+								Get: "/foo",
 							},
 						},
 					},
@@ -132,7 +140,7 @@ func TestMakeRouteConfig(t *testing.T) {
                                                          "name": ":method"
                                                      }
                                                  ],
-                                                 "path": "foo"
+                                                 "path": "/foo"
                                              },
                                              "responseHeadersToAdd": [
                                                  {
@@ -145,6 +153,51 @@ func TestMakeRouteConfig(t *testing.T) {
                                              "route": {
                                                  "cluster": "testapipb.com:443",
                                                  "hostRewrite": "testapipb.com",
+                                                 "retryPolicy": {
+                                                     "numRetries": 1,
+                                                     "retryOn": "connect-failure,refused-stream,reset"
+                                                 },
+                                                 "timeout": "15s"
+                                             }
+                                         }
+                                     ]
+                                 }
+                             ]
+                       }`,
+		},
+		{
+			desc:            "Hash the client IP for ring_hash",
+			backendLbPolicy: "ring_hash",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+			},
+			wantRouteConfig: `{
+                             "name": "local_route",
+                             "virtualHosts": [
+                                 {
+                                     "domains": [
+                                         "*"
+                                     ],
+                                     "name": "backend",
+                                     "routes": [
+                                         {
+                                             "match": {
+                                                 "prefix": "/"
+                                             },
+                                             "route": {
+                                                 "cluster": "bookstore.endpoints.project123.cloud.goog_local",
+                                                 "hashPolicy": [
+                                                     {
+                                                         "connectionProperties": {
+                                                             "sourceIp": true
+                                                         }
+                                                     }
+                                                 ],
                                                  "timeout": "15s"
                                              }
                                          }
@@ -158,6 +211,9 @@ func TestMakeRouteConfig(t *testing.T) {
 	for i, tc := range testData {
 		opts := options.DefaultConfigGeneratorOptions()
 		opts.EnableHSTS = tc.enableStrictTransportSecurity
+		if tc.backendLbPolicy != "" {
+			opts.BackendLbPolicy = tc.backendLbPolicy
+		}
 		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
 		if err != nil {
 			t.Fatal(err)
@@ -183,6 +239,967 @@ func TestMakeRouteConfig(t *testing.T) {
 	}
 }
 
+func TestMakeHttpRouteMatcher(t *testing.T) {
+	testData := []struct {
+		desc             string
+		httpRule         *commonpb.Pattern
+		wantRouteMatcher string
+		wantError        string
+	}{
+		{
+			desc:             "Exact path for a template without wildcard",
+			httpRule:         &commonpb.Pattern{UriTemplate: "/v1/shelves.list", HttpMethod: util.GET},
+			wantRouteMatcher: `{"path":"/v1/shelves.list","headers":[{"name":":method","exactMatch":"GET"}]}`,
+		},
+		{
+			desc:             "Variables and custom verb",
+			httpRule:         &commonpb.Pattern{UriTemplate: "/v1/shelves/{shelf}/books/{book.id}:publish", HttpMethod: util.POST},
+			wantRouteMatcher: `{"safeRegex":{"googleRe2":{"maxProgramSize":1000},"regex":"^/v1/shelves/[^/]+/books/[^/]+:publish$"},"headers":[{"name":":method","exactMatch":"POST"}]}`,
+		},
+		{
+			desc:             "Variable with multiple segments",
+			httpRule:         &commonpb.Pattern{UriTemplate: "/v1/{name=shelves/*/books/**}", HttpMethod: util.GET},
+			wantRouteMatcher: `{"safeRegex":{"googleRe2":{"maxProgramSize":1000},"regex":"^/v1/shelves/[^/]+/books(/.*)?$"},"headers":[{"name":":method","exactMatch":"GET"}]}`,
+		},
+		{
+			desc:             "Wildcard of all the paths",
+			httpRule:         &commonpb.Pattern{UriTemplate: "/**", HttpMethod: util.DELETE},
+			wantRouteMatcher: `{"safeRegex":{"googleRe2":{"maxProgramSize":1000},"regex":"^(/.*)?$"},"headers":[{"name":":method","exactMatch":"DELETE"}]}`,
+		},
+		{
+			desc:      "Invalid template",
+			httpRule:  &commonpb.Pattern{UriTemplate: "/v1/**/books", HttpMethod: util.GET},
+			wantError: `invalid path template "/v1/**/books", ** must be the last segment`,
+		},
+	}
+
+	for i, tc := range testData {
+		template, err := util.ParseUriTemplate(tc.httpRule.UriTemplate)
+		if tc.wantError != "" {
+			if err == nil || err.Error() != tc.wantError {
+				t.Errorf("Test Desc(%d): %s, got error: %v, want: %v", i, tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test Desc(%d): %s, got error: %v", i, tc.desc, err)
+			continue
+		}
+		gotRouteMatcher, err := util.ProtoToJson(makeHttpRouteMatcher(tc.httpRule, template))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(tc.wantRouteMatcher, gotRouteMatcher); err != nil {
+			t.Errorf("Test Desc(%d): %s, makeHttpRouteMatcher failed, %v", i, tc.desc, err)
+		}
+	}
+}
+
+func TestMakeRouteConfigForRetryPolicy(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{Name: "ListShelves"},
+					{Name: "CreateShelf"},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Address:  "https://shelves.run.app",
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+					Address:  "https://shelves.run.app",
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/shelves",
+					},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.CreateShelf",
+					Pattern: &annotationspb.HttpRule_Post{
+						Post: "/shelves",
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc              string
+		fakeServiceConfig *confpb.Service
+		optsMergeFunc     func(opts *options.ConfigGeneratorOptions)
+		// The retry policies of the routes in the order of the selectors, ""
+		// if none.
+		wantRetryPolicies []string
+	}{
+		{
+			desc: "No retry policy of the catch-all route by default",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+			},
+			wantRetryPolicies: []string{""},
+		},
+		{
+			desc: "Retry policy of the flags for the catch-all route",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+			},
+			optsMergeFunc: func(opts *options.ConfigGeneratorOptions) {
+				opts.BackendRetryOn = "connect-failure"
+				opts.BackendRetryNumRetries = 2
+			},
+			wantRetryPolicies: []string{`{"retryOn":"connect-failure","numRetries":2}`},
+		},
+		{
+			desc:              "GET methods are retried by default",
+			fakeServiceConfig: fakeServiceConfig,
+			wantRetryPolicies: []string{
+				"",
+				`{"retryOn":"connect-failure,refused-stream,reset","numRetries":1}`,
+			},
+		},
+		{
+			desc:              "GET methods are not retried by default if disabled",
+			fakeServiceConfig: fakeServiceConfig,
+			optsMergeFunc: func(opts *options.ConfigGeneratorOptions) {
+				opts.BackendRetryGetMethods = false
+			},
+			wantRetryPolicies: []string{"", ""},
+		},
+		{
+			desc:              "Retry policy of the flags for all the dynamic routes",
+			fakeServiceConfig: fakeServiceConfig,
+			optsMergeFunc: func(opts *options.ConfigGeneratorOptions) {
+				opts.BackendRetryOn = "5xx"
+				opts.BackendRetryPerTryTimeout = time.Second
+			},
+			wantRetryPolicies: []string{
+				`{"retryOn":"5xx","numRetries":1,"perTryTimeout":"1s"}`,
+				`{"retryOn":"5xx","numRetries":1,"perTryTimeout":"1s"}`,
+			},
+		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		if tc.optsMergeFunc != nil {
+			tc.optsMergeFunc(&opts)
+		}
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gotRoute, err := MakeRouteConfig(fakeServiceInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes := gotRoute.GetVirtualHosts()[0].GetRoutes()
+		if len(routes) != len(tc.wantRetryPolicies) {
+			t.Errorf("Test Desc(%d): %s, got %d routes, want %d", i, tc.desc, len(routes), len(tc.wantRetryPolicies))
+			continue
+		}
+		for j, want := range tc.wantRetryPolicies {
+			policy := routes[j].GetRoute().GetRetryPolicy()
+			if want == "" {
+				if policy != nil {
+					t.Errorf("Test Desc(%d): %s, got retry policy of route %d: %v, want none", i, tc.desc, j, policy)
+				}
+				continue
+			}
+			got, err := util.ProtoToJson(policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.JsonEqual(want, got); err != nil {
+				t.Errorf("Test Desc(%d): %s, retry policy of route %d: %v", i, tc.desc, j, err)
+			}
+		}
+	}
+}
+
+func TestMakeRouteConfigForRateLimits(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{Name: "ListShelves"},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Address:  "https://shelves.run.app",
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/shelves",
+					},
+				},
+			},
+		},
+	}
+	descriptorRateLimits := `[
+  {"actions": [{"requestHeaders": {"headerName": "x-endpoint-api-rate-limit-operation", "descriptorKey": "operation"}}]},
+  {"actions": [
+    {"requestHeaders": {"headerName": "x-endpoint-api-rate-limit-operation", "descriptorKey": "operation"}},
+    {"requestHeaders": {"headerName": "x-endpoint-api-rate-limit-api-key", "descriptorKey": "api_key"}}
+  ]},
+  {"actions": [
+    {"requestHeaders": {"headerName": "x-endpoint-api-rate-limit-operation", "descriptorKey": "operation"}},
+    {"requestHeaders": {"headerName": "x-endpoint-api-rate-limit-jwt-issuer", "descriptorKey": "jwt_issuer"}},
+    {"requestHeaders": {"headerName": "x-endpoint-api-rate-limit-jwt-subject", "descriptorKey": "jwt_subject"}}
+  ]}%s
+]`
+	headersToRemove := []string{
+		"x-endpoint-api-rate-limit-operation",
+		"x-endpoint-api-rate-limit-api-key",
+		"x-endpoint-api-rate-limit-jwt-issuer",
+		"x-endpoint-api-rate-limit-jwt-subject",
+	}
+
+	testData := []struct {
+		desc              string
+		fakeServiceConfig *confpb.Service
+		optsMergeFunc     func(opts *options.ConfigGeneratorOptions)
+		// The rate limits of the routes, "" if none.
+		wantRateLimits      []string
+		wantHeadersToRemove []string
+	}{
+		{
+			desc:              "No rate limits without the rate limit service",
+			fakeServiceConfig: fakeServiceConfig,
+			wantRateLimits:    []string{""},
+		},
+		{
+			desc: "Rate limits of the catch-all route",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: testApiName,
+					},
+				},
+			},
+			optsMergeFunc: func(opts *options.ConfigGeneratorOptions) {
+				opts.RateLimitServiceAddress = "grpc://127.0.0.1:8081"
+			},
+			wantRateLimits:      []string{fmt.Sprintf(descriptorRateLimits, "")},
+			wantHeadersToRemove: headersToRemove,
+		},
+		{
+			desc:              "Rate limits of the dynamic routes with the custom headers",
+			fakeServiceConfig: fakeServiceConfig,
+			optsMergeFunc: func(opts *options.ConfigGeneratorOptions) {
+				opts.RateLimitServiceAddress = "grpc://127.0.0.1:8081"
+				opts.RateLimitDescriptorHeaders = "x-tenant, ,x-region"
+			},
+			wantRateLimits: []string{fmt.Sprintf(descriptorRateLimits, `,
+  {"actions": [
+    {"requestHeaders": {"headerName": "x-endpoint-api-rate-limit-operation", "descriptorKey": "operation"}},
+    {"requestHeaders": {"headerName": "x-tenant", "descriptorKey": "x-tenant"}}
+  ]},
+  {"actions": [
+    {"requestHeaders": {"headerName": "x-endpoint-api-rate-limit-operation", "descriptorKey": "operation"}},
+    {"requestHeaders": {"headerName": "x-region", "descriptorKey": "x-region"}}
+  ]}`)},
+			wantHeadersToRemove: headersToRemove,
+		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		if tc.optsMergeFunc != nil {
+			tc.optsMergeFunc(&opts)
+		}
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(tc.fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gotRoute, err := MakeRouteConfig(fakeServiceInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gotRoute.GetRequestHeadersToRemove(), tc.wantHeadersToRemove) {
+			t.Errorf("Test Desc(%d): %s, got request headers to remove: %v, want: %v", i, tc.desc, gotRoute.GetRequestHeadersToRemove(), tc.wantHeadersToRemove)
+		}
+		routes := gotRoute.GetVirtualHosts()[0].GetRoutes()
+		if len(routes) != len(tc.wantRateLimits) {
+			t.Errorf("Test Desc(%d): %s, got %d routes, want %d", i, tc.desc, len(routes), len(tc.wantRateLimits))
+			continue
+		}
+		for j, want := range tc.wantRateLimits {
+			rateLimits := routes[j].GetRoute().GetRateLimits()
+			if want == "" {
+				if rateLimits != nil {
+					t.Errorf("Test Desc(%d): %s, got rate limits of route %d: %v, want none", i, tc.desc, j, rateLimits)
+				}
+				continue
+			}
+			var gotRateLimits []string
+			for _, rateLimit := range rateLimits {
+				got, err := util.ProtoToJson(rateLimit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gotRateLimits = append(gotRateLimits, got)
+			}
+			got := "[" + strings.Join(gotRateLimits, ",") + "]"
+			if err := util.JsonEqual(want, got); err != nil {
+				t.Errorf("Test Desc(%d): %s, rate limits of route %d: %v", i, tc.desc, j, err)
+			}
+		}
+	}
+}
+
+func TestMakeRouteConfigForSpecificity(t *testing.T) {
+	testData := []struct {
+		desc string
+		// The HTTP rules of the methods, in "selector METHOD template".
+		httpRules []string
+		// The routes in "METHOD template" in their order.
+		wantRoutes []string
+	}{
+		{
+			desc: "Exact path before the template of a selector sorted first",
+			httpRules: []string{
+				"A GET /v1/{x}",
+				"B GET /v1/stats",
+			},
+			wantRoutes: []string{
+				"GET /v1/stats",
+				"GET /v1/{x}",
+			},
+		},
+		{
+			desc: "Templates with more literal segments first, then more segments",
+			httpRules: []string{
+				"A GET /v1/{name=**}",
+				"B GET /v1/{shelf}/{book}",
+				"C GET /v1/shelves/{shelf}/books/{book}",
+				"D GET /v1/shelves/{shelf}",
+				"E GET /v1/{shelf}",
+				"F GET /v1/{shelf}:undelete",
+			},
+			wantRoutes: []string{
+				"GET /v1/shelves/{shelf}/books/{book}",
+				"GET /v1/shelves/{shelf}",
+				"GET /v1/{shelf}:undelete",
+				"GET /v1/{shelf}/{book}",
+				"GET /v1/{shelf}",
+				"GET /v1/{name=**}",
+			},
+		},
+		{
+			desc: "Ties keep the order of the selectors and the exact paths are not reordered",
+			httpRules: []string{
+				"A POST /v1/shelves/{shelf}",
+				"A POST /v1/a/b/c",
+				"B GET /v1/shelves/{shelf}",
+				"C GET /v1/shelves",
+			},
+			wantRoutes: []string{
+				"POST /v1/a/b/c",
+				"GET /v1/shelves",
+				"POST /v1/shelves/{shelf}",
+				"GET /v1/shelves/{shelf}",
+			},
+		},
+	}
+
+	for i, tc := range testData {
+		fakeServiceConfig := &confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+			Http:    &annotationspb.Http{},
+			Backend: &confpb.Backend{},
+		}
+		methods := make(map[string]bool)
+		// The HTTP rules by the JSON of their route matchers.
+		httpRules := make(map[string]string)
+		for _, rule := range tc.httpRules {
+			fields := strings.Fields(rule)
+			template, err := util.ParseUriTemplate(fields[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			matcherJson, _ := util.ProtoToJson(makeHttpRouteMatcher(&commonpb.Pattern{UriTemplate: fields[2], HttpMethod: fields[1]}, template))
+			httpRules[matcherJson] = fields[1] + " " + fields[2]
+			selector := testApiName + "." + fields[0]
+			if !methods[selector] {
+				methods[selector] = true
+				fakeServiceConfig.Apis[0].Methods = append(fakeServiceConfig.Apis[0].Methods, &apipb.Method{Name: fields[0]})
+				fakeServiceConfig.Backend.Rules = append(fakeServiceConfig.Backend.Rules, &confpb.BackendRule{
+					Selector: selector,
+					Address:  "https://shelves.run.app",
+				})
+			}
+			fakeServiceConfig.Http.Rules = append(fakeServiceConfig.Http.Rules, &annotationspb.HttpRule{
+				Selector: selector,
+				Pattern: &annotationspb.HttpRule_Custom{
+					Custom: &annotationspb.CustomHttpPattern{
+						Kind: fields[1],
+						Path: fields[2],
+					},
+				},
+			})
+		}
+
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "http://127.0.0.1:8082"
+		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotRoute, err := MakeRouteConfig(fakeServiceInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var gotRoutes []string
+		for _, r := range gotRoute.GetVirtualHosts()[0].GetRoutes() {
+			matcherJson, _ := util.ProtoToJson(r.GetMatch())
+			gotRoutes = append(gotRoutes, httpRules[matcherJson])
+		}
+		if !reflect.DeepEqual(gotRoutes, tc.wantRoutes) {
+			t.Errorf("Test Desc(%d): %s, got routes: %v, want: %v", i, tc.desc, gotRoutes, tc.wantRoutes)
+		}
+	}
+}
+
+func TestFindShadowedRoutes(t *testing.T) {
+	testData := []struct {
+		desc string
+		// The HTTP rules of the routes in their order, in "METHOD template".
+		routes []string
+		// The pairs of shadowing and shadowed routes, by index.
+		wantShadowed [][2]int
+	}{
+		{
+			desc:   "Different methods and more specific routes are not shadowed",
+			routes: []string{"GET /v1/stats", "POST /v1/{x}", "GET /v1/{x}", "GET /v1/**"},
+		},
+		{
+			desc:         "Same template with different variables",
+			routes:       []string{"GET /v1/{shelf}/books", "GET /v1/{name}/books", "GET /v1/{name=*/books}"},
+			wantShadowed: [][2]int{{0, 1}, {0, 2}},
+		},
+		{
+			desc:         "Wildcards after more specific routes",
+			routes:       []string{"GET /v1/**", "GET /v1/{x}", "GET /v1/{x}:undelete", "GET /v1", "GET /v2/{x}"},
+			wantShadowed: [][2]int{{0, 1}, {0, 2}, {0, 3}},
+		},
+		{
+			desc:         "Duplicate exact path",
+			routes:       []string{"DELETE /v1/stats", "DELETE /v1/stats"},
+			wantShadowed: [][2]int{{0, 1}},
+		},
+	}
+
+	for i, tc := range testData {
+		var routes []*dynamicRoute
+		index := make(map[*dynamicRoute]int)
+		for j, r := range tc.routes {
+			fields := strings.Fields(r)
+			template, err := util.ParseUriTemplate(fields[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			route := &dynamicRoute{
+				httpRule: &commonpb.Pattern{UriTemplate: fields[1], HttpMethod: fields[0]},
+				template: template,
+			}
+			routes = append(routes, route)
+			index[route] = j
+		}
+
+		var gotShadowed [][2]int
+		for _, pair := range findShadowedRoutes(routes) {
+			gotShadowed = append(gotShadowed, [2]int{index[pair[0]], index[pair[1]]})
+		}
+		if !reflect.DeepEqual(gotShadowed, tc.wantShadowed) {
+			t.Errorf("Test Desc(%d): %s, got shadowed routes: %v, want: %v", i, tc.desc, gotShadowed, tc.wantShadowed)
+		}
+	}
+}
+
+func TestMakeRouteConfigForWeightedBackends(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{Name: "ListShelves"},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Address:  "https://shelves.run.app",
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/shelves",
+					},
+				},
+			},
+		},
+	}
+	backendRules := `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  weighted_backends:
+  - {address: "https://shelves.run.app", weight: 95}
+  - {address: "https://shelves-canary.run.app", weight: 5}
+`
+	wantRoute := `{
+  "match": {
+    "headers": [{"exactMatch": "GET", "name": ":method"}],
+    "path": "/shelves"
+  },
+  "route": {
+    "autoHostRewrite": true,
+    "retryPolicy": {"numRetries": 1, "retryOn": "connect-failure,refused-stream,reset"},
+    "timeout": "15s",
+    "weightedClusters": {
+      "clusters": [
+        {"name": "shelves.run.app:443", "weight": 95},
+        {"name": "shelves-canary.run.app:443", "weight": 5}
+      ],
+      "totalWeight": 100
+    }
+  }
+}`
+
+	dir, err := ioutil.TempDir("", "route_generator_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendRulesPath = filepath.Join(dir, "backend_rules.yaml")
+	if err := ioutil.WriteFile(opts.BackendRulesPath, []byte(backendRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotRouteConfig, err := MakeRouteConfig(fakeServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := gotRouteConfig.GetVirtualHosts()[0].GetRoutes()
+	if len(routes) != 1 {
+		t.Fatalf("got %d routes, want 1", len(routes))
+	}
+	gotRoute, err := util.ProtoToJson(routes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.JsonEqual(wantRoute, gotRoute); err != nil {
+		t.Errorf("MakeRouteConfig failed for weighted backends, %v", err)
+	}
+}
+
+func TestMakeRouteConfigForWeightedBackendsWithCatchAllBackend(t *testing.T) {
+	// ListShelves and GetBook are both served by the catch-all backend.
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{Name: "ListShelves"},
+					{Name: "GetBook"},
+				},
+			},
+		},
+		Http: &annotationspb.Http{
+			Rules: []*annotationspb.HttpRule{
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/shelves",
+					},
+				},
+				{
+					Selector: "endpoints.examples.bookstore.Bookstore.GetBook",
+					Pattern: &annotationspb.HttpRule_Get{
+						Get: "/books/{book}",
+					},
+				},
+			},
+		},
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotRouteConfig, err := MakeRouteConfig(fakeServiceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := gotRouteConfig.GetVirtualHosts()[0].GetRoutes()
+	if len(routes) != 1 || routes[0].GetMatch().GetPrefix() != "/" {
+		t.Fatalf("got routes %v, want the catch-all route only", routes)
+	}
+
+	// Weighted routes for ListShelves would replace the catch-all route of
+	// GetBook, so they are rejected.
+	dir, err := ioutil.TempDir("", "route_generator_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts.BackendRulesPath = filepath.Join(dir, "backend_rules.yaml")
+	backendRules := `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  weighted_backends:
+  - {address: "https://shelves.run.app", weight: 95}
+  - {address: "https://shelves-canary.run.app", weight: 5}
+`
+	if err := ioutil.WriteFile(opts.BackendRulesPath, []byte(backendRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wantErr := "weighted backends of selector endpoints.examples.bookstore.Bookstore.ListShelves need a backend rule with an address in the service config"
+	if _, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts); err == nil || err.Error() != wantErr {
+		t.Errorf("NewServiceInfoFromServiceConfig got error: %v, want: %s", err, wantErr)
+	}
+}
+
+func TestMakeRouteConfigForMultipleServices(t *testing.T) {
+	testData := []struct {
+		desc               string
+		fakeServiceConfigs []*confpb.Service
+		wantedError        string
+		wantRouteConfig    string
+	}{
+		{
+			desc: "One virtual host per service, matched by service name and aliases",
+			fakeServiceConfigs: []*confpb.Service{
+				{
+					Name: "bookstore.endpoints.project123.cloud.goog",
+					Apis: []*apipb.Api{
+						{
+							Name: "endpoints.examples.bookstore.Bookstore",
+						},
+					},
+					Endpoints: []*confpb.Endpoint{
+						{
+							Name:    "bookstore.endpoints.project123.cloud.goog",
+							Aliases: []string{"bookstore.example.com"},
+						},
+					},
+				},
+				{
+					Name: "echo.endpoints.project123.cloud.goog",
+					Apis: []*apipb.Api{
+						{
+							Name: "endpoints.examples.echo.Echo",
+						},
+					},
+				},
+			},
+			wantRouteConfig: `{
+                             "name": "local_route",
+                             "virtualHosts": [
+                                 {
+                                     "domains": [
+                                         "bookstore.endpoints.project123.cloud.goog",
+                                         "bookstore.endpoints.project123.cloud.goog:*",
+                                         "bookstore.example.com",
+                                         "bookstore.example.com:*"
+                                     ],
+                                     "name": "bookstore.endpoints.project123.cloud.goog",
+                                     "routes": [
+                                         {
+                                             "match": {
+                                                 "prefix": "/"
+                                             },
+                                             "metadata": {
+                                                 "filterMetadata": {
+                                                     "envoy.filters.http.path_matcher": {
+                                                         "service_name": "bookstore.endpoints.project123.cloud.goog"
+                                                     }
+                                                 }
+                                             },
+                                             "route": {
+                                                 "cluster": "bookstore.endpoints.project123.cloud.goog_local",
+                                                 "timeout": "15s"
+                                             }
+                                         }
+                                     ]
+                                 },
+                                 {
+                                     "domains": [
+                                         "echo.endpoints.project123.cloud.goog",
+                                         "echo.endpoints.project123.cloud.goog:*"
+                                     ],
+                                     "name": "echo.endpoints.project123.cloud.goog",
+                                     "routes": [
+                                         {
+                                             "match": {
+                                                 "prefix": "/"
+                                             },
+                                             "metadata": {
+                                                 "filterMetadata": {
+                                                     "envoy.filters.http.path_matcher": {
+                                                         "service_name": "echo.endpoints.project123.cloud.goog"
+                                                     }
+                                                 }
+                                             },
+                                             "route": {
+                                                 "cluster": "echo.endpoints.project123.cloud.goog_local",
+                                                 "timeout": "15s"
+                                             }
+                                         }
+                                     ]
+                                 }
+                             ]
+                       }`,
+		},
+		{
+			desc: "Fail when an alias is used by two services",
+			fakeServiceConfigs: []*confpb.Service{
+				{
+					Name: "bookstore.endpoints.project123.cloud.goog",
+					Apis: []*apipb.Api{
+						{
+							Name: "endpoints.examples.bookstore.Bookstore",
+						},
+					},
+					Endpoints: []*confpb.Endpoint{
+						{
+							Name:    "bookstore.endpoints.project123.cloud.goog",
+							Aliases: []string{"api.example.com"},
+						},
+					},
+				},
+				{
+					Name: "echo.endpoints.project123.cloud.goog",
+					Apis: []*apipb.Api{
+						{
+							Name: "endpoints.examples.echo.Echo",
+						},
+					},
+					Endpoints: []*confpb.Endpoint{
+						{
+							Name:    "echo.endpoints.project123.cloud.goog",
+							Aliases: []string{"api.example.com"},
+						},
+					},
+				},
+			},
+			wantedError: "domain api.example.com is used by both service bookstore.endpoints.project123.cloud.goog and service echo.endpoints.project123.cloud.goog",
+		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		var fakeServiceInfos []*configinfo.ServiceInfo
+		for _, fakeServiceConfig := range tc.fakeServiceConfigs {
+			fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fakeServiceInfos = append(fakeServiceInfos, fakeServiceInfo)
+		}
+
+		gotRoute, err := MakeRouteConfig(fakeServiceInfos...)
+		if tc.wantedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantedError) {
+				t.Errorf("Test (%s): expected err: %v, got: %v", tc.desc, tc.wantedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		marshaler := &jsonpb.Marshaler{}
+		gotConfig, err := marshaler.MarshalToString(gotRoute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := util.JsonEqual(tc.wantRouteConfig, gotConfig); err != nil {
+			t.Errorf("Test Desc(%d): %s, MakeRouteConfig failed, \n %v", i, tc.desc, err)
+		}
+	}
+}
+
+func TestMakeRouteConfigForTrafficPercentRollout(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	var serviceInfos []*configinfo.ServiceInfo
+	for _, rolloutConfig := range []struct {
+		configId string
+		percent  float64
+	}{
+		{configId: "2019-10-01r2", percent: 50},
+		{configId: "2019-10-01r1", percent: 30},
+		{configId: "2019-10-01r0", percent: 20},
+	} {
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Name: "bookstore.endpoints.project123.cloud.goog",
+			Id:   rolloutConfig.configId,
+			Apis: []*apipb.Api{
+				{
+					Name: "endpoints.examples.bookstore.Bookstore",
+				},
+			},
+		}, rolloutConfig.configId, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serviceInfo.TrafficPercent = rolloutConfig.percent
+		serviceInfos = append(serviceInfos, serviceInfo)
+	}
+	serviceInfos[0].Canaries = serviceInfos[1:]
+
+	wantRouteConfig := `{
+        "name": "local_route",
+        "virtualHosts": [
+            {
+                "domains": ["*"],
+                "name": "backend",
+                "routes": [
+                    {
+                        "match": {
+                            "prefix": "/",
+                            "runtimeFraction": {
+                                "defaultValue": {
+                                    "denominator": "TEN_THOUSAND",
+                                    "numerator": 3000
+                                }
+                            }
+                        },
+                        "metadata": {
+                            "filterMetadata": {
+                                "envoy.filters.http.service_control": {
+                                    "service_config_id": "2019-10-01r1"
+                                }
+                            }
+                        },
+                        "route": {
+                            "cluster": "bookstore.endpoints.project123.cloud.goog_local",
+                            "timeout": "15s"
+                        }
+                    },
+                    {
+                        "match": {
+                            "prefix": "/",
+                            "runtimeFraction": {
+                                "defaultValue": {
+                                    "denominator": "TEN_THOUSAND",
+                                    "numerator": 5000
+                                }
+                            }
+                        },
+                        "metadata": {
+                            "filterMetadata": {
+                                "envoy.filters.http.service_control": {
+                                    "service_config_id": "2019-10-01r0"
+                                }
+                            }
+                        },
+                        "route": {
+                            "cluster": "bookstore.endpoints.project123.cloud.goog_local",
+                            "timeout": "15s"
+                        }
+                    },
+                    {
+                        "match": {
+                            "prefix": "/"
+                        },
+                        "route": {
+                            "cluster": "bookstore.endpoints.project123.cloud.goog_local",
+                            "timeout": "15s"
+                        }
+                    }
+                ]
+            }
+        ]
+    }`
+
+	gotRoute, err := MakeRouteConfig(serviceInfos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshaler := &jsonpb.Marshaler{}
+	gotConfig, err := marshaler.MarshalToString(gotRoute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.JsonEqual(wantRouteConfig, gotConfig); err != nil {
+		t.Errorf("MakeRouteConfig failed for traffic percent rollout, \n %v", err)
+	}
+
+	// The clusters shared by the service configs are only generated once.
+	clusters, err := MakeClusters(serviceInfos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterNames := make(map[string]bool)
+	for _, c := range clusters {
+		if clusterNames[c.Name] {
+			t.Errorf("MakeClusters got duplicated cluster: %v", c.Name)
+		}
+		clusterNames[c.Name] = true
+	}
+}
+
 func TestMakeRouteConfigForCors(t *testing.T) {
 	testData := []struct {
 		desc string
@@ -0,0 +1,78 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	authpb "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+)
+
+// MakeSecrets provides the SDS secrets of the server and client certs. The
+// cert and key files are read inline, so that a new secret is generated when
+// the files are rotated.
+func MakeSecrets(opts options.ConfigGeneratorOptions) ([]*authpb.Secret, error) {
+	var secrets []*authpb.Secret
+	if opts.SslServerCertPath != "" {
+		certPath, keyPath := util.ServerCertFiles(opts.SslServerCertPath)
+		secret, err := makeTlsCertificateSecret(util.ServerCertSecretName, certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	if opts.SslClientCertPath != "" {
+		certPath, keyPath := util.ClientCertFiles(opts.SslClientCertPath)
+		secret, err := makeTlsCertificateSecret(util.ClientCertSecretName, certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+func makeTlsCertificateSecret(name, certPath, keyPath string) (*authpb.Secret, error) {
+	cert, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read cert file %v for secret %v, %v", certPath, name, err)
+	}
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read key file %v for secret %v, %v", keyPath, name, err)
+	}
+	return &authpb.Secret{
+		Name: name,
+		Type: &authpb.Secret_TlsCertificate{
+			TlsCertificate: &authpb.TlsCertificate{
+				CertificateChain: &corepb.DataSource{
+					Specifier: &corepb.DataSource_InlineBytes{
+						InlineBytes: cert,
+					},
+				},
+				PrivateKey: &corepb.DataSource{
+					Specifier: &corepb.DataSource_InlineBytes{
+						InlineBytes: key,
+					},
+				},
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+)
+
+func TestMakeSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret_generator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for file, content := range map[string]string{
+		"server.crt": "server cert",
+		"server.key": "server key",
+		"client.crt": "client cert",
+		"client.key": "client key",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testData := []struct {
+		desc              string
+		sslServerCertPath string
+		sslClientCertPath string
+		wantSecrets       []string
+		wantError         string
+	}{
+		{
+			desc: "No secrets without ssl cert paths",
+		},
+		{
+			desc:              "Success for server and client certs",
+			sslServerCertPath: dir,
+			sslClientCertPath: dir,
+			wantSecrets: []string{
+				`{
+					"name":"server_cert",
+					"tlsCertificate":{
+						"certificateChain":{
+							"inlineBytes":"c2VydmVyIGNlcnQ="
+						},
+						"privateKey":{
+							"inlineBytes":"c2VydmVyIGtleQ=="
+						}
+					}
+				}`,
+				`{
+					"name":"client_cert",
+					"tlsCertificate":{
+						"certificateChain":{
+							"inlineBytes":"Y2xpZW50IGNlcnQ="
+						},
+						"privateKey":{
+							"inlineBytes":"Y2xpZW50IGtleQ=="
+						}
+					}
+				}`,
+			},
+		},
+		{
+			desc:              "Fail for missing cert files",
+			sslServerCertPath: filepath.Join(dir, "missing"),
+			wantError:         "fail to read cert file",
+		},
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.SslServerCertPath = tc.sslServerCertPath
+		opts.SslClientCertPath = tc.sslClientCertPath
+
+		secrets, err := MakeSecrets(opts)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test Desc(%d): %s, MakeSecrets got error: %v, want: %v", i, tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(secrets) != len(tc.wantSecrets) {
+			t.Errorf("Test Desc(%d): %s, MakeSecrets got %d secrets, want: %d", i, tc.desc, len(secrets), len(tc.wantSecrets))
+			continue
+		}
+
+		marshaler := &jsonpb.Marshaler{}
+		for j, wantSecret := range tc.wantSecrets {
+			gotSecret, err := marshaler.MarshalToString(secrets[j])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.JsonEqual(wantSecret, gotSecret); err != nil {
+				t.Errorf("Test Desc(%d): %s, MakeSecrets failed for secret(%d),\n %v", i, tc.desc, j, err)
+			}
+		}
+	}
+}
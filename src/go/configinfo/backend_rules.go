@@ -0,0 +1,768 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configinfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	lrlpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/local_rate_limit"
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/service_control"
+	v2pb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	clusterpb "github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	typepb "github.com/envoyproxy/go-control-plane/envoy/type"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// The retry_on conditions supported by Envoy, for HTTP and gRPC.
+var retryOnConditions = map[string]bool{
+	"5xx":                    true,
+	"gateway-error":          true,
+	"reset":                  true,
+	"connect-failure":        true,
+	"retriable-4xx":          true,
+	"refused-stream":         true,
+	"retriable-status-codes": true,
+	"retriable-headers":      true,
+	"cancelled":              true,
+	"deadline-exceeded":      true,
+	"internal":               true,
+	"resource-exhausted":     true,
+	"unavailable":            true,
+}
+
+// DefaultGetRetryPolicy is the retry policy of the GET methods which have no
+// retry policy configured. They are idempotent, so a request is retried once
+// when the backend fails to respond.
+var DefaultGetRetryPolicy = &routepb.RetryPolicy{
+	RetryOn:    "connect-failure,refused-stream,reset",
+	NumRetries: &wrapperspb.UInt32Value{Value: 1},
+}
+
+// localBackendRule configures the backend of the methods matched by the
+// selector, or of the backend address, in the file of --backend_rules_path.
+type localBackendRule struct {
+	// The selector of the methods, either a method name, "*" or a prefix
+	// ending with ".*".
+	Selector string `json:"selector"`
+	// The backend address, the same as the address of the backend rules in
+	// the service config, or --backend_address.
+	Backend string `json:"backend"`
+	// The retry policy of the routes, in the JSON of Envoy RetryPolicy.
+	RetryPolicy json.RawMessage `json:"retry_policy"`
+	// The backends splitting the requests of the method by their weights,
+	// only with the selector of a method.
+	WeightedBackends []*localWeightedBackend `json:"weighted_backends"`
+	// The hosts balancing the requests of the backend address in host:port,
+	// only with a backend address.
+	Endpoints []string `json:"endpoints"`
+	// The active health check of the hosts of the backend address, in the
+	// JSON of Envoy HealthCheck, only with a backend address.
+	HealthCheck json.RawMessage `json:"health_check"`
+	// The outlier detection of the hosts of the backend address, in the JSON
+	// of Envoy OutlierDetection, only with a backend address.
+	OutlierDetection json.RawMessage `json:"outlier_detection"`
+	// The circuit breakers of the backend address, in the JSON of Envoy
+	// CircuitBreakers, only with a backend address.
+	CircuitBreakers json.RawMessage `json:"circuit_breakers"`
+	// The maximum requests per connection to the backend address, only with
+	// a backend address.
+	MaxRequestsPerConnection uint32 `json:"max_requests_per_connection"`
+	// The local rate limit of the methods, only with a selector.
+	RateLimit *localRateLimit `json:"rate_limit"`
+
+	retryPolicy      *routepb.RetryPolicy
+	address          string
+	endpoints        []*BackendEndpoint
+	healthCheck      *corepb.HealthCheck
+	outlierDetection *clusterpb.OutlierDetection
+	circuitBreakers  *clusterpb.CircuitBreakers
+	rateLimit        *lrlpb.RateLimitRule
+}
+
+// localWeightedBackend is a backend serving a weight of the requests of a
+// method, with its own cluster.
+type localWeightedBackend struct {
+	// The backend address, in the same format as the address of the backend
+	// rules in the service config.
+	Address string `json:"address"`
+	// The share of the requests, relative to the other weighted backends.
+	Weight uint32 `json:"weight"`
+	// The HTTP protocol of the backend, "http/1.1" or "h2" for the http(s)
+	// addresses.
+	Protocol string `json:"protocol"`
+}
+
+// localRateLimit is the token bucket of each method matched by a selector, in
+// the same format as the local rate limit flags.
+type localRateLimit struct {
+	// The size of the bucket, which is the burst of the requests.
+	MaxTokens uint32 `json:"max_tokens"`
+	// The tokens added at each fill, max_tokens by default.
+	TokensPerFill uint32 `json:"tokens_per_fill"`
+	// The interval between the fills, such as "1s", 1s by default.
+	FillInterval string `json:"fill_interval"`
+	// "api_key", "jwt_subject", "client_ip" or "header:<name>", or empty for
+	// one bucket per method.
+	Key string `json:"key"`
+}
+
+// readLocalBackendRules reads the rules of --backend_rules_path, if any.
+func (s *ServiceInfo) readLocalBackendRules() error {
+	if s.Options.BackendRulesPath == "" {
+		return nil
+	}
+	rules, err := readLocalBackendRulesFile(s.Options.BackendRulesPath)
+	if err != nil {
+		return err
+	}
+	s.localBackendRules = rules
+	return nil
+}
+
+// readLocalBackendRulesFile reads the backend rules file in JSON or YAML.
+func readLocalBackendRulesFile(path string) ([]*localBackendRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read backend rules file: %s, error: %v", path, err)
+	}
+	// JSON is YAML as well.
+	var file struct {
+		Rules []*localBackendRule `json:"rules"`
+	}
+	if err := util.UnmarshalYAML(data, &file); err != nil {
+		return nil, fmt.Errorf("fail to parse backend rules file: %s, error: %v", path, err)
+	}
+
+	for i, r := range file.Rules {
+		if (r.Selector == "") == (r.Backend == "") {
+			return nil, fmt.Errorf("backend rule %d in %s must have either a selector or a backend", i, path)
+		}
+		if strings.Contains(r.Selector, "*") && r.Selector != "*" && (!strings.HasSuffix(r.Selector, ".*") || strings.Count(r.Selector, "*") > 1) {
+			return nil, fmt.Errorf("backend rule %d in %s has invalid selector %q, wildcard is only allowed as the last segment", i, path, r.Selector)
+		}
+		if r.Backend != "" {
+			_, hostname, port, _, err := util.ParseURI(r.Backend)
+			if err != nil {
+				return nil, fmt.Errorf("backend rule %d in %s has invalid backend %q, %v", i, path, r.Backend, err)
+			}
+			r.address = fmt.Sprintf("%v:%v", hostname, port)
+		}
+		if len(r.WeightedBackends) > 0 {
+			if r.Selector == "" || strings.Contains(r.Selector, "*") {
+				return nil, fmt.Errorf("backend rule %d in %s has weighted_backends, which need the selector of a method", i, path)
+			}
+			var totalWeight uint32
+			for _, b := range r.WeightedBackends {
+				if _, _, _, _, err := util.ParseURI(b.Address); err != nil {
+					return nil, fmt.Errorf("backend rule %d in %s has invalid weighted backend address %q, %v", i, path, b.Address, err)
+				}
+				totalWeight += b.Weight
+			}
+			if totalWeight == 0 {
+				return nil, fmt.Errorf("backend rule %d in %s has weighted_backends without any weight", i, path)
+			}
+		}
+		if len(r.Endpoints) > 0 {
+			if r.Backend == "" {
+				return nil, fmt.Errorf("backend rule %d in %s has endpoints, which need a backend address", i, path)
+			}
+			for _, endpoint := range r.Endpoints {
+				host, port, err := net.SplitHostPort(endpoint)
+				if err != nil {
+					return nil, fmt.Errorf("backend rule %d in %s has invalid endpoint %q, %v", i, path, endpoint, err)
+				}
+				portVal, err := strconv.ParseUint(port, 10, 16)
+				if err != nil || host == "" {
+					return nil, fmt.Errorf("backend rule %d in %s has invalid endpoint %q, it must be in host:port", i, path, endpoint)
+				}
+				r.endpoints = append(r.endpoints, &BackendEndpoint{
+					Hostname: host,
+					Port:     uint32(portVal),
+				})
+			}
+		}
+		if (len(r.HealthCheck) > 0 || len(r.OutlierDetection) > 0) && r.Backend == "" {
+			return nil, fmt.Errorf("backend rule %d in %s has health_check or outlier_detection, which need a backend address", i, path)
+		}
+		if len(r.HealthCheck) > 0 {
+			r.healthCheck = new(corepb.HealthCheck)
+			if err := jsonpb.Unmarshal(bytes.NewReader(r.HealthCheck), r.healthCheck); err != nil {
+				return nil, fmt.Errorf("backend rule %d in %s has invalid health_check, %v", i, path, err)
+			}
+			if err := r.healthCheck.Validate(); err != nil {
+				return nil, fmt.Errorf("backend rule %d in %s has invalid health_check, %v", i, path, err)
+			}
+		}
+		if len(r.OutlierDetection) > 0 {
+			r.outlierDetection = new(clusterpb.OutlierDetection)
+			if err := jsonpb.Unmarshal(bytes.NewReader(r.OutlierDetection), r.outlierDetection); err != nil {
+				return nil, fmt.Errorf("backend rule %d in %s has invalid outlier_detection, %v", i, path, err)
+			}
+			if err := r.outlierDetection.Validate(); err != nil {
+				return nil, fmt.Errorf("backend rule %d in %s has invalid outlier_detection, %v", i, path, err)
+			}
+		}
+		if (len(r.CircuitBreakers) > 0 || r.MaxRequestsPerConnection > 0) && r.Backend == "" {
+			return nil, fmt.Errorf("backend rule %d in %s has circuit_breakers or max_requests_per_connection, which need a backend address", i, path)
+		}
+		if len(r.CircuitBreakers) > 0 {
+			r.circuitBreakers = new(clusterpb.CircuitBreakers)
+			if err := jsonpb.Unmarshal(bytes.NewReader(r.CircuitBreakers), r.circuitBreakers); err != nil {
+				return nil, fmt.Errorf("backend rule %d in %s has invalid circuit_breakers, %v", i, path, err)
+			}
+			if err := r.circuitBreakers.Validate(); err != nil {
+				return nil, fmt.Errorf("backend rule %d in %s has invalid circuit_breakers, %v", i, path, err)
+			}
+		}
+		if r.RateLimit != nil {
+			if r.Selector == "" {
+				return nil, fmt.Errorf("backend rule %d in %s has rate_limit, which needs a selector", i, path)
+			}
+			fillInterval := time.Second
+			if r.RateLimit.FillInterval != "" {
+				if fillInterval, err = time.ParseDuration(r.RateLimit.FillInterval); err != nil {
+					return nil, fmt.Errorf("backend rule %d in %s has invalid rate_limit, %v", i, path, err)
+				}
+			}
+			if r.rateLimit, err = makeRateLimitRule(r.RateLimit.MaxTokens, r.RateLimit.TokensPerFill, fillInterval, r.RateLimit.Key); err != nil {
+				return nil, fmt.Errorf("backend rule %d in %s has invalid rate_limit, %v", i, path, err)
+			}
+		}
+		if len(r.RetryPolicy) > 0 {
+			r.retryPolicy = new(routepb.RetryPolicy)
+			if err := jsonpb.Unmarshal(bytes.NewReader(r.RetryPolicy), r.retryPolicy); err != nil {
+				return nil, fmt.Errorf("backend rule %d in %s has invalid retry_policy, %v", i, path, err)
+			}
+			if err := validateRetryPolicy(r.retryPolicy); err != nil {
+				return nil, fmt.Errorf("backend rule %d in %s has invalid retry_policy, %v", i, path, err)
+			}
+		}
+	}
+	return file.Rules, nil
+}
+
+func validateRetryPolicy(policy *routepb.RetryPolicy) error {
+	for _, condition := range strings.Split(policy.GetRetryOn(), ",") {
+		if condition = strings.TrimSpace(condition); condition != "" && !retryOnConditions[condition] {
+			return fmt.Errorf("unknown retry_on condition %q", condition)
+		}
+	}
+	return policy.Validate()
+}
+
+// makeFlagRetryPolicy returns the retry policy of the backend flags, or nil
+// if they disable the retries.
+func (s *ServiceInfo) makeFlagRetryPolicy() (*routepb.RetryPolicy, error) {
+	if s.Options.BackendRetryOn == "" && s.Options.BackendRetriableStatusCodes == "" {
+		return nil, nil
+	}
+	if s.Options.BackendRetryNumRetries < 0 {
+		return nil, fmt.Errorf("backend_retry_num_retries cannot be negative, got %d", s.Options.BackendRetryNumRetries)
+	}
+	if s.Options.BackendRetryPerTryTimeout < 0 {
+		return nil, fmt.Errorf("backend_retry_per_try_timeout cannot be negative, got %v", s.Options.BackendRetryPerTryTimeout)
+	}
+
+	policy := &routepb.RetryPolicy{
+		RetryOn:    s.Options.BackendRetryOn,
+		NumRetries: &wrapperspb.UInt32Value{Value: uint32(s.Options.BackendRetryNumRetries)},
+	}
+	if s.Options.BackendRetryPerTryTimeout > 0 {
+		policy.PerTryTimeout = ptypes.DurationProto(s.Options.BackendRetryPerTryTimeout)
+	}
+	if s.Options.BackendRetriableStatusCodes != "" {
+		for _, c := range strings.Split(s.Options.BackendRetriableStatusCodes, ",") {
+			code, err := strconv.ParseUint(strings.TrimSpace(c), 10, 32)
+			if err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("invalid HTTP status code %q in backend_retriable_status_codes", c)
+			}
+			policy.RetriableStatusCodes = append(policy.RetriableStatusCodes, uint32(code))
+		}
+		// The status codes are only retried with this condition.
+		if !strings.Contains(policy.RetryOn, "retriable-status-codes") {
+			policy.RetryOn = strings.TrimPrefix(policy.RetryOn+",retriable-status-codes", ",")
+		}
+	}
+	if err := validateRetryPolicy(policy); err != nil {
+		return nil, fmt.Errorf("invalid backend retry flags, %v", err)
+	}
+	return policy, nil
+}
+
+// processBackendRetryPolicies sets the retry policies of the methods with a
+// backend, and of the catch-all route. The retry policy of a method is the one
+// of the most specific rule matching its selector in --backend_rules_path,
+// or the one of the rule of its backend address, or the one of the flags.
+// The catch-all route serves all the methods, so only "*" matches it.
+func (s *ServiceInfo) processBackendRetryPolicies() error {
+	flagPolicy, err := s.makeFlagRetryPolicy()
+	if err != nil {
+		return err
+	}
+	rules := s.localBackendRules
+	hasRetryPolicy := func(r *localBackendRule) bool { return r.RetryPolicy != nil }
+
+	retryPolicy := func(selector, address string) *routepb.RetryPolicy {
+		if r := matchSelectorRule(rules, selector, hasRetryPolicy); r != nil {
+			return r.retryPolicy
+		}
+		policy := flagPolicy
+		for _, r := range rules {
+			if r.address == address && r.RetryPolicy != nil {
+				policy = r.retryPolicy
+			}
+		}
+		return policy
+	}
+
+	catchAllAddress := fmt.Sprintf("%v:%v", s.CatchAllBackend.Hostname, s.CatchAllBackend.Port)
+	s.CatchAllRetryPolicy = retryPolicy("*", catchAllAddress)
+	matched := make(map[*localBackendRule]bool)
+	for selector, method := range s.Methods {
+		if r := matchSelectorRule(rules, selector, hasRetryPolicy); r != nil {
+			matched[r] = true
+		}
+		if method.BackendInfo != nil {
+			method.RetryPolicy = retryPolicy(selector, method.BackendInfo.ClusterName)
+		}
+	}
+	for _, r := range rules {
+		if r.Selector != "" && r.RetryPolicy != nil && !strings.HasSuffix(r.Selector, "*") && !matched[r] {
+			glog.Warningf("selector %s of the backend rules file %s does not match any method of service %s", r.Selector, s.Options.BackendRulesPath, s.Name)
+		}
+	}
+	return nil
+}
+
+// matchSelectorRule returns the most specific rule with the setting matching
+// the selector: the one of the method name, of the longest prefix, or of "*".
+// The later one wins the ties.
+func matchSelectorRule(rules []*localBackendRule, selector string, hasSetting func(r *localBackendRule) bool) *localBackendRule {
+	var best *localBackendRule
+	bestLen := -1
+	for _, r := range rules {
+		if r.Selector == "" || !hasSetting(r) {
+			continue
+		}
+		var matchLen int
+		switch {
+		case r.Selector == selector:
+			matchLen = len(selector) + 1
+		case r.Selector == "*":
+			matchLen = 0
+		case strings.HasSuffix(r.Selector, ".*") && strings.HasPrefix(selector, strings.TrimSuffix(r.Selector, "*")):
+			matchLen = len(r.Selector) - 1
+		default:
+			continue
+		}
+		if matchLen >= bestLen {
+			best, bestLen = r, matchLen
+		}
+	}
+	return best
+}
+
+// processWeightedBackends splits the requests of the methods with the
+// weighted_backends of their selectors in --backend_rules_path among the
+// clusters of the backends. The path translation, the deadline and the JWT
+// audience of a method come from its backend rule in the service config, so
+// all the backends have the same path. The method must have a backend rule
+// with an address, otherwise its weighted routes would replace the catch-all
+// route of the other methods.
+func (s *ServiceInfo) processWeightedBackends() error {
+	for _, r := range s.localBackendRules {
+		if len(r.WeightedBackends) == 0 {
+			continue
+		}
+		method, ok := s.Methods[r.Selector]
+		if !ok {
+			glog.Warningf("selector %s of the weighted backends in %s does not match any method of service %s", r.Selector, s.Options.BackendRulesPath, s.Name)
+			continue
+		}
+
+		if method.BackendInfo == nil {
+			return fmt.Errorf("weighted backends of selector %s need a backend rule with an address in the service config", r.Selector)
+		}
+
+		var weightedClusters []*WeightedCluster
+		for _, b := range r.WeightedBackends {
+			scheme, hostname, port, uri, err := util.ParseURI(b.Address)
+			if err != nil {
+				return err
+			}
+			if uri != method.BackendInfo.Uri && !(uri == "" && method.BackendInfo.Uri == "/") {
+				return fmt.Errorf("weighted backend %s of selector %s must have the path %q of its backend rule", b.Address, r.Selector, method.BackendInfo.Uri)
+			}
+
+			clusterName, err := s.addBackendRoutingCluster(scheme, hostname, port, b.Protocol)
+			if err != nil {
+				return fmt.Errorf("invalid weighted backend %s of selector %s, %v", b.Address, r.Selector, err)
+			}
+			weightedClusters = append(weightedClusters, &WeightedCluster{
+				ClusterName: clusterName,
+				Weight:      b.Weight,
+			})
+		}
+		method.BackendInfo.WeightedClusters = weightedClusters
+	}
+	return nil
+}
+
+// BackendLbPolicies are the load balancing policies of the backend clusters
+// by their names in --backend_lb_policy.
+var BackendLbPolicies = map[string]v2pb.Cluster_LbPolicy{
+	"round_robin":   v2pb.Cluster_ROUND_ROBIN,
+	"least_request": v2pb.Cluster_LEAST_REQUEST,
+	"ring_hash":     v2pb.Cluster_RING_HASH,
+	"random":        v2pb.Cluster_RANDOM,
+}
+
+// processBackendEndpoints sets the hosts of the backend clusters, the
+// catch-all one or the ones of dynamic routing, from the endpoints of the
+// rules of their backend addresses in --backend_rules_path. The requests are
+// balanced among the hosts by --backend_lb_policy.
+func (s *ServiceInfo) processBackendEndpoints() error {
+	if _, ok := BackendLbPolicies[s.Options.BackendLbPolicy]; !ok {
+		return fmt.Errorf("invalid backend_lb_policy: %s, only round_robin, least_request, ring_hash or random are valid", s.Options.BackendLbPolicy)
+	}
+	return s.applyBackendRules("endpoints",
+		func(r *localBackendRule) bool { return len(r.endpoints) > 0 },
+		func(r *localBackendRule, c *BackendRoutingCluster) error {
+			c.Endpoints = r.endpoints
+			return nil
+		})
+}
+
+// backendClusters returns the backend clusters, the catch-all one and the
+// ones of dynamic routing.
+func (s *ServiceInfo) backendClusters() []*BackendRoutingCluster {
+	return append([]*BackendRoutingCluster{s.CatchAllBackend}, s.BackendRoutingClusters...)
+}
+
+// applyBackendRules calls apply with each rule of --backend_rules_path which
+// has the config, and each backend cluster matching its backend address, in
+// the order of the rules. The rules which match no backend of the service are
+// logged as warnings.
+func (s *ServiceInfo) applyBackendRules(config string, hasConfig func(r *localBackendRule) bool, apply func(r *localBackendRule, c *BackendRoutingCluster) error) error {
+	clusters := s.backendClusters()
+	for _, r := range s.localBackendRules {
+		if !hasConfig(r) {
+			continue
+		}
+		matched := false
+		for _, c := range clusters {
+			if fmt.Sprintf("%v:%v", c.Hostname, c.Port) != r.address {
+				continue
+			}
+			matched = true
+			if err := apply(r, c); err != nil {
+				return err
+			}
+		}
+		if !matched {
+			glog.Warningf("backend %s of the %s in %s does not match any backend of service %s", r.Backend, config, s.Options.BackendRulesPath, s.Name)
+		}
+	}
+	return nil
+}
+
+// makeFlagHealthCheck returns the active health check of the backend flags
+// for a cluster, or nil if they disable it. The gRPC health check needs an
+// HTTP/2 cluster, so the other clusters have none.
+func (s *ServiceInfo) makeFlagHealthCheck(c *BackendRoutingCluster) (*corepb.HealthCheck, error) {
+	isHttp2 := c.Protocol == util.GRPC || c.Protocol == util.HTTP2
+	hc := &corepb.HealthCheck{
+		Timeout:            ptypes.DurationProto(s.Options.BackendHealthCheckTimeout),
+		Interval:           ptypes.DurationProto(s.Options.BackendHealthCheckInterval),
+		HealthyThreshold:   &wrapperspb.UInt32Value{Value: uint32(s.Options.BackendHealthCheckHealthyThreshold)},
+		UnhealthyThreshold: &wrapperspb.UInt32Value{Value: uint32(s.Options.BackendHealthCheckUnhealthyThreshold)},
+	}
+	switch s.Options.BackendHealthCheckProtocol {
+	case "":
+		return nil, nil
+	case "http":
+		// The host header is the cluster name by default.
+		httpHealthCheck := &corepb.HealthCheck_HttpHealthCheck{
+			Host: c.Hostname,
+			Path: s.Options.BackendHealthCheckPath,
+		}
+		if isHttp2 {
+			httpHealthCheck.CodecClientType = typepb.CodecClientType_HTTP2
+		}
+		hc.HealthChecker = &corepb.HealthCheck_HttpHealthCheck_{
+			HttpHealthCheck: httpHealthCheck,
+		}
+	case "grpc":
+		if !isHttp2 {
+			glog.Warningf("backend %s:%d is not HTTP/2, it has no gRPC health check", c.Hostname, c.Port)
+			return nil, nil
+		}
+		hc.HealthChecker = &corepb.HealthCheck_GrpcHealthCheck_{
+			GrpcHealthCheck: &corepb.HealthCheck_GrpcHealthCheck{},
+		}
+	default:
+		return nil, fmt.Errorf("invalid backend_health_check_protocol: %s, only http or grpc are valid", s.Options.BackendHealthCheckProtocol)
+	}
+	if s.Options.BackendHealthCheckHealthyThreshold < 1 || s.Options.BackendHealthCheckUnhealthyThreshold < 1 {
+		return nil, fmt.Errorf("backend health check thresholds must be positive, got %d and %d", s.Options.BackendHealthCheckHealthyThreshold, s.Options.BackendHealthCheckUnhealthyThreshold)
+	}
+	if err := hc.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid backend health check flags, %v", err)
+	}
+	return hc, nil
+}
+
+// makeFlagOutlierDetection returns the outlier detection of the backend
+// flags, or nil if they disable it.
+func (s *ServiceInfo) makeFlagOutlierDetection() (*clusterpb.OutlierDetection, error) {
+	if s.Options.BackendOutlierDetectionConsecutive5xx == 0 {
+		return nil, nil
+	}
+	if s.Options.BackendOutlierDetectionConsecutive5xx < 0 {
+		return nil, fmt.Errorf("backend_outlier_detection_consecutive_5xx cannot be negative, got %d", s.Options.BackendOutlierDetectionConsecutive5xx)
+	}
+	od := &clusterpb.OutlierDetection{
+		Consecutive_5Xx:  &wrapperspb.UInt32Value{Value: uint32(s.Options.BackendOutlierDetectionConsecutive5xx)},
+		BaseEjectionTime: ptypes.DurationProto(s.Options.BackendOutlierDetectionBaseEjectionTime),
+	}
+	if err := od.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid backend outlier detection flags, %v", err)
+	}
+	return od, nil
+}
+
+// processBackendHealthChecks sets the active health checks and the outlier
+// detection of the backend clusters, the catch-all one and the ones of
+// dynamic routing, from the rules of their backend addresses in
+// --backend_rules_path, or from the flags.
+func (s *ServiceInfo) processBackendHealthChecks() error {
+	flagOutlierDetection, err := s.makeFlagOutlierDetection()
+	if err != nil {
+		return err
+	}
+	for _, c := range s.backendClusters() {
+		if c.HealthCheck, err = s.makeFlagHealthCheck(c); err != nil {
+			return err
+		}
+		c.OutlierDetection = flagOutlierDetection
+	}
+
+	return s.applyBackendRules("health checks",
+		func(r *localBackendRule) bool { return r.healthCheck != nil || r.outlierDetection != nil },
+		func(r *localBackendRule, c *BackendRoutingCluster) error {
+			if r.healthCheck != nil {
+				if r.healthCheck.GetGrpcHealthCheck() != nil && c.Protocol != util.GRPC && c.Protocol != util.HTTP2 {
+					return fmt.Errorf("backend %s of %s is not HTTP/2, it cannot have a gRPC health check", r.Backend, s.Options.BackendRulesPath)
+				}
+				c.HealthCheck = r.healthCheck
+			}
+			if r.outlierDetection != nil {
+				c.OutlierDetection = r.outlierDetection
+			}
+			return nil
+		})
+}
+
+// makeFlagCircuitBreakers returns the circuit breakers of the backend flags,
+// or nil if they keep the Envoy defaults.
+func (s *ServiceInfo) makeFlagCircuitBreakers() (*clusterpb.CircuitBreakers, error) {
+	thresholds := &clusterpb.CircuitBreakers_Thresholds{}
+	for _, limit := range []struct {
+		flag  string
+		value int
+		field **wrapperspb.UInt32Value
+	}{
+		{"backend_max_connections", s.Options.BackendMaxConnections, &thresholds.MaxConnections},
+		{"backend_max_pending_requests", s.Options.BackendMaxPendingRequests, &thresholds.MaxPendingRequests},
+		{"backend_max_requests", s.Options.BackendMaxRequests, &thresholds.MaxRequests},
+		{"backend_max_retries", s.Options.BackendMaxRetries, &thresholds.MaxRetries},
+	} {
+		if limit.value < 0 {
+			return nil, fmt.Errorf("%s cannot be negative, got %d", limit.flag, limit.value)
+		}
+		if limit.value > 0 {
+			*limit.field = &wrapperspb.UInt32Value{Value: uint32(limit.value)}
+		}
+	}
+	if proto.Equal(thresholds, &clusterpb.CircuitBreakers_Thresholds{}) {
+		return nil, nil
+	}
+	return &clusterpb.CircuitBreakers{
+		Thresholds: []*clusterpb.CircuitBreakers_Thresholds{thresholds},
+	}, nil
+}
+
+// processBackendCircuitBreakers sets the circuit breakers and the maximum
+// requests per connection of the backend clusters, the catch-all one and the
+// ones of dynamic routing, from the rules of their backend addresses in
+// --backend_rules_path, or from the flags.
+func (s *ServiceInfo) processBackendCircuitBreakers() error {
+	flagCircuitBreakers, err := s.makeFlagCircuitBreakers()
+	if err != nil {
+		return err
+	}
+	if s.Options.BackendMaxRequestsPerConnection < 0 {
+		return fmt.Errorf("backend_max_requests_per_connection cannot be negative, got %d", s.Options.BackendMaxRequestsPerConnection)
+	}
+	for _, c := range s.backendClusters() {
+		c.CircuitBreakers = flagCircuitBreakers
+		c.MaxRequestsPerConnection = uint32(s.Options.BackendMaxRequestsPerConnection)
+	}
+
+	return s.applyBackendRules("circuit breakers",
+		func(r *localBackendRule) bool { return r.circuitBreakers != nil || r.MaxRequestsPerConnection > 0 },
+		func(r *localBackendRule, c *BackendRoutingCluster) error {
+			if r.circuitBreakers != nil {
+				c.CircuitBreakers = r.circuitBreakers
+			}
+			if r.MaxRequestsPerConnection > 0 {
+				c.MaxRequestsPerConnection = r.MaxRequestsPerConnection
+			}
+			return nil
+		})
+}
+
+var headerNameRegexp = regexp.MustCompile("^[0-9A-Za-z!#$%&'*+.^_`|~-]+$")
+
+// makeRateLimitRule returns the local rate limit of a method without its
+// operation, and without the locations of its API key, which depend on the
+// method.
+func makeRateLimitRule(maxTokens, tokensPerFill uint32, fillInterval time.Duration, key string) (*lrlpb.RateLimitRule, error) {
+	if maxTokens == 0 {
+		return nil, fmt.Errorf("max_tokens must be positive")
+	}
+	if tokensPerFill == 0 {
+		tokensPerFill = maxTokens
+	}
+	if fillInterval < time.Millisecond {
+		return nil, fmt.Errorf("fill_interval must be 1ms at least, got %v", fillInterval)
+	}
+	rule := &lrlpb.RateLimitRule{
+		TokenBucket: &lrlpb.TokenBucket{
+			MaxTokens:     maxTokens,
+			TokensPerFill: tokensPerFill,
+			FillInterval:  ptypes.DurationProto(fillInterval),
+		},
+	}
+
+	switch {
+	case key == "":
+	case key == "api_key":
+		rule.Key = &lrlpb.RateLimitKey{
+			Key: &lrlpb.RateLimitKey_ApiKey{ApiKey: &lrlpb.ApiKey{}},
+		}
+	case key == "jwt_subject":
+		rule.Key = &lrlpb.RateLimitKey{
+			Key: &lrlpb.RateLimitKey_JwtSubject{JwtSubject: true},
+		}
+	case key == "client_ip":
+		rule.Key = &lrlpb.RateLimitKey{
+			Key: &lrlpb.RateLimitKey_ClientIp{ClientIp: true},
+		}
+	case strings.HasPrefix(key, "header:") && headerNameRegexp.MatchString(strings.TrimPrefix(key, "header:")):
+		rule.Key = &lrlpb.RateLimitKey{
+			Key: &lrlpb.RateLimitKey_Header{Header: strings.ToLower(strings.TrimPrefix(key, "header:"))},
+		}
+	default:
+		return nil, fmt.Errorf("invalid key %q, it must be api_key, jwt_subject, client_ip or header:<name>", key)
+	}
+	return rule, nil
+}
+
+// makeFlagRateLimit returns the local rate limit of the flags, or nil if they
+// disable it.
+func (s *ServiceInfo) makeFlagRateLimit() (*lrlpb.RateLimitRule, error) {
+	if s.Options.LocalRateLimitMaxTokens == 0 {
+		return nil, nil
+	}
+	for name, value := range map[string]int{
+		"local_rate_limit_max_tokens":      s.Options.LocalRateLimitMaxTokens,
+		"local_rate_limit_tokens_per_fill": s.Options.LocalRateLimitTokensPerFill,
+	} {
+		if value < 0 {
+			return nil, fmt.Errorf("%s cannot be negative, got %d", name, value)
+		}
+	}
+	rule, err := makeRateLimitRule(uint32(s.Options.LocalRateLimitMaxTokens), uint32(s.Options.LocalRateLimitTokensPerFill), s.Options.LocalRateLimitFillInterval, s.Options.LocalRateLimitKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local rate limit flags, %v", err)
+	}
+	return rule, nil
+}
+
+// processRateLimits sets the local rate limits of the methods, from the most
+// specific rule matching their selectors in --backend_rules_path, or from the
+// flags. The methods generated by ESPv2, such as the health check and the CORS
+// preflight, are not limited. The API key of a method is in its own locations.
+func (s *ServiceInfo) processRateLimits() error {
+	flagRateLimit, err := s.makeFlagRateLimit()
+	if err != nil {
+		return err
+	}
+	hasRateLimit := func(r *localBackendRule) bool { return r.rateLimit != nil }
+
+	matched := make(map[*localBackendRule]bool)
+	for selector, method := range s.Methods {
+		rateLimit := flagRateLimit
+		if r := matchSelectorRule(s.localBackendRules, selector, hasRateLimit); r != nil {
+			matched[r] = true
+			rateLimit = r.rateLimit
+		}
+		if rateLimit == nil || method.IsGenerated {
+			continue
+		}
+
+		method.RateLimit = proto.Clone(rateLimit).(*lrlpb.RateLimitRule)
+		method.RateLimit.Operation = selector
+		if apiKey := method.RateLimit.GetKey().GetApiKey(); apiKey != nil {
+			apiKey.Locations = method.ApiKeyLocations
+			if len(apiKey.Locations) == 0 {
+				apiKey.Locations = defaultApiKeyLocations()
+			}
+		}
+	}
+	for _, r := range s.localBackendRules {
+		if r.rateLimit != nil && !strings.HasSuffix(r.Selector, "*") && !matched[r] {
+			glog.Warningf("selector %s of the rate limit in %s does not match any method of service %s", r.Selector, s.Options.BackendRulesPath, s.Name)
+		}
+	}
+	return nil
+}
+
+// defaultApiKeyLocations returns the locations of the API key of the methods
+// without their own, the same as the Service Control filter.
+func defaultApiKeyLocations() []*scpb.ApiKeyLocation {
+	return []*scpb.ApiKeyLocation{
+		{Key: &scpb.ApiKeyLocation_Query{Query: util.DefaultApiKeyQueryParamKey}},
+		{Key: &scpb.ApiKeyLocation_Query{Query: util.DefaultApiKeyQueryParamApiKey}},
+		{Key: &scpb.ApiKeyLocation_Header{Header: util.DefaultApiKeyHeader}},
+	}
+}
@@ -0,0 +1,1024 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configinfo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestProcessBackendRetryPolicies(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{Name: "ListShelves"},
+					{Name: "CreateShelf"},
+					{Name: "GetBook"},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector: testApiName + ".ListShelves",
+					Address:  "https://shelves.run.app",
+				},
+				{
+					Selector: testApiName + ".CreateShelf",
+					Address:  "https://shelves.run.app",
+				},
+				{
+					Selector: testApiName + ".GetBook",
+					Address:  "https://books.run.app/v1",
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc         string
+		opts         func(opts *options.ConfigGeneratorOptions)
+		backendRules string
+		// The retry policies in JSON by selector, "" for the catch-all route.
+		wantRetryPolicies map[string]string
+		wantError         string
+	}{
+		{
+			desc: "No retry policy by default",
+			wantRetryPolicies: map[string]string{
+				"":            "",
+				"ListShelves": "",
+				"CreateShelf": "",
+				"GetBook":     "",
+			},
+		},
+		{
+			desc: "Retry policy of the flags for all the routes",
+			opts: func(opts *options.ConfigGeneratorOptions) {
+				opts.BackendRetryOn = "5xx,reset"
+				opts.BackendRetryNumRetries = 3
+				opts.BackendRetryPerTryTimeout = 2 * time.Second
+				opts.BackendRetriableStatusCodes = "409, 429"
+			},
+			wantRetryPolicies: map[string]string{
+				"":            `{"retryOn":"5xx,reset,retriable-status-codes","numRetries":3,"perTryTimeout":"2s","retriableStatusCodes":[409,429]}`,
+				"ListShelves": `{"retryOn":"5xx,reset,retriable-status-codes","numRetries":3,"perTryTimeout":"2s","retriableStatusCodes":[409,429]}`,
+				"GetBook":     `{"retryOn":"5xx,reset,retriable-status-codes","numRetries":3,"perTryTimeout":"2s","retriableStatusCodes":[409,429]}`,
+			},
+		},
+		{
+			desc:         "Wildcard which is not the last segment of a selector",
+			backendRules: "rules:\n- selector: endpoints.examples.bookstore.Bookstore.Create*\n  retry_policy: {retry_on: 5xx}\n",
+			wantError:    `invalid selector "endpoints.examples.bookstore.Bookstore.Create*"`,
+		},
+		{
+			desc: "Most specific selector wins over the backend address",
+			opts: func(opts *options.ConfigGeneratorOptions) {
+				opts.BackendRetryOn = "connect-failure"
+			},
+			backendRules: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.*
+  retry_policy:
+    retry_on: 5xx
+    num_retries: 2
+- selector: endpoints.examples.bookstore.Bookstore.CreateShelf
+  retry_policy:
+    num_retries: 0
+- backend: https://books.run.app
+  retry_policy: {retry_on: reset, per_try_timeout: 1.5s}
+- backend: http://127.0.0.1:8082
+  retry_policy: {retry_on: refused-stream}
+`,
+			wantRetryPolicies: map[string]string{
+				"":            `{"retryOn":"refused-stream"}`,
+				"ListShelves": `{"retryOn":"5xx","numRetries":2}`,
+				"CreateShelf": `{"numRetries":0}`,
+				"GetBook":     `{"retryOn":"5xx","numRetries":2}`,
+			},
+		},
+		{
+			desc: "Backend address rule in JSON, and a wildcard selector for the catch-all route",
+			backendRules: `{
+  "rules": [
+    {"selector": "*", "retry_policy": {"retry_on": "unavailable"}},
+    {"backend": "https://books.run.app:443", "retry_policy": {"retry_on": "reset", "per_try_timeout": "1.5s"}}
+  ]
+}`,
+			wantRetryPolicies: map[string]string{
+				"":            `{"retryOn":"unavailable"}`,
+				"ListShelves": `{"retryOn":"unavailable"}`,
+				"GetBook":     `{"retryOn":"unavailable"}`,
+			},
+		},
+		{
+			desc: "Backend address rule",
+			backendRules: `
+rules:
+- backend: https://books.run.app:443
+  retry_policy: {retry_on: reset, per_try_timeout: 1.5s}
+`,
+			wantRetryPolicies: map[string]string{
+				"":            "",
+				"ListShelves": "",
+				"GetBook":     `{"retryOn":"reset","perTryTimeout":"1.500s"}`,
+			},
+		},
+		{
+			desc: "Unknown retry_on condition of the flags",
+			opts: func(opts *options.ConfigGeneratorOptions) {
+				opts.BackendRetryOn = "5xx,timeout"
+			},
+			wantError: `unknown retry_on condition "timeout"`,
+		},
+		{
+			desc: "Invalid status code of the flags",
+			opts: func(opts *options.ConfigGeneratorOptions) {
+				opts.BackendRetriableStatusCodes = "503,5xx"
+			},
+			wantError: `invalid HTTP status code "5xx"`,
+		},
+		{
+			desc:         "Rule without a selector or a backend",
+			backendRules: "rules:\n- retry_policy: {retry_on: 5xx}\n",
+			wantError:    "backend rule 0 in",
+		},
+		{
+			desc:         "Unknown field of a rule",
+			backendRules: "rules:\n- selector: '*'\n  retry: {retry_on: 5xx}\n",
+			wantError:    `unknown field "retry"`,
+		},
+		{
+			desc:         "Unknown field of a retry policy",
+			backendRules: "rules:\n- selector: '*'\n  retry_policy: {retry_count: 5}\n",
+			wantError:    "has invalid retry_policy",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "backend_rules_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		if tc.opts != nil {
+			tc.opts(&opts)
+		}
+		if tc.backendRules != "" {
+			opts.BackendRulesPath = filepath.Join(dir, "backend_rules.yaml")
+			if err := ioutil.WriteFile(opts.BackendRulesPath, []byte(tc.backendRules), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test Desc(%d): %s, got error: %v, want: %v", i, tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test Desc(%d): %s, got error: %v", i, tc.desc, err)
+			continue
+		}
+
+		for selector, want := range tc.wantRetryPolicies {
+			policy := s.CatchAllRetryPolicy
+			if selector != "" {
+				policy = s.Methods[testApiName+"."+selector].RetryPolicy
+			}
+			if want == "" {
+				if policy != nil {
+					t.Errorf("Test Desc(%d): %s, got retry policy of %q: %v, want none", i, tc.desc, selector, policy)
+				}
+				continue
+			}
+			got, err := util.ProtoToJson(policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.JsonEqual(want, got); err != nil {
+				t.Errorf("Test Desc(%d): %s, retry policy of %q: %v", i, tc.desc, selector, err)
+			}
+		}
+	}
+}
+
+func TestProcessWeightedBackends(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{Name: "ListShelves"},
+					{Name: "GetBook"},
+					{Name: "CreateShelf"},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector: testApiName + ".ListShelves",
+					Address:  "https://shelves.run.app/v1",
+					Deadline: 10,
+				},
+				{
+					Selector:        testApiName + ".GetBook",
+					Address:         "grpcs://books.run.app",
+					PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc         string
+		backendRules string
+		// The backend info of the methods by selector, with the weighted
+		// clusters.
+		wantBackendInfos map[string]*backendInfo
+		wantClusters     []*BackendRoutingCluster
+		wantError        string
+	}{
+		{
+			desc: "Weighted backends of the methods with backend rules",
+			backendRules: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  weighted_backends:
+  - {address: "https://shelves.run.app/v1", weight: 95}
+  - {address: "https://shelves-canary.run.app/v1", weight: 5, protocol: h2}
+- selector: endpoints.examples.bookstore.Bookstore.GetBook
+  weighted_backends:
+  - {address: "grpcs://books.run.app", weight: 1}
+  - {address: "grpc://books-canary.internal:8080", weight: 1}
+`,
+			wantBackendInfos: map[string]*backendInfo{
+				"ListShelves": {
+					ClusterName:     "shelves.run.app:443",
+					Uri:             "/v1",
+					Hostname:        "shelves.run.app",
+					TranslationType: confpb.BackendRule_PATH_TRANSLATION_UNSPECIFIED,
+					JwtAudience:     "https://shelves.run.app",
+					Deadline:        10 * time.Second,
+					WeightedClusters: []*WeightedCluster{
+						{ClusterName: "shelves.run.app:443", Weight: 95},
+						{ClusterName: "shelves-canary.run.app:443", Weight: 5},
+					},
+				},
+				"GetBook": {
+					ClusterName:     "books.run.app:443",
+					Hostname:        "books.run.app",
+					TranslationType: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+					JwtAudience:     "https://books.run.app",
+					Deadline:        util.DefaultResponseDeadline,
+					WeightedClusters: []*WeightedCluster{
+						{ClusterName: "books.run.app:443", Weight: 1},
+						{ClusterName: "books-canary.internal:8080", Weight: 1},
+					},
+				},
+			},
+			wantClusters: []*BackendRoutingCluster{
+				{ClusterName: "shelves.run.app:443", Hostname: "shelves.run.app", Port: 443, UseTLS: true, Protocol: util.HTTP1},
+				{ClusterName: "books.run.app:443", Hostname: "books.run.app", Port: 443, UseTLS: true, Protocol: util.GRPC},
+				{ClusterName: "shelves-canary.run.app:443", Hostname: "shelves-canary.run.app", Port: 443, UseTLS: true, Protocol: util.HTTP2},
+				{ClusterName: "books-canary.internal:8080", Hostname: "books-canary.internal", Port: 8080, UseTLS: false, Protocol: util.GRPC},
+			},
+		},
+		{
+			desc: "Weighted backends with another path than the backend rule",
+			backendRules: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  weighted_backends:
+  - {address: "https://shelves.run.app/v1", weight: 95}
+  - {address: "https://shelves-canary.run.app/v2", weight: 5}
+`,
+			wantError: `weighted backend https://shelves-canary.run.app/v2 of selector endpoints.examples.bookstore.Bookstore.ListShelves must have the path "/v1" of its backend rule`,
+		},
+		{
+			desc:         "Weighted backends in JSON with numeric weights",
+			backendRules: `{"rules": [{"selector": "endpoints.examples.bookstore.Bookstore.GetBook", "weighted_backends": [{"address": "grpcs://books.run.app", "weight": 3}, {"address": "grpcs://books-canary.run.app", "weight": 1}]}]}`,
+			wantBackendInfos: map[string]*backendInfo{
+				"GetBook": {
+					ClusterName:     "books.run.app:443",
+					Hostname:        "books.run.app",
+					TranslationType: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+					JwtAudience:     "https://books.run.app",
+					Deadline:        util.DefaultResponseDeadline,
+					WeightedClusters: []*WeightedCluster{
+						{ClusterName: "books.run.app:443", Weight: 3},
+						{ClusterName: "books-canary.run.app:443", Weight: 1},
+					},
+				},
+			},
+			wantClusters: []*BackendRoutingCluster{
+				{ClusterName: "shelves.run.app:443", Hostname: "shelves.run.app", Port: 443, UseTLS: true, Protocol: util.HTTP1},
+				{ClusterName: "books.run.app:443", Hostname: "books.run.app", Port: 443, UseTLS: true, Protocol: util.GRPC},
+				{ClusterName: "books-canary.run.app:443", Hostname: "books-canary.run.app", Port: 443, UseTLS: true, Protocol: util.GRPC},
+			},
+		},
+		{
+			desc:         "Weighted backends of a method without a backend rule",
+			backendRules: "rules:\n- selector: endpoints.examples.bookstore.Bookstore.CreateShelf\n  weighted_backends: [{address: 'https://a.run.app', weight: 1}]\n",
+			wantError:    "weighted backends of selector endpoints.examples.bookstore.Bookstore.CreateShelf need a backend rule with an address in the service config",
+		},
+		{
+			desc:         "Weighted backends of a wildcard selector",
+			backendRules: "rules:\n- selector: '*'\n  weighted_backends: [{address: 'https://a.run.app', weight: 1}]\n",
+			wantError:    "has weighted_backends, which need the selector of a method",
+		},
+		{
+			desc:         "Weighted backends without any weight",
+			backendRules: "rules:\n- selector: a.b\n  weighted_backends: [{address: 'https://a.run.app'}]\n",
+			wantError:    "has weighted_backends without any weight",
+		},
+		{
+			desc:         "Weighted backend with an IP address",
+			backendRules: "rules:\n- selector: endpoints.examples.bookstore.Bookstore.GetBook\n  weighted_backends: [{address: 'http://10.0.0.1:8080', weight: 1}]\n",
+			wantError:    "dynamic routing only supports domain name, got IP address: 10.0.0.1",
+		},
+		{
+			desc:         "Weighted backend with an unknown protocol",
+			backendRules: "rules:\n- selector: endpoints.examples.bookstore.Bookstore.GetBook\n  weighted_backends: [{address: 'https://a.run.app', weight: 1, protocol: h3}]\n",
+			wantError:    "unknown backend http protocol [h3]",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "weighted_backends_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendRulesPath = filepath.Join(dir, "backend_rules.yaml")
+		if err := ioutil.WriteFile(opts.BackendRulesPath, []byte(tc.backendRules), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test Desc(%d): %s, got error: %v, want: %v", i, tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test Desc(%d): %s, got error: %v", i, tc.desc, err)
+			continue
+		}
+
+		for selector, want := range tc.wantBackendInfos {
+			if got := s.Methods[testApiName+"."+selector].BackendInfo; !reflect.DeepEqual(got, want) {
+				t.Errorf("Test Desc(%d): %s, got backend info of %s: %+v, want: %+v", i, tc.desc, selector, got, want)
+			}
+		}
+		if !reflect.DeepEqual(s.BackendRoutingClusters, tc.wantClusters) {
+			t.Errorf("Test Desc(%d): %s, got backend routing clusters: %+v, want: %+v", i, tc.desc, s.BackendRoutingClusters, tc.wantClusters)
+		}
+		if !s.GrpcSupportRequired {
+			t.Errorf("Test Desc(%d): %s, gRPC support is required by the gRPC weighted backends", i, tc.desc)
+		}
+	}
+}
+
+func TestProcessBackendEndpoints(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{Name: "ListShelves"},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector: testApiName + ".ListShelves",
+					Address:  "https://shelves.internal:8443",
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc            string
+		backendAddress  string
+		backendLbPolicy string
+		backendRules    string
+		// The endpoints of the catch-all cluster and of the dynamic routing
+		// cluster, in host:port.
+		wantCatchAllEndpoints []string
+		wantEndpoints         []string
+		wantError             string
+	}{
+		{
+			desc:           "Single backend address",
+			backendAddress: "http://127.0.0.1:8082",
+		},
+		{
+			desc:                  "Several backend addresses",
+			backendAddress:        "http://10.0.0.1:8080, http://10.0.0.2:8081",
+			wantCatchAllEndpoints: []string{"10.0.0.1:8080", "10.0.0.2:8081"},
+		},
+		{
+			desc:           "Several backend addresses with different schemes",
+			backendAddress: "http://10.0.0.1:8080,grpc://10.0.0.2:8081",
+			wantError:      "backend uris must have the same scheme, got http and grpc",
+		},
+		{
+			desc:           "Endpoints of the backend addresses",
+			backendAddress: "http://127.0.0.1:8082",
+			backendRules: `
+rules:
+- backend: http://127.0.0.1:8082
+  endpoints: ["127.0.0.1:8082", "127.0.0.1:8083"]
+- backend: https://shelves.internal:8443
+  endpoints: [shelves-1.internal:8443, "[::1]:8443"]
+`,
+			wantCatchAllEndpoints: []string{"127.0.0.1:8082", "127.0.0.1:8083"},
+			wantEndpoints:         []string{"shelves-1.internal:8443", "::1:8443"},
+		},
+		{
+			desc:            "Invalid lb policy",
+			backendAddress:  "http://127.0.0.1:8082",
+			backendLbPolicy: "maglev",
+			wantError:       "invalid backend_lb_policy: maglev",
+		},
+		{
+			desc:           "Endpoints without a backend address",
+			backendAddress: "http://127.0.0.1:8082",
+			backendRules:   "rules:\n- selector: '*'\n  endpoints: ['127.0.0.1:8082']\n",
+			wantError:      "has endpoints, which need a backend address",
+		},
+		{
+			desc:           "Endpoint without a port",
+			backendAddress: "http://127.0.0.1:8082",
+			backendRules:   "rules:\n- backend: http://127.0.0.1:8082\n  endpoints: ['127.0.0.1']\n",
+			wantError:      `has invalid endpoint "127.0.0.1"`,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "backend_endpoints_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	endpointsToStrings := func(endpoints []*BackendEndpoint) []string {
+		var got []string
+		for _, e := range endpoints {
+			got = append(got, fmt.Sprintf("%v:%v", e.Hostname, e.Port))
+		}
+		return got
+	}
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = tc.backendAddress
+		if tc.backendLbPolicy != "" {
+			opts.BackendLbPolicy = tc.backendLbPolicy
+		}
+		if tc.backendRules != "" {
+			opts.BackendRulesPath = filepath.Join(dir, "backend_rules.yaml")
+			if err := ioutil.WriteFile(opts.BackendRulesPath, []byte(tc.backendRules), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test Desc(%d): %s, got error: %v, want: %v", i, tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test Desc(%d): %s, got error: %v", i, tc.desc, err)
+			continue
+		}
+
+		if got := endpointsToStrings(s.CatchAllBackend.Endpoints); !reflect.DeepEqual(got, tc.wantCatchAllEndpoints) {
+			t.Errorf("Test Desc(%d): %s, got catch-all endpoints: %v, want: %v", i, tc.desc, got, tc.wantCatchAllEndpoints)
+		}
+		if got := endpointsToStrings(s.BackendRoutingClusters[0].Endpoints); !reflect.DeepEqual(got, tc.wantEndpoints) {
+			t.Errorf("Test Desc(%d): %s, got endpoints: %v, want: %v", i, tc.desc, got, tc.wantEndpoints)
+		}
+	}
+}
+
+func TestProcessBackendHealthChecks(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{Name: "ListShelves"},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector: testApiName + ".ListShelves",
+					Address:  "https://shelves.internal:8443",
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                string
+		backendAddress      string
+		healthCheckProtocol string
+		consecutive5xx      int
+		backendRules        string
+		// The health checks and the outlier detections of the catch-all
+		// cluster and of the dynamic routing cluster, in JSON.
+		wantCatchAllHealthCheck      string
+		wantHealthCheck              string
+		wantCatchAllOutlierDetection string
+		wantOutlierDetection         string
+		wantError                    string
+	}{
+		{
+			desc: "Disabled by default",
+		},
+		{
+			desc:                "HTTP health check and outlier detection of the flags",
+			healthCheckProtocol: "http",
+			consecutive5xx:      5,
+			wantCatchAllHealthCheck: `{
+  "timeout": "1s", "interval": "5s", "healthyThreshold": 2, "unhealthyThreshold": 3,
+  "httpHealthCheck": {"host": "127.0.0.1", "path": "/healthz"}
+}`,
+			wantHealthCheck: `{
+  "timeout": "1s", "interval": "5s", "healthyThreshold": 2, "unhealthyThreshold": 3,
+  "httpHealthCheck": {"host": "shelves.internal", "path": "/healthz"}
+}`,
+			wantCatchAllOutlierDetection: `{"consecutive5xx": 5, "baseEjectionTime": "30s"}`,
+			wantOutlierDetection:         `{"consecutive5xx": 5, "baseEjectionTime": "30s"}`,
+		},
+		{
+			desc:                "HTTP health check of a gRPC backend uses HTTP/2",
+			backendAddress:      "grpc://127.0.0.1:8082",
+			healthCheckProtocol: "http",
+			wantCatchAllHealthCheck: `{
+  "timeout": "1s", "interval": "5s", "healthyThreshold": 2, "unhealthyThreshold": 3,
+  "httpHealthCheck": {"host": "127.0.0.1", "path": "/healthz", "codecClientType": "HTTP2"}
+}`,
+			wantHealthCheck: `{
+  "timeout": "1s", "interval": "5s", "healthyThreshold": 2, "unhealthyThreshold": 3,
+  "httpHealthCheck": {"host": "shelves.internal", "path": "/healthz"}
+}`,
+		},
+		{
+			desc:                "gRPC health check only of the HTTP/2 backends",
+			backendAddress:      "grpc://127.0.0.1:8082",
+			healthCheckProtocol: "grpc",
+			wantCatchAllHealthCheck: `{
+  "timeout": "1s", "interval": "5s", "healthyThreshold": 2, "unhealthyThreshold": 3,
+  "grpcHealthCheck": {}
+}`,
+		},
+		{
+			desc:                "Backend rules override the flags",
+			healthCheckProtocol: "http",
+			consecutive5xx:      5,
+			backendRules: `
+rules:
+- backend: https://shelves.internal:8443
+  health_check:
+    timeout: 2s
+    interval: 10s
+    healthy_threshold: 1
+    unhealthy_threshold: 2
+    http_health_check: {path: /ready}
+  outlier_detection: {consecutive_5xx: 3, base_ejection_time: 60s}
+`,
+			wantCatchAllHealthCheck: `{
+  "timeout": "1s", "interval": "5s", "healthyThreshold": 2, "unhealthyThreshold": 3,
+  "httpHealthCheck": {"host": "127.0.0.1", "path": "/healthz"}
+}`,
+			wantHealthCheck: `{
+  "timeout": "2s", "interval": "10s", "healthyThreshold": 1, "unhealthyThreshold": 2,
+  "httpHealthCheck": {"path": "/ready"}
+}`,
+			wantCatchAllOutlierDetection: `{"consecutive5xx": 5, "baseEjectionTime": "30s"}`,
+			wantOutlierDetection:         `{"consecutive5xx": 3, "baseEjectionTime": "60s"}`,
+		},
+		{
+			desc:                "Invalid health check protocol",
+			healthCheckProtocol: "tcp",
+			wantError:           "invalid backend_health_check_protocol: tcp",
+		},
+		{
+			desc:           "Negative consecutive 5xx",
+			consecutive5xx: -1,
+			wantError:      "backend_outlier_detection_consecutive_5xx cannot be negative",
+		},
+		{
+			desc:         "Health check without a backend address",
+			backendRules: "rules:\n- selector: '*'\n  outlier_detection: {consecutive_5xx: 3}\n",
+			wantError:    "has health_check or outlier_detection, which need a backend address",
+		},
+		{
+			desc:         "Health check without a health checker",
+			backendRules: "rules:\n- backend: https://shelves.internal:8443\n  health_check: {timeout: 1s, interval: 5s, healthy_threshold: 1, unhealthy_threshold: 1}\n",
+			wantError:    "has invalid health_check",
+		},
+		{
+			desc:         "gRPC health check of an HTTP/1 backend",
+			backendRules: "rules:\n- backend: https://shelves.internal:8443\n  health_check: {timeout: 1s, interval: 5s, healthy_threshold: 1, unhealthy_threshold: 1, grpc_health_check: {}}\n",
+			wantError:    "it cannot have a gRPC health check",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "backend_health_checks_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		if tc.backendAddress != "" {
+			opts.BackendAddress = tc.backendAddress
+		}
+		opts.BackendHealthCheckProtocol = tc.healthCheckProtocol
+		opts.BackendOutlierDetectionConsecutive5xx = tc.consecutive5xx
+		if tc.backendRules != "" {
+			opts.BackendRulesPath = filepath.Join(dir, "backend_rules.yaml")
+			if err := ioutil.WriteFile(opts.BackendRulesPath, []byte(tc.backendRules), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test Desc(%d): %s, got error: %v, want: %v", i, tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test Desc(%d): %s, got error: %v", i, tc.desc, err)
+			continue
+		}
+
+		checkProtoJson(t, i, tc.desc, "catch-all health check", s.CatchAllBackend.HealthCheck, tc.wantCatchAllHealthCheck)
+		checkProtoJson(t, i, tc.desc, "health check", s.BackendRoutingClusters[0].HealthCheck, tc.wantHealthCheck)
+		checkProtoJson(t, i, tc.desc, "catch-all outlier detection", s.CatchAllBackend.OutlierDetection, tc.wantCatchAllOutlierDetection)
+		checkProtoJson(t, i, tc.desc, "outlier detection", s.BackendRoutingClusters[0].OutlierDetection, tc.wantOutlierDetection)
+	}
+}
+
+func TestProcessBackendCircuitBreakers(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{Name: "ListShelves"},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector: testApiName + ".ListShelves",
+					Address:  "https://shelves.internal:8443",
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc               string
+		maxConnections     int
+		maxPendingRequests int
+		maxRetries         int
+		maxRequestsPerConn int
+		backendRules       string
+		// The circuit breakers of the catch-all cluster and of the dynamic
+		// routing cluster, in JSON.
+		wantCatchAllCircuitBreakers    string
+		wantCircuitBreakers            string
+		wantCatchAllMaxRequestsPerConn uint32
+		wantMaxRequestsPerConn         uint32
+		wantError                      string
+	}{
+		{
+			desc: "Envoy defaults",
+		},
+		{
+			desc:                           "Limits of the flags",
+			maxConnections:                 100,
+			maxPendingRequests:             10,
+			maxRequestsPerConn:             1000,
+			wantCatchAllCircuitBreakers:    `{"thresholds": [{"maxConnections": 100, "maxPendingRequests": 10}]}`,
+			wantCircuitBreakers:            `{"thresholds": [{"maxConnections": 100, "maxPendingRequests": 10}]}`,
+			wantCatchAllMaxRequestsPerConn: 1000,
+			wantMaxRequestsPerConn:         1000,
+		},
+		{
+			desc:           "Backend rules override the flags",
+			maxConnections: 100,
+			backendRules: `
+rules:
+- backend: https://shelves.internal:8443
+  circuit_breakers:
+    thresholds:
+    - {max_requests: 50, max_retries: 1}
+    - {priority: HIGH, max_requests: 100}
+  max_requests_per_connection: 10
+`,
+			wantCatchAllCircuitBreakers: `{"thresholds": [{"maxConnections": 100}]}`,
+			wantCircuitBreakers: `{"thresholds": [
+  {"maxRequests": 50, "maxRetries": 1},
+  {"priority": "HIGH", "maxRequests": 100}
+]}`,
+			wantMaxRequestsPerConn: 10,
+		},
+		{
+			desc:       "Negative limit",
+			maxRetries: -1,
+			wantError:  "backend_max_retries cannot be negative",
+		},
+		{
+			desc:               "Negative max requests per connection",
+			maxRequestsPerConn: -1,
+			wantError:          "backend_max_requests_per_connection cannot be negative",
+		},
+		{
+			desc:         "Circuit breakers without a backend address",
+			backendRules: "rules:\n- selector: '*'\n  max_requests_per_connection: 10\n",
+			wantError:    "has circuit_breakers or max_requests_per_connection, which need a backend address",
+		},
+		{
+			desc:         "Invalid circuit breakers",
+			backendRules: "rules:\n- backend: https://shelves.internal:8443\n  circuit_breakers: {thresholds: [{max_connection: 1}]}\n",
+			wantError:    "has invalid circuit_breakers",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "backend_circuit_breakers_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendMaxConnections = tc.maxConnections
+		opts.BackendMaxPendingRequests = tc.maxPendingRequests
+		opts.BackendMaxRetries = tc.maxRetries
+		opts.BackendMaxRequestsPerConnection = tc.maxRequestsPerConn
+		if tc.backendRules != "" {
+			opts.BackendRulesPath = filepath.Join(dir, "backend_rules.yaml")
+			if err := ioutil.WriteFile(opts.BackendRulesPath, []byte(tc.backendRules), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test Desc(%d): %s, got error: %v, want: %v", i, tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test Desc(%d): %s, got error: %v", i, tc.desc, err)
+			continue
+		}
+
+		checkProtoJson(t, i, tc.desc, "catch-all circuit breakers", s.CatchAllBackend.CircuitBreakers, tc.wantCatchAllCircuitBreakers)
+		checkProtoJson(t, i, tc.desc, "circuit breakers", s.BackendRoutingClusters[0].CircuitBreakers, tc.wantCircuitBreakers)
+		if got := s.CatchAllBackend.MaxRequestsPerConnection; got != tc.wantCatchAllMaxRequestsPerConn {
+			t.Errorf("Test Desc(%d): %s, got catch-all max requests per connection: %v, want: %v", i, tc.desc, got, tc.wantCatchAllMaxRequestsPerConn)
+		}
+		if got := s.BackendRoutingClusters[0].MaxRequestsPerConnection; got != tc.wantMaxRequestsPerConn {
+			t.Errorf("Test Desc(%d): %s, got max requests per connection: %v, want: %v", i, tc.desc, got, tc.wantMaxRequestsPerConn)
+		}
+	}
+}
+
+func TestProcessRateLimits(t *testing.T) {
+	fakeServiceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{Name: "ListShelves"},
+					{Name: "GetBook"},
+				},
+			},
+		},
+		SystemParameters: &confpb.SystemParameters{
+			Rules: []*confpb.SystemParameterRule{
+				{
+					Selector: testApiName + ".GetBook",
+					Parameters: []*confpb.SystemParameter{
+						{
+							Name:       util.ApiKeyParameterName,
+							HttpHeader: "x-book-key",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc            string
+		maxTokens       int
+		tokensPerFill   int
+		fillInterval    time.Duration
+		key             string
+		backendRules    string
+		wantListShelves string
+		wantGetBook     string
+		wantError       string
+	}{
+		{
+			desc: "No rate limit",
+		},
+		{
+			desc:            "Rate limit of the flags",
+			maxTokens:       10,
+			fillInterval:    time.Second,
+			key:             "client_ip",
+			wantListShelves: `{"operation": "endpoints.examples.bookstore.Bookstore.ListShelves", "tokenBucket": {"maxTokens": 10, "tokensPerFill": 10, "fillInterval": "1s"}, "key": {"clientIp": true}}`,
+			wantGetBook:     `{"operation": "endpoints.examples.bookstore.Bookstore.GetBook", "tokenBucket": {"maxTokens": 10, "tokensPerFill": 10, "fillInterval": "1s"}, "key": {"clientIp": true}}`,
+		},
+		{
+			desc:         "Backend rules override the flags",
+			maxTokens:    10,
+			fillInterval: time.Second,
+			backendRules: `
+rules:
+- selector: '*'
+  rate_limit:
+    max_tokens: 100
+    key: api_key
+- selector: endpoints.examples.bookstore.Bookstore.GetBook
+  rate_limit:
+    max_tokens: 5
+    tokens_per_fill: 1
+    fill_interval: 100ms
+    key: header:X-Tenant
+`,
+			wantListShelves: `{
+  "operation": "endpoints.examples.bookstore.Bookstore.ListShelves",
+  "tokenBucket": {"maxTokens": 100, "tokensPerFill": 100, "fillInterval": "1s"},
+  "key": {"apiKey": {"locations": [{"query": "key"}, {"query": "api_key"}, {"header": "x-api-key"}]}}
+}`,
+			wantGetBook: `{
+  "operation": "endpoints.examples.bookstore.Bookstore.GetBook",
+  "tokenBucket": {"maxTokens": 5, "tokensPerFill": 1, "fillInterval": "0.100s"},
+  "key": {"header": "x-tenant"}
+}`,
+		},
+		{
+			desc:         "API key in the locations of the method",
+			backendRules: "rules:\n- selector: endpoints.examples.bookstore.Bookstore.GetBook\n  rate_limit: {max_tokens: 1, key: api_key}\n",
+			wantGetBook: `{
+  "operation": "endpoints.examples.bookstore.Bookstore.GetBook",
+  "tokenBucket": {"maxTokens": 1, "tokensPerFill": 1, "fillInterval": "1s"},
+  "key": {"apiKey": {"locations": [{"header": "x-book-key"}]}}
+}`,
+		},
+		{
+			desc:      "Negative flag",
+			maxTokens: -1,
+			wantError: "local_rate_limit_max_tokens cannot be negative",
+		},
+		{
+			desc:         "Invalid key flag",
+			maxTokens:    10,
+			fillInterval: time.Second,
+			key:          "cookie",
+			wantError:    `invalid local rate limit flags, invalid key "cookie"`,
+		},
+		{
+			desc:         "Fill interval flag below 1ms",
+			maxTokens:    10,
+			fillInterval: time.Microsecond,
+			wantError:    "fill_interval must be 1ms at least",
+		},
+		{
+			desc:         "Rate limit without a selector",
+			backendRules: "rules:\n- backend: https://shelves.run.app\n  rate_limit: {max_tokens: 1}\n",
+			wantError:    "has rate_limit, which needs a selector",
+		},
+		{
+			desc:         "Rate limit without max tokens",
+			backendRules: "rules:\n- selector: '*'\n  rate_limit: {tokens_per_fill: 1}\n",
+			wantError:    "has invalid rate_limit, max_tokens must be positive",
+		},
+		{
+			desc:         "Invalid fill interval",
+			backendRules: "rules:\n- selector: '*'\n  rate_limit: {max_tokens: 1, fill_interval: 1 second}\n",
+			wantError:    "has invalid rate_limit, time: ",
+		},
+		{
+			desc:         "Invalid header name",
+			backendRules: "rules:\n- selector: '*'\n  rate_limit: {max_tokens: 1, key: 'header:x tenant'}\n",
+			wantError:    "has invalid rate_limit, invalid key",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "rate_limits_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.LocalRateLimitMaxTokens = tc.maxTokens
+		opts.LocalRateLimitTokensPerFill = tc.tokensPerFill
+		opts.LocalRateLimitFillInterval = tc.fillInterval
+		opts.LocalRateLimitKey = tc.key
+		if tc.backendRules != "" {
+			opts.BackendRulesPath = filepath.Join(dir, "backend_rules.yaml")
+			if err := ioutil.WriteFile(opts.BackendRulesPath, []byte(tc.backendRules), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test Desc(%d): %s, got error: %v, want: %v", i, tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test Desc(%d): %s, got error: %v", i, tc.desc, err)
+			continue
+		}
+
+		checkProtoJson(t, i, tc.desc, "rate limit of ListShelves", s.Methods[testApiName+".ListShelves"].RateLimit, tc.wantListShelves)
+		checkProtoJson(t, i, tc.desc, "rate limit of GetBook", s.Methods[testApiName+".GetBook"].RateLimit, tc.wantGetBook)
+	}
+}
+
+// checkProtoJson compares the message with the wanted JSON, or with nil if
+// it is empty.
+func checkProtoJson(t *testing.T, i int, desc, name string, got proto.Message, want string) {
+	if want == "" {
+		if !reflect.ValueOf(got).IsNil() {
+			t.Errorf("Test Desc(%d): %s, got %s: %v, want nil", i, desc, name, got)
+		}
+		return
+	}
+	gotJson, err := util.ProtoToJson(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.JsonEqual(want, gotJson); err != nil {
+		t.Errorf("Test Desc(%d): %s, %s: %v", i, desc, name, err)
+	}
+}
@@ -18,7 +18,10 @@ import (
 	"time"
 
 	commonpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/common"
+	lrlpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/local_rate_limit"
+	rldpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/rate_limit_descriptors"
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/service_control"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 )
 
@@ -37,6 +40,13 @@ type methodInfo struct {
 	MetricCosts        []*scpb.MetricCost
 	// All non-unary gRPC methods are considered streaming.
 	IsStreaming bool
+	// The retry policy of the routes to the backend, nil if none is configured.
+	RetryPolicy *routepb.RetryPolicy
+	// The local rate limit of the method, nil if none is configured.
+	RateLimit *lrlpb.RateLimitRule
+	// The descriptors of the method for the rate limit service, nil if it is
+	// not used.
+	RateLimitDescriptor *rldpb.DescriptorRule
 }
 
 // backendInfo stores information from Backend rule for backend rerouting.
@@ -48,4 +58,13 @@ type backendInfo struct {
 	JwtAudience     string
 	// Response timeout for the backend.
 	Deadline time.Duration
+	// The clusters of the weighted backends splitting the requests, which
+	// replace ClusterName if any.
+	WeightedClusters []*WeightedCluster
+}
+
+// WeightedCluster is a cluster of a weighted backend with its weight.
+type WeightedCluster struct {
+	ClusterName string
+	Weight      uint32
 }
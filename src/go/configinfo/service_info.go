@@ -29,7 +29,11 @@ import (
 
 	commonpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/common"
 	pmpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/path_matcher"
+	rldpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/rate_limit_descriptors"
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/service_control"
+	clusterpb "github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
 	durationpb "github.com/golang/protobuf/ptypes/duration"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
@@ -65,6 +69,19 @@ type ServiceInfo struct {
 	GrpcSupportRequired    bool
 	CatchAllBackend        *BackendRoutingCluster
 	BackendRoutingClusters []*BackendRoutingCluster
+	// The retry policy of the catch-all route, nil if none is configured.
+	CatchAllRetryPolicy *routepb.RetryPolicy
+
+	// The other service configs of the service in a traffic percent rollout.
+	// Each of them serves its TrafficPercent of the requests with its own
+	// routes, and the rest of the requests are served by this one.
+	Canaries []*ServiceInfo
+	// The traffic percentage of this service config in a traffic percent
+	// rollout.
+	TrafficPercent float64
+
+	// The rules of the file of --backend_rules_path.
+	localBackendRules []*localBackendRule
 }
 
 type BackendRoutingCluster struct {
@@ -73,6 +90,23 @@ type BackendRoutingCluster struct {
 	Port        uint32
 	UseTLS      bool
 	Protocol    util.BackendProtocol
+	// The hosts balancing the requests of the cluster if it has several, which
+	// replace Hostname and Port. Hostname is still the TLS SNI.
+	Endpoints []*BackendEndpoint
+	// The active health check and the outlier detection of the hosts of the
+	// cluster, nil if disabled.
+	HealthCheck      *corepb.HealthCheck
+	OutlierDetection *clusterpb.OutlierDetection
+	// The limits of the connections and the requests to the cluster, nil or 0
+	// for the Envoy defaults.
+	CircuitBreakers          *clusterpb.CircuitBreakers
+	MaxRequestsPerConnection uint32
+}
+
+// BackendEndpoint is a host of a backend.
+type BackendEndpoint struct {
+	Hostname string
+	Port     uint32
 }
 
 // NewServiceInfoFromServiceConfig returns an instance of ServiceInfo.
@@ -105,16 +139,38 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 	//     used by addGrpcHttpRules
 	// * Methods:
 	//		 set by processApis, processHttpRule, addGrpcHttpRules, processUsageRule
-	//     used by processApiKeyLocations
+	//     used by processApiKeyLocations, processBackendRetryPolicies,
+	//     processRateLimits, processRateLimitDescriptors
+	// * ApiKeyLocations:
+	//     set by processApiKeyLocations
+	//     used by processRateLimits, processRateLimitDescriptors
+	// * BackendInfo of the weighted backends:
+	//     set by processWeightedBackends
+	//     used by processHttpRule for the CORS methods
 	if err := serviceInfo.buildCatchAllBackend(); err != nil {
 		return nil, err
 	}
+	if err := serviceInfo.readLocalBackendRules(); err != nil {
+		return nil, err
+	}
 	serviceInfo.processEndpoints()
 	serviceInfo.processApis()
 	serviceInfo.processQuota()
 	if err := serviceInfo.processBackendRule(); err != nil {
 		return nil, err
 	}
+	if err := serviceInfo.processWeightedBackends(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processBackendEndpoints(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processBackendHealthChecks(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processBackendCircuitBreakers(); err != nil {
+		return nil, err
+	}
 	if err := serviceInfo.processHttpRule(); err != nil {
 		return nil, err
 	}
@@ -131,6 +187,13 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 	if err := serviceInfo.processApiKeyLocations(); err != nil {
 		return nil, err
 	}
+	if err := serviceInfo.processBackendRetryPolicies(); err != nil {
+		return nil, err
+	}
+	if err := serviceInfo.processRateLimits(); err != nil {
+		return nil, err
+	}
+	serviceInfo.processRateLimitDescriptors()
 
 	if err := serviceInfo.processEmptyJwksUriByOpenID(); err != nil {
 		return nil, err
@@ -142,15 +205,36 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 	}
 	sort.Strings(serviceInfo.Operations)
 
+	if err := serviceInfo.processHttpRuleConflicts(); err != nil {
+		return nil, err
+	}
+
 	return serviceInfo, nil
 }
 
 func (s *ServiceInfo) buildCatchAllBackend() error {
-
-	scheme, hostname, port, _, err := util.ParseURI(s.Options.BackendAddress)
+	// The requests are balanced among the addresses separated by comma.
+	addresses := strings.Split(s.Options.BackendAddress, ",")
+	scheme, hostname, port, _, err := util.ParseURI(strings.TrimSpace(addresses[0]))
 	if err != nil {
 		return fmt.Errorf("error parsing backend uri: %v", err)
 	}
+	var endpoints []*BackendEndpoint
+	if len(addresses) > 1 {
+		for _, address := range addresses {
+			epScheme, epHostname, epPort, _, err := util.ParseURI(strings.TrimSpace(address))
+			if err != nil {
+				return fmt.Errorf("error parsing backend uri: %v", err)
+			}
+			if epScheme != scheme {
+				return fmt.Errorf("backend uris must have the same scheme, got %s and %s", scheme, epScheme)
+			}
+			endpoints = append(endpoints, &BackendEndpoint{
+				Hostname: epHostname,
+				Port:     epPort,
+			})
+		}
+	}
 
 	// For local backend, user cannot configure http protocol explicitly.
 	protocol, tls, err := util.ParseBackendProtocol(scheme, "")
@@ -167,6 +251,7 @@ func (s *ServiceInfo) buildCatchAllBackend() error {
 		ClusterName: s.BackendClusterName(),
 		Hostname:    hostname,
 		Port:        port,
+		Endpoints:   endpoints,
 	}
 	return nil
 }
@@ -312,10 +397,16 @@ func addHttpRule(method *methodInfo, r *annotationspb.HttpRule, httpPathWithOpti
 			UriTemplate: r.GetCustom().GetPath(),
 			HttpMethod:  r.GetCustom().GetKind(),
 		}
-		httpPathWithOptionsSet[r.GetCustom().GetPath()] = true
 	default:
 		return fmt.Errorf("unsupported http method %T", r.GetPattern())
 	}
+	template, err := util.ParseUriTemplate(httpRule.UriTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid http rule of selector %s, %v", r.GetSelector(), err)
+	}
+	if _, ok := r.GetPattern().(*annotationspb.HttpRule_Custom); ok {
+		httpPathWithOptionsSet[template.String()] = true
+	}
 	method.HttpRule = append(method.HttpRule, httpRule)
 
 	return nil
@@ -352,9 +443,12 @@ func (s *ServiceInfo) processHttpRule() error {
 			method := s.Methods[r.GetSelector()]
 			for _, httpRule := range method.HttpRule {
 				if httpRule.HttpMethod != "OPTIONS" {
-					if _, exist := httpPathWithOptionsSet[httpRule.UriTemplate]; !exist {
+					// The templates with different variable names match the
+					// same paths, so they share the OPTIONS method.
+					template, _ := util.ParseUriTemplate(httpRule.UriTemplate)
+					if _, exist := httpPathWithOptionsSet[template.String()]; !exist {
 						s.addOptionMethod(method.ApiName, httpRule.UriTemplate, method.BackendInfo)
-						httpPathWithOptionsSet[httpRule.UriTemplate] = true
+						httpPathWithOptionsSet[template.String()] = true
 					}
 
 				}
@@ -364,13 +458,16 @@ func (s *ServiceInfo) processHttpRule() error {
 
 	// Add HttpRule for HealthCheck method
 	if s.Options.Healthz != "" {
-		hcMethod, err := s.getOrCreateMethod("ESPv2.HealthCheck")
+		hcMethod, err := s.getOrCreateMethod(util.HealthCheckOperation)
 		if err != nil {
 			return err
 		}
 		if !strings.HasPrefix(s.Options.Healthz, "/") {
 			s.Options.Healthz = fmt.Sprintf("/%s", s.Options.Healthz)
 		}
+		if _, err := util.ParseUriTemplate(s.Options.Healthz); err != nil {
+			return fmt.Errorf("invalid healthz path, %v", err)
+		}
 
 		hcMethod.HttpRule = append(hcMethod.HttpRule, &commonpb.Pattern{
 			UriTemplate: s.Options.Healthz,
@@ -383,6 +480,59 @@ func (s *ServiceInfo) processHttpRule() error {
 	return nil
 }
 
+// processHttpRuleConflicts checks that no HTTP rules of different selectors
+// have the same HTTP method and path template, including the generated CORS,
+// health check and gRPC methods. Their requests are only routed to one of
+// them, so the service config is rejected unless --allow_conflicting_http_rules.
+// With the flag, only the first selector in the order of the operations, which
+// is the order of the routes, keeps the conflicting HTTP rule, which is
+// dropped from the others, so that neither the Path Matcher filter nor the
+// routes have the same HTTP method and path template twice.
+func (s *ServiceInfo) processHttpRuleConflicts() error {
+	type binding struct {
+		operation string
+		httpRule  *commonpb.Pattern
+	}
+	index := make(map[string][]binding)
+	var conflicts []string
+	for _, operation := range s.Operations {
+		method := s.Methods[operation]
+		var httpRules []*commonpb.Pattern
+		for _, httpRule := range method.HttpRule {
+			template, err := util.ParseUriTemplate(httpRule.UriTemplate)
+			if err != nil {
+				return fmt.Errorf("invalid http rule of selector %s, %v", operation, err)
+			}
+			key := httpRule.HttpMethod + " " + template.String()
+			conflicting := false
+			for _, prev := range index[key] {
+				if prev.operation != operation {
+					conflicts = append(conflicts, fmt.Sprintf("%s %s of selector %s and %s %s of selector %s",
+						prev.httpRule.HttpMethod, prev.httpRule.UriTemplate, prev.operation,
+						httpRule.HttpMethod, httpRule.UriTemplate, operation))
+					conflicting = true
+				}
+			}
+			if conflicting && s.Options.AllowConflictingHttpRules {
+				continue
+			}
+			index[key] = append(index[key], binding{operation: operation, httpRule: httpRule})
+			httpRules = append(httpRules, httpRule)
+		}
+		method.HttpRule = httpRules
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	if s.Options.AllowConflictingHttpRules {
+		for _, conflict := range conflicts {
+			glog.Warningf("conflicting http rules, the second one is dropped: %s", conflict)
+		}
+		return nil
+	}
+	return fmt.Errorf("conflicting http rules: %s", strings.Join(conflicts, "; "))
+}
+
 func (s *ServiceInfo) addOptionMethod(apiName string, path string, backendInfo *backendInfo) {
 	// All options have their operation as the following format: CORS_${suffix}.
 	// Appends ${suffix} to make sure it is not used by any http rules.
@@ -413,43 +563,50 @@ func (s *ServiceInfo) addOptionMethod(apiName string, path string, backendInfo *
 	}
 }
 
-func (s *ServiceInfo) processBackendRule() error {
-	backendRoutingClustersMap := make(map[string]string)
+// addBackendRoutingCluster adds the cluster of a backend address for dynamic
+// routing unless it exists, and returns its name.
+func (s *ServiceInfo) addBackendRoutingCluster(scheme, hostname string, port uint32, httpProtocol string) (string, error) {
+	if net.ParseIP(hostname) != nil {
+		return "", fmt.Errorf("dynamic routing only supports domain name, got IP address: %v", hostname)
+	}
+	address := fmt.Sprintf("%v:%v", hostname, port)
+	for _, c := range s.BackendRoutingClusters {
+		if c.ClusterName == address {
+			return c.ClusterName, nil
+		}
+	}
 
+	protocol, tls, err := util.ParseBackendProtocol(scheme, httpProtocol)
+	if err != nil {
+		return "", err
+	}
+	if protocol == util.GRPC {
+		s.GrpcSupportRequired = true
+	}
+	s.BackendRoutingClusters = append(s.BackendRoutingClusters,
+		&BackendRoutingCluster{
+			ClusterName: address,
+			UseTLS:      tls,
+			Protocol:    protocol,
+			Hostname:    hostname,
+			Port:        port,
+		})
+	return address, nil
+}
+
+func (s *ServiceInfo) processBackendRule() error {
 	for _, r := range s.ServiceConfig().Backend.GetRules() {
 		if r.Address != "" {
 			scheme, hostname, port, uri, err := util.ParseURI(r.Address)
 			if err != nil {
 				return err
 			}
-			if net.ParseIP(hostname) != nil {
-				return fmt.Errorf("dynamic routing only supports domain name, got IP address: %v", hostname)
-			}
 			address := fmt.Sprintf("%v:%v", hostname, port)
-
-			if _, exist := backendRoutingClustersMap[address]; !exist {
-				protocol, tls, err := util.ParseBackendProtocol(scheme, r.Protocol)
-				if err != nil {
-					return err
-				}
-				if protocol == util.GRPC {
-					s.GrpcSupportRequired = true
-				}
-
-				backendSelector := address
-				s.BackendRoutingClusters = append(s.BackendRoutingClusters,
-					&BackendRoutingCluster{
-						ClusterName: backendSelector,
-						UseTLS:      tls,
-						Protocol:    protocol,
-						Hostname:    hostname,
-						Port:        port,
-					})
-				backendRoutingClustersMap[address] = backendSelector
+			clusterName, err := s.addBackendRoutingCluster(scheme, hostname, port, r.Protocol)
+			if err != nil {
+				return err
 			}
 
-			clusterName := backendRoutingClustersMap[address]
-
 			method, err := s.getOrCreateMethod(r.GetSelector())
 			if err != nil {
 				return err
@@ -607,6 +764,27 @@ func (s *ServiceInfo) extractApiKeyLocations(method *methodInfo, parameters []*c
 	method.ApiKeyLocations = append(method.ApiKeyLocations, headerNames...)
 }
 
+// processRateLimitDescriptors sets the descriptors of the methods for the
+// rate limit service, if it is used. Like the local rate limits, the methods
+// generated by ESPv2 are not limited.
+func (s *ServiceInfo) processRateLimitDescriptors() {
+	if s.Options.RateLimitServiceAddress == "" {
+		return
+	}
+	for selector, method := range s.Methods {
+		if method.IsGenerated {
+			continue
+		}
+		method.RateLimitDescriptor = &rldpb.DescriptorRule{
+			Operation:       selector,
+			ApiKeyLocations: method.ApiKeyLocations,
+		}
+		if len(method.ApiKeyLocations) == 0 {
+			method.RateLimitDescriptor.ApiKeyLocations = defaultApiKeyLocations()
+		}
+	}
+}
+
 func (s *ServiceInfo) processTypes() {
 	// Create snake name to JSON name mapping.
 	for _, t := range s.ServiceConfig().GetTypes() {
@@ -21,6 +21,7 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -803,13 +804,13 @@ func TestMethods(t *testing.T) {
 						{
 							Selector: "2.echo_api_endpoints_cloudesf_testing_cloud_goog.Echo_Auth_Jwt",
 							Pattern: &annotationspb.HttpRule_Get{
-								Get: "/auth/info/googlejwt",
+								Get: "/v2/auth/info/googlejwt",
 							},
 						},
 						{
 							Selector: "2.echo_api_endpoints_cloudesf_testing_cloud_goog.Echo",
 							Pattern: &annotationspb.HttpRule_Post{
-								Post: "/echo",
+								Post: "/v2/echo",
 							},
 							Body: "message",
 						},
@@ -843,7 +844,7 @@ func TestMethods(t *testing.T) {
 					ApiName:   "2.echo_api_endpoints_cloudesf_testing_cloud_goog",
 					HttpRule: []*commonpb.Pattern{
 						{
-							UriTemplate: "/echo",
+							UriTemplate: "/v2/echo",
 							HttpMethod:  util.POST,
 						},
 					},
@@ -853,7 +854,7 @@ func TestMethods(t *testing.T) {
 					ApiName:   "2.echo_api_endpoints_cloudesf_testing_cloud_goog",
 					HttpRule: []*commonpb.Pattern{
 						{
-							UriTemplate: "/auth/info/googlejwt",
+							UriTemplate: "/v2/auth/info/googlejwt",
 							HttpMethod:  util.GET,
 						},
 					},
@@ -1115,6 +1116,46 @@ func TestMethods(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "Fail for invalid path template",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: "endpoints.examples.bookstore.Bookstore",
+						Methods: []*apipb.Method{
+							{
+								Name: "GetBook",
+							},
+						},
+					},
+				},
+				Http: &annotationspb.Http{
+					Rules: []*annotationspb.HttpRule{
+						{
+							Selector: "endpoints.examples.bookstore.Bookstore.GetBook",
+							Pattern: &annotationspb.HttpRule_Get{
+								Get: "/v1/shelves/{shelf/books",
+							},
+						},
+					},
+				},
+			},
+			wantError: `invalid http rule of selector endpoints.examples.bookstore.Bookstore.GetBook, invalid path template "/v1/shelves/{shelf/books" at position 13, unterminated variable`,
+		},
+		{
+			desc: "Fail for invalid healthz path",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: []*apipb.Api{
+					{
+						Name: "endpoints.examples.bookstore.Bookstore",
+					},
+				},
+			},
+			healthz:   "/healthz//check",
+			wantError: `invalid healthz path, invalid path template "/healthz//check" at position 9, empty segment`,
+		},
 	}
 
 	for i, tc := range testData {
@@ -1145,6 +1186,146 @@ func TestMethods(t *testing.T) {
 	}
 }
 
+func TestProcessHttpRuleConflicts(t *testing.T) {
+	testData := []struct {
+		desc string
+		// The HTTP rules in "selector METHOD template".
+		httpRules                 []string
+		allowCors                 bool
+		healthz                   string
+		backendAddress            string
+		allowConflictingHttpRules bool
+		wantError                 string
+	}{
+		{
+			desc: "Same path template of the same selector and different HTTP methods do not conflict",
+			httpRules: []string{
+				"ListShelves GET /v1/shelves",
+				"ListShelves GET /v1/{parent=shelves}",
+				"CreateShelf POST /v1/shelves",
+			},
+		},
+		{
+			desc: "Each pair of selectors with the same HTTP method and path template",
+			httpRules: []string{
+				"GetShelf GET /v1/shelves/{shelf}",
+				"GetBook GET /v1/shelves/{id}",
+				"DeleteShelf DELETE /v1/shelves/{shelf}",
+				"ListBooks GET /v1/{parent=shelves/*}",
+			},
+			wantError: "conflicting http rules: " +
+				"GET /v1/shelves/{id} of selector endpoints.examples.bookstore.Bookstore.GetBook and GET /v1/shelves/{shelf} of selector endpoints.examples.bookstore.Bookstore.GetShelf; " +
+				"GET /v1/shelves/{id} of selector endpoints.examples.bookstore.Bookstore.GetBook and GET /v1/{parent=shelves/*} of selector endpoints.examples.bookstore.Bookstore.ListBooks; " +
+				"GET /v1/shelves/{shelf} of selector endpoints.examples.bookstore.Bookstore.GetShelf and GET /v1/{parent=shelves/*} of selector endpoints.examples.bookstore.Bookstore.ListBooks",
+		},
+		{
+			desc: "Conflicts are allowed by the flag",
+			httpRules: []string{
+				"GetShelf GET /v1/shelves/{shelf}",
+				"GetBook GET /v1/shelves/{id}",
+			},
+			allowConflictingHttpRules: true,
+		},
+		{
+			desc: "Conflict with the health check method",
+			httpRules: []string{
+				"Check GET /healthz",
+			},
+			healthz:   "healthz",
+			wantError: "conflicting http rules: GET /healthz of selector ESPv2.HealthCheck and GET /healthz of selector endpoints.examples.bookstore.Bookstore.Check",
+		},
+		{
+			desc: "Conflict with the gRPC method",
+			httpRules: []string{
+				"GetShelf GET /v1/shelves/{shelf}",
+				"CreateShelf POST /endpoints.examples.bookstore.Bookstore/GetShelf",
+			},
+			backendAddress: "grpc://127.0.0.1:80",
+			wantError:      "conflicting http rules: POST /endpoints.examples.bookstore.Bookstore/GetShelf of selector endpoints.examples.bookstore.Bookstore.CreateShelf and POST /endpoints.examples.bookstore.Bookstore/GetShelf of selector endpoints.examples.bookstore.Bookstore.GetShelf",
+		},
+		{
+			desc: "No CORS method is generated for the OPTIONS rule of the same path template with different variables",
+			httpRules: []string{
+				"GetShelf GET /v1/shelves/{shelf}",
+				"CorsShelf OPTIONS /v1/shelves/{id}",
+			},
+			allowCors: true,
+		},
+		{
+			desc: "Conflict with the OPTIONS rule of another selector",
+			httpRules: []string{
+				"GetShelf GET /v1/shelves/{shelf}",
+				"CorsShelf OPTIONS /v1/shelves/{id}",
+				"CorsShelfAlias OPTIONS /v1/shelves/*",
+			},
+			allowCors: true,
+			wantError: "conflicting http rules: OPTIONS /v1/shelves/{id} of selector endpoints.examples.bookstore.Bookstore.CorsShelf and OPTIONS /v1/shelves/* of selector endpoints.examples.bookstore.Bookstore.CorsShelfAlias",
+		},
+		{
+			desc: "The CORS methods of the same path template with different variables do not conflict",
+			httpRules: []string{
+				"GetShelf GET /v1/shelves/{shelf}",
+				"DeleteShelf DELETE /v1/shelves/{id}",
+			},
+			allowCors: true,
+		},
+	}
+
+	for i, tc := range testData {
+		fakeServiceConfig := &confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+				},
+			},
+			Http: &annotationspb.Http{},
+		}
+		if tc.allowCors {
+			fakeServiceConfig.Endpoints = []*confpb.Endpoint{
+				{
+					Name:      testProjectName,
+					AllowCors: true,
+				},
+			}
+		}
+		methods := make(map[string]bool)
+		for _, rule := range tc.httpRules {
+			fields := strings.Fields(rule)
+			if !methods[fields[0]] {
+				methods[fields[0]] = true
+				fakeServiceConfig.Apis[0].Methods = append(fakeServiceConfig.Apis[0].Methods, &apipb.Method{Name: fields[0]})
+			}
+			fakeServiceConfig.Http.Rules = append(fakeServiceConfig.Http.Rules, &annotationspb.HttpRule{
+				Selector: testApiName + "." + fields[0],
+				Pattern: &annotationspb.HttpRule_Custom{
+					Custom: &annotationspb.CustomHttpPattern{
+						Kind: fields[1],
+						Path: fields[2],
+					},
+				},
+			})
+		}
+
+		opts := options.DefaultConfigGeneratorOptions()
+		if tc.backendAddress != "" {
+			opts.BackendAddress = tc.backendAddress
+		}
+		opts.Healthz = tc.healthz
+		opts.AllowConflictingHttpRules = tc.allowConflictingHttpRules
+		_, err := NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
+		if tc.wantError != "" {
+			if err == nil || err.Error() != tc.wantError {
+				t.Errorf("Test Desc(%d): %s, got error: %v, want: %v", i, tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test Desc(%d): %s, got error: %v", i, tc.desc, err)
+		}
+	}
+}
+
 func TestProcessBackendRuleForDeadline(t *testing.T) {
 	testData := []struct {
 		desc              string
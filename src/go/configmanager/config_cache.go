@@ -0,0 +1,106 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// cachedServiceConfig is the last-known-good service config of one service,
+// persisted in the service config cache directory.
+type cachedServiceConfig struct {
+	ServiceName string `json:"serviceName"`
+	ConfigId    string `json:"configId"`
+	RolloutId   string `json:"rolloutId,omitempty"`
+	// The serialized confpb.Service. It is kept in binary format, so that the
+	// Any fields can be read back without knowing their types.
+	ServiceConfig []byte `json:"serviceConfig"`
+}
+
+func cachedServiceConfigPath(cacheDir, serviceName string) string {
+	return filepath.Join(cacheDir, url.PathEscape(serviceName)+".json")
+}
+
+// saveServiceConfig writes the service config to the cache directory. The file
+// is replaced atomically, so a crash never leaves a partial cache behind.
+func saveServiceConfig(cacheDir, serviceName, rolloutId string, serviceConfig *confpb.Service) error {
+	serviceConfigBytes, err := proto.Marshal(serviceConfig)
+	if err != nil {
+		return fmt.Errorf("fail to marshal service config, %v", err)
+	}
+	content, err := json.Marshal(&cachedServiceConfig{
+		ServiceName:   serviceName,
+		ConfigId:      serviceConfig.GetId(),
+		RolloutId:     rolloutId,
+		ServiceConfig: serviceConfigBytes,
+	})
+	if err != nil {
+		return fmt.Errorf("fail to marshal cached service config, %v", err)
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("fail to create service config cache dir %s, %v", cacheDir, err)
+	}
+	tmpFile, err := ioutil.TempFile(cacheDir, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("fail to create service config cache file, %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("fail to write service config cache file, %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("fail to write service config cache file, %v", err)
+	}
+	return os.Rename(tmpFile.Name(), cachedServiceConfigPath(cacheDir, serviceName))
+}
+
+// loadServiceConfig reads the service config and its rollout id from the
+// cache directory.
+func loadServiceConfig(cacheDir, serviceName string) (*confpb.Service, string, error) {
+	path := cachedServiceConfigPath(cacheDir, serviceName)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("fail to read service config cache file %s, %v", path, err)
+	}
+
+	var cached cachedServiceConfig
+	if err := json.Unmarshal(content, &cached); err != nil {
+		return nil, "", fmt.Errorf("fail to unmarshal service config cache file %s, %v", path, err)
+	}
+	if cached.ServiceName != serviceName {
+		return nil, "", fmt.Errorf("service config cache file %s is for service %s, not %s", path, cached.ServiceName, serviceName)
+	}
+
+	serviceConfig := &confpb.Service{}
+	if err := proto.Unmarshal(cached.ServiceConfig, serviceConfig); err != nil {
+		return nil, "", fmt.Errorf("fail to unmarshal service config in cache file %s, %v", path, err)
+	}
+	if serviceConfig.GetId() != cached.ConfigId {
+		return nil, "", fmt.Errorf("service config cache file %s is corrupted, got config id %s, want %s", path, serviceConfig.GetId(), cached.ConfigId)
+	}
+	return serviceConfig, cached.RolloutId, nil
+}
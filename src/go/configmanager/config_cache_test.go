@@ -0,0 +1,263 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/metadata"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	v2pb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestSaveAndLoadServiceConfig(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "service_config_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	sourceFile, err := ptypes.MarshalAny(&smpb.ConfigFile{
+		FilePath:     "api_descriptor.pb",
+		FileContents: []byte("rawDescriptor"),
+		FileType:     smpb.ConfigFile_FILE_DESCRIPTOR_SET_PROTO,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceConfig := &confpb.Service{
+		Name: testProjectName,
+		Id:   testConfigID,
+		Apis: []*apipb.Api{
+			{
+				Name: testEndpointName,
+			},
+		},
+		SourceInfo: &confpb.SourceInfo{
+			SourceFiles: []*anypb.Any{sourceFile},
+		},
+	}
+
+	if _, _, err := loadServiceConfig(cacheDir, testProjectName); err == nil {
+		t.Errorf("loadServiceConfig should fail without a cached service config")
+	}
+
+	if err := saveServiceConfig(cacheDir, testProjectName, "2017-05-01r1", serviceConfig); err != nil {
+		t.Fatal(err)
+	}
+	gotServiceConfig, gotRolloutId, err := loadServiceConfig(cacheDir, testProjectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(gotServiceConfig, serviceConfig) {
+		t.Errorf("loadServiceConfig got service config: %v, want: %v", gotServiceConfig, serviceConfig)
+	}
+	if gotRolloutId != "2017-05-01r1" {
+		t.Errorf("loadServiceConfig got rollout id: %v, want: %v", gotRolloutId, "2017-05-01r1")
+	}
+
+	// The cache file of another service is not used.
+	if err := os.Rename(cachedServiceConfigPath(cacheDir, testProjectName), cachedServiceConfigPath(cacheDir, "echo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadServiceConfig(cacheDir, "echo"); err == nil || !strings.Contains(err.Error(), "is for service") {
+		t.Errorf("loadServiceConfig should reject the cache file of another service, got: %v", err)
+	}
+
+	// A corrupted cache file is not used.
+	if err := ioutil.WriteFile(cachedServiceConfigPath(cacheDir, testProjectName), []byte(`{"serviceName": "`+testProjectName+`", "serviceConfig": "invalid"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadServiceConfig(cacheDir, testProjectName); err == nil {
+		t.Errorf("loadServiceConfig should reject a corrupted cache file")
+	}
+
+	files, err := filepath.Glob(filepath.Join(cacheDir, ".tmp-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("saveServiceConfig left temporary files: %v", files)
+	}
+}
+
+func TestStartFromCachedServiceConfig(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "service_config_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+
+	flag.Set("service", testProjectName)
+	flag.Set("service_config_id", testConfigID)
+	flag.Set("rollout_strategy", util.FixedRolloutStrategy)
+	flag.Set("check_rollout_interval", "100ms")
+	flag.Set("service_json_path", "")
+	flag.Set("service_config_cache_dir", cacheDir)
+	defer flag.Set("service_config_cache_dir", "")
+
+	// Service Management is down, and nothing is cached yet.
+	setFakeConfig([]byte("invalid service config"))
+	mockConfig := initMockConfigServer(t)
+	defer mockConfig.Close()
+	util.FetchConfigURL = func(serviceManagementUrl, serviceName, configId string) string {
+		return mockConfig.URL
+	}
+	if _, err := NewConfigManager(nil, opts); err == nil || !strings.Contains(err.Error(), "no cached one can be used") {
+		t.Fatalf("NewConfigManager should fail without a cached service config, got: %v", err)
+	}
+
+	// The service config is cached once it is applied.
+	config, err := genFakeConfig(makeFakeServiceConfig(testConfigID))
+	if err != nil {
+		t.Fatalf("genFakeConfig failed: %v", err)
+	}
+	setFakeConfig(config)
+	runTest(t, opts, func(env *testEnv) {
+		if _, err := os.Stat(cachedServiceConfigPath(cacheDir, testProjectName)); err != nil {
+			t.Errorf("service config is not cached, %v", err)
+		}
+	})
+
+	// Service Management is down, start from the cached service config.
+	setFakeConfig([]byte("invalid service config"))
+	runTest(t, opts, func(env *testEnv) {
+		ctx := context.Background()
+		req := v2pb.DiscoveryRequest{
+			Node: &corepb.Node{
+				Id: opts.Node,
+			},
+			TypeUrl: cache.ListenerType,
+		}
+		resp, err := env.configManager.cache.Fetch(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Version != testConfigID {
+			t.Errorf("snapshot cache fetch got version: %v, want: %v", resp.Version, testConfigID)
+		}
+		if status := env.configManager.Status(); status.LastError == "" {
+			t.Errorf("the failed initial fetch should be reported in the status, got: %v", status)
+		}
+
+		// Service Management is back, the service config is fetched in the background.
+		config, err := genFakeConfig(strings.Replace(makeFakeServiceConfig(testConfigID), testEndpointName, "endpoints.examples.bookstore.BookstoreV2", 1))
+		if err != nil {
+			t.Fatalf("genFakeConfig failed: %v", err)
+		}
+		setFakeConfig(config)
+		time.Sleep(time.Duration(*checkNewRolloutInterval + time.Second))
+
+		env.configManager.mutex.Lock()
+		defer env.configManager.mutex.Unlock()
+		s := env.configManager.services[0]
+		if s.fromCache {
+			t.Errorf("service config should be fetched after Service Management is back")
+		}
+		if got := s.curServiceConfig.GetApis()[0].GetName(); got != "endpoints.examples.bookstore.BookstoreV2" {
+			t.Errorf("got api name: %v, want the fetched service config", got)
+		}
+	})
+}
+
+func TestInitialFetchDeadline(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "service_config_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	// Both services are cached, and Service Management keeps failing with a
+	// retryable code.
+	serviceNames := []string{testProjectName, "echo.endpoints.project123.cloud.goog"}
+	for i, apiName := range []string{testEndpointName, "endpoints.examples.echo.Echo"} {
+		serviceConfig := &confpb.Service{
+			Name: serviceNames[i],
+			Id:   testConfigID,
+			Apis: []*apipb.Api{
+				{
+					Name: apiName,
+				},
+			},
+		}
+		if err := saveServiceConfig(cacheDir, serviceNames[i], testConfigID, serviceConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mockConfig := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer mockConfig.Close()
+	util.FetchConfigURL = func(serviceManagementUrl, serviceName, configId string) string {
+		return mockConfig.URL
+	}
+	mockMetadataServer := util.InitMockServerFromPathResp(map[string]string{
+		util.AccessTokenSuffix: fakeToken,
+	})
+	defer mockMetadataServer.Close()
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.ServiceManagementInitialFetchDeadline = time.Second
+	opts.ServiceManagementRetryInitialInterval = 50 * time.Millisecond
+	opts.ServiceManagementRetryMaxInterval = 50 * time.Millisecond
+
+	flag.Set("service", strings.Join(serviceNames, ","))
+	flag.Set("service_config_id", testConfigID+","+testConfigID)
+	flag.Set("rollout_strategy", util.FixedRolloutStrategy)
+	flag.Set("check_rollout_interval", "0")
+	flag.Set("service_json_path", "")
+	flag.Set("service_config_cache_dir", cacheDir)
+	defer flag.Set("service", testProjectName)
+	defer flag.Set("service_config_id", testConfigID)
+	defer flag.Set("check_rollout_interval", "60s")
+	defer flag.Set("service_config_cache_dir", "")
+
+	// The deadline is shared by the services, so both of them start from the
+	// cached service configs within one deadline.
+	start := time.Now()
+	manager, err := NewConfigManager(metadata.NewMockMetadataFetcher(mockMetadataServer.URL, time.Now()), opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+	if elapsed := time.Since(start); elapsed > opts.ServiceManagementInitialFetchDeadline+500*time.Millisecond {
+		t.Errorf("the initial fetch took %v, want it within the deadline %v", elapsed, opts.ServiceManagementInitialFetchDeadline)
+	}
+	if status := manager.Status(); status.ConfigId != testConfigID+","+testConfigID {
+		t.Errorf("got config id: %v, want the cached ones", status.ConfigId)
+	}
+}
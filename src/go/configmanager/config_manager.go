@@ -15,18 +15,23 @@
 package configmanager
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/metadata"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/metrics"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/envoyproxy/go-control-plane/pkg/cache"
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	gen "github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
 	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/serviceconfig"
@@ -39,73 +44,280 @@ var (
 	checkNewRolloutInterval = flag.Duration("check_rollout_interval", 60*time.Second, `the interval periodically to call servicemanagment to check the latest rolloutil.`)
 	CheckMetadata           = flag.Bool("check_metadata", false, `enable fetching service name, config ID and rollout strategy from service metadata server`)
 	RolloutStrategy         = flag.String("rollout_strategy", "fixed", `service config rollout strategy, must be either "managed" or "fixed"`)
-	ServiceConfigId         = flag.String("service_config_id", "", "initial service config id")
-	ServiceName             = flag.String("service", "", "endpoint service name")
-	ServicePath             = flag.String("service_json_path", "", `file path to the endpoint service config.
+	MetricsPort             = flag.Int("metrics_port", 0, `port of the Prometheus /metrics endpoint of ConfigManager, served on all interfaces to be scraped. Disabled if 0`)
+	StatusServerPort        = flag.Int("status_server_port", 0, `port of the status server on localhost, serving config ids, rollout ids, last error and the generated Envoy config. Disabled if 0`)
+	ServiceConfigCacheDir   = flag.String("service_config_cache_dir", "", `directory to persist the last applied service configs. When the initial fetch from Service Management fails, ConfigManager starts from the cached ones and keeps retrying in the background`)
+	ServiceConfigId         = flag.String("service_config_id", "", `initial service config id. When multiple services are specified,
+					a comma separated list of config ids in the same order as --service`)
+	ServiceName = flag.String("service", "", `endpoint service name. Multiple services can be served by one
+					proxy with a comma separated list, each of them is matched by its service name or endpoint aliases`)
+	ServicePath = flag.String("service_json_path", "", `file path to the endpoint service config, in JSON or YAML.
+					Multiple services can be served by one proxy with a comma separated list of file paths.
 					When this flag is used, fixed rollout_strategy will be used,
 					GCP metadata server will not be called to fetch access token, and
 					following flags will be ignored; --service_config_id, --service,
 					--rollout_strategy`)
+	OpenAPIPath = flag.String("openapi_path", "", `file path to the OpenAPI 2.0 document in JSON or YAML, translated into the service config
+					the same way as Service Management does. Multiple services can be served by one proxy
+					with a comma separated list of file paths. Service Control is not used for the services.
+					Like --service_json_path, following flags will be ignored; --service_config_id, --service,
+					--rollout_strategy`)
+	APIConfigPath = flag.String("api_config_path", "", `file path to the gRPC API config in YAML, built into the service config
+					with the proto descriptor set file of --descriptor_path, the same way as Service Management does.
+					Multiple services can be served by one proxy with a comma separated list of file paths, in the same
+					order as --descriptor_path. Service Control is not used for the services, unless the API config
+					enables it. Like --service_json_path, following flags will be ignored; --service_config_id,
+					--service, --rollout_strategy`)
+	DescriptorPath = flag.String("descriptor_path", "", `file path to the proto descriptor set of the gRPC services of --api_config_path,
+					generated by protoc with --include_imports. Multiple files are in a comma separated list`)
+	ServiceConfigSource     = flag.String("service_config_source", "", `URIs of the service config sources, one for each service, separated by comma. Supported URIs are servicemanagement://SERVICE_NAME[?config_id=CONFIG_ID], file:///PATH, openapi:///PATH for an OpenAPI 2.0 document, apiconfig:///PATH?descriptor=DESCRIPTOR_PATH for a gRPC API config and its proto descriptor set, dir:///PATH for the service config with the highest config id in the directory, and http(s)://HOST/PATH polled with ETags. The sources are checked every --check_rollout_interval. When this flag is used, --service, --service_config_id, --rollout_strategy, --service_json_path, --openapi_path and --api_config_path are ignored`)
+	servicePathPollInterval = flag.Duration("service_json_poll_interval", 10*time.Second, `the interval to check the files of --service_json_path, --openapi_path, --api_config_path or --descriptor_path for changes, which are applied without restarting. Disabled if 0`)
+	sslCertPollInterval     = flag.Duration("ssl_cert_poll_interval", 10*time.Second, `the interval to check the files of --ssl_server_cert_path and --ssl_client_cert_path for changes, which are pushed to Envoy as SDS secrets. Disabled if 0`)
+)
+
+var (
+	snapshotGenerationTime = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "config_manager_snapshot_generation_seconds",
+		Help:    "Time to generate and set a snapshot in seconds.",
+		Buckets: metrics.DefaultBuckets,
+	})
+	configIdChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_manager_config_id_changes_total",
+		Help: "Number of config id changes applied to the snapshot, by service.",
+	}, []string{"service"})
+	snapshotNacks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "config_manager_snapshot_nacks_total",
+		Help: "Number of snapshots rejected by Envoy.",
+	})
+	snapshotRollbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "config_manager_snapshot_rollbacks_total",
+		Help: "Number of rejected snapshots rolled back to the previous snapshot.",
+	})
 )
 
 // Config Manager handles service configuration fetching and updating.
-// TODO(jilinxia): handles multi service name.
 type ConfigManager struct {
-	serviceName        string
-	serviceInfo        *configinfo.ServiceInfo
+	services           []*serviceState
 	envoyConfigOptions options.ConfigGeneratorOptions
-	curServiceConfig   *confpb.Service
-
-	cache               cache.SnapshotCache
-	checkRolloutsTicker *time.Ticker
+	rolloutStrategy    string
+	// Empty if the service configs are not cached.
+	serviceConfigCacheDir string
+
+	// Protects services, the snapshot and the status below, which are updated
+	// by the rollout checks of all services.
+	mutex sync.Mutex
+	cache cache.SnapshotCache
+	// The config ids and revision of the current snapshot. The revision is
+	// bumped when the snapshot changes without any config id change, so that
+	// the snapshot version still changes.
+	snapshotConfigId string
+	snapshotRevision int
+	// The current and the previous snapshots, the previous one is restored
+	// when Envoy rejects the current one.
+	curSnapshotState  *snapshotState
+	prevSnapshotState *snapshotState
+	nackCount         int
+	rollbackCount     int
+	// The server and client certs served as SDS secrets, and the checksum of
+	// their content.
+	secrets     []cache.Resource
+	secretsHash [sha256.Size]byte
+
+	// Status of the rollout checks, served by the status server.
+	lastRolloutCheckTime time.Time
+	lastError            error
+	lastErrorTime        time.Time
+
+	// Serializes the periodic rollout checks and the ones forced from the
+	// status server.
+	checkRolloutMutex sync.Mutex
+
+	// The last response sent on each xDS stream, by type url.
+	responseMutex sync.Mutex
+	sentResponses map[int64]map[string]sentResponse
+
+	metadataFetcher *metadata.MetadataFetcher
+}
 
-	metadataFetcher      *metadata.MetadataFetcher
-	serviceConfigFetcher *sc.ServiceConfigFetcher
+// serviceState holds the service configuration applied for one endpoint service.
+type serviceState struct {
+	name             string
+	serviceInfo      *configinfo.ServiceInfo
+	curServiceConfig *confpb.Service
+	curRolloutId     string
+	source           sc.ConfigSource
+	// Whether the current service config is loaded from the cache, and has
+	// not been fetched from the source yet.
+	fromCache bool
 }
 
 // NewConfigManager creates new instance of Config Manager.
 // mf is set to nil on non-gcp deployments
 func NewConfigManager(mf *metadata.MetadataFetcher, opts options.ConfigGeneratorOptions) (*ConfigManager, error) {
+	// The certs are served as SDS secrets, so that they are rotated without
+	// restarting Envoy.
+	opts.UseSdsForSslCerts = true
 	m := &ConfigManager{
 		metadataFetcher:    mf,
 		envoyConfigOptions: opts,
+		sentResponses:      make(map[int64]map[string]sentResponse),
 	}
 	m.cache = cache.NewSnapshotCache(true, m, m)
 
+	var err error
+	if m.secrets, m.secretsHash, err = m.readSecrets(); err != nil {
+		return nil, err
+	}
+
+	sources, interval, err := m.configSources(mf, opts)
+	if err != nil {
+		return nil, err
+	}
+	// The initial fetch of all the services, including the retries of their
+	// calls, shares one deadline, after which the cached service configs are
+	// used.
+	ctx, cancel := context.WithTimeout(context.Background(), opts.ServiceManagementInitialFetchDeadline)
+	defer cancel()
+	for _, source := range sources {
+		s := &serviceState{
+			name:   source.ServiceName(),
+			source: source,
+		}
+		rolloutConfigs, err := source.Fetch(ctx)
+		if err != nil {
+			if m.serviceConfigCacheDir == "" || s.name == "" {
+				return nil, err
+			}
+			glog.Errorf("fail to fetch service config for service %v, try the cached one, %v", s.name, err)
+			m.setLastError(err)
+			if cacheErr := m.loadCachedServiceConfig(s); cacheErr != nil {
+				return nil, fmt.Errorf("fail to fetch service config for service %v, %v, and no cached one can be used, %v", s.name, err, cacheErr)
+			}
+		} else {
+			if s.name == "" {
+				s.name = rolloutConfigs[0].ServiceConfig.GetName()
+			}
+			if err := m.updateServiceInfo(s, rolloutConfigs); err != nil {
+				return nil, err
+			}
+		}
+		m.services = append(m.services, s)
+	}
+	if err := m.updateSnapshot(); err != nil {
+		return nil, err
+	}
+	for _, s := range m.services {
+		if s.fromCache {
+			continue
+		}
+		m.saveServiceConfig(s)
+	}
+
+	glog.Infof("create new Config Manager for services (%v) with configuration ids (%v), %v rollout strategy",
+		m.serviceNames(), m.curConfigId(), m.rolloutStrategy)
+
+	// The sources are polled periodically, which also reconciles the services
+	// started from the cached service configs.
+	if interval > 0 {
+		m.setFetchConfigTimer(interval)
+	}
+	if len(m.secrets) > 0 && *sslCertPollInterval > 0 {
+		m.setSecretsPollTimer(*sslCertPollInterval)
+	}
+	return m, nil
+}
+
+// configSources creates the service config sources from the flags, and
+// returns the interval to poll them.
+func (m *ConfigManager) configSources(mf *metadata.MetadataFetcher, opts options.ConfigGeneratorOptions) ([]sc.ConfigSource, time.Duration, error) {
+	var sources []sc.ConfigSource
+	if *ServiceConfigSource != "" {
+		for _, uri := range splitFlagList(*ServiceConfigSource) {
+			source, err := sc.NewConfigSource(uri, mf, opts)
+			if err != nil {
+				return nil, 0, err
+			}
+			sources = append(sources, source)
+		}
+		m.rolloutStrategy = sourcesRolloutStrategy(sources)
+		m.serviceConfigCacheDir = *ServiceConfigCacheDir
+		glog.Infof("create new Config Manager from service config sources %v", *ServiceConfigSource)
+		return sources, *checkNewRolloutInterval, nil
+	}
+
 	// If service config is provided as a file, just use it and disable managed rollout
-	if *ServicePath != "" {
+	if *ServicePath != "" || *OpenAPIPath != "" || *APIConfigPath != "" || *DescriptorPath != "" {
+		var pathFlags []string
+		for _, f := range []struct {
+			name  string
+			value string
+		}{
+			{"--service_json_path", *ServicePath},
+			{"--openapi_path", *OpenAPIPath},
+			{"--api_config_path", *APIConfigPath},
+		} {
+			if f.value != "" {
+				pathFlags = append(pathFlags, f.name)
+			}
+		}
+		if len(pathFlags) > 1 {
+			return nil, 0, fmt.Errorf("flags %s cannot be used together", strings.Join(pathFlags, " and "))
+		}
+		apiConfigPaths, descriptorPaths := splitFlagList(*APIConfigPath), splitFlagList(*DescriptorPath)
+		if len(apiConfigPaths) != len(descriptorPaths) {
+			return nil, 0, fmt.Errorf("flags --api_config_path and --descriptor_path must have the same number of files, got %d and %d",
+				len(apiConfigPaths), len(descriptorPaths))
+		}
+
+		var pathFlag, paths string
+		switch {
+		case *ServicePath != "":
+			pathFlag, paths = "--service_json_path", *ServicePath
+			for _, path := range splitFlagList(*ServicePath) {
+				sources = append(sources, sc.NewFileSource(path))
+			}
+		case *OpenAPIPath != "":
+			pathFlag, paths = "--openapi_path", *OpenAPIPath
+			for _, path := range splitFlagList(*OpenAPIPath) {
+				sources = append(sources, sc.NewOpenAPISource(path))
+			}
+		default:
+			pathFlag, paths = "--api_config_path", *APIConfigPath
+			for i, path := range apiConfigPaths {
+				sources = append(sources, sc.NewAPIConfigSource(path, descriptorPaths[i]))
+			}
+		}
+
 		// Following flags will not be used
 		if *ServiceName != "" {
-			glog.Infof("flag --service is ignored when --service_json_path is specified.")
+			glog.Infof("flag --service is ignored when %s is specified.", pathFlag)
 		}
 		if *ServiceConfigId != "" {
-			glog.Infof("flag --service_config_id is ignored when --service_json_path is specified.")
+			glog.Infof("flag --service_config_id is ignored when %s is specified.", pathFlag)
 		}
 		if *RolloutStrategy != "fixed" {
-			glog.Infof("flag --rollout_strategy will be fixed when --service_json_path is specified.")
+			glog.Infof("flag --rollout_strategy will be fixed when %s is specified.", pathFlag)
 		}
 
-		if err := m.readAndApplyServiceConfig(*ServicePath); err != nil {
-			return nil, err
-		}
-
-		glog.Infof("create new Config Manager from static service config json file at %v", *ServicePath)
-		return m, nil
+		m.rolloutStrategy = util.FixedRolloutStrategy
+		glog.Infof("create new Config Manager from static service config files of %s at %v", pathFlag, paths)
+		return sources, *servicePathPollInterval, nil
 	}
 
-	m.serviceName = *ServiceName
+	serviceNames := splitFlagList(*ServiceName)
 	checkMetadata := *CheckMetadata
 	var err error
 
-	if m.serviceName == "" && checkMetadata && mf != nil {
-		m.serviceName, err = mf.FetchServiceName()
-		if m.serviceName == "" || err != nil {
-			return nil, fmt.Errorf("failed to read metadata with key endpoints-service-name from metadata server")
+	if len(serviceNames) == 0 && checkMetadata && mf != nil {
+		serviceName, err := mf.FetchServiceName()
+		if serviceName == "" || err != nil {
+			return nil, 0, fmt.Errorf("failed to read metadata with key endpoints-service-name from metadata server")
 		}
-	} else if m.serviceName == "" && !checkMetadata {
-		return nil, fmt.Errorf("service name is not specified, required because metadata fetching is disabled")
-	} else if m.serviceName == "" && mf == nil {
-		return nil, fmt.Errorf("service name is not specified, required on a non-gcp deployment")
+		serviceNames = []string{serviceName}
+	} else if len(serviceNames) == 0 && !checkMetadata {
+		return nil, 0, fmt.Errorf("service name is not specified, required because metadata fetching is disabled")
+	} else if len(serviceNames) == 0 && mf == nil {
+		return nil, 0, fmt.Errorf("service name is not specified, required on a non-gcp deployment")
 	}
 	rolloutStrategy := *RolloutStrategy
 	// try to fetch from metadata, if not found, set to fixed instead of throwing an error
@@ -116,73 +328,190 @@ func NewConfigManager(mf *metadata.MetadataFetcher, opts options.ConfigGenerator
 		rolloutStrategy = util.FixedRolloutStrategy
 	}
 	if !(rolloutStrategy == util.FixedRolloutStrategy || rolloutStrategy == util.ManagedRolloutStrategy) {
-		return nil, fmt.Errorf(`failed to set rollout strategy. It must be either "managed" or "fixed"`)
+		return nil, 0, fmt.Errorf(`failed to set rollout strategy. It must be either "managed" or "fixed"`)
 	}
 
-	configId := ""
+	configIds := make([]string, len(serviceNames))
 	if rolloutStrategy == util.FixedRolloutStrategy {
 		// rollout strategy is fixed mode
-		configId = *ServiceConfigId
-		if configId == "" {
-			if checkMetadata && mf != nil {
-				configId, err = mf.FetchConfigId()
-				if configId == "" || err != nil {
-					return nil, fmt.Errorf("failed to read metadata with key endpoints-service-version from metadata server")
-				}
-			} else if !checkMetadata {
-				return nil, fmt.Errorf("service config id is not specified, required because metadata fetching is disabled")
-			} else if mf == nil {
-				return nil, fmt.Errorf("service config id is not specified, required on a non-gcp deployment")
+		if *ServiceConfigId != "" {
+			configIds = splitFlagList(*ServiceConfigId)
+			if len(configIds) != len(serviceNames) {
+				return nil, 0, fmt.Errorf("got %d service config ids for %d services, one config id is required for each service", len(configIds), len(serviceNames))
 			}
+		} else if len(serviceNames) > 1 {
+			return nil, 0, fmt.Errorf("service config ids are not specified, required when serving multiple services")
+		} else if checkMetadata && mf != nil {
+			configIds[0], err = mf.FetchConfigId()
+			if configIds[0] == "" || err != nil {
+				return nil, 0, fmt.Errorf("failed to read metadata with key endpoints-service-version from metadata server")
+			}
+		} else if !checkMetadata {
+			return nil, 0, fmt.Errorf("service config id is not specified, required because metadata fetching is disabled")
+		} else if mf == nil {
+			return nil, 0, fmt.Errorf("service config id is not specified, required on a non-gcp deployment")
 		}
+	}
 
+	for i, serviceName := range serviceNames {
+		source, err := sc.NewServiceManagementSource(mf, opts, serviceName, configIds[i])
+		if err != nil {
+			return nil, 0, err
+		}
+		sources = append(sources, source)
 	}
+	m.rolloutStrategy = rolloutStrategy
+	m.serviceConfigCacheDir = *ServiceConfigCacheDir
+	return sources, *checkNewRolloutInterval, nil
+}
 
-	if m.serviceConfigFetcher, err = sc.NewServiceConfigFetcher(mf, opts, m.serviceName); err != nil {
-		return nil, fmt.Errorf(`failed to create https client to call ServiceManagement service, got error: %v`, err)
+// sourcesRolloutStrategy returns the rollout strategy of the service config
+// sources, which is managed if any of them follows the latest rollout of
+// Service Management, or fixed otherwise.
+func sourcesRolloutStrategy(sources []sc.ConfigSource) string {
+	for _, source := range sources {
+		if s, ok := source.(*sc.ServiceManagementSource); ok && s.ConfigId() == "" {
+			return util.ManagedRolloutStrategy
+		}
 	}
+	return util.FixedRolloutStrategy
+}
 
-	if serviceConfig, err := m.serviceConfigFetcher.FetchConfig(configId); err != nil {
-		return nil, err
-	} else if err = m.applyServiceConfig(serviceConfig); err != nil {
-		return nil, err
+// loadCachedServiceConfig starts the service from its cached service config.
+// For a source of a fixed config id, only the cached one with the same config
+// id can be used.
+func (m *ConfigManager) loadCachedServiceConfig(s *serviceState) error {
+	serviceConfig, rolloutId, err := loadServiceConfig(m.serviceConfigCacheDir, s.name)
+	if err != nil {
+		return err
 	}
+	configId := ""
+	if source, ok := s.source.(*sc.ServiceManagementSource); ok {
+		configId = source.ConfigId()
+	}
+	if configId != "" && serviceConfig.GetId() != configId {
+		return fmt.Errorf("cached service config id %v is not the requested one %v", serviceConfig.GetId(), configId)
+	}
+	if err := m.updateServiceInfo(s, sc.FullRollout(serviceConfig)); err != nil {
+		return err
+	}
+	s.curRolloutId = rolloutId
+	s.fromCache = true
+	glog.Warningf("service %v starts from the cached service config %v, rollout %v", s.name, serviceConfig.GetId(), rolloutId)
+	return nil
+}
 
-	glog.Infof("create new Config Manager for service (%v) with configuration id (%v), %v rollout strategy",
-		m.serviceName, m.curConfigId(), rolloutStrategy)
+// saveServiceConfig persists the current service config of the service, if
+// the cache is enabled. Failures are only logged, since the config has already
+// been applied.
+func (m *ConfigManager) saveServiceConfig(s *serviceState) {
+	if m.serviceConfigCacheDir == "" {
+		return
+	}
+	if err := saveServiceConfig(m.serviceConfigCacheDir, s.name, s.curRolloutId, s.curServiceConfig); err != nil {
+		glog.Errorf("fail to cache service config for service %v, %v", s.name, err)
+	}
+}
 
-	if rolloutStrategy == util.ManagedRolloutStrategy {
-		m.serviceConfigFetcher.SetFetchConfigTimer(checkNewRolloutInterval, func(serviceConfig *confpb.Service) {
-			err := m.applyServiceConfig(serviceConfig)
-			if err != nil {
+// setFetchConfigTimer polls the service config sources of all services
+// periodically.
+func (m *ConfigManager) setFetchConfigTimer(interval time.Duration) {
+	go func() {
+		glog.Infof("start checking service config sources every %v", interval)
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if err := m.checkNewRollouts(); err != nil {
 				glog.Errorf("error occurred when checking new rollouts, %v", err)
 			}
-		})
-	}
-	return m, nil
+		}
+	}()
 }
 
-func (m *ConfigManager) readAndApplyServiceConfig(servicePath string) error {
-	config, err := ioutil.ReadFile(servicePath)
-	if err != nil {
-		return fmt.Errorf("fail to read service config file: %s, error: %s", servicePath, err)
+// checkNewRollouts polls the service config source of each service, e.g. the
+// latest rollout of Service Management, and applies the new service configs
+// if there are any.
+func (m *ConfigManager) checkNewRollouts() error {
+	m.checkRolloutMutex.Lock()
+	defer m.checkRolloutMutex.Unlock()
+
+	var errs []string
+	for _, s := range m.services {
+		if err := m.checkServiceConfigSource(s); err != nil {
+			errs = append(errs, fmt.Sprintf("service %s: %v", s.name, err))
+		}
 	}
 
-	serviceConfig, err := util.UnmarshalServiceConfig(bytes.NewReader(config))
-	if err != nil {
-		return fmt.Errorf("fail to unmarshal service config: %v, error: %s", config, err)
+	m.mutex.Lock()
+	m.lastRolloutCheckTime = time.Now()
+	m.mutex.Unlock()
+
+	if len(errs) > 0 {
+		err := fmt.Errorf("%s", strings.Join(errs, "; "))
+		m.setLastError(err)
+		return err
 	}
+	return nil
+}
 
-	m.serviceName = serviceConfig.GetName()
-	return m.applyServiceConfig(serviceConfig)
+// setLastError records the error for the status server.
+func (m *ConfigManager) setLastError(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastError = err
+	m.lastErrorTime = time.Now()
 }
 
-func (m *ConfigManager) applyServiceConfig(serviceConfig *confpb.Service) error {
-	var err error
-	m.curServiceConfig = serviceConfig
-	m.serviceInfo, err = configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.Id, m.envoyConfigOptions)
-	if err != nil {
-		return fmt.Errorf("fail to initialize ServiceInfo, %s", err)
+// checkServiceConfigSource applies the service configs of the source of the
+// service, if they have changed since the last check.
+func (m *ConfigManager) checkServiceConfigSource(s *serviceState) error {
+	rolloutConfigs, err := s.source.Poll()
+	if err != nil || rolloutConfigs == nil {
+		return err
+	}
+	if name := rolloutConfigs[0].ServiceConfig.GetName(); name != s.name {
+		return fmt.Errorf("service name is changed from %s to %s, which requires a restart", s.name, name)
+	}
+
+	glog.Infof("service config source %v is changed, applying service config %v", s.source, rolloutConfigs[0].ServiceConfig.GetId())
+	return m.applyServiceConfig(s, rolloutConfigs)
+}
+
+// applyServiceConfig replaces the service configs of one service and updates
+// the snapshot for all services. The service keeps its previous service
+// configs if the snapshot cannot be updated.
+func (m *ConfigManager) applyServiceConfig(s *serviceState, rolloutConfigs []*sc.RolloutConfig) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	prevState := *s
+	if err := m.updateServiceInfo(s, rolloutConfigs); err != nil {
+		return err
+	}
+	if err := m.updateSnapshot(); err != nil {
+		*s = prevState
+		return err
+	}
+	s.fromCache = false
+	m.saveServiceConfig(s)
+	return nil
+}
+
+// updateServiceInfo replaces the service configs of one service. The first
+// rollout config, which has the highest traffic percentage, is the main
+// service config, and the others are its canaries.
+func (m *ConfigManager) updateServiceInfo(s *serviceState, rolloutConfigs []*sc.RolloutConfig) error {
+	var serviceInfos []*configinfo.ServiceInfo
+	for _, rolloutConfig := range rolloutConfigs {
+		serviceConfig := rolloutConfig.ServiceConfig
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.Id, m.envoyConfigOptions)
+		if err != nil {
+			return fmt.Errorf("fail to initialize ServiceInfo, %s", err)
+		}
+		if serviceConfig.GetName() != rolloutConfigs[0].ServiceConfig.GetName() {
+			return fmt.Errorf("service config %s is for service %s, not %s", serviceConfig.GetId(), serviceConfig.GetName(), rolloutConfigs[0].ServiceConfig.GetName())
+		}
+		serviceInfo.TrafficPercent = rolloutConfig.TrafficPercent
+		serviceInfos = append(serviceInfos, serviceInfo)
 	}
 
 	if m.metadataFetcher != nil {
@@ -190,22 +519,64 @@ func (m *ConfigManager) applyServiceConfig(serviceConfig *confpb.Service) error
 		if err != nil {
 			m.Infof("metadata server was not reached, skipping GCP Attributes")
 		} else {
-			m.serviceInfo.GcpAttributes = attrs
+			for _, serviceInfo := range serviceInfos {
+				serviceInfo.GcpAttributes = attrs
+			}
 		}
 	}
 
-	snapshot, err := m.makeSnapshot()
+	s.curServiceConfig = rolloutConfigs[0].ServiceConfig
+	s.serviceInfo = serviceInfos[0]
+	s.serviceInfo.Canaries = serviceInfos[1:]
+	s.curRolloutId = s.source.RolloutId()
+	return nil
+}
+
+func (m *ConfigManager) updateSnapshot() error {
+	// The snapshot version must change for Envoy to apply the snapshot, even
+	// if the config ids do not, e.g. when a service config file is changed.
+	configId := m.curConfigId()
+	revision := 0
+	if _, err := m.cache.GetSnapshot(m.envoyConfigOptions.Node); err == nil && configId == m.snapshotConfigId {
+		revision = m.snapshotRevision + 1
+	}
+	version := configId
+	if revision > 0 {
+		version = fmt.Sprintf("%s-%d", configId, revision)
+	}
+
+	start := time.Now()
+	snapshot, err := m.makeSnapshot(version)
 	if err != nil {
 		return fmt.Errorf("fail to make a snapshot, %s", err)
 	}
-	return m.cache.SetSnapshot(m.envoyConfigOptions.Node, *snapshot)
+	if err := m.cache.SetSnapshot(m.envoyConfigOptions.Node, *snapshot); err != nil {
+		return err
+	}
+	snapshotGenerationTime.Observe(time.Since(start).Seconds())
+	m.snapshotConfigId, m.snapshotRevision = configId, revision
+	m.prevSnapshotState, m.curSnapshotState = m.curSnapshotState, m.newSnapshotState(*snapshot)
+	recordConfigIdChanges(m.prevSnapshotState, m.curSnapshotState)
+	return nil
+}
+
+// recordConfigIdChanges counts the services whose config ids, including the
+// ones of the canaries, are changed from one snapshot to the other.
+func recordConfigIdChanges(from, to *snapshotState) {
+	for i, serviceInfo := range to.serviceInfos {
+		if from != nil && i < len(from.serviceInfos) && serviceConfigId(from.serviceInfos[i]) == serviceConfigId(serviceInfo) {
+			continue
+		}
+		configIdChanges.WithLabelValues(serviceInfo.Name).Inc()
+	}
 }
 
-func (m *ConfigManager) makeSnapshot() (*cache.Snapshot, error) {
-	m.Infof("making configuration for api: %v", m.serviceInfo.Name)
+func (m *ConfigManager) makeSnapshot(version string) (*cache.Snapshot, error) {
+	serviceInfos := m.serviceInfos()
+	m.Infof("making configuration for apis: %v", m.serviceNames())
 
 	var clusterResources, endpoints, runtimes, routes, listenerResources []cache.Resource
-	clusters, err := gen.MakeClusters(m.serviceInfo)
+	clusters, err := gen.MakeClusters(serviceInfos...)
 	if err != nil {
 		return nil, err
 	}
@@ -213,8 +584,17 @@ func (m *ConfigManager) makeSnapshot() (*cache.Snapshot, error) {
 		clusterResources = append(clusterResources, clusters[i])
 	}
 
-	m.Infof("adding Listeners configuration for api: %v", m.serviceInfo.Name)
-	listeners, err := gen.MakeListeners(m.serviceInfo)
+	// Routes are served by RDS, so that route only changes do not replace
+	// the listener and drain its connections.
+	m.Infof("adding Routes configuration for apis: %v", m.serviceNames())
+	route, err := gen.MakeRouteConfig(serviceInfos...)
+	if err != nil {
+		return nil, err
+	}
+	routes = append(routes, route)
+
+	m.Infof("adding Listeners configuration for apis: %v", m.serviceNames())
+	listeners, err := gen.MakeRdsListeners(serviceInfos...)
 	if err != nil {
 		return nil, err
 	}
@@ -222,23 +602,72 @@ func (m *ConfigManager) makeSnapshot() (*cache.Snapshot, error) {
 		listenerResources = append(listenerResources, lis)
 	}
 
-	snapshot := cache.NewSnapshot(m.curConfigId(), endpoints, clusterResources, routes, listenerResources, runtimes)
-	m.Infof("Envoy Dynamic Configuration is cached for service: %v", m.serviceName)
+	snapshot := cache.NewSnapshot(version, endpoints, clusterResources, routes, listenerResources, runtimes)
+	snapshot.Secrets = m.secretResources()
+	if err := snapshot.Consistent(); err != nil {
+		return nil, err
+	}
+	m.Infof("Envoy Dynamic Configuration is cached for services: %v", m.serviceNames())
 	return &snapshot, nil
 }
 
+func (m *ConfigManager) serviceInfos() []*configinfo.ServiceInfo {
+	var serviceInfos []*configinfo.ServiceInfo
+	for _, s := range m.services {
+		serviceInfos = append(serviceInfos, s.serviceInfo)
+	}
+	return serviceInfos
+}
+
+func (m *ConfigManager) serviceNames() []string {
+	var names []string
+	for _, s := range m.services {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+// curConfigId returns the config ids of all services, separated by comma.
+// The canary config ids of a service in a traffic percent rollout follow its
+// main config id, separated by plus. It is used as the snapshot version.
 func (m *ConfigManager) curConfigId() string {
-	if m.curServiceConfig == nil {
-		return ""
+	var configIds []string
+	for _, s := range m.services {
+		configIds = append(configIds, serviceConfigId(s.serviceInfo))
 	}
-	return m.curServiceConfig.Id
+	return strings.Join(configIds, ",")
 }
 
+// serviceConfigId returns the config id of the service, followed by the ones
+// of its canaries.
+func serviceConfigId(serviceInfo *configinfo.ServiceInfo) string {
+	configId := serviceInfo.ConfigID
+	for _, canary := range serviceInfo.Canaries {
+		configId += "+" + canary.ConfigID
+	}
+	return configId
+}
+
+// curRolloutId returns the rollout ids of all services, separated by comma.
 func (m *ConfigManager) curRolloutId() string {
-	if m.serviceConfigFetcher == nil {
-		return ""
+	var rolloutIds []string
+	for _, s := range m.services {
+		if _, ok := s.source.(*sc.FileSource); ok {
+			continue
+		}
+		rolloutIds = append(rolloutIds, s.curRolloutId)
+	}
+	return strings.Join(rolloutIds, ",")
+}
+
+func splitFlagList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
 	}
-	return m.serviceConfigFetcher.CurRolloutId()
+	return values
 }
 
 func (m *ConfigManager) ID(node *corepb.Node) string {
@@ -18,10 +18,15 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -35,6 +40,7 @@ import (
 
 	pmpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/path_matcher"
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/service_control"
+	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/serviceconfig"
 	v2pb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	authpb "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
@@ -59,7 +65,12 @@ const (
 )
 
 var (
-	fakeConfig             []byte
+	fakeConfig []byte
+	// Guards fakeConfig when it changes while the mock config server runs.
+	fakeConfigMutex sync.Mutex
+	// The service configs served by config id, fakeConfig is served for the
+	// other config ids.
+	fakeConfigs            map[string][]byte
 	fakeRollout            []byte
 	fakeProtoDescriptor    = base64.StdEncoding.EncodeToString([]byte("rawDescriptor"))
 	testBackendClusterName = fmt.Sprintf("%s_local", testProjectName)
@@ -73,6 +84,7 @@ func TestFetchListeners(t *testing.T) {
 		BackendAddress    string
 		fakeServiceConfig string
 		wantedListeners   string
+		wantedRoutes      string
 	}{
 		{
 			desc:           "Success for grpc backend with transcoding",
@@ -171,7 +183,23 @@ func TestFetchListeners(t *testing.T) {
                         }
                      }
                   ],
-                  "routeConfig":{
+                  "rds":{
+                     "configSource":{
+                        "ads":{}
+                     },
+                     "routeConfigName":"local_route"
+                  },
+                  "statPrefix":"ingress_http",
+                  "useRemoteAddress":false,
+                  "xffNumTrustedHops":2
+               }
+            }
+         ]
+      }
+   ]
+}
+`, fakeProtoDescriptor, testEndpointName),
+			wantedRoutes: fmt.Sprintf(`{
                      "name":"local_route",
                      "virtualHosts":[
                         {
@@ -192,18 +220,7 @@ func TestFetchListeners(t *testing.T) {
                            ]
                         }
                      ]
-                  },
-                  "statPrefix":"ingress_http",
-                  "useRemoteAddress":false,
-                  "xffNumTrustedHops":2
-               }
-            }
-         ]
-      }
-   ]
-}
-`,
-				fakeProtoDescriptor, testEndpointName, testBackendClusterName),
+                  }`, testBackendClusterName),
 		},
 		{
 			desc:           "Success for grpc backend, with Jwt filter, with audiences, no Http Rules",
@@ -248,7 +265,7 @@ func TestFetchListeners(t *testing.T) {
                 }
             }`, testEndpointName, testEndpointName),
 
-			wantedListeners: fmt.Sprintf(`
+			wantedListeners: `
 {
    "address":{
       "socketAddress":{
@@ -348,7 +365,23 @@ func TestFetchListeners(t *testing.T) {
                         }
                      }
                   ],
-                  "routeConfig":{
+                  "rds":{
+                     "configSource":{
+                        "ads":{}
+                     },
+                     "routeConfigName":"local_route"
+                  },
+                  "statPrefix":"ingress_http",
+                  "useRemoteAddress":false,
+                  "xffNumTrustedHops":2
+               }
+            }
+         ]
+      }
+   ]
+}
+              `,
+			wantedRoutes: fmt.Sprintf(`{
                      "name":"local_route",
                      "virtualHosts":[
                         {
@@ -369,17 +402,7 @@ func TestFetchListeners(t *testing.T) {
                            ]
                         }
                      ]
-                  },
-                  "statPrefix":"ingress_http",
-                  "useRemoteAddress":false,
-                  "xffNumTrustedHops":2
-               }
-            }
-         ]
-      }
-   ]
-}
-              `, testBackendClusterName),
+                  }`, testBackendClusterName),
 		},
 		{
 			desc:           "Success for gRPC backend, with Jwt filter, without audiences",
@@ -441,7 +464,7 @@ func TestFetchListeners(t *testing.T) {
                     ]
                 }
             }`, testEndpointName, testEndpointName),
-			wantedListeners: fmt.Sprintf(`{
+			wantedListeners: `{
    "address":{
       "socketAddress":{
          "address":"0.0.0.0",
@@ -558,7 +581,22 @@ func TestFetchListeners(t *testing.T) {
                         }
                      }
                   ],
-                  "routeConfig":{
+                  "rds":{
+                     "configSource":{
+                        "ads":{}
+                     },
+                     "routeConfigName":"local_route"
+                  },
+                  "statPrefix":"ingress_http",
+                  "useRemoteAddress":false,
+                  "xffNumTrustedHops":2
+               }
+            }
+         ]
+      }
+   ]
+}`,
+			wantedRoutes: fmt.Sprintf(`{
                      "name":"local_route",
                      "virtualHosts":[
                         {
@@ -579,16 +617,7 @@ func TestFetchListeners(t *testing.T) {
                            ]
                         }
                      ]
-                  },
-                  "statPrefix":"ingress_http",
-                  "useRemoteAddress":false,
-                  "xffNumTrustedHops":2
-               }
-            }
-         ]
-      }
-   ]
-}`, testBackendClusterName),
+                  }`, testBackendClusterName),
 		},
 		{
 			desc:           "Success for gRPC backend, with Jwt filter, with multi requirements, matching with regex",
@@ -653,7 +682,7 @@ func TestFetchListeners(t *testing.T) {
                     ]
                 }
             }`, testEndpointName, testEndpointName),
-			wantedListeners: fmt.Sprintf(`{
+			wantedListeners: `{
    "address":{
       "socketAddress":{
          "address":"0.0.0.0",
@@ -804,7 +833,22 @@ func TestFetchListeners(t *testing.T) {
                         }
                      }
                   ],
-                  "routeConfig":{
+                  "rds":{
+                     "configSource":{
+                        "ads":{}
+                     },
+                     "routeConfigName":"local_route"
+                  },
+                  "statPrefix":"ingress_http",
+                  "useRemoteAddress":false,
+                  "xffNumTrustedHops":2
+               }
+            }
+         ]
+      }
+   ]
+}`,
+			wantedRoutes: fmt.Sprintf(`{
                      "name":"local_route",
                      "virtualHosts":[
                         {
@@ -825,16 +869,7 @@ func TestFetchListeners(t *testing.T) {
                            ]
                         }
                      ]
-                  },
-                  "statPrefix":"ingress_http",
-                  "useRemoteAddress":false,
-                  "xffNumTrustedHops":2
-               }
-            }
-         ]
-      }
-   ]
-}`, testBackendClusterName),
+                  }`, testBackendClusterName),
 		},
 		{
 			desc:           "Success for gRPC backend with Service Control",
@@ -1026,7 +1061,22 @@ func TestFetchListeners(t *testing.T) {
                         }
                      }
                   ],
-                  "routeConfig":{
+                  "rds":{
+                     "configSource":{
+                        "ads":{}
+                     },
+                     "routeConfigName":"local_route"
+                  },
+                  "statPrefix":"ingress_http",
+                  "useRemoteAddress":false,
+                  "xffNumTrustedHops":2
+               }
+            }
+         ]
+      }
+   ]
+}`, testProjectID, testConfigID, testProjectName),
+			wantedRoutes: fmt.Sprintf(`{
                      "name":"local_route",
                      "virtualHosts":[
                         {
@@ -1047,16 +1097,7 @@ func TestFetchListeners(t *testing.T) {
                            ]
                         }
                      ]
-                  },
-                  "statPrefix":"ingress_http",
-                  "useRemoteAddress":false,
-                  "xffNumTrustedHops":2
-               }
-            }
-         ]
-      }
-   ]
-}`, testProjectID, testConfigID, testProjectName, testBackendClusterName),
+                  }`, testBackendClusterName),
 		},
 		{
 			desc:           "Success for http backend, with Jwt filter, with audiences",
@@ -1116,7 +1157,7 @@ func TestFetchListeners(t *testing.T) {
                     ]
                 }
             }`, testEndpointName),
-			wantedListeners: fmt.Sprintf(`{
+			wantedListeners: `{
    "address":{
       "socketAddress":{
          "address":"0.0.0.0",
@@ -1212,7 +1253,22 @@ func TestFetchListeners(t *testing.T) {
                         }
                      }
                   ],
-                  "routeConfig":{
+                  "rds":{
+                     "configSource":{
+                        "ads":{}
+                     },
+                     "routeConfigName":"local_route"
+                  },
+                  "statPrefix":"ingress_http",
+                  "useRemoteAddress":false,
+                  "xffNumTrustedHops":2
+               }
+            }
+         ]
+      }
+   ]
+}`,
+			wantedRoutes: fmt.Sprintf(`{
                      "name":"local_route",
                      "virtualHosts":[
                         {
@@ -1233,16 +1289,7 @@ func TestFetchListeners(t *testing.T) {
                            ]
                         }
                      ]
-                  },
-                  "statPrefix":"ingress_http",
-                  "useRemoteAddress":false,
-                  "xffNumTrustedHops":2
-               }
-            }
-         ]
-      }
-   ]
-}`, testBackendClusterName),
+                  }`, testBackendClusterName),
 		},
 		{
 			desc:           "Success for backend that allow CORS, with tracing and debug enabled",
@@ -1376,7 +1423,25 @@ func TestFetchListeners(t *testing.T) {
                         }
                      }
                   ],
-                  "routeConfig":{
+                  "rds":{
+                     "configSource":{
+                        "ads":{}
+                     },
+                     "routeConfigName":"local_route"
+                  },
+                  "statPrefix":"ingress_http",
+                  "tracing":{
+
+                  },
+                  "useRemoteAddress":false,
+                  "xffNumTrustedHops":2
+               }
+            }
+         ]
+      }
+   ]
+}`,
+			wantedRoutes: `{
                      "name":"local_route",
                      "virtualHosts":[
                         {
@@ -1397,19 +1462,7 @@ func TestFetchListeners(t *testing.T) {
                            ]
                         }
                      ]
-                  },
-                  "statPrefix":"ingress_http",
-                  "tracing":{
-
-                  },
-                  "useRemoteAddress":false,
-                  "xffNumTrustedHops":2
-               }
-            }
-         ]
-      }
-   ]
-}`,
+                  }`,
 		},
 	}
 
@@ -1462,6 +1515,29 @@ func TestFetchListeners(t *testing.T) {
 			if err := util.JsonEqual(tc.wantedListeners, gotListeners); err != nil {
 				t.Errorf("Test Desc(%d): %s, snapshot cache fetch got unexpected Listeners, \n %v", i, tc.desc, err)
 			}
+
+			reqForRoutes := v2pb.DiscoveryRequest{
+				Node: &corepb.Node{
+					Id: opts.Node,
+				},
+				TypeUrl:       cache.RouteType,
+				ResourceNames: []string{"local_route"},
+			}
+			respForRoutes, err := env.configManager.cache.Fetch(ctx, reqForRoutes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotRoutes, err := marshaler.MarshalToString(respForRoutes.Resources[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if respForRoutes.Version != testConfigID {
+				t.Errorf("Test Desc(%d): %s, snapshot cache fetch got routes version: %v, want: %v", i, tc.desc, respForRoutes.Version, testConfigID)
+			}
+			if err := util.JsonEqual(tc.wantedRoutes, gotRoutes); err != nil {
+				t.Errorf("Test Desc(%d): %s, snapshot cache fetch got unexpected Routes, \n %v", i, tc.desc, err)
+			}
 		})
 	}
 }
@@ -1473,6 +1549,7 @@ func TestDynamicBackendRouting(t *testing.T) {
 		BackendAddress    string
 		wantedClusters    []string
 		wantedListener    string
+		wantedRoutes      string
 	}{
 		{
 			desc:              "Success for http with dynamic routing",
@@ -1480,6 +1557,7 @@ func TestDynamicBackendRouting(t *testing.T) {
 			BackendAddress:    "http://127.0.0.1:8082",
 			wantedClusters:    testdata.FakeWantedClustersForDynamicRouting,
 			wantedListener:    testdata.FakeWantedListenerForDynamicRouting,
+			wantedRoutes:      testdata.FakeWantedRouteConfigForDynamicRouting,
 		},
 	}
 
@@ -1563,6 +1641,401 @@ func TestDynamicBackendRouting(t *testing.T) {
 		if err := util.JsonEqual(tc.wantedListener, gotListener); err != nil {
 			t.Errorf("Test Desc(%d): %s, snapshot cache fetch Listener,\n\t %v", i, tc.desc, err)
 		}
+
+		reqForRoutes := v2pb.DiscoveryRequest{
+			Node: &corepb.Node{
+				Id: opts.Node,
+			},
+			TypeUrl:       cache.RouteType,
+			ResourceNames: []string{"local_route"},
+		}
+
+		respForRoutes, err := manager.cache.Fetch(ctx, reqForRoutes)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		gotRoutes, err := marshaler.MarshalToString(respForRoutes.Resources[0])
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if err := util.JsonEqual(tc.wantedRoutes, gotRoutes); err != nil {
+			t.Errorf("Test Desc(%d): %s, snapshot cache fetch Routes,\n\t %v", i, tc.desc, err)
+		}
+	}
+}
+
+func TestMultipleServicesFromFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_manager_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serviceConfigs := map[string]string{
+		"bookstore.json": `{
+                "name":"bookstore.endpoints.project123.cloud.goog",
+                "id": "2017-05-01r0",
+                "apis":[{"name":"endpoints.examples.bookstore.Bookstore"}],
+                "endpoints": [{"name": "bookstore.endpoints.project123.cloud.goog", "aliases": ["bookstore.example.com"]}]
+            }`,
+		"echo.json": `{
+                "name":"echo.endpoints.project123.cloud.goog",
+                "id": "2017-05-01r1",
+                "apis":[{"name":"endpoints.examples.echo.Echo"}]
+            }`,
+	}
+	var paths []string
+	for _, name := range []string{"bookstore.json", "echo.json"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(serviceConfigs[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.DisableTracing = true
+
+	flag.Set("service_json_path", strings.Join(paths, ","))
+	defer flag.Set("service_json_path", "")
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+
+	if got, want := manager.curConfigId(), "2017-05-01r0,2017-05-01r1"; got != want {
+		t.Errorf("got config id: %v, want: %v", got, want)
+	}
+
+	req := v2pb.DiscoveryRequest{
+		Node: &corepb.Node{
+			Id: opts.Node,
+		},
+		TypeUrl:       cache.RouteType,
+		ResourceNames: []string{"local_route"},
+	}
+	resp, err := manager.cache.Fetch(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotDomains [][]string
+	for _, host := range resp.Resources[0].(*v2pb.RouteConfiguration).GetVirtualHosts() {
+		gotDomains = append(gotDomains, host.GetDomains())
+	}
+	wantDomains := [][]string{
+		{
+			"bookstore.endpoints.project123.cloud.goog",
+			"bookstore.endpoints.project123.cloud.goog:*",
+			"bookstore.example.com",
+			"bookstore.example.com:*",
+		},
+		{
+			"echo.endpoints.project123.cloud.goog",
+			"echo.endpoints.project123.cloud.goog:*",
+		},
+	}
+	if !reflect.DeepEqual(gotDomains, wantDomains) {
+		t.Errorf("got virtual host domains: %v, want: %v", gotDomains, wantDomains)
+	}
+}
+
+func TestServiceConfigFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_manager_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	servicePath := filepath.Join(dir, "service.json")
+	writeServiceConfig := func(content string) {
+		if err := ioutil.WriteFile(servicePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fetchVersion := func(manager *ConfigManager, typeUrl string) string {
+		resp, err := manager.cache.Fetch(context.Background(), v2pb.DiscoveryRequest{
+			Node: &corepb.Node{
+				Id: manager.envoyConfigOptions.Node,
+			},
+			TypeUrl: typeUrl,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Version
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.DisableTracing = true
+
+	writeServiceConfig(makeFakeServiceConfig(testConfigID))
+	flag.Set("service_json_path", servicePath)
+	flag.Set("service_json_poll_interval", "50ms")
+	defer flag.Set("service_json_path", "")
+	defer flag.Set("service_json_poll_interval", "10s")
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+	if got := fetchVersion(manager, cache.ListenerType); got != testConfigID {
+		t.Errorf("got snapshot version: %v, want: %v", got, testConfigID)
+	}
+
+	// The content changes without a new config id, the snapshot version still changes.
+	writeServiceConfig(strings.Replace(makeFakeServiceConfig(testConfigID), testEndpointName, "endpoints.examples.bookstore.BookstoreV2", 1))
+	time.Sleep(500 * time.Millisecond)
+	if got, want := fetchVersion(manager, cache.ListenerType), testConfigID+"-1"; got != want {
+		t.Errorf("got snapshot version: %v, want: %v", got, want)
+	}
+
+	// An invalid file keeps the current snapshot.
+	writeServiceConfig(`{"name": `)
+	time.Sleep(500 * time.Millisecond)
+	if got, want := fetchVersion(manager, cache.RouteType), testConfigID+"-1"; got != want {
+		t.Errorf("got snapshot version: %v, want: %v", got, want)
+	}
+	if status := manager.Status(); !strings.Contains(status.LastError, "fail to unmarshal service config") {
+		t.Errorf("got last error: %v, want the unmarshal error", status.LastError)
+	}
+
+	// A service config failing the snapshot keeps the current service config.
+	writeServiceConfig(strings.Replace(makeFakeServiceConfig("2017-05-01r2"), `"id"`, `"control": {"environment": "servicecontrol.googleapis.com/v1"}, "id"`, 1))
+	time.Sleep(500 * time.Millisecond)
+	if got, want := fetchVersion(manager, cache.ListenerType), testConfigID+"-1"; got != want {
+		t.Errorf("got snapshot version: %v, want: %v", got, want)
+	}
+	status := manager.Status()
+	if !strings.Contains(status.LastError, "fail to make a snapshot") {
+		t.Errorf("got last error: %v, want the snapshot error", status.LastError)
+	}
+	if status.ConfigId != testConfigID {
+		t.Errorf("got config id: %v, want: %v", status.ConfigId, testConfigID)
+	}
+
+	// A new config id is applied.
+	writeServiceConfig(makeFakeServiceConfig("2017-05-01r1"))
+	time.Sleep(500 * time.Millisecond)
+	if got, want := fetchVersion(manager, cache.ClusterType), "2017-05-01r1"; got != want {
+		t.Errorf("got snapshot version: %v, want: %v", got, want)
+	}
+}
+
+func TestOpenAPIPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_manager_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	openapiPath := filepath.Join(dir, "openapi.json")
+	if err := ioutil.WriteFile(openapiPath, []byte(fmt.Sprintf(`{
+		"swagger": "2.0",
+		"info": {"title": "Bookstore", "version": "1.0.0"},
+		"host": "%s",
+		"paths": {"/shelves": {"get": {"operationId": "listShelves"}}}
+	}`, testProjectName)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.DisableTracing = true
+
+	flag.Set("openapi_path", openapiPath)
+	defer flag.Set("openapi_path", "")
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+	if got := strings.Join(manager.serviceNames(), ","); got != testProjectName {
+		t.Errorf("got service name: %v, want: %v", got, testProjectName)
+	}
+	if got := manager.curConfigId(); !strings.HasPrefix(got, "openapi-") {
+		t.Errorf("got config id: %v, want the one of the OpenAPI document", got)
+	}
+	if _, ok := manager.services[0].serviceInfo.Methods["1.bookstore_endpoints_project123_cloud_goog.ListShelves"]; !ok {
+		t.Errorf("got methods: %v, want the operation of the OpenAPI document", manager.services[0].serviceInfo.Methods)
+	}
+
+	flag.Set("service_json_path", openapiPath)
+	defer flag.Set("service_json_path", "")
+	if _, err := NewConfigManager(nil, opts); err == nil || !strings.Contains(err.Error(), "cannot be used together") {
+		t.Errorf("got error: %v, want the flags cannot be used together", err)
+	}
+}
+
+func TestAPIConfigPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_manager_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	apiConfigPath := filepath.Join(dir, "api_config.yaml")
+	if err := ioutil.WriteFile(apiConfigPath, []byte(fmt.Sprintf(`
+type: google.api.Service
+config_version: 3
+name: %s
+apis:
+- name: test.grpc.Test
+usage:
+  rules:
+  - selector: "*"
+    allow_unregistered_calls: true
+`, testProjectName)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "grpc://127.0.0.1:8082"
+	opts.DisableTracing = true
+
+	flag.Set("api_config_path", apiConfigPath)
+	defer flag.Set("api_config_path", "")
+	flag.Set("descriptor_path", "../../../tests/endpoints/grpc_echo/proto/api_descriptor.pb")
+	defer flag.Set("descriptor_path", "")
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+	if got := strings.Join(manager.serviceNames(), ","); got != testProjectName {
+		t.Errorf("got service name: %v, want: %v", got, testProjectName)
+	}
+	configId := manager.curConfigId()
+	if !strings.HasPrefix(configId, "apiconfig-") {
+		t.Errorf("got config id: %v, want the one of the API config", configId)
+	}
+	if method, ok := manager.services[0].serviceInfo.Methods["test.grpc.Test.EchoStream"]; !ok || !method.IsStreaming {
+		t.Errorf("got methods: %v, want the streaming method of the descriptor set", manager.services[0].serviceInfo.Methods)
+	}
+
+	// The descriptor set is used by the gRPC transcoder.
+	ctx := context.Background()
+	respForListener, err := manager.cache.Fetch(ctx, v2pb.DiscoveryRequest{
+		Node: &corepb.Node{
+			Id: opts.Node,
+		},
+		TypeUrl: cache.ListenerType,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotListener, err := util.ProtoToJson(respForListener.Resources[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(gotListener, util.GRPCJSONTranscoder) {
+		t.Errorf("got listener: %s, want the gRPC transcoder filter", gotListener)
+	}
+
+	flag.Set("descriptor_path", "")
+	if _, err := NewConfigManager(nil, opts); err == nil || !strings.Contains(err.Error(), "must have the same number of files") {
+		t.Errorf("got error: %v, want a descriptor set is required", err)
+	}
+}
+
+func TestServiceConfigSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_manager_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeServiceConfig := func(file, configId string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(makeFakeServiceConfig(configId)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.DisableTracing = true
+
+	writeServiceConfig("v0.json", testConfigID)
+	flag.Set("service_config_source", "dir://"+dir)
+	flag.Set("check_rollout_interval", "50ms")
+	defer flag.Set("service_config_source", "")
+	defer flag.Set("check_rollout_interval", "60s")
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+	// The state is read through Status, which holds the lock of the manager,
+	// as the source is polled in the background.
+	status := manager.Status()
+	if status.ConfigId != testConfigID {
+		t.Errorf("got config id: %v, want: %v", status.ConfigId, testConfigID)
+	}
+	if len(status.Services) != 1 || status.Services[0].Name != testProjectName {
+		t.Errorf("got services: %v, want: %v", status.Services, testProjectName)
+	}
+	if status.RolloutStrategy != util.FixedRolloutStrategy {
+		t.Errorf("got rollout strategy: %v, want: %v", status.RolloutStrategy, util.FixedRolloutStrategy)
+	}
+
+	writeServiceConfig("v1.json", "2017-05-01r1")
+	time.Sleep(500 * time.Millisecond)
+	status = manager.Status()
+	if got, want := status.ConfigId, "2017-05-01r1"; got != want {
+		t.Errorf("got config id: %v, want: %v", got, want)
+	}
+	if got, want := status.RolloutId, filepath.Join(dir, "v1.json"); got != want {
+		t.Errorf("got rollout id: %v, want: %v", got, want)
+	}
+}
+
+func TestSourcesRolloutStrategy(t *testing.T) {
+	testData := []struct {
+		uris []string
+		want string
+	}{
+		{
+			uris: []string{"servicemanagement://bookstore.endpoints.project123.cloud.goog"},
+			want: util.ManagedRolloutStrategy,
+		},
+		{
+			uris: []string{"servicemanagement://bookstore.endpoints.project123.cloud.goog?config_id=2017-05-01r0"},
+			want: util.FixedRolloutStrategy,
+		},
+		{
+			uris: []string{
+				"file:///etc/espv2/service.json",
+				"openapi:///etc/espv2/openapi.json",
+				"apiconfig:///etc/espv2/api_config.yaml?descriptor=/etc/espv2/api_descriptor.pb",
+				"dir:///etc/espv2/configs",
+				"https://configs.example.com/bookstore.json",
+			},
+			want: util.FixedRolloutStrategy,
+		},
+		{
+			uris: []string{
+				"file:///etc/espv2/service.json",
+				"servicemanagement://echo.endpoints.project123.cloud.goog",
+			},
+			want: util.ManagedRolloutStrategy,
+		},
+	}
+
+	for i, tc := range testData {
+		var sources []sc.ConfigSource
+		for _, uri := range tc.uris {
+			source, err := sc.NewConfigSource(uri, nil, options.DefaultConfigGeneratorOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sources = append(sources, source)
+		}
+		if got := sourcesRolloutStrategy(sources); got != tc.want {
+			t.Errorf("Test (%d): got rollout strategy of %v: %v, want: %v", i, tc.uris, got, tc.want)
+		}
 	}
 }
 
@@ -1709,9 +2182,16 @@ func TestServiceConfigAutoUpdate(t *testing.T) {
 			t.Errorf("Test Desc: %s, snapshot cache fetch got request: %v, want: %v", testCase.desc, resp.Request, req)
 		}
 
+		// Both service configs of the new rollout are served.
+		oldServiceConfig := fakeConfig
 		if fakeConfig, err = genFakeConfig(testCase.fakeNewServiceConfig); err != nil {
 			t.Fatalf("genFakeConfig failed: %v", err)
 		}
+		fakeConfigs = map[string][]byte{
+			oldConfigID: oldServiceConfig,
+			newConfigID: fakeConfig,
+		}
+		defer func() { fakeConfigs = nil }()
 		if fakeRollout, err = genFakeRollout(testCase.fakeNewServiceRollout); err != nil {
 			t.Fatalf("genFakeRollout failed: %v", err)
 		}
@@ -1723,8 +2203,41 @@ func TestServiceConfigAutoUpdate(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if resp.Version != newConfigID {
-			t.Errorf("Test Desc: %s, snapshot cache fetch got version: %v, want: %v", testCase.desc, resp.Version, newConfigID)
+		// The config id with the highest traffic percentage goes first.
+		wantVersion := newConfigID + "+" + oldConfigID
+		if resp.Version != wantVersion {
+			t.Errorf("Test Desc: %s, snapshot cache fetch got version: %v, want: %v", testCase.desc, resp.Version, wantVersion)
+		}
+		wantTrafficPercents := map[string]float64{
+			oldConfigID: 40,
+			newConfigID: 60,
+		}
+		if got := env.configManager.Status().Services[0].TrafficPercents; !reflect.DeepEqual(got, wantTrafficPercents) {
+			t.Errorf("Test Desc: %s, status got traffic percents: %v, want: %v", testCase.desc, got, wantTrafficPercents)
+		}
+
+		// The old service config serves 40% of the requests with its own routes.
+		routeResp, err := env.configManager.cache.Fetch(ctx, v2pb.DiscoveryRequest{
+			Node: &corepb.Node{
+				Id: opts.Node,
+			},
+			TypeUrl: cache.RouteType,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes := routeResp.Resources[0].(*v2pb.RouteConfiguration).GetVirtualHosts()[0].GetRoutes()
+		if len(routes) != 2 {
+			t.Fatalf("Test Desc: %s, got routes: %v, want one for each service config", testCase.desc, routes)
+		}
+		if got := routes[0].GetMatch().GetRuntimeFraction().GetDefaultValue().GetNumerator(); got != 4000 {
+			t.Errorf("Test Desc: %s, got runtime fraction numerator: %v, want: 4000", testCase.desc, got)
+		}
+		if got := routes[0].GetMetadata().GetFilterMetadata()[util.ServiceControl].GetFields()["service_config_id"].GetStringValue(); got != oldConfigID {
+			t.Errorf("Test Desc: %s, got route service config id: %v, want: %v", testCase.desc, got, oldConfigID)
+		}
+		if routes[1].GetMatch().GetRuntimeFraction() != nil || routes[1].GetMetadata() != nil {
+			t.Errorf("Test Desc: %s, the route of the main service config should match the rest of the requests, got: %v", testCase.desc, routes[1])
 		}
 		if env.configManager.curRolloutId() != newRolloutID {
 			t.Errorf("Test Desc: %s, config manager rollout id: %v, want: %v", testCase.desc, env.configManager.curRolloutId(), newRolloutID)
@@ -1745,7 +2258,7 @@ func runTest(t *testing.T, opts options.ConfigGeneratorOptions, f func(*testEnv)
 	mockConfig := initMockConfigServer(t)
 	defer mockConfig.Close()
 	util.FetchConfigURL = func(serviceManagementUrl, serviceName, configId string) string {
-		return mockConfig.URL
+		return fmt.Sprintf("%s/%s", mockConfig.URL, configId)
 	}
 
 	mockRollout := initMockRolloutServer(t)
@@ -1774,13 +2287,26 @@ func runTest(t *testing.T, opts options.ConfigGeneratorOptions, f func(*testEnv)
 
 func initMockConfigServer(t *testing.T) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := w.Write(fakeConfig)
+		fakeConfigMutex.Lock()
+		config, ok := fakeConfigs[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			config = fakeConfig
+		}
+		fakeConfigMutex.Unlock()
+		_, err := w.Write(config)
 		if err != nil {
 			t.Fatal("fail to write config: ", err)
 		}
 	}))
 }
 
+// setFakeConfig sets the service config served by the mock config server.
+func setFakeConfig(config []byte) {
+	fakeConfigMutex.Lock()
+	defer fakeConfigMutex.Unlock()
+	fakeConfig = config
+}
+
 func initMockRolloutServer(t *testing.T) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
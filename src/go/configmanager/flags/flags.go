@@ -41,12 +41,60 @@ var (
 
 	// Backend routing configurations.
 	BackendDnsLookupFamily = flag.String("backend_dns_lookup_family", "auto", `Define the dns lookup family for all backends. The options are "auto", "v4only" and "v6only". The default is "auto".`)
+	BackendLbPolicy        = flag.String("backend_lb_policy", "round_robin", `Load balancing policy among the hosts of each backend. The options are "round_robin", "least_request", "ring_hash" by the client IP and "random".`)
+	BackendStrictDns       = flag.Bool("backend_strict_dns", false, "Resolve the backend hostnames with STRICT_DNS, to balance the requests among all their hosts, instead of LOGICAL_DNS which connects to the first host resolved. Always set for the backends with several addresses.")
+	BackendRulesPath       = flag.String("backend_rules_path", "", `Path to a JSON or YAML file of the backend rules, which override the backend flags per selector or per backend address, e.g.
+	rules: [{selector: "*", retry_policy: {retry_on: "5xx", num_retries: 2}}, {backend: "https://example.com", retry_policy: {...}}].
+	The selector is a method name, "*" or a prefix ending with ".*", and the most specific one wins over the backend address.
+	The retry_policy is the Envoy route RetryPolicy.
+	The rule of a method name with a backend rule address in the service config can split its requests among weighted_backends, e.g. [{address: "https://v1.example.com", weight: 95}, {address: "https://v2.example.com", weight: 5, protocol: "h2"}].
+	The rule of a backend address can list its endpoints in host:port, and override the health check flags with health_check and outlier_detection, the Envoy core HealthCheck and cluster OutlierDetection.
+	It can override the circuit breaker flags with circuit_breakers, the Envoy cluster CircuitBreakers, and max_requests_per_connection.`)
+
+	// Retry policy of the routes to the backends.
+	BackendRetryOn              = flag.String("backend_retry_on", "", `Envoy retry_on conditions of the requests to the backends, separated by comma, e.g. "5xx,connect-failure". Applied to the catch-all route and the dynamic routes without a backend rule in --backend_rules_path. Disabled if empty.`)
+	BackendRetryNumRetries      = flag.Int("backend_retry_num_retries", 1, "Maximum retries of a request to the backends, with --backend_retry_on.")
+	BackendRetryPerTryTimeout   = flag.Duration("backend_retry_per_try_timeout", 0, "Timeout of each try of a request to the backends, with --backend_retry_on. The route timeout if 0.")
+	BackendRetriableStatusCodes = flag.String("backend_retriable_status_codes", "", `HTTP status codes of the backends to retry, separated by comma, e.g. "503,504". Adds the "retriable-status-codes" condition to --backend_retry_on.`)
+	BackendRetryGetMethods      = flag.Bool("backend_retry_get_methods", true, "Retry the requests of the GET methods once on connect-failure, refused-stream and reset, as they are idempotent, unless they have another retry policy. Only for the dynamic routes, as the catch-all route serves all the methods.")
+
+	// Active health check and outlier detection of the backend clusters.
+	BackendHealthCheckProtocol              = flag.String("backend_health_check_protocol", "", `Active health check of the hosts of the backends, "http" or "grpc". The gRPC health check only applies to the HTTP/2 backends. Disabled if empty.`)
+	BackendHealthCheckPath                  = flag.String("backend_health_check_path", "/healthz", `Path of the "http" active health check of the backends.`)
+	BackendHealthCheckInterval              = flag.Duration("backend_health_check_interval", 5*time.Second, "Interval between the active health checks of a backend host.")
+	BackendHealthCheckTimeout               = flag.Duration("backend_health_check_timeout", time.Second, "Timeout of an active health check of a backend host.")
+	BackendHealthCheckHealthyThreshold      = flag.Int("backend_health_check_healthy_threshold", 2, "Successful active health checks to mark a backend host healthy.")
+	BackendHealthCheckUnhealthyThreshold    = flag.Int("backend_health_check_unhealthy_threshold", 3, "Failed active health checks to mark a backend host unhealthy.")
+	BackendOutlierDetectionConsecutive5xx   = flag.Int("backend_outlier_detection_consecutive_5xx", 0, "Consecutive 5xx responses of a backend host to eject it from the load balancing. Disabled if 0.")
+	BackendOutlierDetectionBaseEjectionTime = flag.Duration("backend_outlier_detection_base_ejection_time", 30*time.Second, "Base time a backend host is ejected, multiplied by the number of times it has been ejected.")
+
+	// Circuit breakers and connection pool limits of the backend clusters.
+	BackendMaxConnections           = flag.Int("backend_max_connections", 0, "Maximum connections to the hosts of each backend. The Envoy default 1024 if 0.")
+	BackendMaxPendingRequests       = flag.Int("backend_max_pending_requests", 0, "Maximum requests of each backend waiting for a connection. The Envoy default 1024 if 0.")
+	BackendMaxRequests              = flag.Int("backend_max_requests", 0, "Maximum outstanding requests to each backend. The Envoy default 1024 if 0.")
+	BackendMaxRetries               = flag.Int("backend_max_retries", 0, "Maximum outstanding retries to each backend. The Envoy default 3 if 0.")
+	BackendMaxRequestsPerConnection = flag.Int("backend_max_requests_per_connection", 0, "Maximum requests per connection to the backends. Unlimited if 0.")
+
+	// Local token bucket rate limit of each operation.
+	LocalRateLimitMaxTokens     = flag.Int("local_rate_limit_max_tokens", 0, "Maximum tokens of the local rate limit bucket of each operation, which is the burst of its requests. Disabled if 0.")
+	LocalRateLimitTokensPerFill = flag.Int("local_rate_limit_tokens_per_fill", 0, "Tokens added to the local rate limit buckets at each fill. local_rate_limit_max_tokens if 0.")
+	LocalRateLimitFillInterval  = flag.Duration("local_rate_limit_fill_interval", time.Second, "Interval between the fills of the local rate limit buckets.")
+	LocalRateLimitKey           = flag.String("local_rate_limit_key", "", `Key of the local rate limit buckets, each value of which has its own bucket: "api_key", "jwt_subject", "client_ip" or "header:<name>". The requests of an operation share a bucket if empty, and the ones without the key share the bucket of an unknown key.`)
+
+	// External rate limit service shared by the replicas.
+	RateLimitServiceAddress    = flag.String("rate_limit_service_address", "", `Address of the rate limit service called for the descriptors of each operation, as "grpc://host:port" or "grpcs://host:port". Disabled if empty.`)
+	RateLimitDomain            = flag.String("rate_limit_domain", "", "Domain of the descriptors sent to the rate limit service. The service name if empty.")
+	RateLimitTimeout           = flag.Duration("rate_limit_timeout", 20*time.Millisecond, "Timeout of the calls to the rate limit service.")
+	RateLimitFailureModeDeny   = flag.Bool("rate_limit_failure_mode_deny", false, "Reject the requests with 500 if the rate limit service fails, instead of allowing them.")
+	RateLimitDescriptorHeaders = flag.String("rate_limit_descriptor_headers", "", "Comma-separated request headers, each of which makes a descriptor with the operation and its value.")
+
+	AllowConflictingHttpRules = flag.Bool("allow_conflicting_http_rules", false, "Log the HTTP rules of different selectors with the same HTTP method and path template as warnings, instead of rejecting the service config. Only the first selector in the order of the routes keeps the conflicting HTTP rule, which is dropped from the others.")
 
 	// Envoy specific configurations.
 	ClusterConnectTimeout = flag.Duration("cluster_connect_timeout", 20*time.Second, "cluster connect timeout in seconds")
 
 	// Network related configurations.
-	BackendAddress       = flag.String("backend_address", "http://127.0.0.1:8082", `The application server URI to which ESPv2 proxies requests.`)
+	BackendAddress       = flag.String("backend_address", "http://127.0.0.1:8082", `The application server URI to which ESPv2 proxies requests. Several URIs with the same scheme, separated by comma, balance the requests among them, e.g. "http://10.0.0.1:8080,http://10.0.0.2:8080".`)
 	ListenerAddress      = flag.String("listener_address", "0.0.0.0", "listener socket ip address")
 	ServiceManagementURL = flag.String("service_management_url", "https://servicemanagement.googleapis.com", "url of service management server")
 
@@ -60,6 +108,15 @@ var (
 	RootCertsPath      = flag.String("root_certs_path", util.DefaultRootCAPaths, "Path to the root certificates to make TLS connection.")
 	EnableHSTS         = flag.Bool("enable_strict_transport_security", false, "Enable HSTS (HTTP Strict Transport Security).")
 
+	// Retry policy of the calls to Service Management.
+	ServiceManagementRetryAttempts        = flag.Int("service_management_retry_attempts", 5, "Maximum attempts of each call to Service Management in the background rollout checks, including the first one. The initial fetch retries until --service_management_initial_fetch_deadline.")
+	ServiceManagementRetryInitialInterval = flag.Duration("service_management_retry_initial_interval", time.Second, "Backoff before the first retry of a call to Service Management, doubled for each retry.")
+	ServiceManagementRetryMaxInterval     = flag.Duration("service_management_retry_max_interval", 30*time.Second, "Maximum backoff between the retries of a call to Service Management.")
+	ServiceManagementRetryJitter          = flag.Float64("service_management_retry_jitter", 0.5, "Randomization factor of the backoff between the retries of a call to Service Management, between 0 and 1.")
+	ServiceManagementRetryCodes           = flag.String("service_management_retry_codes", "429,500,502,503,504", "HTTP status codes of Service Management to retry, separated by comma. Network errors are always retried.")
+	ServiceManagementInitialFetchDeadline = flag.Duration("service_management_initial_fetch_deadline", 2*time.Minute, "Overall deadline of the initial fetch from Service Management, shared by all its calls and services, after which the cached service configs are used.")
+	ServiceManagementFetchDeadline        = flag.Duration("service_management_fetch_deadline", 30*time.Second, "Overall deadline of the retries of each call to Service Management in the background rollout checks.")
+
 	// Flags for non_gcp deployment.
 	ServiceAccountKey = flag.String("service_account_key", "", `Use the service account key JSON file to access the service control and the
 	service management.  You can also set {creds_key} environment variable to the location of the service account credentials JSON file. If the option is
@@ -119,9 +176,47 @@ func EnvoyConfigOptionsFromFlags() options.ConfigGeneratorOptions {
 		CorsExposeHeaders:                       *CorsExposeHeaders,
 		CorsPreset:                              *CorsPreset,
 		BackendDnsLookupFamily:                  *BackendDnsLookupFamily,
+		BackendLbPolicy:                         *BackendLbPolicy,
+		BackendStrictDns:                        *BackendStrictDns,
+		BackendRulesPath:                        *BackendRulesPath,
+		BackendRetryOn:                          *BackendRetryOn,
+		BackendRetryNumRetries:                  *BackendRetryNumRetries,
+		BackendRetryPerTryTimeout:               *BackendRetryPerTryTimeout,
+		BackendRetriableStatusCodes:             *BackendRetriableStatusCodes,
+		BackendRetryGetMethods:                  *BackendRetryGetMethods,
+		BackendHealthCheckProtocol:              *BackendHealthCheckProtocol,
+		BackendHealthCheckPath:                  *BackendHealthCheckPath,
+		BackendHealthCheckInterval:              *BackendHealthCheckInterval,
+		BackendHealthCheckTimeout:               *BackendHealthCheckTimeout,
+		BackendHealthCheckHealthyThreshold:      *BackendHealthCheckHealthyThreshold,
+		BackendHealthCheckUnhealthyThreshold:    *BackendHealthCheckUnhealthyThreshold,
+		BackendOutlierDetectionConsecutive5xx:   *BackendOutlierDetectionConsecutive5xx,
+		BackendOutlierDetectionBaseEjectionTime: *BackendOutlierDetectionBaseEjectionTime,
+		BackendMaxConnections:                   *BackendMaxConnections,
+		BackendMaxPendingRequests:               *BackendMaxPendingRequests,
+		BackendMaxRequests:                      *BackendMaxRequests,
+		BackendMaxRetries:                       *BackendMaxRetries,
+		BackendMaxRequestsPerConnection:         *BackendMaxRequestsPerConnection,
+		LocalRateLimitMaxTokens:                 *LocalRateLimitMaxTokens,
+		LocalRateLimitTokensPerFill:             *LocalRateLimitTokensPerFill,
+		LocalRateLimitFillInterval:              *LocalRateLimitFillInterval,
+		LocalRateLimitKey:                       *LocalRateLimitKey,
+		RateLimitServiceAddress:                 *RateLimitServiceAddress,
+		RateLimitDomain:                         *RateLimitDomain,
+		RateLimitTimeout:                        *RateLimitTimeout,
+		RateLimitFailureModeDeny:                *RateLimitFailureModeDeny,
+		RateLimitDescriptorHeaders:              *RateLimitDescriptorHeaders,
+		AllowConflictingHttpRules:               *AllowConflictingHttpRules,
 		ClusterConnectTimeout:                   *ClusterConnectTimeout,
 		ListenerAddress:                         *ListenerAddress,
 		ServiceManagementURL:                    *ServiceManagementURL,
+		ServiceManagementRetryAttempts:          *ServiceManagementRetryAttempts,
+		ServiceManagementRetryInitialInterval:   *ServiceManagementRetryInitialInterval,
+		ServiceManagementRetryMaxInterval:       *ServiceManagementRetryMaxInterval,
+		ServiceManagementRetryJitter:            *ServiceManagementRetryJitter,
+		ServiceManagementRetryCodes:             *ServiceManagementRetryCodes,
+		ServiceManagementInitialFetchDeadline:   *ServiceManagementInitialFetchDeadline,
+		ServiceManagementFetchDeadline:          *ServiceManagementFetchDeadline,
 		ListenerPort:                            *ListenerPort,
 		Healthz:                                 *Healthz,
 		RootCertsPath:                           *RootCertsPath,
@@ -19,6 +19,7 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -27,6 +28,7 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/flags"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/metadata"
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
 
 	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
@@ -51,7 +53,9 @@ func main() {
 	if err != nil {
 		glog.Exitf("fail to initialize config manager: %v", err)
 	}
-	server := xds.NewServer(ctx, m.Cache(), nil)
+	// Config Manager watches the xDS requests to roll back the snapshots
+	// rejected by Envoy.
+	server := xds.NewServer(ctx, m.Cache(), m)
 	grpcServer := grpc.NewServer()
 	lis, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", opts.DiscoveryPort))
 	if err != nil {
@@ -63,6 +67,36 @@ func main() {
 
 	fmt.Printf("config manager server is running at %s .......\n", lis.Addr())
 
+	var statusServer *http.Server
+	if *configmanager.StatusServerPort != 0 {
+		statusServer = &http.Server{
+			Addr:    fmt.Sprintf("127.0.0.1:%d", *configmanager.StatusServerPort),
+			Handler: m.StatusHandler(),
+		}
+		go func() {
+			glog.Infof("config manager status server is running at %s", statusServer.Addr)
+			if err := statusServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("status server fail to serve: %v", err)
+			}
+		}()
+	}
+
+	var metricsServer *http.Server
+	if *configmanager.MetricsPort != 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		metricsServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", *configmanager.MetricsPort),
+			Handler: mux,
+		}
+		go func() {
+			glog.Infof("config manager metrics server is running at %s", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("metrics server fail to serve: %v", err)
+			}
+		}()
+	}
+
 	// Handle signals gracefully
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
@@ -71,6 +105,12 @@ func main() {
 		sig := <-signalChan
 		glog.Warningf("Server got signal %v, stopping", sig)
 		cancel()
+		if statusServer != nil {
+			statusServer.Close()
+		}
+		if metricsServer != nil {
+			metricsServer.Close()
+		}
 		grpcServer.Stop()
 	}()
 
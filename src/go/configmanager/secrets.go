@@ -0,0 +1,103 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+
+	gen "github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
+)
+
+// readSecrets reads the server and client certs as SDS secrets, and returns
+// the checksum of their content as well.
+func (m *ConfigManager) readSecrets() ([]cache.Resource, [sha256.Size]byte, error) {
+	secrets, err := gen.MakeSecrets(m.envoyConfigOptions)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, err
+	}
+
+	var resources []cache.Resource
+	h := sha256.New()
+	for _, secret := range secrets {
+		b, err := proto.Marshal(secret)
+		if err != nil {
+			return nil, [sha256.Size]byte{}, fmt.Errorf("fail to marshal secret %v, %v", secret.GetName(), err)
+		}
+		h.Write(b)
+		resources = append(resources, secret)
+	}
+	var hash [sha256.Size]byte
+	copy(hash[:], h.Sum(nil))
+	return resources, hash, nil
+}
+
+// secretResources returns the current secrets of the snapshot. Their version
+// is the checksum of their content, independent of the config ids, so that
+// rotating the certs does not change the other resources.
+func (m *ConfigManager) secretResources() cache.Resources {
+	return cache.NewResources(fmt.Sprintf("%x", m.secretsHash[:8]), m.secrets)
+}
+
+// setSecretsPollTimer checks the cert files periodically, and pushes the new
+// secrets when their content changes.
+func (m *ConfigManager) setSecretsPollTimer(interval time.Duration) {
+	go func() {
+		glog.Infof("start checking ssl cert files every %v", interval)
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if err := m.reloadSecrets(); err != nil {
+				glog.Errorf("fail to reload ssl certs, keep the current ones, %v", err)
+				m.setLastError(err)
+			}
+		}
+	}()
+}
+
+// reloadSecrets replaces the secrets of the current snapshot, if the cert
+// files have changed since the last check. The snapshots kept for rollback
+// get the new secrets as well, so that a rollback never restores old certs.
+func (m *ConfigManager) reloadSecrets() error {
+	secrets, hash, err := m.readSecrets()
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if hash == m.secretsHash {
+		return nil
+	}
+	m.secrets, m.secretsHash = secrets, hash
+
+	cur := m.curSnapshotState
+	if cur == nil {
+		return nil
+	}
+	cur.snapshot.Secrets = m.secretResources()
+	if err := m.cache.SetSnapshot(m.envoyConfigOptions.Node, cur.snapshot); err != nil {
+		return fmt.Errorf("fail to push the new secrets, %v", err)
+	}
+	if prev := m.prevSnapshotState; prev != nil {
+		prev.snapshot.Secrets = m.secretResources()
+	}
+	glog.Infof("ssl cert files are changed, pushed secrets version %v", cur.snapshot.GetVersion(cache.SecretType))
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/protobuf/ptypes"
+
+	v2pb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	authpb "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	corepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+)
+
+func TestRotateSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_manager_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(file, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("service.json", makeFakeServiceConfig(testConfigID))
+	writeFile("server.crt", "server cert")
+	writeFile("server.key", "server key")
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.SslServerCertPath = dir
+
+	flag.Set("service_json_path", filepath.Join(dir, "service.json"))
+	flag.Set("service_json_poll_interval", "0")
+	flag.Set("ssl_cert_poll_interval", "0")
+	defer flag.Set("service_json_path", "")
+	defer flag.Set("service_json_poll_interval", "10s")
+	defer flag.Set("ssl_cert_poll_interval", "10s")
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+
+	fetchServerCert := func() (string, string) {
+		resp, err := manager.cache.Fetch(context.Background(), v2pb.DiscoveryRequest{
+			Node: &corepb.Node{
+				Id: opts.Node,
+			},
+			TypeUrl: cache.SecretType,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Resources) != 1 {
+			t.Fatalf("got secrets: %v, want the server cert only", resp.Resources)
+		}
+		secret := resp.Resources[0].(*authpb.Secret)
+		if secret.GetName() != "server_cert" {
+			t.Errorf("got secret name: %v, want: server_cert", secret.GetName())
+		}
+		return resp.Version, string(secret.GetTlsCertificate().GetCertificateChain().GetInlineBytes())
+	}
+
+	// The listener references the secret instead of the cert files.
+	snapshot, err := manager.cache.GetSnapshot(opts.Node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := snapshot.Listeners.Items["https_listener"].(*v2pb.Listener)
+	tlsContext := &authpb.DownstreamTlsContext{}
+	if err := ptypes.UnmarshalAny(listener.GetFilterChains()[0].GetTransportSocket().GetTypedConfig(), tlsContext); err != nil {
+		t.Fatal(err)
+	}
+	if got := tlsContext.GetCommonTlsContext().GetTlsCertificateSdsSecretConfigs(); len(got) != 1 || got[0].GetName() != "server_cert" {
+		t.Errorf("got sds secret configs: %v, want the server cert", got)
+	}
+
+	oldVersion, cert := fetchServerCert()
+	if cert != "server cert" {
+		t.Errorf("got server cert: %v, want: server cert", cert)
+	}
+
+	// Nothing is pushed if the cert files are unchanged.
+	if err := manager.reloadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := fetchServerCert(); version != oldVersion {
+		t.Errorf("got secret version: %v, want unchanged: %v", version, oldVersion)
+	}
+
+	// The rotated cert is pushed without a new listener version.
+	writeFile("server.crt", "rotated server cert")
+	if err := manager.reloadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	version, cert := fetchServerCert()
+	if version == oldVersion || cert != "rotated server cert" {
+		t.Errorf("got secret version: %v, cert: %v, want the rotated cert with a new version", version, cert)
+	}
+	if status := manager.Status(); status.SnapshotVersion != testConfigID {
+		t.Errorf("got snapshot version: %v, want unchanged: %v", status.SnapshotVersion, testConfigID)
+	}
+
+	// The current secrets are kept if a cert file is gone.
+	os.Remove(filepath.Join(dir, "server.key"))
+	if err := manager.reloadSecrets(); err == nil || !strings.Contains(err.Error(), "fail to read key file") {
+		t.Errorf("reloadSecrets got error: %v, want the missing key file", err)
+	}
+	if _, cert := fetchServerCert(); cert != "rotated server cert" {
+		t.Errorf("got server cert: %v, want the current one", cert)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/jsonpb"
+)
+
+const (
+	statusPath       = "/status"
+	configDumpPath   = "/config_dump"
+	checkRolloutPath = "/check_rollout"
+)
+
+// Status is the state of the Config Manager served on the status server.
+// NackCount is the number of snapshots rejected by Envoy, and RollbackCount
+// is the number of them rolled back to the previous snapshot.
+type Status struct {
+	ConfigId             string          `json:"configId"`
+	RolloutId            string          `json:"rolloutId,omitempty"`
+	RolloutStrategy      string          `json:"rolloutStrategy"`
+	SnapshotVersion      string          `json:"snapshotVersion"`
+	LastRolloutCheckTime *time.Time      `json:"lastRolloutCheckTime,omitempty"`
+	LastError            string          `json:"lastError,omitempty"`
+	LastErrorTime        *time.Time      `json:"lastErrorTime,omitempty"`
+	NackCount            int             `json:"nackCount"`
+	RollbackCount        int             `json:"rollbackCount"`
+	Services             []ServiceStatus `json:"services"`
+}
+
+// ServiceStatus is the state of one endpoint service. TrafficPercents is only
+// set in a traffic percent rollout, with the percentage of each config id.
+type ServiceStatus struct {
+	Name            string             `json:"name"`
+	ConfigId        string             `json:"configId"`
+	RolloutId       string             `json:"rolloutId,omitempty"`
+	TrafficPercents map[string]float64 `json:"trafficPercents,omitempty"`
+}
+
+// ConfigDump is the Envoy configuration in the current snapshot.
+type ConfigDump struct {
+	Version   string            `json:"version"`
+	Clusters  []json.RawMessage `json:"clusters"`
+	Routes    []json.RawMessage `json:"routes"`
+	Listeners []json.RawMessage `json:"listeners"`
+}
+
+// StatusHandler returns the handler of the status server. GET /status serves
+// the config and rollout ids, the snapshot version and the last error.
+// GET /config_dump serves the generated clusters, routes and listeners in
+// JSON. POST /check_rollout checks new rollouts immediately, for managed
+// rollout strategy only.
+func (m *ConfigManager) StatusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(statusPath, m.handleStatus)
+	mux.HandleFunc(configDumpPath, m.handleConfigDump)
+	mux.HandleFunc(checkRolloutPath, m.handleCheckRollout)
+	return mux
+}
+
+// Status returns the current state of the Config Manager.
+func (m *ConfigManager) Status() *Status {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	status := &Status{
+		ConfigId:        m.curConfigId(),
+		RolloutId:       m.curRolloutId(),
+		RolloutStrategy: m.rolloutStrategy,
+		NackCount:       m.nackCount,
+		RollbackCount:   m.rollbackCount,
+	}
+	if snapshot, err := m.cache.GetSnapshot(m.envoyConfigOptions.Node); err == nil {
+		status.SnapshotVersion = snapshot.GetVersion(cache.ListenerType)
+	}
+	if !m.lastRolloutCheckTime.IsZero() {
+		lastRolloutCheckTime := m.lastRolloutCheckTime
+		status.LastRolloutCheckTime = &lastRolloutCheckTime
+	}
+	if m.lastError != nil {
+		lastErrorTime := m.lastErrorTime
+		status.LastError = m.lastError.Error()
+		status.LastErrorTime = &lastErrorTime
+	}
+	for _, s := range m.services {
+		serviceStatus := ServiceStatus{
+			Name:      s.name,
+			ConfigId:  s.curServiceConfig.GetId(),
+			RolloutId: s.curRolloutId,
+		}
+		if len(s.serviceInfo.Canaries) > 0 {
+			serviceStatus.TrafficPercents = map[string]float64{
+				s.serviceInfo.ConfigID: s.serviceInfo.TrafficPercent,
+			}
+			for _, canary := range s.serviceInfo.Canaries {
+				serviceStatus.TrafficPercents[canary.ConfigID] = canary.TrafficPercent
+			}
+		}
+		status.Services = append(status.Services, serviceStatus)
+	}
+	return status
+}
+
+// ConfigDump returns the Envoy configuration in the current snapshot.
+func (m *ConfigManager) ConfigDump() (*ConfigDump, error) {
+	snapshot, err := m.cache.GetSnapshot(m.envoyConfigOptions.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	configDump := &ConfigDump{
+		Version: snapshot.GetVersion(cache.ListenerType),
+	}
+	if configDump.Clusters, err = marshalResources(snapshot.Clusters.Items); err != nil {
+		return nil, err
+	}
+	if configDump.Routes, err = marshalResources(snapshot.Routes.Items); err != nil {
+		return nil, err
+	}
+	if configDump.Listeners, err = marshalResources(snapshot.Listeners.Items); err != nil {
+		return nil, err
+	}
+	return configDump, nil
+}
+
+// marshalResources converts the resources to JSON, ordered by name.
+func marshalResources(resources map[string]cache.Resource) ([]json.RawMessage, error) {
+	var names []string
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Any types are resolved from the registered protos, since the typed
+	// configs are not all known by util.Resolver.
+	marshaler := &jsonpb.Marshaler{}
+	out := []json.RawMessage{}
+	for _, name := range names {
+		jsonStr, err := marshaler.MarshalToString(resources[name])
+		if err != nil {
+			return nil, fmt.Errorf("fail to marshal resource %s, %v", name, err)
+		}
+		out = append(out, json.RawMessage(jsonStr))
+	}
+	return out, nil
+}
+
+func (m *ConfigManager) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, http.StatusOK, m.Status())
+}
+
+func (m *ConfigManager) handleConfigDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	configDump, err := m.ConfigDump()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("fail to dump config, %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, http.StatusOK, configDump)
+}
+
+func (m *ConfigManager) handleCheckRollout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, fmt.Sprintf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if m.rolloutStrategy != util.ManagedRolloutStrategy {
+		http.Error(w, fmt.Sprintf("rollouts are only checked with %q rollout strategy", util.ManagedRolloutStrategy), http.StatusPreconditionFailed)
+		return
+	}
+
+	glog.Infof("check new rollouts requested from the status server")
+	if err := m.checkNewRollouts(); err != nil {
+		glog.Errorf("error occurred when checking new rollouts, %v", err)
+		http.Error(w, fmt.Sprintf("fail to check new rollouts, %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, http.StatusOK, m.Status())
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("fail to marshal response, %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(body); err != nil {
+		glog.Errorf("fail to write response, %v", err)
+	}
+}
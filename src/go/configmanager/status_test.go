@@ -0,0 +1,191 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+)
+
+func makeFakeRollout(rolloutID, configID string) string {
+	return fmt.Sprintf(`{
+            "rollouts": [
+                {
+                  "rolloutId": "%s",
+                  "createTime": "2018-12-05T19:07:18.438Z",
+                  "createdBy": "mocktest@google.com",
+                  "status": "SUCCESS",
+                  "trafficPercentStrategy": {
+                    "percentages": {
+                      "%s": 100
+                    }
+                  },
+                  "serviceName": "%s"
+                }
+              ]
+            }`, rolloutID, configID, testProjectName)
+}
+
+func makeFakeServiceConfig(configID string) string {
+	return fmt.Sprintf(`{
+                "name": "%s",
+                "apis":[
+                    {
+                        "name":"%s"
+                    }
+                ],
+                "id": "%s"
+            }`, testProjectName, testEndpointName, configID)
+}
+
+func serveStatus(t *testing.T, handler http.Handler, method, path string) (int, string) {
+	req := httptest.NewRequest(method, path, nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	return resp.Code, resp.Body.String()
+}
+
+func TestStatusServerCheckRollout(t *testing.T) {
+	oldConfigID, newConfigID := "2018-12-05r0", "2018-12-05r1"
+
+	var err error
+	if fakeConfig, err = genFakeConfig(makeFakeServiceConfig(oldConfigID)); err != nil {
+		t.Fatalf("genFakeConfig failed: %v", err)
+	}
+	if fakeRollout, err = genFakeRollout(makeFakeRollout(oldConfigID, oldConfigID)); err != nil {
+		t.Fatalf("genFakeRollout failed: %v", err)
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+
+	flag.Set("service", testProjectName)
+	flag.Set("service_config_id", oldConfigID)
+	flag.Set("rollout_strategy", util.ManagedRolloutStrategy)
+	// Rollouts are only checked from the status server in this test.
+	flag.Set("check_rollout_interval", "1h")
+	flag.Set("service_json_path", "")
+	defer flag.Set("check_rollout_interval", "100ms")
+
+	runTest(t, opts, func(env *testEnv) {
+		handler := env.configManager.StatusHandler()
+
+		code, body := serveStatus(t, handler, http.MethodGet, statusPath)
+		if code != http.StatusOK {
+			t.Fatalf("GET %s got code: %v, body: %v", statusPath, code, body)
+		}
+		var status Status
+		if err := json.Unmarshal([]byte(body), &status); err != nil {
+			t.Fatal(err)
+		}
+		if status.ConfigId != oldConfigID || status.SnapshotVersion != oldConfigID || status.RolloutStrategy != util.ManagedRolloutStrategy {
+			t.Errorf("GET %s got unexpected status: %v", statusPath, body)
+		}
+		if status.LastRolloutCheckTime != nil || status.LastError != "" {
+			t.Errorf("GET %s should not have rollout checks yet, got: %v", statusPath, body)
+		}
+
+		if code, body := serveStatus(t, handler, http.MethodGet, checkRolloutPath); code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s got code: %v, body: %v, want: %v", checkRolloutPath, code, body, http.StatusMethodNotAllowed)
+		}
+
+		// A new rollout whose service config is invalid, the error is kept in the status.
+		if fakeRollout, err = genFakeRollout(makeFakeRollout(newConfigID, newConfigID)); err != nil {
+			t.Fatalf("genFakeRollout failed: %v", err)
+		}
+		fakeConfig = []byte("invalid service config")
+
+		if code, body := serveStatus(t, handler, http.MethodPost, checkRolloutPath); code != http.StatusInternalServerError {
+			t.Errorf("POST %s got code: %v, body: %v, want: %v", checkRolloutPath, code, body, http.StatusInternalServerError)
+		}
+		status = *env.configManager.Status()
+		if status.ConfigId != oldConfigID || status.SnapshotVersion != oldConfigID {
+			t.Errorf("config id should not change after a failed rollout check, got: %v", status)
+		}
+		if status.LastError == "" || status.LastErrorTime == nil || status.LastRolloutCheckTime == nil {
+			t.Errorf("last error should be set after a failed rollout check, got: %v", status)
+		}
+
+		// The new rollout is applied immediately.
+		if fakeConfig, err = genFakeConfig(makeFakeServiceConfig(newConfigID)); err != nil {
+			t.Fatalf("genFakeConfig failed: %v", err)
+		}
+		if fakeRollout, err = genFakeRollout(makeFakeRollout(newConfigID+"-retry", newConfigID)); err != nil {
+			t.Fatalf("genFakeRollout failed: %v", err)
+		}
+
+		code, body = serveStatus(t, handler, http.MethodPost, checkRolloutPath)
+		if code != http.StatusOK {
+			t.Fatalf("POST %s got code: %v, body: %v", checkRolloutPath, code, body)
+		}
+		status = Status{}
+		if err := json.Unmarshal([]byte(body), &status); err != nil {
+			t.Fatal(err)
+		}
+		if status.ConfigId != newConfigID || status.SnapshotVersion != newConfigID || status.RolloutId != newConfigID+"-retry" {
+			t.Errorf("POST %s got unexpected status: %v", checkRolloutPath, body)
+		}
+	})
+}
+
+func TestStatusServerConfigDump(t *testing.T) {
+	var err error
+	if fakeConfig, err = genFakeConfig(makeFakeServiceConfig(testConfigID)); err != nil {
+		t.Fatalf("genFakeConfig failed: %v", err)
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	opts.Healthz = "/healthz"
+
+	flag.Set("service", testProjectName)
+	flag.Set("service_config_id", testConfigID)
+	flag.Set("rollout_strategy", util.FixedRolloutStrategy)
+	flag.Set("service_json_path", "")
+
+	runTest(t, opts, func(env *testEnv) {
+		handler := env.configManager.StatusHandler()
+
+		if code, body := serveStatus(t, handler, http.MethodPost, checkRolloutPath); code != http.StatusPreconditionFailed {
+			t.Errorf("POST %s got code: %v, body: %v, want: %v", checkRolloutPath, code, body, http.StatusPreconditionFailed)
+		}
+
+		code, body := serveStatus(t, handler, http.MethodGet, configDumpPath)
+		if code != http.StatusOK {
+			t.Fatalf("GET %s got code: %v, body: %v", configDumpPath, code, body)
+		}
+		var configDump ConfigDump
+		if err := json.Unmarshal([]byte(body), &configDump); err != nil {
+			t.Fatal(err)
+		}
+		if configDump.Version != testConfigID {
+			t.Errorf("GET %s got version: %v, want: %v", configDumpPath, configDump.Version, testConfigID)
+		}
+		if len(configDump.Clusters) == 0 || len(configDump.Routes) != 1 || len(configDump.Listeners) != 1 {
+			t.Errorf("GET %s got unexpected resources: %v", configDumpPath, body)
+		}
+		if !strings.Contains(string(configDump.Listeners[0]), "envoy.health_check") {
+			t.Errorf("GET %s should dump the typed config of all filters, got listener: %s", configDumpPath, configDump.Listeners[0])
+		}
+	})
+}
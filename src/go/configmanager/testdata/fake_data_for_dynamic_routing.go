@@ -361,7 +361,25 @@ var (
                         }
                      }
                   ],
-                  "routeConfig":{
+                  "rds":{
+                     "configSource":{
+                        "ads":{}
+                     },
+                     "routeConfigName":"local_route"
+                  },
+                  "statPrefix":"ingress_http",
+                  "useRemoteAddress":false,
+                  "xffNumTrustedHops":2
+               }
+            }
+         ]
+      }
+   ]
+}
+`
+
+	FakeWantedRouteConfigForDynamicRouting = `
+{
                      "name":"local_route",
                      "virtualHosts":[
                         {
@@ -394,16 +412,15 @@ var (
                                           "name":":method"
                                        }
                                     ],
-                                    "safeRegex":{
-                                      "googleRe2":{
-                                        "maxProgramSize":1000
-                                      },
-                                      "regex":"/pet/[^\\/]+$"
-                                    }
+                                    "path":"/hello"
                                  },
                                  "route":{
-                                    "cluster":"pets.appspot.com:8008",
-                                    "hostRewrite":"pets.appspot.com",
+                                    "cluster":"us-central1-cloud-esf.cloudfunctions.net:443",
+                                    "hostRewrite":"us-central1-cloud-esf.cloudfunctions.net",
+                                    "retryPolicy":{
+                                       "numRetries":1,
+                                       "retryOn":"connect-failure,refused-stream,reset"
+                                    },
                                     "timeout":"15s"
                                  }
                               },
@@ -415,11 +432,15 @@ var (
                                           "name":":method"
                                        }
                                     ],
-                                    "path":"/hello"
+                                    "path":"/pets"
                                  },
                                  "route":{
-                                    "cluster":"us-central1-cloud-esf.cloudfunctions.net:443",
-                                    "hostRewrite":"us-central1-cloud-esf.cloudfunctions.net",
+                                    "cluster":"pets.appspot.com:443",
+                                    "hostRewrite":"pets.appspot.com",
+                                    "retryPolicy":{
+                                       "numRetries":1,
+                                       "retryOn":"connect-failure,refused-stream,reset"
+                                    },
                                     "timeout":"15s"
                                  }
                               },
@@ -431,11 +452,15 @@ var (
                                           "name":":method"
                                        }
                                     ],
-                                    "path":"/pets"
+                                    "path":"/search"
                                  },
                                  "route":{
-                                    "cluster":"pets.appspot.com:443",
-                                    "hostRewrite":"pets.appspot.com",
+                                    "cluster":"us-west2-cloud-esf.cloudfunctions.net:443",
+                                    "hostRewrite":"us-west2-cloud-esf.cloudfunctions.net",
+                                    "retryPolicy":{
+                                       "numRetries":1,
+                                       "retryOn":"connect-failure,refused-stream,reset"
+                                    },
                                     "timeout":"15s"
                                  }
                               },
@@ -447,26 +472,25 @@ var (
                                           "name":":method"
                                        }
                                     ],
-                                    "path":"/search"
+                                    "safeRegex":{
+                                      "googleRe2":{
+                                        "maxProgramSize":1000
+                                      },
+                                      "regex":"^/pet/[^/]+$"
+                                    }
                                  },
                                  "route":{
-                                    "cluster":"us-west2-cloud-esf.cloudfunctions.net:443",
-                                    "hostRewrite":"us-west2-cloud-esf.cloudfunctions.net",
+                                    "cluster":"pets.appspot.com:8008",
+                                    "hostRewrite":"pets.appspot.com",
+                                    "retryPolicy":{
+                                       "numRetries":1,
+                                       "retryOn":"connect-failure,refused-stream,reset"
+                                    },
                                     "timeout":"15s"
                                  }
                               }
                            ]
                         }
                      ]
-                  },
-                  "statPrefix":"ingress_http",
-                  "useRemoteAddress":false,
-                  "xffNumTrustedHops":2
-               }
-            }
-         ]
-      }
-   ]
-}
-`
+                  }`
 )
@@ -0,0 +1,160 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/glog"
+
+	v2pb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// snapshotState is a snapshot and the service configs it is generated from,
+// kept to roll back to when Envoy rejects the next snapshot.
+type snapshotState struct {
+	snapshot         cache.Snapshot
+	snapshotConfigId string
+	snapshotRevision int
+	serviceInfos     []*configinfo.ServiceInfo
+	serviceConfigs   []*confpb.Service
+	rolloutIds       []string
+}
+
+// sentResponse is the last response sent on an xDS stream for a type.
+type sentResponse struct {
+	nonce   string
+	version string
+}
+
+// newSnapshotState records the snapshot with the current service configs.
+func (m *ConfigManager) newSnapshotState(snapshot cache.Snapshot) *snapshotState {
+	state := &snapshotState{
+		snapshot:         snapshot,
+		snapshotConfigId: m.snapshotConfigId,
+		snapshotRevision: m.snapshotRevision,
+	}
+	for _, s := range m.services {
+		state.serviceInfos = append(state.serviceInfos, s.serviceInfo)
+		state.serviceConfigs = append(state.serviceConfigs, s.curServiceConfig)
+		state.rolloutIds = append(state.rolloutIds, s.curRolloutId)
+	}
+	return state
+}
+
+// rollbackSnapshot restores the previous snapshot and its service configs if
+// the rejected version is the current snapshot. Envoy keeps using the last
+// accepted config, so the state of Config Manager is brought back in line
+// with it.
+func (m *ConfigManager) rollbackSnapshot(rejectedVersion string, nackErr error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.nackCount++
+	snapshotNacks.Inc()
+	m.lastError = nackErr
+	m.lastErrorTime = time.Now()
+
+	cur := m.curSnapshotState
+	if cur == nil || cur.snapshot.GetVersion(cache.ListenerType) != rejectedVersion {
+		glog.Warningf("rejected snapshot version %v is not the current one, nothing to roll back", rejectedVersion)
+		return
+	}
+	prev := m.prevSnapshotState
+	if prev == nil {
+		glog.Errorf("snapshot version %v is rejected, but there is no previous snapshot to roll back to", rejectedVersion)
+		return
+	}
+
+	// The secrets do not depend on the service configs, keep the latest certs.
+	prev.snapshot.Secrets = m.secretResources()
+	if err := m.cache.SetSnapshot(m.envoyConfigOptions.Node, prev.snapshot); err != nil {
+		glog.Errorf("fail to roll back to snapshot version %v, %v", prev.snapshot.GetVersion(cache.ListenerType), err)
+		return
+	}
+	for i, s := range m.services {
+		s.serviceInfo = prev.serviceInfos[i]
+		s.curServiceConfig = prev.serviceConfigs[i]
+		s.curRolloutId = prev.rolloutIds[i]
+		m.saveServiceConfig(s)
+	}
+	m.snapshotConfigId, m.snapshotRevision = prev.snapshotConfigId, prev.snapshotRevision
+	recordConfigIdChanges(cur, prev)
+	m.curSnapshotState, m.prevSnapshotState = prev, nil
+	m.rollbackCount++
+	snapshotRollbacks.Inc()
+	glog.Warningf("rolled back from rejected snapshot version %v to version %v", rejectedVersion, prev.snapshot.GetVersion(cache.ListenerType))
+}
+
+// OnStreamOpen implements the xDS server callbacks.
+func (m *ConfigManager) OnStreamOpen(context.Context, int64, string) error {
+	return nil
+}
+
+// OnStreamClosed implements the xDS server callbacks.
+func (m *ConfigManager) OnStreamClosed(streamId int64) {
+	m.responseMutex.Lock()
+	defer m.responseMutex.Unlock()
+	delete(m.sentResponses, streamId)
+}
+
+// OnStreamRequest implements the xDS server callbacks. A request with error
+// detail is a NACK of the response with the same nonce, and the snapshot of
+// that response is rolled back.
+func (m *ConfigManager) OnStreamRequest(streamId int64, req *v2pb.DiscoveryRequest) error {
+	if req.GetErrorDetail() == nil {
+		return nil
+	}
+
+	m.responseMutex.Lock()
+	sent, ok := m.sentResponses[streamId][req.GetTypeUrl()]
+	m.responseMutex.Unlock()
+
+	rejectedVersion := ""
+	if ok && sent.nonce == req.GetResponseNonce() {
+		rejectedVersion = sent.version
+	}
+	nackErr := fmt.Errorf("Envoy rejected %v version %v, keeping version %v, %v", req.GetTypeUrl(), rejectedVersion, req.GetVersionInfo(), req.GetErrorDetail().GetMessage())
+	glog.Errorf("%v", nackErr)
+	m.rollbackSnapshot(rejectedVersion, nackErr)
+	return nil
+}
+
+// OnStreamResponse implements the xDS server callbacks. The version of each
+// response is kept to find the rejected snapshot of a NACK.
+func (m *ConfigManager) OnStreamResponse(streamId int64, req *v2pb.DiscoveryRequest, resp *v2pb.DiscoveryResponse) {
+	m.responseMutex.Lock()
+	defer m.responseMutex.Unlock()
+	if m.sentResponses[streamId] == nil {
+		m.sentResponses[streamId] = make(map[string]sentResponse)
+	}
+	m.sentResponses[streamId][resp.GetTypeUrl()] = sentResponse{
+		nonce:   resp.GetNonce(),
+		version: resp.GetVersionInfo(),
+	}
+}
+
+// OnFetchRequest implements the xDS server callbacks.
+func (m *ConfigManager) OnFetchRequest(context.Context, *v2pb.DiscoveryRequest) error {
+	return nil
+}
+
+// OnFetchResponse implements the xDS server callbacks.
+func (m *ConfigManager) OnFetchResponse(*v2pb.DiscoveryRequest, *v2pb.DiscoveryResponse) {}
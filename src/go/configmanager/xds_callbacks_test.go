@@ -0,0 +1,133 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	v2pb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+func TestRollbackRejectedSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_manager_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	servicePath := filepath.Join(dir, "service.json")
+	if err := ioutil.WriteFile(servicePath, []byte(makeFakeServiceConfig(testConfigID)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+
+	flag.Set("service_json_path", servicePath)
+	flag.Set("service_json_poll_interval", "0")
+	defer flag.Set("service_json_path", "")
+	defer flag.Set("service_json_poll_interval", "10s")
+
+	nacks, rollbacks := testutil.ToFloat64(snapshotNacks), testutil.ToFloat64(snapshotRollbacks)
+	configIdChangeCount := testutil.ToFloat64(configIdChanges.WithLabelValues(testProjectName))
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+
+	newConfigID := "2017-05-01r1"
+	if err := ioutil.WriteFile(servicePath, []byte(makeFakeServiceConfig(newConfigID)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.checkServiceConfigSource(manager.services[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Envoy accepts the clusters of the new snapshot, but rejects its listeners.
+	manager.OnStreamResponse(1, &v2pb.DiscoveryRequest{}, &v2pb.DiscoveryResponse{
+		VersionInfo: newConfigID,
+		Nonce:       "1",
+		TypeUrl:     cache.ClusterType,
+	})
+	manager.OnStreamResponse(1, &v2pb.DiscoveryRequest{}, &v2pb.DiscoveryResponse{
+		VersionInfo: newConfigID,
+		Nonce:       "2",
+		TypeUrl:     cache.ListenerType,
+	})
+	if err := manager.OnStreamRequest(1, &v2pb.DiscoveryRequest{
+		VersionInfo:   newConfigID,
+		ResponseNonce: "1",
+		TypeUrl:       cache.ClusterType,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if status := manager.Status(); status.NackCount != 0 || status.SnapshotVersion != newConfigID {
+		t.Errorf("an ACK should not roll back the snapshot, got status: %v", status)
+	}
+
+	nack := &v2pb.DiscoveryRequest{
+		VersionInfo:   testConfigID,
+		ResponseNonce: "2",
+		TypeUrl:       cache.ListenerType,
+		ErrorDetail: &statuspb.Status{
+			Message: "invalid listener",
+		},
+	}
+	if err := manager.OnStreamRequest(1, nack); err != nil {
+		t.Fatal(err)
+	}
+	status := manager.Status()
+	if status.SnapshotVersion != testConfigID || status.ConfigId != testConfigID {
+		t.Errorf("the rejected snapshot should be rolled back, got status: %v", status)
+	}
+	if status.NackCount != 1 || status.RollbackCount != 1 {
+		t.Errorf("got nack count: %v, rollback count: %v, want: 1, 1", status.NackCount, status.RollbackCount)
+	}
+	if gotNacks, gotRollbacks := testutil.ToFloat64(snapshotNacks)-nacks, testutil.ToFloat64(snapshotRollbacks)-rollbacks; gotNacks != 1 || gotRollbacks != 1 {
+		t.Errorf("got nack metric: %v, rollback metric: %v, want: 1, 1", gotNacks, gotRollbacks)
+	}
+	// The initial config id, the new one and the rollback.
+	if got := testutil.ToFloat64(configIdChanges.WithLabelValues(testProjectName)) - configIdChangeCount; got != 3 {
+		t.Errorf("got config id change metric: %v, want: 3", got)
+	}
+	if !strings.Contains(status.LastError, "invalid listener") || !strings.Contains(status.LastError, newConfigID) {
+		t.Errorf("got last error: %v, want the NACK error", status.LastError)
+	}
+
+	// The same NACK again, the snapshot is already rolled back.
+	if err := manager.OnStreamRequest(1, nack); err != nil {
+		t.Fatal(err)
+	}
+	status = manager.Status()
+	if status.SnapshotVersion != testConfigID || status.NackCount != 2 || status.RollbackCount != 1 {
+		t.Errorf("a NACK of an old snapshot should not roll back again, got status: %v", status)
+	}
+
+	// The responses of a closed stream are forgotten.
+	manager.OnStreamClosed(1)
+	if len(manager.sentResponses) != 0 {
+		t.Errorf("got sent responses: %v, want none after the stream is closed", manager.sentResponses)
+	}
+}
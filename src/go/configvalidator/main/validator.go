@@ -0,0 +1,65 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The validator generates the Envoy configuration for service configs without
+// starting any server. It prints the generated clusters and listeners, or the
+// validation errors with a non-zero exit code.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/flags"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configvalidator"
+	"github.com/golang/protobuf/jsonpb"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] service_config.json [service_config.json ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := flags.EnvoyConfigOptionsFromFlags()
+	serviceConfigs, errs := configvalidator.ReadServiceConfigs(flag.Args())
+	if len(errs) > 0 {
+		exitWithErrors(errs)
+	}
+	staticResources, errs := configvalidator.GenerateStaticResources(serviceConfigs, opts)
+	if len(errs) > 0 {
+		exitWithErrors(errs)
+	}
+
+	marshaler := &jsonpb.Marshaler{
+		Indent: "  ",
+	}
+	if err := marshaler.Marshal(os.Stdout, staticResources); err != nil {
+		exitWithErrors([]error{fmt.Errorf("fail to marshal Envoy config, %v", err)})
+	}
+	fmt.Println()
+}
+
+func exitWithErrors(errs []error) {
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	}
+	os.Exit(1)
+}
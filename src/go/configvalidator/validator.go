@@ -0,0 +1,99 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package configvalidator generates the Envoy configuration from service
+// configs offline, so that they can be validated before being deployed.
+package configvalidator
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	gen "github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
+	bootstrappb "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v2"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// ReadServiceConfigs reads the service configs in JSON or YAML, in the same
+// format as --service_json_path. The errors of all files are returned.
+func ReadServiceConfigs(paths []string) ([]*confpb.Service, []error) {
+	var serviceConfigs []*confpb.Service
+	var errs []error
+	for _, path := range paths {
+		serviceConfig, err := readServiceConfig(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		serviceConfigs = append(serviceConfigs, serviceConfig)
+	}
+	return serviceConfigs, errs
+}
+
+func readServiceConfig(path string) (*confpb.Service, error) {
+	config, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read service config file: %s, error: %v", path, err)
+	}
+
+	serviceConfig, err := util.UnmarshalServiceConfigFile(path, config)
+	if err != nil {
+		return nil, fmt.Errorf("fail to unmarshal service config file: %s, error: %v", path, err)
+	}
+	return serviceConfig, nil
+}
+
+// GenerateStaticResources generates the Envoy clusters and listeners for the
+// service configs, the same way as Config Manager does. The errors of all
+// services are returned, instead of stopping at the first one.
+func GenerateStaticResources(serviceConfigs []*confpb.Service, opts options.ConfigGeneratorOptions) (*bootstrappb.Bootstrap_StaticResources, []error) {
+	if len(serviceConfigs) == 0 {
+		return nil, []error{fmt.Errorf("at least one service config is required")}
+	}
+
+	var serviceInfos []*configinfo.ServiceInfo
+	var errs []error
+	for _, serviceConfig := range serviceConfigs {
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.GetId(), opts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %s: fail to initialize ServiceInfo, %v", serviceConfig.GetName(), err))
+			continue
+		}
+		serviceInfos = append(serviceInfos, serviceInfo)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	clusters, err := gen.MakeClusters(serviceInfos...)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("fail to make clusters, %v", err))
+	}
+	listeners, err := gen.MakeListeners(serviceInfos...)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("fail to make listeners, %v", err))
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return &bootstrappb.Bootstrap_StaticResources{
+		Listeners: listeners,
+		Clusters:  clusters,
+	}, nil
+}
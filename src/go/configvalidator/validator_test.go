@@ -0,0 +1,173 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configvalidator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestReadServiceConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configvalidator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	validPath := filepath.Join(dir, "valid.json")
+	if err := ioutil.WriteFile(validPath, []byte(`{"name": "bookstore.endpoints.project123.cloud.goog", "id": "2017-05-01r0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalidPath := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalidPath, []byte(`{"name": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missingPath := filepath.Join(dir, "missing.json")
+
+	serviceConfigs, errs := ReadServiceConfigs([]string{validPath, invalidPath, missingPath})
+	if len(serviceConfigs) != 1 || serviceConfigs[0].GetId() != "2017-05-01r0" {
+		t.Errorf("ReadServiceConfigs got service configs: %v, want the valid one only", serviceConfigs)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("ReadServiceConfigs got errors: %v, want one for each invalid file", errs)
+	}
+	if !strings.Contains(errs[0].Error(), invalidPath) || !strings.Contains(errs[1].Error(), missingPath) {
+		t.Errorf("ReadServiceConfigs errors should contain the file paths, got: %v", errs)
+	}
+}
+
+func TestGenerateStaticResources(t *testing.T) {
+	testData := []struct {
+		desc           string
+		serviceConfigs []*confpb.Service
+		backendAddress string
+		wantErrors     []string
+		wantClusters   []string
+		wantListeners  []string
+	}{
+		{
+			desc: "Success for http backend",
+			serviceConfigs: []*confpb.Service{
+				{
+					Name: "bookstore.endpoints.project123.cloud.goog",
+					Id:   "2017-05-01r0",
+					Apis: []*apipb.Api{
+						{
+							Name: "endpoints.examples.bookstore.Bookstore",
+						},
+					},
+				},
+			},
+			backendAddress: "http://127.0.0.1:8082",
+			wantClusters: []string{
+				"bookstore.endpoints.project123.cloud.goog_local",
+				"metadata-cluster",
+			},
+			wantListeners: []string{"http_listener"},
+		},
+		{
+			desc: "Errors of all services are reported",
+			serviceConfigs: []*confpb.Service{
+				{
+					Name: "bookstore.endpoints.project123.cloud.goog",
+				},
+				{
+					Name: "echo.endpoints.project123.cloud.goog",
+					Apis: []*apipb.Api{
+						{
+							Name: "endpoints.examples.echo.Echo",
+						},
+					},
+					Backend: &confpb.Backend{
+						Rules: []*confpb.BackendRule{
+							{
+								Selector: "endpoints.examples.echo.Echo.Echo",
+								Address:  "https://127.0.0.1/echo",
+							},
+						},
+					},
+				},
+			},
+			backendAddress: "http://127.0.0.1:8082",
+			wantErrors: []string{
+				"service bookstore.endpoints.project123.cloud.goog: fail to initialize ServiceInfo, service config must have one api at least",
+				"service echo.endpoints.project123.cloud.goog: fail to initialize ServiceInfo, dynamic routing only supports domain name, got IP address: 127.0.0.1",
+			},
+		},
+		{
+			desc: "Fail for unsupported backend protocol",
+			serviceConfigs: []*confpb.Service{
+				{
+					Name: "bookstore.endpoints.project123.cloud.goog",
+					Apis: []*apipb.Api{
+						{
+							Name: "endpoints.examples.bookstore.Bookstore",
+						},
+					},
+				},
+			},
+			backendAddress: "ftp://127.0.0.1:8082",
+			wantErrors: []string{
+				"service bookstore.endpoints.project123.cloud.goog: fail to initialize ServiceInfo",
+			},
+		},
+		{
+			desc:       "Fail without service configs",
+			wantErrors: []string{"at least one service config is required"},
+		},
+	}
+
+	for _, tc := range testData {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = tc.backendAddress
+
+		staticResources, errs := GenerateStaticResources(tc.serviceConfigs, opts)
+		if len(errs) != len(tc.wantErrors) {
+			t.Errorf("Test (%s): got errors: %v, want: %v", tc.desc, errs, tc.wantErrors)
+			continue
+		}
+		for i, wantError := range tc.wantErrors {
+			if !strings.Contains(errs[i].Error(), wantError) {
+				t.Errorf("Test (%s): got error: %v, want: %v", tc.desc, errs[i], wantError)
+			}
+		}
+		if len(tc.wantErrors) > 0 {
+			continue
+		}
+
+		var gotClusters []string
+		for _, cluster := range staticResources.GetClusters() {
+			gotClusters = append(gotClusters, cluster.GetName())
+		}
+		if strings.Join(gotClusters, ",") != strings.Join(tc.wantClusters, ",") {
+			t.Errorf("Test (%s): got clusters: %v, want: %v", tc.desc, gotClusters, tc.wantClusters)
+		}
+		var gotListeners []string
+		for _, listener := range staticResources.GetListeners() {
+			gotListeners = append(gotListeners, listener.GetName())
+		}
+		if strings.Join(gotListeners, ",") != strings.Join(tc.wantListeners, ",") {
+			t.Errorf("Test (%s): got listeners: %v, want: %v", tc.desc, gotListeners, tc.wantListeners)
+		}
+	}
+}
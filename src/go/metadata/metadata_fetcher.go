@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -26,6 +27,8 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/service_control"
 )
@@ -34,6 +37,13 @@ const (
 	tokenExpiry = 3599
 )
 
+var (
+	metadataCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_manager_metadata_server_calls_total",
+		Help: "Number of calls to the metadata server, by metadata key and HTTP status code. The code is \"error\" if no response is received.",
+	}, []string{"key", "code"})
+)
+
 type tokenInfo struct {
 	accessToken  string
 	tokenTimeout time.Time
@@ -73,14 +83,26 @@ func (mf *MetadataFetcher) createUrl(suffix string) string {
 	return mf.baseUrl + suffix
 }
 
+// metadataKey returns the metadata key of the path without the query, e.g.
+// the audience of an identity token, to keep the metric labels bounded.
+func (mf *MetadataFetcher) metadataKey(path string) string {
+	key := strings.TrimPrefix(path, mf.baseUrl)
+	if i := strings.Index(key, "?"); i >= 0 {
+		key = key[:i]
+	}
+	return key
+}
+
 func (mf *MetadataFetcher) getMetadata(path string) ([]byte, error) {
 	req, _ := http.NewRequest("GET", path, nil)
 	req.Header.Add("Metadata-Flavor", "Google")
 	resp, err := mf.client.Do(req)
 	if err != nil {
+		metadataCalls.WithLabelValues(mf.metadataKey(path), "error").Inc()
 		return nil, err
 	}
 	defer resp.Body.Close()
+	metadataCalls.WithLabelValues(mf.metadataKey(path), strconv.Itoa(resp.StatusCode)).Inc()
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf(`failed fetching metadata: %v, status code %v"`, path, resp.StatusCode)
 	}
@@ -22,6 +22,7 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/service_control"
 )
@@ -171,6 +172,7 @@ func TestFetchServiceName(t *testing.T) {
 
 	mf := NewMockMetadataFetcher(ts.GetURL(), time.Now())
 
+	calls := testutil.ToFloat64(metadataCalls.WithLabelValues(util.ServiceNameSuffix, "200"))
 	name, err := mf.FetchServiceName()
 	if err != nil {
 		t.Fatal(err)
@@ -178,6 +180,9 @@ func TestFetchServiceName(t *testing.T) {
 	if !strings.EqualFold(name, fakeServiceName) {
 		t.Errorf("fetchServiceName = %s, want %s", name, fakeServiceName)
 	}
+	if got := testutil.ToFloat64(metadataCalls.WithLabelValues(util.ServiceNameSuffix, "200")) - calls; got != 1 {
+		t.Errorf("got %v calls for key %s in the metrics, want 1", got, util.ServiceNameSuffix)
+	}
 }
 
 func TestFetchConfigId(t *testing.T) {
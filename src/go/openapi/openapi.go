@@ -0,0 +1,593 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package openapi translates OpenAPI 2.0 documents into service configs, the
+// same way as Service Management does when the documents are deployed, so
+// that ESPv2 can serve an API without deploying it first.
+package openapi
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	anypb "github.com/golang/protobuf/ptypes/any"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+	apipb "google.golang.org/genproto/protobuf/api"
+	sourcecontextpb "google.golang.org/genproto/protobuf/source_context"
+)
+
+const (
+	allowConfigured = "configured"
+	allowAll        = "all"
+
+	securityTypeApiKey = "apiKey"
+	securityTypeOAuth2 = "oauth2"
+)
+
+// The operations of a path item, in the order of the OpenAPI specification.
+var operationVerbs = []string{"get", "put", "post", "delete", "options", "head", "patch"}
+
+// The methods generated for x-google-allow: all, which accept the calls to
+// any path not in the document.
+var allowAllVerbs = []string{"get", "delete", "patch", "post", "put"}
+
+type document struct {
+	Swagger             string                     `json:"swagger"`
+	Info                info                       `json:"info"`
+	Host                string                     `json:"host"`
+	BasePath            string                     `json:"basePath"`
+	Paths               map[string]pathItem        `json:"paths"`
+	SecurityDefinitions map[string]*securityScheme `json:"securityDefinitions"`
+	Security            *[]securityRequirement     `json:"security"`
+	Backend             *backend                   `json:"x-google-backend"`
+	Allow               string                     `json:"x-google-allow"`
+	Endpoints           []endpoint                 `json:"x-google-endpoints"`
+}
+
+type info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// pathItem holds the operations keyed by their verbs, and the parameters
+// shared by them.
+type pathItem map[string]json.RawMessage
+
+type operation struct {
+	OperationId string      `json:"operationId"`
+	Parameters  []parameter `json:"parameters"`
+	// Nil if the operation uses the security requirements of the document.
+	Security *[]securityRequirement `json:"security"`
+	Backend  *backend               `json:"x-google-backend"`
+}
+
+type parameter struct {
+	Name string `json:"name"`
+	In   string `json:"in"`
+}
+
+// securityRequirement maps the names of security schemes to their scopes.
+// All the schemes of a requirement are needed, any of the requirements of an
+// operation can be used.
+type securityRequirement map[string][]string
+
+type securityScheme struct {
+	Type string `json:"type"`
+	// For apiKey schemes.
+	Name string `json:"name"`
+	In   string `json:"in"`
+	// For oauth2 schemes.
+	Issuer       string        `json:"x-google-issuer"`
+	JwksUri      string        `json:"x-google-jwks_uri"`
+	Audiences    string        `json:"x-google-audiences"`
+	JwtLocations []jwtLocation `json:"x-google-jwt-locations"`
+}
+
+type jwtLocation struct {
+	Header      string `json:"header"`
+	Query       string `json:"query"`
+	ValuePrefix string `json:"value_prefix"`
+}
+
+type backend struct {
+	Address         string `json:"address"`
+	JwtAudience     string `json:"jwt_audience"`
+	DisableAuth     bool   `json:"disable_auth"`
+	PathTranslation string `json:"path_translation"`
+	// json.Number accepts the string scalars of the YAML documents as well.
+	Deadline json.Number `json:"deadline"`
+	Protocol string      `json:"protocol"`
+}
+
+type endpoint struct {
+	Name      string `json:"name"`
+	Target    string `json:"target"`
+	AllowCors bool   `json:"allowCors"`
+}
+
+// ReadServiceConfig reads the OpenAPI document in the file, in JSON or YAML by
+// its extension or its content, and translates it into a service config, and
+// returns the checksum of the document as well.
+func ReadServiceConfig(path string) (*confpb.Service, [sha256.Size]byte, error) {
+	doc, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, fmt.Errorf("fail to read OpenAPI file: %s, error: %s", path, err)
+	}
+	hash := sha256.Sum256(doc)
+
+	serviceConfig, err := ToServiceConfig(doc, filepath.Base(path))
+	if err != nil {
+		return nil, hash, fmt.Errorf("fail to translate OpenAPI file: %s, error: %v", path, err)
+	}
+	return serviceConfig, hash, nil
+}
+
+// ToServiceConfig translates the OpenAPI 2.0 document in JSON or YAML, by the
+// extension of the file name or the content, into a service config. The service is named by the host of the document, and the config id
+// is derived from the document content, so that it changes with the document.
+//
+// Service Control is not enabled in the service config, since the service is
+// not managed by Service Management.
+func ToServiceConfig(doc []byte, fileName string) (*confpb.Service, error) {
+	isYAML := util.IsYAMLFile(fileName, doc)
+	jsonDoc := doc
+	fileType := smpb.ConfigFile_OPEN_API_JSON
+	if isYAML {
+		var err error
+		if jsonDoc, err = util.YAMLToJSON(doc); err != nil {
+			return nil, fmt.Errorf("fail to unmarshal OpenAPI document, %v", err)
+		}
+		fileType = smpb.ConfigFile_OPEN_API_YAML
+	}
+	var d document
+	if err := json.Unmarshal(jsonDoc, &d); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal OpenAPI document, %v", err)
+	}
+	if d.Swagger != "2.0" {
+		return nil, fmt.Errorf("only OpenAPI 2.0 is supported, got swagger: %q", d.Swagger)
+	}
+	if d.Host == "" {
+		return nil, fmt.Errorf("host is required as the service name")
+	}
+
+	hash := sha256.Sum256(doc)
+	sourceFile, err := ptypes.MarshalAny(&smpb.ConfigFile{
+		FilePath:     fileName,
+		FileContents: doc,
+		FileType:     fileType,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := &translator{
+		doc:     &d,
+		apiName: apiName(d.Host, d.Info.Version),
+		serviceConfig: &confpb.Service{
+			Name:  d.Host,
+			Id:    fmt.Sprintf("openapi-%x", hash[:8]),
+			Title: d.Info.Title,
+			SourceInfo: &confpb.SourceInfo{
+				SourceFiles: []*anypb.Any{sourceFile},
+			},
+		},
+		methodNames: make(map[string]bool),
+	}
+	t.serviceConfig.Apis = []*apipb.Api{
+		{
+			Name:    t.apiName,
+			Version: d.Info.Version,
+			SourceContext: &sourcecontextpb.SourceContext{
+				FileName: fileName,
+			},
+		},
+	}
+	if err := t.translate(); err != nil {
+		return nil, err
+	}
+	return t.serviceConfig, nil
+}
+
+// apiName returns the api name of Service Management, e.g.
+// 1.bookstore_endpoints_project_cloud_goog for version 1.0.0 of the service
+// bookstore.endpoints.project.cloud.goog.
+func apiName(host, version string) string {
+	major := strings.TrimPrefix(version, "v")
+	if i := strings.IndexFunc(major, func(r rune) bool { return !unicode.IsDigit(r) }); i >= 0 {
+		major = major[:i]
+	}
+	if major == "" {
+		major = "1"
+	}
+	return major + "." + strings.NewReplacer(".", "_", "-", "_").Replace(host)
+}
+
+type translator struct {
+	doc           *document
+	apiName       string
+	serviceConfig *confpb.Service
+	// The short names of the methods, to reject duplicated operation ids.
+	methodNames map[string]bool
+}
+
+func (t *translator) translate() error {
+	if err := t.translateEndpoints(); err != nil {
+		return err
+	}
+	if err := t.translateSecurityDefinitions(); err != nil {
+		return err
+	}
+
+	sc := t.serviceConfig
+	sc.Backend = &confpb.Backend{}
+	sc.Http = &annotationspb.Http{}
+	sc.Usage = &confpb.Usage{}
+	sc.SystemParameters = &confpb.SystemParameters{}
+
+	// The paths are sorted, so that the service config is stable.
+	var paths []string
+	for path := range t.doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := t.translatePathItem(path, t.doc.Paths[path]); err != nil {
+			return err
+		}
+	}
+
+	switch t.doc.Allow {
+	case "", allowConfigured:
+	case allowAll:
+		for _, verb := range allowAllVerbs {
+			selector, err := t.addMethod(fmt.Sprintf("_%s_anypath", verb))
+			if err != nil {
+				return err
+			}
+			sc.Http.Rules = append(sc.Http.Rules, makeHttpRule(selector, verb, "/**", ""))
+			sc.Usage.Rules = append(sc.Usage.Rules, &confpb.UsageRule{
+				Selector:               selector,
+				AllowUnregisteredCalls: true,
+			})
+		}
+	default:
+		return fmt.Errorf(`x-google-allow must be either "%s" or "%s", got %q`, allowConfigured, allowAll, t.doc.Allow)
+	}
+	return nil
+}
+
+// translateEndpoints adds the endpoint of the service, and the ones of
+// x-google-endpoints.
+func (t *translator) translateEndpoints() error {
+	serviceEndpoint := &confpb.Endpoint{
+		Name: t.doc.Host,
+	}
+	t.serviceConfig.Endpoints = []*confpb.Endpoint{serviceEndpoint}
+	for _, e := range t.doc.Endpoints {
+		if e.Name == "" {
+			return fmt.Errorf("name is required in x-google-endpoints")
+		}
+		if e.Name == t.doc.Host {
+			serviceEndpoint.Target = e.Target
+			serviceEndpoint.AllowCors = e.AllowCors
+			continue
+		}
+		t.serviceConfig.Endpoints = append(t.serviceConfig.Endpoints, &confpb.Endpoint{
+			Name:      e.Name,
+			Target:    e.Target,
+			AllowCors: e.AllowCors,
+		})
+	}
+	return nil
+}
+
+// translateSecurityDefinitions adds the oauth2 security schemes as the
+// authentication providers, ordered by their names.
+func (t *translator) translateSecurityDefinitions() error {
+	t.serviceConfig.Authentication = &confpb.Authentication{}
+	var names []string
+	for name := range t.doc.SecurityDefinitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		scheme := t.doc.SecurityDefinitions[name]
+		switch scheme.Type {
+		case securityTypeApiKey:
+			if scheme.Name == "" || (scheme.In != "query" && scheme.In != "header") {
+				return fmt.Errorf(`security definition %s of type apiKey must have a name, and be in either "query" or "header"`, name)
+			}
+		case securityTypeOAuth2:
+			if scheme.Issuer == "" {
+				return fmt.Errorf("security definition %s of type oauth2 must have x-google-issuer", name)
+			}
+			provider := &confpb.AuthProvider{
+				Id:        name,
+				Issuer:    scheme.Issuer,
+				JwksUri:   scheme.JwksUri,
+				Audiences: scheme.Audiences,
+			}
+			for _, l := range scheme.JwtLocations {
+				location := &confpb.JwtLocation{
+					ValuePrefix: l.ValuePrefix,
+				}
+				switch {
+				case l.Header != "" && l.Query == "":
+					location.In = &confpb.JwtLocation_Header{Header: l.Header}
+				case l.Query != "" && l.Header == "":
+					location.In = &confpb.JwtLocation_Query{Query: l.Query}
+				default:
+					return fmt.Errorf("x-google-jwt-locations of security definition %s must have either a header or a query", name)
+				}
+				provider.JwtLocations = append(provider.JwtLocations, location)
+			}
+			t.serviceConfig.Authentication.Providers = append(t.serviceConfig.Authentication.Providers, provider)
+		default:
+			return fmt.Errorf("security definition %s has unsupported type %q, only apiKey and oauth2 are supported", name, scheme.Type)
+		}
+	}
+	return nil
+}
+
+func (t *translator) translatePathItem(path string, item pathItem) error {
+	var sharedParameters []parameter
+	if raw, ok := item["parameters"]; ok {
+		if err := json.Unmarshal(raw, &sharedParameters); err != nil {
+			return fmt.Errorf("invalid parameters of path %s, %v", path, err)
+		}
+	}
+
+	for _, verb := range operationVerbs {
+		raw, ok := item[verb]
+		if !ok {
+			continue
+		}
+		var op operation
+		if err := json.Unmarshal(raw, &op); err != nil {
+			return fmt.Errorf("invalid operation %s %s, %v", strings.ToUpper(verb), path, err)
+		}
+		if err := t.translateOperation(path, verb, &op, sharedParameters); err != nil {
+			return fmt.Errorf("operation %s %s: %v", strings.ToUpper(verb), path, err)
+		}
+	}
+	return nil
+}
+
+func (t *translator) translateOperation(path, verb string, op *operation, sharedParameters []parameter) error {
+	name := op.OperationId
+	if name == "" {
+		// E.g. Get_shelves_shelf for GET /shelves/{shelf}.
+		name = verb + strings.NewReplacer("{", "", "}", "").Replace(path)
+	}
+	selector, err := t.addMethod(methodName(name))
+	if err != nil {
+		return err
+	}
+	sc := t.serviceConfig
+
+	body := ""
+	for _, p := range append(sharedParameters, op.Parameters...) {
+		if p.In == "body" {
+			body = p.Name
+		}
+	}
+	sc.Http.Rules = append(sc.Http.Rules, makeHttpRule(selector, verb, joinPath(t.doc.BasePath, path), body))
+
+	backendRule, err := makeBackendRule(selector, t.doc.Backend, op.Backend)
+	if err != nil {
+		return err
+	}
+	sc.Backend.Rules = append(sc.Backend.Rules, backendRule)
+
+	security := t.doc.Security
+	if op.Security != nil {
+		security = op.Security
+	}
+	requirements, apiKeyScheme, err := t.translateSecurity(security)
+	if err != nil {
+		return err
+	}
+	// Service Management adds an authentication rule for every method once
+	// there are security definitions.
+	if len(t.doc.SecurityDefinitions) > 0 {
+		sc.Authentication.Rules = append(sc.Authentication.Rules, &confpb.AuthenticationRule{
+			Selector:     selector,
+			Requirements: requirements,
+		})
+	}
+	sc.Usage.Rules = append(sc.Usage.Rules, &confpb.UsageRule{
+		Selector:               selector,
+		AllowUnregisteredCalls: apiKeyScheme == nil,
+	})
+	// The API key in the default query parameter is found without a system
+	// parameter.
+	if apiKeyScheme != nil && !(apiKeyScheme.In == "query" && apiKeyScheme.Name == util.DefaultApiKeyQueryParamKey) {
+		parameter := &confpb.SystemParameter{
+			Name: util.ApiKeyParameterName,
+		}
+		if apiKeyScheme.In == "query" {
+			parameter.UrlQueryParameter = apiKeyScheme.Name
+		} else {
+			parameter.HttpHeader = apiKeyScheme.Name
+		}
+		sc.SystemParameters.Rules = append(sc.SystemParameters.Rules, &confpb.SystemParameterRule{
+			Selector:   selector,
+			Parameters: []*confpb.SystemParameter{parameter},
+		})
+	}
+	return nil
+}
+
+// addMethod adds the method to the api, and returns its selector.
+func (t *translator) addMethod(name string) (string, error) {
+	if t.methodNames[name] {
+		return "", fmt.Errorf("duplicated operation %s", name)
+	}
+	t.methodNames[name] = true
+	api := t.serviceConfig.Apis[0]
+	api.Methods = append(api.Methods, &apipb.Method{
+		Name: name,
+	})
+	return fmt.Sprintf("%s.%s", t.apiName, name), nil
+}
+
+// translateSecurity returns the authentication requirements of the oauth2
+// schemes of the security requirements, and the apiKey scheme if any. The
+// requirements are satisfied by any of the providers.
+func (t *translator) translateSecurity(security *[]securityRequirement) ([]*confpb.AuthRequirement, *securityScheme, error) {
+	if security == nil {
+		return nil, nil, nil
+	}
+	var requirements []*confpb.AuthRequirement
+	var apiKeyScheme *securityScheme
+	providers := make(map[string]bool)
+	for _, requirement := range *security {
+		var names []string
+		for name := range requirement {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			scheme, ok := t.doc.SecurityDefinitions[name]
+			if !ok {
+				return nil, nil, fmt.Errorf("security definition %s is not found", name)
+			}
+			if scheme.Type == securityTypeApiKey {
+				apiKeyScheme = scheme
+				continue
+			}
+			if providers[name] {
+				continue
+			}
+			providers[name] = true
+			requirements = append(requirements, &confpb.AuthRequirement{
+				ProviderId: name,
+				Audiences:  scheme.Audiences,
+			})
+		}
+	}
+	return requirements, apiKeyScheme, nil
+}
+
+// makeBackendRule returns the backend rule of the operation. The
+// x-google-backend of the operation overrides the one of the document.
+func makeBackendRule(selector string, docBackend, opBackend *backend) (*confpb.BackendRule, error) {
+	rule := &confpb.BackendRule{
+		Selector: selector,
+	}
+	b := opBackend
+	// The path of the request is appended to the address of the document,
+	// while the address of an operation is used as is by default.
+	defaultTranslation := confpb.BackendRule_CONSTANT_ADDRESS
+	if b == nil {
+		b = docBackend
+		defaultTranslation = confpb.BackendRule_APPEND_PATH_TO_ADDRESS
+	}
+	if b == nil {
+		return rule, nil
+	}
+	if b.Address == "" {
+		return nil, fmt.Errorf("address is required in x-google-backend")
+	}
+	if b.JwtAudience != "" && b.DisableAuth {
+		return nil, fmt.Errorf("jwt_audience and disable_auth cannot be both set in x-google-backend")
+	}
+
+	rule.Address = b.Address
+	if b.Deadline != "" {
+		deadline, err := b.Deadline.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid deadline %q in x-google-backend", b.Deadline)
+		}
+		rule.Deadline = deadline
+	}
+	rule.Protocol = b.Protocol
+	rule.PathTranslation = defaultTranslation
+	if b.PathTranslation != "" {
+		translation, ok := confpb.BackendRule_PathTranslation_value[b.PathTranslation]
+		if !ok || translation == int32(confpb.BackendRule_PATH_TRANSLATION_UNSPECIFIED) {
+			return nil, fmt.Errorf("path_translation must be either CONSTANT_ADDRESS or APPEND_PATH_TO_ADDRESS in x-google-backend, got %q", b.PathTranslation)
+		}
+		rule.PathTranslation = confpb.BackendRule_PathTranslation(translation)
+	}
+	if b.JwtAudience != "" {
+		rule.Authentication = &confpb.BackendRule_JwtAudience{JwtAudience: b.JwtAudience}
+	} else if b.DisableAuth {
+		rule.Authentication = &confpb.BackendRule_DisableAuth{DisableAuth: true}
+	}
+	return rule, nil
+}
+
+func makeHttpRule(selector, verb, path, body string) *annotationspb.HttpRule {
+	rule := &annotationspb.HttpRule{
+		Selector: selector,
+		Body:     body,
+	}
+	switch verb {
+	case "get":
+		rule.Pattern = &annotationspb.HttpRule_Get{Get: path}
+	case "put":
+		rule.Pattern = &annotationspb.HttpRule_Put{Put: path}
+	case "post":
+		rule.Pattern = &annotationspb.HttpRule_Post{Post: path}
+	case "delete":
+		rule.Pattern = &annotationspb.HttpRule_Delete{Delete: path}
+	case "patch":
+		rule.Pattern = &annotationspb.HttpRule_Patch{Patch: path}
+	default:
+		rule.Pattern = &annotationspb.HttpRule_Custom{
+			Custom: &annotationspb.CustomHttpPattern{
+				Kind: strings.ToUpper(verb),
+				Path: path,
+			},
+		}
+	}
+	return rule
+}
+
+// methodName returns the method name of an operation id, the same way as
+// Service Management: the first letter is capitalized, and the characters not
+// allowed in a method name are replaced by underscores.
+func methodName(operationId string) string {
+	name := []rune(operationId)
+	for i, r := range name {
+		if !(r == '_' || r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r))) {
+			name[i] = '_'
+		}
+	}
+	if len(name) > 0 {
+		name[0] = unicode.ToUpper(name[0])
+	}
+	return string(name)
+}
+
+func joinPath(basePath, path string) string {
+	basePath = strings.TrimSuffix(basePath, "/")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return basePath + path
+}
@@ -0,0 +1,475 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+)
+
+// The service configs generated by Service Management from the OpenAPI
+// documents of the examples.
+func TestReadServiceConfigLikeServiceManagement(t *testing.T) {
+	testData := []string{
+		"../../../examples/auth",
+		"../../../examples/dynamic_routing",
+		"../../../examples/service_control",
+		"../bootstrap/static/testdata/path_matcher",
+	}
+
+	for _, dir := range testData {
+		got, _, err := ReadServiceConfig(dir + "/openapi_swagger.json")
+		if err != nil {
+			t.Errorf("Test (%s): got error: %v", dir, err)
+			continue
+		}
+		file, err := os.Open(dir + "/service_config_generated.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := util.UnmarshalServiceConfig(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.GetName() != want.GetName() || got.GetTitle() != want.GetTitle() {
+			t.Errorf("Test (%s): got service %s titled %q, want: %s titled %q", dir, got.GetName(), got.GetTitle(), want.GetName(), want.GetTitle())
+		}
+		// Types are not generated from the definitions.
+		for _, method := range want.GetApis()[0].GetMethods() {
+			method.RequestTypeUrl = ""
+			method.ResponseTypeUrl = ""
+		}
+		checks := []struct {
+			field     string
+			got, want proto.Message
+		}{
+			{"apis", got.GetApis()[0], want.GetApis()[0]},
+			{"http", got.GetHttp(), want.GetHttp()},
+			{"backend", got.GetBackend(), want.GetBackend()},
+			{"authentication", got.GetAuthentication(), want.GetAuthentication()},
+			{"usage", got.GetUsage(), want.GetUsage()},
+			{"system_parameters", got.GetSystemParameters(), want.GetSystemParameters()},
+		}
+		for _, c := range checks {
+			if !proto.Equal(c.got, c.want) {
+				t.Errorf("Test (%s): got %s: %v, want: %v", dir, c.field, c.got, c.want)
+			}
+		}
+		if len(got.GetEndpoints()) != 1 || got.GetEndpoints()[0].GetName() != want.GetName() {
+			t.Errorf("Test (%s): got endpoints: %v, want the endpoint of the service", dir, got.GetEndpoints())
+		}
+	}
+}
+
+func TestToServiceConfig(t *testing.T) {
+	testData := []struct {
+		desc      string
+		doc       string
+		want      string
+		wantError string
+	}{
+		{
+			desc: "Operations with path parameters, base path and a generated name",
+			doc: `{
+				"swagger": "2.0",
+				"info": {"title": "Bookstore", "version": "2.1.0"},
+				"host": "bookstore.endpoints.project-id.cloud.goog",
+				"basePath": "/v2/",
+				"paths": {
+					"/shelves/{shelf}": {
+						"parameters": [{"name": "shelf", "in": "path"}],
+						"get": {"operationId": "get-shelf"},
+						"put": {"parameters": [{"name": "shelf_resource", "in": "body"}]},
+						"head": {"operationId": "headShelf"}
+					}
+				}
+			}`,
+			want: `{
+				"name": "bookstore.endpoints.project-id.cloud.goog",
+				"title": "Bookstore",
+				"apis": [{
+					"name": "2.bookstore_endpoints_project_id_cloud_goog",
+					"version": "2.1.0",
+					"methods": [{"name": "Get_shelf"}, {"name": "Put_shelves_shelf"}, {"name": "HeadShelf"}],
+					"sourceContext": {"fileName": "openapi.json"}
+				}],
+				"http": {
+					"rules": [
+						{"selector": "2.bookstore_endpoints_project_id_cloud_goog.Get_shelf", "get": "/v2/shelves/{shelf}"},
+						{"selector": "2.bookstore_endpoints_project_id_cloud_goog.Put_shelves_shelf", "put": "/v2/shelves/{shelf}", "body": "shelf_resource"},
+						{"selector": "2.bookstore_endpoints_project_id_cloud_goog.HeadShelf", "custom": {"kind": "HEAD", "path": "/v2/shelves/{shelf}"}}
+					]
+				},
+				"backend": {
+					"rules": [
+						{"selector": "2.bookstore_endpoints_project_id_cloud_goog.Get_shelf"},
+						{"selector": "2.bookstore_endpoints_project_id_cloud_goog.Put_shelves_shelf"},
+						{"selector": "2.bookstore_endpoints_project_id_cloud_goog.HeadShelf"}
+					]
+				},
+				"authentication": {},
+				"usage": {
+					"rules": [
+						{"selector": "2.bookstore_endpoints_project_id_cloud_goog.Get_shelf", "allowUnregisteredCalls": true},
+						{"selector": "2.bookstore_endpoints_project_id_cloud_goog.Put_shelves_shelf", "allowUnregisteredCalls": true},
+						{"selector": "2.bookstore_endpoints_project_id_cloud_goog.HeadShelf", "allowUnregisteredCalls": true}
+					]
+				},
+				"systemParameters": {},
+				"endpoints": [{"name": "bookstore.endpoints.project-id.cloud.goog"}]
+			}`,
+		},
+		{
+			desc: "Backend of the document, overridden by an operation",
+			doc: `{
+				"swagger": "2.0",
+				"info": {"version": "1.0.0"},
+				"host": "bookstore.endpoints.project-id.cloud.goog",
+				"x-google-backend": {"address": "https://backend.run.app", "deadline": 10},
+				"paths": {
+					"/shelves": {
+						"get": {"operationId": "listShelves"},
+						"post": {
+							"operationId": "createShelf",
+							"x-google-backend": {"address": "https://shelves.run.app/create", "disable_auth": true}
+						},
+						"delete": {
+							"operationId": "deleteShelves",
+							"x-google-backend": {"address": "https://shelves.run.app", "jwt_audience": "shelves", "path_translation": "APPEND_PATH_TO_ADDRESS", "protocol": "h2"}
+						}
+					}
+				}
+			}`,
+			want: `{
+				"name": "bookstore.endpoints.project-id.cloud.goog",
+				"apis": [{
+					"name": "1.bookstore_endpoints_project_id_cloud_goog",
+					"version": "1.0.0",
+					"methods": [{"name": "ListShelves"}, {"name": "CreateShelf"}, {"name": "DeleteShelves"}],
+					"sourceContext": {"fileName": "openapi.json"}
+				}],
+				"http": {
+					"rules": [
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.ListShelves", "get": "/shelves"},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.CreateShelf", "post": "/shelves"},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.DeleteShelves", "delete": "/shelves"}
+					]
+				},
+				"backend": {
+					"rules": [
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.ListShelves", "address": "https://backend.run.app", "deadline": 10, "pathTranslation": "APPEND_PATH_TO_ADDRESS"},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.CreateShelf", "address": "https://shelves.run.app/create", "pathTranslation": "CONSTANT_ADDRESS", "disableAuth": true},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.DeleteShelves", "address": "https://shelves.run.app", "pathTranslation": "APPEND_PATH_TO_ADDRESS", "jwtAudience": "shelves", "protocol": "h2"}
+					]
+				},
+				"authentication": {},
+				"usage": {
+					"rules": [
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.ListShelves", "allowUnregisteredCalls": true},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.CreateShelf", "allowUnregisteredCalls": true},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.DeleteShelves", "allowUnregisteredCalls": true}
+					]
+				},
+				"systemParameters": {},
+				"endpoints": [{"name": "bookstore.endpoints.project-id.cloud.goog"}]
+			}`,
+		},
+		{
+			desc: "Security of the document, overridden by operations, with API keys in a header and in the default query parameter",
+			doc: `{
+				"swagger": "2.0",
+				"info": {"version": "1.0.0"},
+				"host": "bookstore.endpoints.project-id.cloud.goog",
+				"securityDefinitions": {
+					"google_id_token": {
+						"type": "oauth2",
+						"x-google-issuer": "https://accounts.google.com",
+						"x-google-audiences": "bookstore",
+						"x-google-jwt-locations": [{"header": "X-Goog-Iap-Jwt-Assertion", "value_prefix": "Bearer "}, {"query": "jwt"}]
+					},
+					"api_key": {"type": "apiKey", "name": "x-api-token", "in": "header"},
+					"default_key": {"type": "apiKey", "name": "key", "in": "query"}
+				},
+				"security": [{"google_id_token": []}, {"api_key": []}],
+				"paths": {
+					"/shelves": {
+						"get": {"operationId": "listShelves"},
+						"post": {"operationId": "createShelf", "security": []},
+						"put": {"operationId": "updateShelf", "security": [{"default_key": []}]}
+					}
+				}
+			}`,
+			want: `{
+				"name": "bookstore.endpoints.project-id.cloud.goog",
+				"apis": [{
+					"name": "1.bookstore_endpoints_project_id_cloud_goog",
+					"version": "1.0.0",
+					"methods": [{"name": "ListShelves"}, {"name": "UpdateShelf"}, {"name": "CreateShelf"}],
+					"sourceContext": {"fileName": "openapi.json"}
+				}],
+				"http": {
+					"rules": [
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.ListShelves", "get": "/shelves"},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.UpdateShelf", "put": "/shelves"},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.CreateShelf", "post": "/shelves"}
+					]
+				},
+				"backend": {
+					"rules": [
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.ListShelves"},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.UpdateShelf"},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.CreateShelf"}
+					]
+				},
+				"authentication": {
+					"providers": [{
+						"id": "google_id_token",
+						"issuer": "https://accounts.google.com",
+						"audiences": "bookstore",
+						"jwtLocations": [{"header": "X-Goog-Iap-Jwt-Assertion", "valuePrefix": "Bearer "}, {"query": "jwt"}]
+					}],
+					"rules": [
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.ListShelves", "requirements": [{"providerId": "google_id_token", "audiences": "bookstore"}]},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.UpdateShelf"},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.CreateShelf"}
+					]
+				},
+				"usage": {
+					"rules": [
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.ListShelves"},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.UpdateShelf"},
+						{"selector": "1.bookstore_endpoints_project_id_cloud_goog.CreateShelf", "allowUnregisteredCalls": true}
+					]
+				},
+				"systemParameters": {
+					"rules": [{
+						"selector": "1.bookstore_endpoints_project_id_cloud_goog.ListShelves",
+						"parameters": [{"name": "api_key", "httpHeader": "x-api-token"}]
+					}]
+				},
+				"endpoints": [{"name": "bookstore.endpoints.project-id.cloud.goog"}]
+			}`,
+		},
+		{
+			desc: "x-google-allow and x-google-endpoints",
+			doc: `{
+				"swagger": "2.0",
+				"info": {"version": "1.0.0"},
+				"host": "echo.endpoints.project-id.cloud.goog",
+				"x-google-allow": "all",
+				"x-google-endpoints": [{"name": "echo.endpoints.project-id.cloud.goog", "allowCors": true}],
+				"paths": {
+					"/echo": {"post": {"operationId": "echo"}}
+				}
+			}`,
+			want: `{
+				"name": "echo.endpoints.project-id.cloud.goog",
+				"apis": [{
+					"name": "1.echo_endpoints_project_id_cloud_goog",
+					"version": "1.0.0",
+					"methods": [{"name": "Echo"}, {"name": "_get_anypath"}, {"name": "_delete_anypath"}, {"name": "_patch_anypath"}, {"name": "_post_anypath"}, {"name": "_put_anypath"}],
+					"sourceContext": {"fileName": "openapi.json"}
+				}],
+				"http": {
+					"rules": [
+						{"selector": "1.echo_endpoints_project_id_cloud_goog.Echo", "post": "/echo"},
+						{"selector": "1.echo_endpoints_project_id_cloud_goog._get_anypath", "get": "/**"},
+						{"selector": "1.echo_endpoints_project_id_cloud_goog._delete_anypath", "delete": "/**"},
+						{"selector": "1.echo_endpoints_project_id_cloud_goog._patch_anypath", "patch": "/**"},
+						{"selector": "1.echo_endpoints_project_id_cloud_goog._post_anypath", "post": "/**"},
+						{"selector": "1.echo_endpoints_project_id_cloud_goog._put_anypath", "put": "/**"}
+					]
+				},
+				"backend": {
+					"rules": [{"selector": "1.echo_endpoints_project_id_cloud_goog.Echo"}]
+				},
+				"authentication": {},
+				"usage": {
+					"rules": [
+						{"selector": "1.echo_endpoints_project_id_cloud_goog.Echo", "allowUnregisteredCalls": true},
+						{"selector": "1.echo_endpoints_project_id_cloud_goog._get_anypath", "allowUnregisteredCalls": true},
+						{"selector": "1.echo_endpoints_project_id_cloud_goog._delete_anypath", "allowUnregisteredCalls": true},
+						{"selector": "1.echo_endpoints_project_id_cloud_goog._patch_anypath", "allowUnregisteredCalls": true},
+						{"selector": "1.echo_endpoints_project_id_cloud_goog._post_anypath", "allowUnregisteredCalls": true},
+						{"selector": "1.echo_endpoints_project_id_cloud_goog._put_anypath", "allowUnregisteredCalls": true}
+					]
+				},
+				"systemParameters": {},
+				"endpoints": [{"name": "echo.endpoints.project-id.cloud.goog", "allowCors": true}]
+			}`,
+		},
+		{
+			desc:      "OpenAPI 3 is not supported",
+			doc:       `{"openapi": "3.0.0", "host": "bookstore.endpoints.project-id.cloud.goog"}`,
+			wantError: "only OpenAPI 2.0 is supported",
+		},
+		{
+			desc:      "Host is required",
+			doc:       `{"swagger": "2.0", "paths": {}}`,
+			wantError: "host is required",
+		},
+		{
+			desc: "Duplicated operation ids",
+			doc: `{"swagger": "2.0", "host": "bookstore.endpoints.project-id.cloud.goog", "paths": {
+				"/a": {"get": {"operationId": "get"}},
+				"/b": {"get": {"operationId": "Get"}}
+			}}`,
+			wantError: "duplicated operation Get",
+		},
+		{
+			desc: "Unknown security definition",
+			doc: `{"swagger": "2.0", "host": "bookstore.endpoints.project-id.cloud.goog", "paths": {
+				"/a": {"get": {"security": [{"firebase": []}]}}
+			}}`,
+			wantError: "security definition firebase is not found",
+		},
+		{
+			desc: "Unsupported security definition",
+			doc: `{"swagger": "2.0", "host": "bookstore.endpoints.project-id.cloud.goog", "securityDefinitions": {
+				"password": {"type": "basic"}
+			}}`,
+			wantError: `unsupported type "basic"`,
+		},
+		{
+			desc: "OAuth2 without issuer",
+			doc: `{"swagger": "2.0", "host": "bookstore.endpoints.project-id.cloud.goog", "securityDefinitions": {
+				"firebase": {"type": "oauth2"}
+			}}`,
+			wantError: "must have x-google-issuer",
+		},
+		{
+			desc: "Invalid path translation",
+			doc: `{"swagger": "2.0", "host": "bookstore.endpoints.project-id.cloud.goog", "paths": {
+				"/a": {"get": {"x-google-backend": {"address": "https://backend.run.app", "path_translation": "APPEND"}}}
+			}}`,
+			wantError: "path_translation must be either CONSTANT_ADDRESS or APPEND_PATH_TO_ADDRESS",
+		},
+		{
+			desc: "Both jwt_audience and disable_auth",
+			doc: `{"swagger": "2.0", "host": "bookstore.endpoints.project-id.cloud.goog", "paths": {
+				"/a": {"get": {"x-google-backend": {"address": "https://backend.run.app", "jwt_audience": "a", "disable_auth": true}}}
+			}}`,
+			wantError: "jwt_audience and disable_auth cannot be both set",
+		},
+		{
+			desc:      "Invalid x-google-allow",
+			doc:       `{"swagger": "2.0", "host": "bookstore.endpoints.project-id.cloud.goog", "x-google-allow": "none"}`,
+			wantError: `x-google-allow must be either "configured" or "all"`,
+		},
+	}
+
+	for _, tc := range testData {
+		got, err := ToServiceConfig([]byte(tc.doc), "openapi.json")
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want: %v", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got error: %v", tc.desc, err)
+			continue
+		}
+
+		if !strings.HasPrefix(got.GetId(), "openapi-") {
+			t.Errorf("Test (%s): got config id: %v, want one derived from the document", tc.desc, got.GetId())
+		}
+		sourceFile := &smpb.ConfigFile{}
+		if err := ptypes.UnmarshalAny(got.GetSourceInfo().GetSourceFiles()[0], sourceFile); err != nil {
+			t.Fatal(err)
+		}
+		if sourceFile.GetFileType() != smpb.ConfigFile_OPEN_API_JSON || string(sourceFile.GetFileContents()) != tc.doc {
+			t.Errorf("Test (%s): got source file: %v, want the document", tc.desc, sourceFile)
+		}
+
+		got.Id = ""
+		got.SourceInfo = nil
+		gotJson, err := util.ProtoToJson(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.JsonEqual(tc.want, gotJson); err != nil {
+			t.Errorf("Test (%s): %v", tc.desc, err)
+		}
+	}
+}
+
+func TestConfigIdChangesWithDocument(t *testing.T) {
+	doc := `{"swagger": "2.0", "host": "bookstore.endpoints.project-id.cloud.goog", "info": {"version": "%s"}}`
+	translate := func(version string) *confpb.Service {
+		serviceConfig, err := ToServiceConfig([]byte(strings.Replace(doc, "%s", version, 1)), "openapi.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serviceConfig
+	}
+	if translate("1.0.0").GetId() != translate("1.0.0").GetId() {
+		t.Errorf("the config id of the same document should not change")
+	}
+	if translate("1.0.0").GetId() == translate("1.0.1").GetId() {
+		t.Errorf("the config id should change with the document")
+	}
+}
+
+// The YAML document in testdata is the same as the JSON one of the
+// dynamic_routing example, with unquoted numbers.
+func TestReadServiceConfigYAML(t *testing.T) {
+	got, _, err := ReadServiceConfig("testdata/openapi_swagger.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _, err := ReadServiceConfig("../../../examples/dynamic_routing/openapi_swagger.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.GetName() != want.GetName() || got.GetTitle() != want.GetTitle() {
+		t.Errorf("got service %s titled %q, want: %s titled %q", got.GetName(), got.GetTitle(), want.GetName(), want.GetTitle())
+	}
+	want.GetApis()[0].GetSourceContext().FileName = "openapi_swagger.yaml"
+	checks := []struct {
+		field     string
+		got, want proto.Message
+	}{
+		{"apis", got.GetApis()[0], want.GetApis()[0]},
+		{"http", got.GetHttp(), want.GetHttp()},
+		{"backend", got.GetBackend(), want.GetBackend()},
+		{"authentication", got.GetAuthentication(), want.GetAuthentication()},
+		{"usage", got.GetUsage(), want.GetUsage()},
+	}
+	for _, c := range checks {
+		if !proto.Equal(c.got, c.want) {
+			t.Errorf("got %s: %v, want: %v", c.field, c.got, c.want)
+		}
+	}
+
+	var sourceFile smpb.ConfigFile
+	if err := ptypes.UnmarshalAny(got.GetSourceInfo().GetSourceFiles()[0], &sourceFile); err != nil {
+		t.Fatal(err)
+	}
+	if sourceFile.GetFileType() != smpb.ConfigFile_OPEN_API_YAML {
+		t.Errorf("got source file type: %v, want: %v", sourceFile.GetFileType(), smpb.ConfigFile_OPEN_API_YAML)
+	}
+}
@@ -36,6 +36,56 @@ type ConfigGeneratorOptions struct {
 
 	// Backend routing configurations.
 	BackendDnsLookupFamily string
+	// The load balancing policy of the backend clusters.
+	BackendLbPolicy string
+	// Resolve the backend hostnames with STRICT_DNS instead of LOGICAL_DNS.
+	BackendStrictDns bool
+	// The file of the backend rules per selector or backend address.
+	BackendRulesPath string
+
+	// Retry policy of the routes to the backends.
+	BackendRetryOn              string
+	BackendRetryNumRetries      int
+	BackendRetryPerTryTimeout   time.Duration
+	BackendRetriableStatusCodes string
+	BackendRetryGetMethods      bool
+
+	// Active health check and outlier detection of the backend clusters.
+	BackendHealthCheckProtocol              string
+	BackendHealthCheckPath                  string
+	BackendHealthCheckInterval              time.Duration
+	BackendHealthCheckTimeout               time.Duration
+	BackendHealthCheckHealthyThreshold      int
+	BackendHealthCheckUnhealthyThreshold    int
+	BackendOutlierDetectionConsecutive5xx   int
+	BackendOutlierDetectionBaseEjectionTime time.Duration
+
+	// Circuit breakers and connection pool limits of the backend clusters,
+	// the Envoy defaults if 0.
+	BackendMaxConnections           int
+	BackendMaxPendingRequests       int
+	BackendMaxRequests              int
+	BackendMaxRetries               int
+	BackendMaxRequestsPerConnection int
+
+	// The local token bucket rate limit of each operation, disabled if
+	// LocalRateLimitMaxTokens is 0.
+	LocalRateLimitMaxTokens     int
+	LocalRateLimitTokensPerFill int
+	LocalRateLimitFillInterval  time.Duration
+	LocalRateLimitKey           string
+
+	// The external rate limit service called for the descriptors of each
+	// operation, disabled if RateLimitServiceAddress is empty.
+	RateLimitServiceAddress    string
+	RateLimitDomain            string
+	RateLimitTimeout           time.Duration
+	RateLimitFailureModeDeny   bool
+	RateLimitDescriptorHeaders string
+
+	// Log the HTTP rules of different selectors with the same HTTP method and
+	// path template as warnings, instead of rejecting the service config.
+	AllowConflictingHttpRules bool
 
 	// Envoy specific configurations.
 	ClusterConnectTimeout time.Duration
@@ -54,6 +104,18 @@ type ConfigGeneratorOptions struct {
 	SslMaximumProtocol   string
 	EnableHSTS           bool
 	RootCertsPath        string
+	// Reference the server and client certs as SDS secrets instead of files.
+	// Only set by Config Manager, which serves the secrets.
+	UseSdsForSslCerts bool
+
+	// Retry policy of the calls to Service Management.
+	ServiceManagementRetryAttempts        int
+	ServiceManagementRetryInitialInterval time.Duration
+	ServiceManagementRetryMaxInterval     time.Duration
+	ServiceManagementRetryJitter          float64
+	ServiceManagementRetryCodes           string
+	ServiceManagementInitialFetchDeadline time.Duration
+	ServiceManagementFetchDeadline        time.Duration
 
 	// Flags for non_gcp deployment.
 	ServiceAccountKey string
@@ -102,6 +164,9 @@ func DefaultConfigGeneratorOptions() ConfigGeneratorOptions {
 	return ConfigGeneratorOptions{
 		CommonOptions:                 DefaultCommonOptions(),
 		BackendDnsLookupFamily:        "auto",
+		BackendLbPolicy:               "round_robin",
+		BackendRetryNumRetries:        1,
+		BackendRetryGetMethods:        true,
 		BackendAddress:                "http://127.0.0.1:8082",
 		ClusterConnectTimeout:         20 * time.Second,
 		EnvoyXffNumTrustedHops:        2,
@@ -115,5 +180,24 @@ func DefaultConfigGeneratorOptions() ConfigGeneratorOptions {
 		ScCheckRetries:                -1,
 		ScQuotaRetries:                -1,
 		ScReportRetries:               -1,
+
+		BackendHealthCheckPath:                  "/healthz",
+		BackendHealthCheckInterval:              5 * time.Second,
+		BackendHealthCheckTimeout:               time.Second,
+		BackendHealthCheckHealthyThreshold:      2,
+		BackendHealthCheckUnhealthyThreshold:    3,
+		BackendOutlierDetectionBaseEjectionTime: 30 * time.Second,
+
+		LocalRateLimitFillInterval: time.Second,
+
+		RateLimitTimeout: 20 * time.Millisecond,
+
+		ServiceManagementRetryAttempts:        5,
+		ServiceManagementRetryInitialInterval: time.Second,
+		ServiceManagementRetryMaxInterval:     30 * time.Second,
+		ServiceManagementRetryJitter:          0.5,
+		ServiceManagementRetryCodes:           "429,500,502,503,504",
+		ServiceManagementInitialFetchDeadline: 2 * time.Minute,
+		ServiceManagementFetchDeadline:        30 * time.Second,
 	}
 }
@@ -0,0 +1,199 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceconfig
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/metadata"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// The schemes of the service config source URIs.
+const (
+	ServiceManagementScheme = "servicemanagement"
+	FileScheme              = "file"
+	OpenAPIScheme           = "openapi"
+	APIConfigScheme         = "apiconfig"
+	DirScheme               = "dir"
+	HttpScheme              = "http"
+	HttpsScheme             = "https"
+)
+
+// ConfigSource provides the service configs of one service. A source is
+// watched by polling it periodically, each poll only returns the service
+// configs if they have changed.
+type ConfigSource interface {
+	// String describes the source in logs and errors.
+	String() string
+	// ServiceName returns the name of the service, if the source knows it
+	// before fetching any service config, or empty otherwise.
+	ServiceName() string
+	// RolloutId identifies the current service configs of the source, e.g. the
+	// rollout id of Service Management, or the ETag of an HTTP source. Empty
+	// if the source has no such id.
+	RolloutId() string
+	// Fetch returns the current service configs, ordered by their traffic
+	// percentages from high to low. The deadline of ctx bounds the whole
+	// initial fetch, including its retries.
+	Fetch(ctx context.Context) ([]*RolloutConfig, error)
+	// Poll returns the service configs if they have changed since the last
+	// Fetch or Poll, or nil otherwise.
+	Poll() ([]*RolloutConfig, error)
+}
+
+// NewConfigSource creates the source of a URI. The supported URIs are
+// servicemanagement://SERVICE_NAME[?config_id=CONFIG_ID] for the service
+// config with the config id, or the ones of the latest rollout if no config id
+// is specified; file:///PATH for the service config in the file;
+// openapi:///PATH for the service config translated from the OpenAPI 2.0
+// document in the file; apiconfig:///PATH?descriptor=DESCRIPTOR_PATH for the
+// service config built from the gRPC API config YAML file and the proto
+// descriptor set file; dir:///PATH for the service config with the highest
+// config id among the files in the directory; and http(s)://HOST/PATH for the
+// service config served at the URL, polled with its ETag.
+func NewConfigSource(uri string, mf *metadata.MetadataFetcher, opts options.ConfigGeneratorOptions) (ConfigSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service config source %q, %v", uri, err)
+	}
+	switch u.Scheme {
+	case ServiceManagementScheme:
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid service config source %q, service name is required", uri)
+		}
+		return NewServiceManagementSource(mf, opts, u.Host, u.Query().Get("config_id"))
+	case FileScheme, OpenAPIScheme, APIConfigScheme, DirScheme:
+		path := u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		if path == "" {
+			return nil, fmt.Errorf("invalid service config source %q, path is required", uri)
+		}
+		switch u.Scheme {
+		case FileScheme:
+			return NewFileSource(path), nil
+		case OpenAPIScheme:
+			return NewOpenAPISource(path), nil
+		case APIConfigScheme:
+			descriptorPath := u.Query().Get("descriptor")
+			if descriptorPath == "" {
+				return nil, fmt.Errorf("invalid service config source %q, descriptor is required", uri)
+			}
+			return NewAPIConfigSource(path, descriptorPath), nil
+		default:
+			return NewDirSource(path), nil
+		}
+	case HttpScheme, HttpsScheme:
+		return NewHttpSource(uri, opts)
+	default:
+		return nil, fmt.Errorf("unsupported service config source %q, the scheme must be one of %s, %s, %s, %s, %s, %s or %s",
+			uri, ServiceManagementScheme, FileScheme, OpenAPIScheme, APIConfigScheme, DirScheme, HttpScheme, HttpsScheme)
+	}
+}
+
+// FullRollout returns the service config as the only one of a rollout.
+func FullRollout(serviceConfig *confpb.Service) []*RolloutConfig {
+	return []*RolloutConfig{
+		{
+			ServiceConfig:  serviceConfig,
+			TrafficPercent: 100,
+		},
+	}
+}
+
+// ServiceManagementSource provides the service configs of Service Management.
+type ServiceManagementSource struct {
+	fetcher *ServiceConfigFetcher
+	// Empty for the latest rollout.
+	configId string
+	// Whether the service config of the config id has been fetched.
+	fetched bool
+}
+
+// NewServiceManagementSource creates the source of the service config with
+// the config id, or of the latest rollout if the config id is empty.
+func NewServiceManagementSource(mf *metadata.MetadataFetcher, opts options.ConfigGeneratorOptions, serviceName, configId string) (*ServiceManagementSource, error) {
+	fetcher, err := NewServiceConfigFetcher(mf, opts, serviceName)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to create https client to call ServiceManagement service, got error: %v`, err)
+	}
+	return &ServiceManagementSource{
+		fetcher:  fetcher,
+		configId: configId,
+	}, nil
+}
+
+func (s *ServiceManagementSource) String() string {
+	if s.configId == "" {
+		return fmt.Sprintf("%s://%s", ServiceManagementScheme, s.fetcher.serviceName)
+	}
+	return fmt.Sprintf("%s://%s?config_id=%s", ServiceManagementScheme, s.fetcher.serviceName, s.configId)
+}
+
+func (s *ServiceManagementSource) ServiceName() string {
+	return s.fetcher.serviceName
+}
+
+func (s *ServiceManagementSource) RolloutId() string {
+	return s.fetcher.CurRolloutId()
+}
+
+// ConfigId returns the config id of the source, or empty if the source
+// follows the latest rollout.
+func (s *ServiceManagementSource) ConfigId() string {
+	return s.configId
+}
+
+// Fetch is the initial fetch, retried until the deadline of ctx instead of
+// the deadline of each call of the polls.
+func (s *ServiceManagementSource) Fetch(ctx context.Context) ([]*RolloutConfig, error) {
+	defer s.fetcher.FinishInitialFetch()
+	if s.configId == "" {
+		rolloutConfigs, err := s.fetcher.FetchRolloutConfigs(ctx)
+		if err == nil && rolloutConfigs == nil {
+			err = fmt.Errorf("no service config is found in the rollouts")
+		}
+		return rolloutConfigs, err
+	}
+	return s.fetchConfig(ctx)
+}
+
+// Poll checks the latest rollout. The service config of a config id never
+// changes, it is only fetched again if it has not been fetched yet, e.g. when
+// the initial fetch failed.
+func (s *ServiceManagementSource) Poll() ([]*RolloutConfig, error) {
+	if s.configId == "" {
+		return s.fetcher.FetchRolloutConfigs(context.Background())
+	}
+	if s.fetched {
+		return nil, nil
+	}
+	return s.fetchConfig(context.Background())
+}
+
+func (s *ServiceManagementSource) fetchConfig(ctx context.Context) ([]*RolloutConfig, error) {
+	serviceConfig, err := s.fetcher.FetchConfig(ctx, s.configId)
+	if err != nil {
+		return nil, err
+	}
+	s.fetched = true
+	return FullRollout(serviceConfig), nil
+}
@@ -0,0 +1,298 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceconfig
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+)
+
+func fakeServiceConfigJson(name, configId string) string {
+	return fmt.Sprintf(`{"name": "%s", "id": "%s"}`, name, configId)
+}
+
+func TestNewConfigSource(t *testing.T) {
+	testData := []struct {
+		uri       string
+		want      string
+		wantError string
+	}{
+		{
+			uri:  "servicemanagement://bookstore.endpoints.project123.cloud.goog",
+			want: "servicemanagement://bookstore.endpoints.project123.cloud.goog",
+		},
+		{
+			uri:  "servicemanagement://bookstore.endpoints.project123.cloud.goog?config_id=2017-05-01r0",
+			want: "servicemanagement://bookstore.endpoints.project123.cloud.goog?config_id=2017-05-01r0",
+		},
+		{
+			uri:  "file:///etc/espv2/service.json",
+			want: "file:///etc/espv2/service.json",
+		},
+		{
+			uri:  "openapi:///etc/espv2/openapi.json",
+			want: "openapi:///etc/espv2/openapi.json",
+		},
+		{
+			uri:  "apiconfig:///etc/espv2/api_config.yaml?descriptor=/etc/espv2/api_descriptor.pb",
+			want: "apiconfig:///etc/espv2/api_config.yaml?descriptor=/etc/espv2/api_descriptor.pb",
+		},
+		{
+			uri:  "dir:///etc/espv2/configs",
+			want: "dir:///etc/espv2/configs",
+		},
+		{
+			uri:  "https://configs.example.com/bookstore.json",
+			want: "https://configs.example.com/bookstore.json",
+		},
+		{
+			uri:       "servicemanagement://",
+			wantError: "service name is required",
+		},
+		{
+			uri:       "file://",
+			wantError: "path is required",
+		},
+		{
+			uri:       "apiconfig:///etc/espv2/api_config.yaml",
+			wantError: "descriptor is required",
+		},
+		{
+			uri:       "gs://bucket/service.json",
+			wantError: "unsupported service config source",
+		},
+	}
+
+	for _, tc := range testData {
+		source, err := NewConfigSource(tc.uri, nil, options.DefaultConfigGeneratorOptions())
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want: %v", tc.uri, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got error: %v", tc.uri, err)
+			continue
+		}
+		if got := source.String(); got != tc.want {
+			t.Errorf("Test (%s): got source: %v, want: %v", tc.uri, got, tc.want)
+		}
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_source_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "service.json")
+	writeFile(t, path, fakeServiceConfigJson("bookstore.endpoints.project123.cloud.goog", "2017-05-01r0"))
+
+	source := NewFileSource(path)
+	rolloutConfigs, err := source.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfigId(t, "fetch", rolloutConfigs, "2017-05-01r0")
+
+	rolloutConfigs, err = source.Poll()
+	if err != nil || rolloutConfigs != nil {
+		t.Errorf("poll of an unchanged file got: %v, %v, want nothing", rolloutConfigs, err)
+	}
+
+	writeFile(t, path, `{"name": `)
+	if _, err := source.Poll(); err == nil || !strings.Contains(err.Error(), "fail to unmarshal service config") {
+		t.Errorf("poll of an invalid file got error: %v", err)
+	}
+	if rolloutConfigs, err := source.Poll(); err != nil || rolloutConfigs != nil {
+		t.Errorf("poll of an invalid file again got: %v, %v, want nothing", rolloutConfigs, err)
+	}
+
+	writeFile(t, path, fakeServiceConfigJson("bookstore.endpoints.project123.cloud.goog", "2017-05-01r1"))
+	rolloutConfigs, err = source.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfigId(t, "poll of a changed file", rolloutConfigs, "2017-05-01r1")
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.Poll(); err == nil || !strings.Contains(err.Error(), "fail to read service config file") {
+		t.Errorf("poll of a removed file got error: %v", err)
+	}
+	if rolloutConfigs, err := source.Poll(); err != nil || rolloutConfigs != nil {
+		t.Errorf("poll of a removed file again got: %v, %v, want nothing", rolloutConfigs, err)
+	}
+
+	writeFile(t, path, fakeServiceConfigJson("bookstore.endpoints.project123.cloud.goog", "2017-05-01r2"))
+	rolloutConfigs, err = source.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfigId(t, "poll of a restored file", rolloutConfigs, "2017-05-01r2")
+}
+
+func TestDirSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_source_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serviceName := "bookstore.endpoints.project123.cloud.goog"
+	writeFile(t, filepath.Join(dir, "a.json"), fakeServiceConfigJson(serviceName, "2017-05-01r0"))
+	writeFile(t, filepath.Join(dir, "b.json"), fakeServiceConfigJson(serviceName, "2017-05-01r1"))
+	writeFile(t, filepath.Join(dir, "README.md"), "not a service config")
+
+	source := NewDirSource(dir)
+	rolloutConfigs, err := source.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfigId(t, "fetch", rolloutConfigs, "2017-05-01r1")
+	if got, want := source.RolloutId(), filepath.Join(dir, "b.json"); got != want {
+		t.Errorf("got rollout id: %v, want: %v", got, want)
+	}
+
+	// Neither a hidden file nor an older service config is a change.
+	writeFile(t, filepath.Join(dir, ".c.json.tmp"), fakeServiceConfigJson(serviceName, "2017-05-01r9"))
+	writeFile(t, filepath.Join(dir, "c.json"), fakeServiceConfigJson(serviceName, "2017-04-01r0"))
+	if rolloutConfigs, err := source.Poll(); err != nil || rolloutConfigs != nil {
+		t.Errorf("poll without a new service config got: %v, %v, want nothing", rolloutConfigs, err)
+	}
+
+	writeFile(t, filepath.Join(dir, "d.json"), fakeServiceConfigJson(serviceName, "2017-05-01r2"))
+	rolloutConfigs, err = source.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfigId(t, "poll of a new service config", rolloutConfigs, "2017-05-01r2")
+
+	writeFile(t, filepath.Join(dir, "d2.yaml"), fmt.Sprintf("name: %s\nid: 2017-05-01r3\n", serviceName))
+	rolloutConfigs, err = source.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfigId(t, "poll of a new service config in YAML", rolloutConfigs, "2017-05-01r3")
+
+	// The revisions are compared as numbers.
+	writeFile(t, filepath.Join(dir, "r10.json"), fakeServiceConfigJson(serviceName, "2017-05-01r10"))
+	rolloutConfigs, err = source.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfigId(t, "poll of revision 10", rolloutConfigs, "2017-05-01r10")
+	writeFile(t, filepath.Join(dir, "r9.json"), fakeServiceConfigJson(serviceName, "2017-05-01r9"))
+	if rolloutConfigs, err := source.Poll(); err != nil || rolloutConfigs != nil {
+		t.Errorf("poll of revision 9 after revision 10 got: %v, %v, want nothing", rolloutConfigs, err)
+	}
+
+	writeFile(t, filepath.Join(dir, "e.json"), fakeServiceConfigJson("other.endpoints.project123.cloud.goog", "2017-05-01r4"))
+	if _, err := source.Poll(); err == nil || !strings.Contains(err.Error(), "not "+serviceName) {
+		t.Errorf("poll of a service config of another service got error: %v", err)
+	}
+}
+
+func TestHttpSource(t *testing.T) {
+	serviceName := "bookstore.endpoints.project123.cloud.goog"
+	configId := "2017-05-01r0"
+	etagSupported := true
+	gets := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		etag := `"` + configId + `"`
+		if etagSupported {
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+		}
+		w.Write([]byte(fakeServiceConfigJson(serviceName, configId)))
+	}))
+	defer server.Close()
+
+	// The root certificates are only needed by HTTPS URLs.
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.RootCertsPath = "/not/exist/ca-certificates.crt"
+	if _, err := NewHttpSource("https://example.com/service.json", opts); err == nil {
+		t.Errorf("HTTPS source without the root certificates got no error")
+	}
+	source, err := NewHttpSource(server.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rolloutConfigs, err := source.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfigId(t, "fetch", rolloutConfigs, configId)
+	if got, want := source.RolloutId(), `"2017-05-01r0"`; got != want {
+		t.Errorf("got rollout id: %v, want: %v", got, want)
+	}
+
+	if rolloutConfigs, err := source.Poll(); err != nil || rolloutConfigs != nil {
+		t.Errorf("poll with the same ETag got: %v, %v, want nothing", rolloutConfigs, err)
+	}
+
+	configId = "2017-05-01r1"
+	rolloutConfigs, err = source.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfigId(t, "poll of a new ETag", rolloutConfigs, configId)
+
+	// Without ETags, the body is compared instead.
+	etagSupported = false
+	if rolloutConfigs, err := source.Poll(); err != nil || rolloutConfigs != nil {
+		t.Errorf("poll of the same body got: %v, %v, want nothing", rolloutConfigs, err)
+	}
+	configId = "2017-05-01r2"
+	rolloutConfigs, err = source.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfigId(t, "poll of a new body", rolloutConfigs, configId)
+	if gets != 5 {
+		t.Errorf("got %d requests, want: 5", gets)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkConfigId(t *testing.T, desc string, rolloutConfigs []*RolloutConfig, want string) {
+	if len(rolloutConfigs) != 1 || rolloutConfigs[0].TrafficPercent != 100 {
+		t.Errorf("%s got rollout configs: %v, want one service config of all traffic", desc, rolloutConfigs)
+		return
+	}
+	if got := rolloutConfigs[0].ServiceConfig.GetId(); got != want {
+		t.Errorf("%s got config id: %v, want: %v", desc, got, want)
+	}
+}
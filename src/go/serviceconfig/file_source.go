@@ -0,0 +1,290 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceconfig
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/apiconfig"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/openapi"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// ReadServiceConfigFile reads the service config file in JSON or YAML, and
+// returns the checksum of its content as well.
+func ReadServiceConfigFile(path string) (*confpb.Service, [sha256.Size]byte, error) {
+	config, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, fmt.Errorf("fail to read service config file: %s, error: %s", path, err)
+	}
+	hash := sha256.Sum256(config)
+
+	serviceConfig, err := util.UnmarshalServiceConfigFile(path, config)
+	if err != nil {
+		return nil, hash, fmt.Errorf("fail to unmarshal service config: %s, error: %s", path, err)
+	}
+	return serviceConfig, hash, nil
+}
+
+// FileSource provides the service config in a file, either the service
+// config itself, an OpenAPI document translated into the service config, or
+// a gRPC API config built into the service config with a proto descriptor
+// set file.
+type FileSource struct {
+	uri  string
+	path string
+	read func(path string) (*confpb.Service, [sha256.Size]byte, error)
+	// The checksum of the file content at the last fetch or poll.
+	hash [sha256.Size]byte
+}
+
+// NewFileSource creates the source of the service config file.
+func NewFileSource(path string) *FileSource {
+	return &FileSource{
+		uri:  fmt.Sprintf("%s://%s", FileScheme, path),
+		path: path,
+		read: ReadServiceConfigFile,
+	}
+}
+
+// NewOpenAPISource creates the source of the OpenAPI 2.0 document.
+func NewOpenAPISource(path string) *FileSource {
+	return &FileSource{
+		uri:  fmt.Sprintf("%s://%s", OpenAPIScheme, path),
+		path: path,
+		read: openapi.ReadServiceConfig,
+	}
+}
+
+// NewAPIConfigSource creates the source of the gRPC API config YAML file and
+// the proto descriptor set file, a change of either one is a new service
+// config.
+func NewAPIConfigSource(apiConfigPath, descriptorPath string) *FileSource {
+	return &FileSource{
+		uri:  fmt.Sprintf("%s://%s?descriptor=%s", APIConfigScheme, apiConfigPath, descriptorPath),
+		path: apiConfigPath,
+		read: func(path string) (*confpb.Service, [sha256.Size]byte, error) {
+			return apiconfig.ReadServiceConfig(path, descriptorPath)
+		},
+	}
+}
+
+func (s *FileSource) String() string {
+	return s.uri
+}
+
+func (s *FileSource) ServiceName() string { return "" }
+
+func (s *FileSource) RolloutId() string { return "" }
+
+func (s *FileSource) Fetch(ctx context.Context) ([]*RolloutConfig, error) {
+	serviceConfig, hash, err := s.read(s.path)
+	if err != nil {
+		return nil, err
+	}
+	s.hash = hash
+	return FullRollout(serviceConfig), nil
+}
+
+// unreadableFileHash is the checksum of a file that cannot be read, e.g.
+// when it is removed.
+var unreadableFileHash = sha256.Sum256([]byte("unreadable service config file"))
+
+// Poll returns the service config if the file content has changed. An
+// invalid or unreadable file is only reported once, until it changes again.
+func (s *FileSource) Poll() ([]*RolloutConfig, error) {
+	serviceConfig, hash, err := s.read(s.path)
+	if hash == ([sha256.Size]byte{}) {
+		hash = unreadableFileHash
+	}
+	if hash == s.hash {
+		return nil, nil
+	}
+	s.hash = hash
+	if err != nil {
+		return nil, err
+	}
+	return FullRollout(serviceConfig), nil
+}
+
+// DirSource provides the service config with the highest config id among the
+// files in a directory, so that a new service config is rolled out by adding
+// its file. Hidden files are ignored, e.g. the temporary ones of atomic
+// writes.
+type DirSource struct {
+	dir string
+	// The checksum of the file names and contents at the last fetch or poll.
+	hash [sha256.Size]byte
+	// The file of the current service config, and the checksum of its content.
+	curFile string
+	curHash [sha256.Size]byte
+}
+
+// NewDirSource creates the source of the service config files in the
+// directory.
+func NewDirSource(dir string) *DirSource {
+	return &DirSource{
+		dir: dir,
+	}
+}
+
+func (s *DirSource) String() string {
+	return fmt.Sprintf("%s://%s", DirScheme, s.dir)
+}
+
+func (s *DirSource) ServiceName() string { return "" }
+
+// RolloutId returns the file of the current service config.
+func (s *DirSource) RolloutId() string { return s.curFile }
+
+func (s *DirSource) Fetch(ctx context.Context) ([]*RolloutConfig, error) {
+	files, hash, err := s.listFiles()
+	if err != nil {
+		return nil, err
+	}
+	s.hash = hash
+	return s.latestConfig(files)
+}
+
+// Poll returns the service config with the highest config id, if the files
+// have changed and the service config is a different one. Invalid files are
+// only reported once, until the files change again.
+func (s *DirSource) Poll() ([]*RolloutConfig, error) {
+	files, hash, err := s.listFiles()
+	if err != nil {
+		return nil, err
+	}
+	if hash == s.hash {
+		return nil, nil
+	}
+	s.hash = hash
+
+	prevFile, prevHash := s.curFile, s.curHash
+	rolloutConfigs, err := s.latestConfig(files)
+	if err != nil {
+		return nil, err
+	}
+	if s.curFile == prevFile && s.curHash == prevHash {
+		return nil, nil
+	}
+	return rolloutConfigs, nil
+}
+
+// listFiles returns the service config files in the directory, and the
+// checksum of their names and contents.
+func (s *DirSource) listFiles() ([]string, [sha256.Size]byte, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, fmt.Errorf("fail to read service config directory: %s, error: %s", s.dir, err)
+	}
+	var files []string
+	h := sha256.New()
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || !isServiceConfigFile(info.Name()) {
+			continue
+		}
+		file := filepath.Join(s.dir, info.Name())
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, [sha256.Size]byte{}, fmt.Errorf("fail to read service config file: %s, error: %s", file, err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", info.Name(), len(content))
+		h.Write(content)
+		files = append(files, file)
+	}
+	var hash [sha256.Size]byte
+	copy(hash[:], h.Sum(nil))
+	return files, hash, nil
+}
+
+// latestConfig parses the files, and returns the service config with the
+// highest config id. All the files must be the service configs of the same
+// service.
+func (s *DirSource) latestConfig(files []string) ([]*RolloutConfig, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no service config file is found in directory %s", s.dir)
+	}
+	type configFile struct {
+		file          string
+		hash          [sha256.Size]byte
+		serviceConfig *confpb.Service
+	}
+	var configs []configFile
+	for _, file := range files {
+		serviceConfig, hash, err := ReadServiceConfigFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if len(configs) > 0 && serviceConfig.GetName() != configs[0].serviceConfig.GetName() {
+			return nil, fmt.Errorf("service config file %s is for service %s, not %s", file, serviceConfig.GetName(), configs[0].serviceConfig.GetName())
+		}
+		configs = append(configs, configFile{
+			file:          file,
+			hash:          hash,
+			serviceConfig: serviceConfig,
+		})
+	}
+	// The files are ordered by name, which breaks the ties of config ids.
+	sort.SliceStable(configs, func(i, j int) bool {
+		return configIdLess(configs[j].serviceConfig.GetId(), configs[i].serviceConfig.GetId())
+	})
+
+	latest := configs[0]
+	s.curFile, s.curHash = latest.file, latest.hash
+	return FullRollout(latest.serviceConfig), nil
+}
+
+// The config ids of Service Management, e.g. 2017-05-01r0, have the date and
+// the revision of the day.
+var configIdRegexp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})r(\d+)$`)
+
+// configIdLess returns whether config id a is older than b. The config ids of
+// Service Management are compared by their dates and revision numbers, so that
+// 2017-05-01r9 is older than 2017-05-01r10, the other ones as strings.
+func configIdLess(a, b string) bool {
+	ma, mb := configIdRegexp.FindStringSubmatch(a), configIdRegexp.FindStringSubmatch(b)
+	if ma == nil || mb == nil {
+		return a < b
+	}
+	if ma[1] != mb[1] {
+		return ma[1] < mb[1]
+	}
+	ra, errA := strconv.ParseUint(ma[2], 10, 64)
+	rb, errB := strconv.ParseUint(mb[2], 10, 64)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return ra < rb
+}
+
+// isServiceConfigFile returns whether the file is a service config in JSON or
+// YAML, by its extension.
+func isServiceConfigFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceconfig
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// HttpSource provides the service config served at an HTTP(S) URL, e.g. by
+// an artifact store. The URL is polled with the ETag of the last response, so
+// that an unchanged service config is not downloaded again. The service
+// config is either in JSON or YAML, or a binary proto with the
+// application/x-protobuf content type.
+type HttpSource struct {
+	url    string
+	client http.Client
+	etag   string
+	// The checksum of the last response body, used when the server does not
+	// support ETags.
+	hash [sha256.Size]byte
+}
+
+// NewHttpSource creates the source of the URL. HTTPS URLs are verified with
+// the root certificates of --root_certs_path.
+func NewHttpSource(url string, opts options.ConfigGeneratorOptions) (*HttpSource, error) {
+	s := &HttpSource{
+		url: url,
+		client: http.Client{
+			Timeout: opts.HttpRequestTimeout,
+		},
+	}
+	if !strings.HasPrefix(url, "https://") {
+		return s, nil
+	}
+	caCert, err := ioutil.ReadFile(opts.RootCertsPath)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read the root certificates of %s, %v", url, err)
+	}
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(caCert)
+	s.client.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs: caCertPool,
+		},
+	}
+	return s, nil
+}
+
+func (s *HttpSource) String() string {
+	return s.url
+}
+
+func (s *HttpSource) ServiceName() string { return "" }
+
+// RolloutId returns the ETag of the current service config.
+func (s *HttpSource) RolloutId() string { return s.etag }
+
+func (s *HttpSource) Fetch(ctx context.Context) ([]*RolloutConfig, error) {
+	serviceConfig, err := s.get(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return FullRollout(serviceConfig), nil
+}
+
+// Poll downloads the service config if its ETag has changed.
+func (s *HttpSource) Poll() ([]*RolloutConfig, error) {
+	serviceConfig, err := s.get(context.Background(), true)
+	if err != nil || serviceConfig == nil {
+		return nil, err
+	}
+	return FullRollout(serviceConfig), nil
+}
+
+// get downloads the service config. With ifChanged, it returns nil if the
+// service config has not changed since the last download.
+func (s *HttpSource) get(ctx context.Context, ifChanged bool) (*confpb.Service, error) {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create request to %s, %v", s.url, err)
+	}
+	req = req.WithContext(ctx)
+	if ifChanged && s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fail to get service config from %s, %v", s.url, err)
+	}
+	defer resp.Body.Close()
+	if ifChanged && resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http call to %s returns not 200 OK: %v", s.url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read response body: %s", err)
+	}
+
+	hash := sha256.Sum256(body)
+	if ifChanged && hash == s.hash {
+		return nil, nil
+	}
+	serviceConfig := new(confpb.Service)
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/x-protobuf" {
+		err = proto.Unmarshal(body, serviceConfig)
+	} else {
+		serviceConfig, err = util.UnmarshalServiceConfig(bytes.NewReader(body))
+	}
+	// The ETag is kept even if the service config is invalid, so that it is
+	// only reported once, until it changes again.
+	s.etag, s.hash = resp.Header.Get("ETag"), hash
+	if err != nil {
+		return nil, fmt.Errorf("fail to unmarshal service config from %s, %v", s.url, err)
+	}
+	return serviceConfig, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceconfig
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/cenkalti/backoff"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	serviceManagementRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_manager_service_management_retries_total",
+		Help: "Number of retried calls to Service Management, by call.",
+	}, []string{"call"})
+)
+
+// retryPolicy decides how the calls to Service Management are retried.
+type retryPolicy struct {
+	// Maximum attempts of each call, including the first one. Unlimited if 0,
+	// and the retries are only bounded by the deadline.
+	attempts        int
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	// Randomization factor of the backoff, between 0 and 1.
+	jitter float64
+	// HTTP status codes to retry, the network errors are always retried.
+	retryableCodes map[int]bool
+	// Overall deadline of the retries of each call. Unlimited if 0, and the
+	// retries are only bounded by the deadline of the context of the call.
+	deadline time.Duration
+}
+
+// newRetryPolicies returns the retry policies of the initial fetch and of the
+// background rollout checks. The initial fetch retries until the deadline of
+// its context, which is shared by all its calls.
+func newRetryPolicies(opts options.ConfigGeneratorOptions) (initial, background retryPolicy, err error) {
+	if opts.ServiceManagementRetryJitter < 0 || opts.ServiceManagementRetryJitter > 1 {
+		return initial, background, fmt.Errorf("retry jitter must be between 0 and 1, got %v", opts.ServiceManagementRetryJitter)
+	}
+	retryableCodes := make(map[int]bool)
+	for _, code := range strings.Split(opts.ServiceManagementRetryCodes, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		c, err := strconv.Atoi(code)
+		if err != nil || c < 100 || c > 599 {
+			return initial, background, fmt.Errorf("invalid retryable HTTP status code: %q", code)
+		}
+		retryableCodes[c] = true
+	}
+
+	background = retryPolicy{
+		attempts:        opts.ServiceManagementRetryAttempts,
+		initialInterval: opts.ServiceManagementRetryInitialInterval,
+		maxInterval:     opts.ServiceManagementRetryMaxInterval,
+		jitter:          opts.ServiceManagementRetryJitter,
+		retryableCodes:  retryableCodes,
+		deadline:        opts.ServiceManagementFetchDeadline,
+	}
+	initial = background
+	initial.attempts = 0
+	initial.deadline = 0
+	return initial, background, nil
+}
+
+func (p retryPolicy) newBackOff() backoff.BackOff {
+	ebo := backoff.NewExponentialBackOff()
+	ebo.InitialInterval = p.initialInterval
+	ebo.MaxInterval = p.maxInterval
+	ebo.RandomizationFactor = p.jitter
+	ebo.Multiplier = 2
+	// The deadline is checked by the caller, which also honors Retry-After.
+	ebo.MaxElapsedTime = 0
+	ebo.Reset()
+	return ebo
+}
+
+// callWithAccessToken calls Service Management, and retries the call with
+// exponential backoff until it succeeds, fails with a non retryable error,
+// runs out of attempts, or the next retry would pass the deadline of the
+// policy or of ctx. The backoff is extended to the Retry-After header of the
+// response, if any.
+func (scf *ServiceConfigFetcher) callWithAccessToken(ctx context.Context, call, path, token string) (*http.Response, error) {
+	policy := scf.retryPolicy()
+	bo := policy.newBackOff()
+	start := scf.timeNow()
+	for attempt := 1; ; attempt++ {
+		resp, retryable, retryAfter, err := scf.callOnce(ctx, call, path, token, policy.retryableCodes)
+		if err == nil {
+			return resp, nil
+		}
+		if !retryable {
+			return nil, err
+		}
+		if policy.attempts > 0 && attempt >= policy.attempts {
+			return nil, fmt.Errorf("%v, giving up after %d attempts", err, attempt)
+		}
+		wait := bo.NextBackOff()
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if elapsed := scf.timeNow().Sub(start); policy.deadline > 0 && elapsed+wait > policy.deadline {
+			return nil, fmt.Errorf("%v, giving up after %d attempts in %v, the next retry would pass the deadline %v", err, attempt, elapsed, policy.deadline)
+		}
+		if deadline, ok := ctx.Deadline(); ok && !scf.timeNow().Add(wait).Before(deadline) {
+			return nil, fmt.Errorf("%v, giving up after %d attempts, the next retry would pass the deadline of the fetch at %v", err, attempt, deadline.Format(time.RFC3339))
+		}
+
+		glog.Warningf("call %d to %s failed, retrying in %v, %v", attempt, path, wait, err)
+		serviceManagementRetries.WithLabelValues(call).Inc()
+		scf.sleep(wait)
+	}
+}
+
+// callOnce makes one attempt of the call, and returns whether a failure can
+// be retried, and the delay asked by the Retry-After header.
+func (scf *ServiceConfigFetcher) callOnce(ctx context.Context, call, path, token string, retryableCodes map[int]bool) (*http.Response, bool, time.Duration, error) {
+	req, _ := http.NewRequest("GET", path, nil)
+	req = req.WithContext(ctx)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	start := time.Now()
+	resp, err := scf.client.Do(req)
+	serviceManagementCallLatency.WithLabelValues(call).Observe(time.Since(start).Seconds())
+	if err != nil {
+		serviceManagementCalls.WithLabelValues(call, "error").Inc()
+		return nil, true, 0, err
+	}
+	serviceManagementCalls.WithLabelValues(call, strconv.Itoa(resp.StatusCode)).Inc()
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), scf.timeNow())
+		return nil, retryableCodes[resp.StatusCode], retryAfter, fmt.Errorf("http call to %s returns not 200 OK: %v", path, resp.Status)
+	}
+	return resp, false, 0, nil
+}
+
+// parseRetryAfter parses the Retry-After header, either in seconds or as an
+// HTTP date. It returns 0 if the header is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
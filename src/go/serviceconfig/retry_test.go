@@ -0,0 +1,199 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceconfig
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+)
+
+type fakeResponse struct {
+	code       int
+	retryAfter string
+}
+
+func TestCallWithRetry(t *testing.T) {
+	testData := []struct {
+		desc         string
+		initialFetch bool
+		// The deadline of the context of the call, if not 0.
+		fetchDeadline time.Duration
+		responses     []fakeResponse
+		wantCalls     int
+		wantWaits     []time.Duration
+		wantError     string
+	}{
+		{
+			desc:      "Success without retry",
+			responses: []fakeResponse{{code: 200}},
+			wantCalls: 1,
+		},
+		{
+			desc:      "Success after retrying 503s with exponential backoff",
+			responses: []fakeResponse{{code: 503}, {code: 503}, {code: 200}},
+			wantCalls: 3,
+			wantWaits: []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			desc:      "Retry-After is respected when longer than the backoff",
+			responses: []fakeResponse{{code: 429, retryAfter: "7"}, {code: 200}},
+			wantCalls: 2,
+			wantWaits: []time.Duration{7 * time.Second},
+		},
+		{
+			desc:      "Non retryable code fails immediately",
+			responses: []fakeResponse{{code: 404}, {code: 200}},
+			wantCalls: 1,
+			wantError: "404",
+		},
+		{
+			desc:      "Give up after the attempts of background checks",
+			responses: []fakeResponse{{code: 500}, {code: 500}, {code: 500}, {code: 200}},
+			wantCalls: 3,
+			wantWaits: []time.Duration{time.Second, 2 * time.Second},
+			wantError: "giving up after 3 attempts",
+		},
+		{
+			desc:      "Give up when the next retry would pass the deadline",
+			responses: []fakeResponse{{code: 503, retryAfter: "60"}, {code: 200}},
+			wantCalls: 1,
+			wantError: "would pass the deadline 30s",
+		},
+		{
+			desc:          "Initial fetch retries beyond the attempts and the deadline of background checks",
+			initialFetch:  true,
+			fetchDeadline: 2 * time.Minute,
+			responses:     []fakeResponse{{code: 500}, {code: 500}, {code: 500}, {code: 503, retryAfter: "60"}, {code: 200}},
+			wantCalls:     5,
+			wantWaits:     []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 60 * time.Second},
+		},
+		{
+			desc:          "Initial fetch gives up when the next retry would pass the deadline of the fetch",
+			initialFetch:  true,
+			fetchDeadline: 2 * time.Minute,
+			responses:     []fakeResponse{{code: 503, retryAfter: "60"}, {code: 503, retryAfter: "60"}, {code: 200}},
+			wantCalls:     2,
+			wantWaits:     []time.Duration{60 * time.Second},
+			wantError:     "would pass the deadline of the fetch",
+		},
+	}
+
+	for _, tc := range testData {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			resp := tc.responses[calls]
+			calls++
+			if resp.retryAfter != "" {
+				w.Header().Set("Retry-After", resp.retryAfter)
+			}
+			w.WriteHeader(resp.code)
+		}))
+
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.ServiceManagementRetryAttempts = 3
+		opts.ServiceManagementRetryJitter = 0
+		scf, err := NewServiceConfigFetcher(nil, opts, "service-name")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tc.initialFetch {
+			scf.FinishInitialFetch()
+		}
+		now := time.Now()
+		var waits []time.Duration
+		scf.timeNow = func() time.Time { return now }
+		scf.sleep = func(d time.Duration) {
+			waits = append(waits, d)
+			now = now.Add(d)
+		}
+
+		ctx, cancel := context.Background(), func() {}
+		if tc.fetchDeadline > 0 {
+			ctx, cancel = context.WithDeadline(ctx, now.Add(tc.fetchDeadline))
+		}
+		resp, err := scf.callWithAccessToken(ctx, configCall, server.URL, "this-is-token")
+		cancel()
+		server.Close()
+		if tc.wantError == "" {
+			if err != nil {
+				t.Errorf("Test (%s): got error: %v", tc.desc, err)
+			} else {
+				resp.Body.Close()
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+			t.Errorf("Test (%s): got error: %v, want: %v", tc.desc, err, tc.wantError)
+		}
+		if calls != tc.wantCalls {
+			t.Errorf("Test (%s): got %d calls, want: %d", tc.desc, calls, tc.wantCalls)
+		}
+		if !reflect.DeepEqual(waits, tc.wantWaits) {
+			t.Errorf("Test (%s): got waits: %v, want: %v", tc.desc, waits, tc.wantWaits)
+		}
+	}
+}
+
+func TestNewRetryPolicies(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	initial, background, err := newRetryPolicies(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if initial.attempts != 0 || initial.deadline != 0 {
+		t.Errorf("got initial retry policy: %+v, want unlimited attempts until the deadline of the initial fetch", initial)
+	}
+	if background.attempts != 5 || background.deadline != 30*time.Second {
+		t.Errorf("got background retry policy: %+v", background)
+	}
+	if !reflect.DeepEqual(background.retryableCodes, map[int]bool{429: true, 500: true, 502: true, 503: true, 504: true}) {
+		t.Errorf("got retryable codes: %v", background.retryableCodes)
+	}
+
+	opts.ServiceManagementRetryCodes = "503,abc"
+	if _, _, err := newRetryPolicies(opts); err == nil || !strings.Contains(err.Error(), "abc") {
+		t.Errorf("got error: %v, want the invalid code", err)
+	}
+	opts.ServiceManagementRetryCodes = "503"
+	opts.ServiceManagementRetryJitter = 1.5
+	if _, _, err := newRetryPolicies(opts); err == nil {
+		t.Errorf("a jitter above 1 should be rejected")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2019, 10, 21, 7, 28, 0, 0, time.UTC)
+	testData := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "120", want: 2 * time.Minute},
+		{value: "-1", want: 0},
+		{value: "Mon, 21 Oct 2019 07:28:30 GMT", want: 30 * time.Second},
+		{value: "Mon, 21 Oct 2019 07:27:00 GMT", want: 0},
+		{value: "soon", want: 0},
+	}
+	for _, tc := range testData {
+		if got := parseRetryAfter(tc.value, now); got != tc.want {
+			t.Errorf("parseRetryAfter(%q) got: %v, want: %v", tc.value, got, tc.want)
+		}
+	}
+}
@@ -15,33 +15,74 @@
 package serviceconfig
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
-	"math"
 	"net/http"
+	"reflect"
+	"sort"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/metadata"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/metrics"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
 )
 
+const (
+	// The calls to Service Management, used as the call label of the metrics.
+	rolloutsCall = "rollouts"
+	configCall   = "config"
+)
+
+var (
+	serviceManagementCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_manager_service_management_calls_total",
+		Help: "Number of calls to Service Management, by call and HTTP status code. The code is \"error\" if no response is received.",
+	}, []string{"call", "code"})
+	serviceManagementCallLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "config_manager_service_management_call_duration_seconds",
+		Help:    "Latency of the calls to Service Management in seconds, by call.",
+		Buckets: metrics.DefaultBuckets,
+	}, []string{"call"})
+	accessTokenFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_manager_access_token_failures_total",
+		Help: "Number of failures to get the access token to call Service Management, by token source.",
+	}, []string{"source"})
+)
+
 type ServiceConfigFetcher struct {
-	serviceName         string
-	checkRolloutsTicker *time.Ticker
-	client              http.Client
-	mf                  *metadata.MetadataFetcher
-	opts                options.ConfigGeneratorOptions
-
-	curServiceConfig *confpb.Service
-	curRolloutId     string
+	serviceName string
+	client      http.Client
+	mf          *metadata.MetadataFetcher
+	opts        options.ConfigGeneratorOptions
+
+	curRolloutId       string
+	curTrafficPercents map[string]float64
+
+	// The calls are retried with the initial retry policy until
+	// FinishInitialFetch is called.
+	initialFetch          bool
+	initialRetryPolicy    retryPolicy
+	backgroundRetryPolicy retryPolicy
+	timeNow               func() time.Time
+	sleep                 func(time.Duration)
+}
+
+// RolloutConfig is a service config in a traffic percent rollout, with the
+// percentage of the traffic it serves.
+type RolloutConfig struct {
+	ServiceConfig  *confpb.Service
+	TrafficPercent float64
 }
 
 func NewServiceConfigFetcher(mf *metadata.MetadataFetcher, opts options.ConfigGeneratorOptions, serviceName string) (*ServiceConfigFetcher, error) {
@@ -51,6 +92,10 @@ func NewServiceConfigFetcher(mf *metadata.MetadataFetcher, opts options.ConfigGe
 	}
 	caCertPool := x509.NewCertPool()
 	caCertPool.AppendCertsFromPEM(caCert)
+	initialRetryPolicy, backgroundRetryPolicy, err := newRetryPolicies(opts)
+	if err != nil {
+		return nil, err
+	}
 	scf := &ServiceConfigFetcher{
 		client: http.Client{
 			Transport: &http.Transport{
@@ -60,69 +105,99 @@ func NewServiceConfigFetcher(mf *metadata.MetadataFetcher, opts options.ConfigGe
 			},
 			Timeout: opts.HttpRequestTimeout,
 		},
-		serviceName: serviceName,
-		mf:          mf,
-		opts:        opts,
+		serviceName:           serviceName,
+		mf:                    mf,
+		opts:                  opts,
+		initialFetch:          true,
+		initialRetryPolicy:    initialRetryPolicy,
+		backgroundRetryPolicy: backgroundRetryPolicy,
+		timeNow:               time.Now,
+		sleep:                 time.Sleep,
 	}
 	return scf, nil
 }
 
-// Fetch the service config by given configId. If configId is empty, try to
-// fetch the latest service config,.
-func (scf *ServiceConfigFetcher) FetchConfig(configId string) (*confpb.Service, error) {
-	_fetchConfig := func(configId string) (*confpb.Service, error) {
-		if configId != "" {
-			token, _, err := scf.accessToken()
-			if err != nil {
-				return nil, fmt.Errorf("fail to get access token: %v", err)
-			}
-			return scf.callServiceManagement(util.FetchConfigURL(scf.opts.ServiceManagementURL, scf.serviceName, configId), token)
-		}
-
-		glog.Infof("check new rollouts for service %v", scf.serviceName)
-		newRolloutId, newConfigId, err := scf.loadConfigFromRollouts(scf.serviceName, scf.curRolloutId, scf.curConfigId())
-		if err != nil {
-			glog.Errorf("error occurred when checking new rollouts, %v", err)
+// Fetch the service config by given configId. If configId is empty, fetch
+// the service config with the highest traffic percentage in the latest
+// rollout.
+func (scf *ServiceConfigFetcher) FetchConfig(ctx context.Context, configId string) (*confpb.Service, error) {
+	if configId == "" {
+		rolloutConfigs, err := scf.FetchRolloutConfigs(ctx)
+		if err != nil || rolloutConfigs == nil {
+			return nil, err
 		}
-		if scf.curRolloutId != newRolloutId && scf.curConfigId() != newConfigId {
-			scf.curRolloutId = newRolloutId
-			token, _, err := scf.accessToken()
-			if err != nil {
-				return nil, fmt.Errorf("fail to get access token: %v", err)
-			}
-			return scf.callServiceManagement(util.FetchConfigURL(scf.opts.ServiceManagementURL, scf.serviceName, newConfigId), token)
-		}
-		return nil, nil
+		return rolloutConfigs[0].ServiceConfig, nil
 	}
-	serviceConfig, err := _fetchConfig(configId)
-	if err == nil {
-		scf.curServiceConfig = serviceConfig
 
+	token, _, err := scf.accessToken()
+	if err != nil {
+		return nil, fmt.Errorf("fail to get access token: %v", err)
 	}
-
-	return serviceConfig, err
+	return scf.callServiceManagement(ctx, util.FetchConfigURL(scf.opts.ServiceManagementURL, scf.serviceName, configId), token)
 }
 
-func (scf *ServiceConfigFetcher) SetFetchConfigTimer(interval *time.Duration, callback func(serviceConfig *confpb.Service)) {
-	go func() {
-		glog.Infof("start checking new rollouts every %v seconds", *interval)
-		scf.checkRolloutsTicker = time.NewTicker(*interval)
+// FetchRolloutConfigs fetches all the service configs in the latest rollout,
+// ordered by their traffic percentages from high to low. It returns nil if
+// the traffic percentages have not changed since the last fetch.
+func (scf *ServiceConfigFetcher) FetchRolloutConfigs(ctx context.Context) ([]*RolloutConfig, error) {
+	glog.Infof("check new rollouts for service %v", scf.serviceName)
+	newRolloutId, trafficPercents, err := scf.loadConfigFromRollouts(ctx, scf.serviceName, scf.curRolloutId)
+	if err != nil {
+		return nil, err
+	}
+	if newRolloutId == scf.curRolloutId {
+		return nil, nil
+	}
+	if reflect.DeepEqual(trafficPercents, scf.curTrafficPercents) {
+		glog.Infof("no new configuration to load for service %v, current traffic percentages %v", scf.serviceName, trafficPercents)
+		scf.curRolloutId = newRolloutId
+		return nil, nil
+	}
 
-		for range scf.checkRolloutsTicker.C {
-			glog.Infof("check new rollouts for service %v", scf.serviceName)
+	var configIds []string
+	for configId, percent := range trafficPercents {
+		if percent > 0 {
+			configIds = append(configIds, configId)
+		}
+	}
+	if len(configIds) == 0 {
+		return nil, fmt.Errorf("no service config with traffic in rollout %v", newRolloutId)
+	}
+	sort.Slice(configIds, func(i, j int) bool {
+		if trafficPercents[configIds[i]] != trafficPercents[configIds[j]] {
+			return trafficPercents[configIds[i]] > trafficPercents[configIds[j]]
+		}
+		return configIds[i] > configIds[j]
+	})
 
-			serviceConfig, err := scf.FetchConfig("")
-			if err != nil {
-				glog.Errorf("error occurred when checking new rollouts, %v", err)
-				continue
+	var rolloutConfigs []*RolloutConfig
+	for _, configId := range configIds {
+		serviceConfig, err := scf.FetchConfig(ctx, configId)
+		if err != nil {
+			return nil, fmt.Errorf("fail to fetch service config %v of rollout %v, %v", configId, newRolloutId, err)
+		}
+		rolloutConfigs = append(rolloutConfigs, &RolloutConfig{
+			ServiceConfig:  serviceConfig,
+			TrafficPercent: trafficPercents[configId],
+		})
+	}
+	glog.Infof("found new configuration Ids %v for service %v", configIds, scf.serviceName)
+	scf.curRolloutId = newRolloutId
+	scf.curTrafficPercents = trafficPercents
+	return rolloutConfigs, nil
+}
 
-			}
+// FinishInitialFetch switches to the retry policy of the background rollout
+// checks, which gives up sooner than the one of the initial fetch.
+func (scf *ServiceConfigFetcher) FinishInitialFetch() {
+	scf.initialFetch = false
+}
 
-			if serviceConfig != nil {
-				callback(serviceConfig)
-			}
-		}
-	}()
+func (scf *ServiceConfigFetcher) retryPolicy() retryPolicy {
+	if scf.initialFetch {
+		return scf.initialRetryPolicy
+	}
+	return scf.backgroundRetryPolicy
 }
 
 // TODO(taoxuy): remove this after relying on service control for configId
@@ -130,80 +205,65 @@ func (scf *ServiceConfigFetcher) CurRolloutId() string {
 	return scf.curRolloutId
 }
 
-func (scf *ServiceConfigFetcher) curConfigId() string {
-	if scf.curServiceConfig == nil {
-		return ""
-	}
-	return scf.curServiceConfig.Id
-}
-
-func (scf *ServiceConfigFetcher) loadConfigFromRollouts(serviceName, curRolloutId, curConfigId string) (string, string, error) {
+func (scf *ServiceConfigFetcher) loadConfigFromRollouts(ctx context.Context, serviceName, curRolloutId string) (string, map[string]float64, error) {
 	var err error
 	var listServiceRolloutsResponse *smpb.ListServiceRolloutsResponse
-	listServiceRolloutsResponse, err = scf.fetchRollouts()
+	listServiceRolloutsResponse, err = scf.fetchRollouts(ctx)
 	if err != nil {
-		return "", "", fmt.Errorf("fail to get rollouts, %s", err)
+		return "", nil, fmt.Errorf("fail to get rollouts, %s", err)
 	}
 
 	if len(listServiceRolloutsResponse.Rollouts) == 0 {
-		return "", "", fmt.Errorf("no active rollouts")
+		return "", nil, fmt.Errorf("no active rollouts")
 	}
 	newRolloutId := listServiceRolloutsResponse.Rollouts[0].RolloutId
 	if newRolloutId == curRolloutId {
-		return curRolloutId, curConfigId, nil
+		return curRolloutId, nil, nil
 	}
 	glog.Infof("found new rollout Id %v for service %v", newRolloutId, serviceName)
 	glog.Infof("new rollout: %v", listServiceRolloutsResponse.Rollouts[0])
 	trafficPercentStrategy := listServiceRolloutsResponse.Rollouts[0].GetTrafficPercentStrategy()
 	trafficPercentMap := trafficPercentStrategy.GetPercentages()
 	if len(trafficPercentMap) == 0 {
-		return "", "", fmt.Errorf("no active rollouts")
-	}
-	var newConfigId string
-	currentMaxPercent := 0.0
-	// take config Id with max traffic percent as new config Id
-	for k, v := range trafficPercentMap {
-		if v > currentMaxPercent {
-			newConfigId = k
-			currentMaxPercent = v
-		}
-	}
-	if newConfigId == curConfigId {
-		glog.Infof("no new configuration to load for service %v, current configuration Id %v", serviceName, curConfigId)
-		return newRolloutId, curConfigId, nil
+		return "", nil, fmt.Errorf("no active rollouts")
 	}
-	if !(math.Abs(100.0-currentMaxPercent) < 1e-9) {
-		glog.Warningf("though traffic percentage of configuration %v is %v%%, set it to 100%%", newConfigId, currentMaxPercent)
-	}
-	glog.Infof("found new configuration Id %v for service %v", curConfigId, serviceName)
-	return newRolloutId, newConfigId, nil
+	return newRolloutId, trafficPercentMap, nil
 }
 
 func (scf *ServiceConfigFetcher) accessToken() (string, time.Duration, error) {
 	if scf.mf == nil && scf.opts.ServiceAccountKey == "" {
+		accessTokenFailures.WithLabelValues("none").Inc()
 		return "", 0, fmt.Errorf("If --non_gcp is specified, --service_account_key has to be specified.")
 	}
 	if scf.opts.ServiceAccountKey != "" {
-		return util.GenerateAccessTokenFromFile(scf.opts.ServiceAccountKey)
+		token, expires, err := util.GenerateAccessTokenFromFile(scf.opts.ServiceAccountKey)
+		if err != nil {
+			accessTokenFailures.WithLabelValues("service_account_key").Inc()
+		}
+		return token, expires, err
+	}
+	token, expires, err := scf.mf.FetchAccessToken()
+	if err != nil {
+		accessTokenFailures.WithLabelValues("metadata").Inc()
 	}
-	return scf.mf.FetchAccessToken()
+	return token, expires, err
 }
 
 // TODO(jcwang) cleanup here. This function is redundant.
-func (scf *ServiceConfigFetcher) fetchRollouts() (*smpb.ListServiceRolloutsResponse, error) {
+func (scf *ServiceConfigFetcher) fetchRollouts(ctx context.Context) (*smpb.ListServiceRolloutsResponse, error) {
 	token, _, err := scf.accessToken()
 	if err != nil {
 		return nil, fmt.Errorf("fail to get access token: %v", err)
 	}
 
-	return scf.callServiceManagementRollouts(util.FetchRolloutsURL(scf.opts.ServiceManagementURL, scf.serviceName), token)
+	return scf.callServiceManagementRollouts(ctx, util.FetchRolloutsURL(scf.opts.ServiceManagementURL, scf.serviceName), token)
 }
 
 // TODO(taoxuy): replace this with callServiceControl for configId
-func (scf *ServiceConfigFetcher) callServiceManagementRollouts(path, token string) (*smpb.ListServiceRolloutsResponse, error) {
+func (scf *ServiceConfigFetcher) callServiceManagementRollouts(ctx context.Context, path, token string) (*smpb.ListServiceRolloutsResponse, error) {
 	var err error
 	var resp *http.Response
-	if resp, err = scf.callWithAccessToken(path, token); err != nil {
+	if resp, err = scf.callWithAccessToken(ctx, rolloutsCall, path, token); err != nil {
 		return nil, err
 	}
 
@@ -219,10 +279,10 @@ func (scf *ServiceConfigFetcher) callServiceManagementRollouts(path, token strin
 	return rolloutsResponse, nil
 }
 
-func (scf *ServiceConfigFetcher) callServiceManagement(path, token string) (*confpb.Service, error) {
+func (scf *ServiceConfigFetcher) callServiceManagement(ctx context.Context, path, token string) (*confpb.Service, error) {
 	var err error
 	var resp *http.Response
-	if resp, err = scf.callWithAccessToken(path, token); err != nil {
+	if resp, err = scf.callWithAccessToken(ctx, configCall, path, token); err != nil {
 		return nil, err
 	}
 	body, err := ioutil.ReadAll(resp.Body)
@@ -236,18 +296,3 @@ func (scf *ServiceConfigFetcher) callServiceManagement(path, token string) (*con
 	}
 	return service, nil
 }
-
-func (scf *ServiceConfigFetcher) callWithAccessToken(path, token string) (*http.Response, error) {
-	req, _ := http.NewRequest("GET", path, nil)
-	req.Header.Add("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/x-protobuf")
-	resp, err := scf.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return nil, fmt.Errorf("http call to %s returns not 200 OK: %v", path, resp.Status)
-	}
-	return resp, nil
-}
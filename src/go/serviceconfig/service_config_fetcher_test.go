@@ -15,34 +15,46 @@
 package serviceconfig
 
 import (
+	"context"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestServiceConfigFetcherTimeout(t *testing.T) {
 	opts := options.DefaultConfigGeneratorOptions()
 	timeout := 1 * time.Second
 	opts.HttpRequestTimeout = timeout
+	opts.ServiceManagementRetryAttempts = 1
 
 	serviceConfigFetcher, err := NewServiceConfigFetcher(nil, opts, "service-name")
 	if err != nil {
 		t.Fatalf("newServiceConfigFetcherClient failed: %v", err)
 	}
+	serviceConfigFetcher.FinishInitialFetch()
 
+	okCalls, errorCalls := testutil.ToFloat64(serviceManagementCalls.WithLabelValues(configCall, "200")), testutil.ToFloat64(serviceManagementCalls.WithLabelValues(configCall, "error"))
 	server := util.InitMockServer(`{}`)
-	_, err = serviceConfigFetcher.callWithAccessToken(server.GetURL(), "this-is-token")
+	_, err = serviceConfigFetcher.callWithAccessToken(context.Background(), configCall, server.GetURL(), "this-is-token")
 	if err != nil {
 		t.Errorf("TestServiceConfigFetcherTimeout: the service config fetcher should get the config but get the error %v", err)
 
 	}
 	server.SetSleepTime(2 * timeout)
-	_, err = serviceConfigFetcher.callWithAccessToken(server.GetURL(), "this-is-token")
+	_, err = serviceConfigFetcher.callWithAccessToken(context.Background(), configCall, server.GetURL(), "this-is-token")
 	if err == nil || !strings.Contains(err.Error(), "Client.Timeout exceeded while awaiting headers") {
 		t.Errorf("TestServiceConfigFetcherTimeout: the service config fetcher get the config but should get timeout error")
 
 	}
+
+	if got := testutil.ToFloat64(serviceManagementCalls.WithLabelValues(configCall, "200")) - okCalls; got != 1 {
+		t.Errorf("TestServiceConfigFetcherTimeout: got %v successful calls in the metrics, want 1", got)
+	}
+	if got := testutil.ToFloat64(serviceManagementCalls.WithLabelValues(configCall, "error")) - errorCalls; got != 1 {
+		t.Errorf("TestServiceConfigFetcherTimeout: got %v failed calls in the metrics, want 1", got)
+	}
 }
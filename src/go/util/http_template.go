@@ -0,0 +1,297 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// UriTemplate is a path template of google.api.http, parsed with its grammar:
+//
+//	Template = "/" Segments [ Verb ] ;
+//	Segments = Segment { "/" Segment } ;
+//	Segment  = "*" | "**" | LITERAL | Variable ;
+//	Variable = "{" FieldPath [ "=" Segments ] "}" ;
+//	FieldPath = IDENT { "." IDENT } ;
+//	Verb     = ":" LITERAL ;
+//
+// The "**" wildcard matches zero or more segments, so it must be the last
+// segment. The root path "/" is a template without any segment.
+type UriTemplate struct {
+	// The segments of the path, with the variables expanded. Each of them is
+	// either "*", "**" or a literal.
+	Segments []string
+	// The variables, which bind the segments between their start and end.
+	Variables []*UriTemplateVariable
+	Verb      string
+}
+
+// UriTemplateVariable is a variable of a path template.
+type UriTemplateVariable struct {
+	FieldPath string
+	// The segments of the variable are Segments[StartSegment:EndSegment].
+	StartSegment int
+	EndSegment   int
+}
+
+var fieldPathRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// ParseUriTemplate parses a path template of google.api.http.
+func ParseUriTemplate(template string) (*UriTemplate, error) {
+	if template == "" {
+		return nil, fmt.Errorf("invalid path template %q, it cannot be empty", template)
+	}
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("invalid path template %q, it must start with /", template)
+	}
+	t := &UriTemplate{}
+	if template == "/" {
+		return t, nil
+	}
+
+	// The verb follows the last segment, outside of the variables.
+	path := template
+	depth, lastSlash := 0, 0
+	for i, c := range template {
+		switch {
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		case c == '/' && depth == 0:
+			lastSlash = i
+		}
+	}
+	depth = 0
+	for i := lastSlash; i < len(template); i++ {
+		switch template[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ':':
+			if depth == 0 {
+				path, t.Verb = template[:i], template[i+1:]
+				if t.Verb == "" || strings.ContainsAny(t.Verb, "/{}*=:") {
+					return nil, fmt.Errorf("invalid path template %q, invalid verb %q", template, t.Verb)
+				}
+				i = len(template)
+			}
+		}
+	}
+
+	p := &uriTemplateParser{template: template, path: path, t: t}
+	if err := p.parseSegments(false); err != nil {
+		return nil, err
+	}
+	if p.i < len(p.path) {
+		return nil, p.errorf("unexpected %q", p.path[p.i:])
+	}
+	for i, segment := range t.Segments {
+		if segment == "**" && i != len(t.Segments)-1 {
+			return nil, fmt.Errorf("invalid path template %q, ** must be the last segment", template)
+		}
+	}
+	return t, nil
+}
+
+type uriTemplateParser struct {
+	template string
+	// The template without the verb.
+	path string
+	i    int
+	t    *UriTemplate
+}
+
+func (p *uriTemplateParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid path template %q at position %d, %s", p.template, p.i, fmt.Sprintf(format, args...))
+}
+
+// parseSegments parses "/" Segment { "/" Segment }, or Segment { "/" Segment }
+// inside a variable.
+func (p *uriTemplateParser) parseSegments(inVariable bool) error {
+	for first := true; ; first = false {
+		if !inVariable || !first {
+			if p.i >= len(p.path) || p.path[p.i] != '/' {
+				return nil
+			}
+			p.i++
+		}
+		if err := p.parseSegment(inVariable); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *uriTemplateParser) parseSegment(inVariable bool) error {
+	rest := p.path[p.i:]
+	switch {
+	case strings.HasPrefix(rest, "**"):
+		p.t.Segments = append(p.t.Segments, "**")
+		p.i += 2
+	case strings.HasPrefix(rest, "*"):
+		p.t.Segments = append(p.t.Segments, "*")
+		p.i++
+	case strings.HasPrefix(rest, "{"):
+		if inVariable {
+			return p.errorf("variables cannot be nested")
+		}
+		return p.parseVariable()
+	default:
+		n := strings.IndexAny(rest, "/{}*")
+		if n < 0 {
+			n = len(rest)
+		}
+		if n == 0 {
+			if rest == "" || rest[0] == '/' {
+				return p.errorf("empty segment")
+			}
+			return p.errorf("unexpected %q", rest[:1])
+		}
+		p.t.Segments = append(p.t.Segments, rest[:n])
+		p.i += n
+	}
+	if p.i < len(p.path) && p.path[p.i] != '/' && p.path[p.i] != '}' {
+		return p.errorf("unexpected %q after segment", p.path[p.i:p.i+1])
+	}
+	return nil
+}
+
+func (p *uriTemplateParser) parseVariable() error {
+	p.i++
+	end := strings.IndexAny(p.path[p.i:], "=}")
+	if end < 0 {
+		return p.errorf("unterminated variable")
+	}
+	fieldPath := p.path[p.i : p.i+end]
+	if !fieldPathRegexp.MatchString(fieldPath) {
+		return p.errorf("invalid field path %q", fieldPath)
+	}
+	for _, v := range p.t.Variables {
+		if v.FieldPath == fieldPath {
+			return p.errorf("duplicate variable %q", fieldPath)
+		}
+	}
+	p.i += end
+
+	v := &UriTemplateVariable{
+		FieldPath:    fieldPath,
+		StartSegment: len(p.t.Segments),
+	}
+	if p.path[p.i] == '=' {
+		p.i++
+		if err := p.parseSegments(true); err != nil {
+			return err
+		}
+	} else {
+		p.t.Segments = append(p.t.Segments, "*")
+	}
+	if p.i >= len(p.path) || p.path[p.i] != '}' {
+		return p.errorf("unterminated variable %q", fieldPath)
+	}
+	p.i++
+	v.EndSegment = len(p.t.Segments)
+	p.t.Variables = append(p.t.Variables, v)
+	return nil
+}
+
+// HasWildcard returns whether the template matches more than one path.
+func (t *UriTemplate) HasWildcard() bool {
+	for _, segment := range t.Segments {
+		if segment == "*" || segment == "**" {
+			return true
+		}
+	}
+	return false
+}
+
+// Regex returns the anchored RE2 regular expression matching the paths of the
+// template. A "*" matches one non-empty segment, and a "**" matches zero or
+// more segments.
+func (t *UriTemplate) Regex() string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, segment := range t.Segments {
+		switch segment {
+		case "*":
+			b.WriteString("/[^/]+")
+		case "**":
+			b.WriteString("(/.*)?")
+		default:
+			b.WriteString("/" + regexp.QuoteMeta(segment))
+		}
+	}
+	if len(t.Segments) == 0 {
+		b.WriteString("/")
+	}
+	if t.Verb != "" {
+		b.WriteString(":" + regexp.QuoteMeta(t.Verb))
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// String returns the template without the names of the variables, which is
+// the same for all the templates matching the same paths.
+func (t *UriTemplate) String() string {
+	s := "/" + strings.Join(t.Segments, "/")
+	if t.Verb != "" {
+		s += ":" + t.Verb
+	}
+	return s
+}
+
+// LiteralCount returns the number of literal segments of the template, with
+// the verb counted as one.
+func (t *UriTemplate) LiteralCount() int {
+	n := 0
+	for _, segment := range t.Segments {
+		if segment != "*" && segment != "**" {
+			n++
+		}
+	}
+	if t.Verb != "" {
+		n++
+	}
+	return n
+}
+
+// Covers returns whether the template matches all the paths matched by the
+// other template.
+func (t *UriTemplate) Covers(other *UriTemplate) bool {
+	for i, segment := range t.Segments {
+		if segment == "**" {
+			// It matches the rest of the path, including the verb.
+			return t.Verb == "" || t.Verb == other.Verb
+		}
+		if i >= len(other.Segments) {
+			return false
+		}
+		switch otherSegment := other.Segments[i]; {
+		case otherSegment == "**":
+			return false
+		case segment == "*":
+			// The last "*" matches the verb of the other template as well.
+			if i == len(t.Segments)-1 && t.Verb == "" && i == len(other.Segments)-1 {
+				return true
+			}
+		case segment != otherSegment:
+			return false
+		}
+	}
+	return len(t.Segments) == len(other.Segments) && t.Verb == other.Verb
+}
@@ -0,0 +1,265 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseUriTemplate(t *testing.T) {
+	testData := []struct {
+		template      string
+		wantSegments  []string
+		wantVariables []*UriTemplateVariable
+		wantVerb      string
+		wantRegex     string
+		wantMatch     []string
+		wantNoMatch   []string
+		wantError     string
+	}{
+		{
+			template:    "/",
+			wantRegex:   `^/$`,
+			wantMatch:   []string{"/"},
+			wantNoMatch: []string{"/a"},
+		},
+		{
+			template:     "/v1/shelves.json",
+			wantSegments: []string{"v1", "shelves.json"},
+			wantRegex:    `^/v1/shelves\.json$`,
+			wantMatch:    []string{"/v1/shelves.json"},
+			wantNoMatch:  []string{"/v1/shelvesXjson", "/v1/shelves.json/1"},
+		},
+		{
+			template:     "/v1/shelves/{shelf}",
+			wantSegments: []string{"v1", "shelves", "*"},
+			wantVariables: []*UriTemplateVariable{
+				{FieldPath: "shelf", StartSegment: 2, EndSegment: 3},
+			},
+			wantRegex:   `^/v1/shelves/[^/]+$`,
+			wantMatch:   []string{"/v1/shelves/1"},
+			wantNoMatch: []string{"/v1/shelves/", "/v1/shelves/1/books", "/v1/shelves"},
+		},
+		{
+			template:     "/v1/{name=shelves/*/books/**}",
+			wantSegments: []string{"v1", "shelves", "*", "books", "**"},
+			wantVariables: []*UriTemplateVariable{
+				{FieldPath: "name", StartSegment: 1, EndSegment: 5},
+			},
+			wantRegex:   `^/v1/shelves/[^/]+/books(/.*)?$`,
+			wantMatch:   []string{"/v1/shelves/1/books", "/v1/shelves/1/books/2", "/v1/shelves/1/books/2/pages/3"},
+			wantNoMatch: []string{"/v1/shelves/books/2", "/v1/shelves/1/book"},
+		},
+		{
+			template:     "/v1/{shelf.name}/books/{book_id}:cancel",
+			wantSegments: []string{"v1", "*", "books", "*"},
+			wantVariables: []*UriTemplateVariable{
+				{FieldPath: "shelf.name", StartSegment: 1, EndSegment: 2},
+				{FieldPath: "book_id", StartSegment: 3, EndSegment: 4},
+			},
+			wantVerb:    "cancel",
+			wantRegex:   `^/v1/[^/]+/books/[^/]+:cancel$`,
+			wantMatch:   []string{"/v1/1/books/2:cancel"},
+			wantNoMatch: []string{"/v1/1/books/2", "/v1/1/books/2:cancelled"},
+		},
+		{
+			template:     "/**",
+			wantSegments: []string{"**"},
+			wantRegex:    `^(/.*)?$`,
+			wantMatch:    []string{"/", "/a", "/a/b/c"},
+		},
+		{
+			template:     "/v1/*:batchGet",
+			wantSegments: []string{"v1", "*"},
+			wantVerb:     "batchGet",
+			wantRegex:    `^/v1/[^/]+:batchGet$`,
+		},
+		{
+			template:     "/v1/{name=*}",
+			wantSegments: []string{"v1", "*"},
+			wantVariables: []*UriTemplateVariable{
+				{FieldPath: "name", StartSegment: 1, EndSegment: 2},
+			},
+			wantRegex: `^/v1/[^/]+$`,
+		},
+		{
+			template:     "/echo.v1.Echo/Echo",
+			wantSegments: []string{"echo.v1.Echo", "Echo"},
+			wantRegex:    `^/echo\.v1\.Echo/Echo$`,
+		},
+		{
+			template:  "",
+			wantError: "it cannot be empty",
+		},
+		{
+			template:  "v1/shelves",
+			wantError: "it must start with /",
+		},
+		{
+			template:  "/v1//shelves",
+			wantError: "empty segment",
+		},
+		{
+			template:  "/v1/shelves/",
+			wantError: "empty segment",
+		},
+		{
+			template:  "/v1/**/shelves",
+			wantError: "** must be the last segment",
+		},
+		{
+			template:  "/v1/{name=shelves/**}/books",
+			wantError: "** must be the last segment",
+		},
+		{
+			template:  "/v1/{name",
+			wantError: "unterminated variable",
+		},
+		{
+			template:  "/v1/{name=shelves/*",
+			wantError: `unterminated variable "name"`,
+		},
+		{
+			template:  "/v1/{name={id}}",
+			wantError: "variables cannot be nested",
+		},
+		{
+			template:  "/v1/{1name}",
+			wantError: `invalid field path "1name"`,
+		},
+		{
+			template:  "/v1/{id}/{id}",
+			wantError: `duplicate variable "id"`,
+		},
+		{
+			template:  "/v1/{id}.json",
+			wantError: `unexpected ".json"`,
+		},
+		{
+			template:  "/v1/a*",
+			wantError: `unexpected "*"`,
+		},
+		{
+			template:  "/v1/shelves:",
+			wantError: `invalid verb ""`,
+		},
+		{
+			template:  "/v1/shelves}",
+			wantError: `unexpected "}"`,
+		},
+	}
+
+	for _, tc := range testData {
+		got, err := ParseUriTemplate(tc.template)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want: %v", tc.template, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got error: %v", tc.template, err)
+			continue
+		}
+		if !reflect.DeepEqual(got.Segments, tc.wantSegments) {
+			t.Errorf("Test (%s): got segments: %q, want: %q", tc.template, got.Segments, tc.wantSegments)
+		}
+		if !reflect.DeepEqual(got.Variables, tc.wantVariables) {
+			t.Errorf("Test (%s): got variables: %+v, want: %+v", tc.template, got.Variables, tc.wantVariables)
+		}
+		if got.Verb != tc.wantVerb {
+			t.Errorf("Test (%s): got verb: %q, want: %q", tc.template, got.Verb, tc.wantVerb)
+		}
+		if got.Regex() != tc.wantRegex {
+			t.Errorf("Test (%s): got regex: %s, want: %s", tc.template, got.Regex(), tc.wantRegex)
+		}
+		re := regexp.MustCompile(got.Regex())
+		for _, path := range tc.wantMatch {
+			if !re.MatchString(path) {
+				t.Errorf("Test (%s): regex %s does not match %s", tc.template, got.Regex(), path)
+			}
+		}
+		for _, path := range tc.wantNoMatch {
+			if re.MatchString(path) {
+				t.Errorf("Test (%s): regex %s matches %s", tc.template, got.Regex(), path)
+			}
+		}
+	}
+}
+
+func TestUriTemplateCovers(t *testing.T) {
+	testData := []struct {
+		template string
+		other    string
+		want     bool
+	}{
+		{"/v1/{x}", "/v1/stats", true},
+		{"/v1/stats", "/v1/{x}", false},
+		{"/v1/{x}", "/v1/{y}", true},
+		{"/v1/{x}", "/v1/{x}/books", false},
+		{"/v1/{x}", "/v1/{x}:undelete", true},
+		{"/v1/{x}:undelete", "/v1/{x}", false},
+		{"/v1/{x}:undelete", "/v1/stats:undelete", true},
+		{"/v1/stats", "/v1/stats:undelete", false},
+		{"/v1/**", "/v1", true},
+		{"/v1/**", "/v1/a/{b=c/**}", true},
+		{"/v1/{x}", "/v1/**", false},
+		{"/v1/**:undelete", "/v1/a/b:undelete", true},
+		{"/v1/**:undelete", "/v1/a/b", false},
+		{"/**", "/", true},
+		{"/", "/", true},
+		{"/", "/v1", false},
+	}
+
+	for _, tc := range testData {
+		template, err := ParseUriTemplate(tc.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := ParseUriTemplate(tc.other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := template.Covers(other); got != tc.want {
+			t.Errorf("Test (%s covers %s): got %v, want %v", tc.template, tc.other, got, tc.want)
+		}
+	}
+}
+
+func TestUriTemplateString(t *testing.T) {
+	testData := []struct {
+		template string
+		want     string
+	}{
+		{"/", "/"},
+		{"/v1/shelves", "/v1/shelves"},
+		{"/v1/shelves/{shelf}", "/v1/shelves/*"},
+		{"/v1/{name=shelves/*/books/**}", "/v1/shelves/*/books/**"},
+		{"/v1/{shelf}:undelete", "/v1/*:undelete"},
+	}
+
+	for _, tc := range testData {
+		template, err := ParseUriTemplate(tc.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := template.String(); got != tc.want {
+			t.Errorf("Test (%s): got %v, want %v", tc.template, got, tc.want)
+		}
+	}
+}
@@ -27,19 +27,37 @@ func CreateLoadAssignment(hostname string, port uint32) *v2pb.ClusterLoadAssignm
 		Endpoints: []*endpointpb.LocalityLbEndpoints{
 			{
 				LbEndpoints: []*endpointpb.LbEndpoint{
-					{
-						HostIdentifier: &endpointpb.LbEndpoint_Endpoint{
-							Endpoint: &endpointpb.Endpoint{
-								Address: &corepb.Address{
-									Address: &corepb.Address_SocketAddress{
-										SocketAddress: &corepb.SocketAddress{
-											Address: hostname,
-											PortSpecifier: &corepb.SocketAddress_PortValue{
-												PortValue: port,
-											},
-										},
-									},
-								},
+					CreateLbEndpoint(hostname, port),
+				},
+			},
+		},
+	}
+}
+
+// CreateMultiEndpointLoadAssignment creates a ClusterLoadAssignment of several
+// endpoints, which are load balanced by the cluster.
+func CreateMultiEndpointLoadAssignment(clusterName string, lbEndpoints []*endpointpb.LbEndpoint) *v2pb.ClusterLoadAssignment {
+	return &v2pb.ClusterLoadAssignment{
+		ClusterName: clusterName,
+		Endpoints: []*endpointpb.LocalityLbEndpoints{
+			{
+				LbEndpoints: lbEndpoints,
+			},
+		},
+	}
+}
+
+// CreateLbEndpoint creates the LbEndpoint of a hostname and a port.
+func CreateLbEndpoint(hostname string, port uint32) *endpointpb.LbEndpoint {
+	return &endpointpb.LbEndpoint{
+		HostIdentifier: &endpointpb.LbEndpoint_Endpoint{
+			Endpoint: &endpointpb.Endpoint{
+				Address: &corepb.Address{
+					Address: &corepb.Address_SocketAddress{
+						SocketAddress: &corepb.SocketAddress{
+							Address: hostname,
+							PortSpecifier: &corepb.SocketAddress_PortValue{
+								PortValue: port,
 							},
 						},
 					},
@@ -16,20 +16,29 @@ package util
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
 
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
+	"gopkg.in/yaml.v3"
 
 	bapb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/backend_auth"
 	drpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/backend_routing"
+	lrlpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/local_rate_limit"
 	pmpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/path_matcher"
+	rldpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/rate_limit_descriptors"
 	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/http/service_control"
 	authpb "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
 	gspb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/grpc_stats/v2alpha"
 	jwtpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/jwt_authn/v2alpha"
+	ratelimitpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/rate_limit/v2"
 	routerpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/router/v2"
 	transcoderpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/transcoder/v2"
 	hcmpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
@@ -89,6 +98,12 @@ var Resolver = FuncResolver(func(url string) (proto.Message, error) {
 		return new(bapb.FilterConfig), nil
 	case "type.googleapis.com/google.api.envoy.http.backend_routing.FilterConfig":
 		return new(drpb.FilterConfig), nil
+	case "type.googleapis.com/google.api.envoy.http.local_rate_limit.FilterConfig":
+		return new(lrlpb.FilterConfig), nil
+	case "type.googleapis.com/google.api.envoy.http.rate_limit_descriptors.FilterConfig":
+		return new(rldpb.FilterConfig), nil
+	case "type.googleapis.com/envoy.config.filter.http.rate_limit.v2.RateLimit":
+		return new(ratelimitpb.RateLimit), nil
 	case "type.googleapis.com/envoy.config.filter.http.router.v2.Router":
 		return new(routerpb.Router), nil
 	case "type.googleapis.com/envoy.api.v2.auth.UpstreamTlsContext":
@@ -142,17 +157,344 @@ func StructToMessage(pbst *structpb.Struct, out proto.Message) error {
 	return jsonpb.Unmarshal(buf, out)
 }
 
-// UnmarshalServiceConfig converts service config in JSON to proto
+// UnmarshalServiceConfig converts service config in JSON or YAML to proto.
+// The format is sniffed from the content: a JSON service config is an object.
 func UnmarshalServiceConfig(config io.Reader) (*confpb.Service, error) {
+	data, err := ioutil.ReadAll(config)
+	if err != nil {
+		return nil, fmt.Errorf("fail to unmarshal serviceConfig: %v", err)
+	}
+	return unmarshalServiceConfig(data, !isJSONObject(data))
+}
+
+// UnmarshalServiceConfigFile converts the service config file at path to
+// proto, in JSON or YAML by its extension, or sniffed from the content for
+// the other extensions.
+func UnmarshalServiceConfigFile(path string, config []byte) (*confpb.Service, error) {
+	return unmarshalServiceConfig(config, IsYAMLFile(path, config))
+}
+
+// IsYAMLFile returns whether the file at path is in YAML rather than JSON, by
+// its extension, or sniffed from the content for the other extensions.
+func IsYAMLFile(path string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return false
+	case ".yaml", ".yml":
+		return true
+	default:
+		return !isJSONObject(data)
+	}
+}
+
+// UnmarshalServiceConfigYAML converts service config in YAML to proto.
+func UnmarshalServiceConfigYAML(config []byte) (*confpb.Service, error) {
+	return unmarshalServiceConfig(config, true)
+}
+
+func isJSONObject(data []byte) bool {
+	data = bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\ufeff")), " \t\r\n")
+	return len(data) > 0 && data[0] == '{'
+}
+
+// YAMLToJSON converts a YAML document into JSON, e.g. the service configs and
+// the OpenAPI documents.
+//
+// Like the YAML parser of Service Management, the scalars are typed by the
+// fields they are unmarshalled into, not by how they look: besides null and
+// booleans, all the scalars are JSON strings, which jsonpb and json.Number
+// accept for numbers as well, so that "version: 1.0" is not turned into "1".
+func YAMLToJSON(data []byte) ([]byte, error) {
+	root, err := parseYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, root); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalYAML unmarshals the YAML document into v with encoding/json, by
+// the JSON field tags of v. Unlike YAMLToJSON, the scalars keep their YAML
+// types, e.g. the numbers are JSON numbers.
+func UnmarshalYAML(data []byte, v interface{}) error {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	jsonData, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// parseYAML parses the YAML document into its root node, which is nil for an
+// empty document.
+func parseYAML(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	return doc.Content[0], nil
+}
+
+// writeJSON writes the JSON of the node.
+func writeJSON(buf *bytes.Buffer, node *yaml.Node) error {
+	if node == nil {
+		buf.WriteString("null")
+		return nil
+	}
+	switch node.Kind {
+	case yaml.AliasNode:
+		return writeJSON(buf, node.Alias)
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if key.Kind != yaml.ScalarNode {
+				return fmt.Errorf("yaml: line %d: mapping key is not a scalar", key.Line)
+			}
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, key.Value)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, node.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, item := range node.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		switch node.ShortTag() {
+		case "!!null":
+			buf.WriteString("null")
+		case "!!bool":
+			var b bool
+			if err := node.Decode(&b); err != nil {
+				return err
+			}
+			fmt.Fprint(buf, b)
+		default:
+			writeJSONString(buf, node.Value)
+		}
+	}
+	return nil
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s)
+	buf.Write(b)
+}
+
+// unmarshalServiceConfig unmarshals service config in JSON or YAML. The
+// errors report the line and column of the value that fails to unmarshal,
+// when it is known.
+func unmarshalServiceConfig(data []byte, isYAML bool) (*confpb.Service, error) {
+	var root *yaml.Node
+	jsonConfig := data
+	if isYAML {
+		var err error
+		if root, err = parseYAML(data); err != nil {
+			return nil, fmt.Errorf("fail to unmarshal serviceConfig: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := writeJSON(&buf, root); err != nil {
+			return nil, fmt.Errorf("fail to unmarshal serviceConfig: %v", err)
+		}
+		jsonConfig = buf.Bytes()
+	}
+
+	var serviceConfig confpb.Service
+	err := unmarshalJSON(jsonConfig, &serviceConfig)
+	if err == nil {
+		return &serviceConfig, nil
+	}
+	if syntaxErr, ok := err.(*json.SyntaxError); ok && !isYAML {
+		prefix := data[:syntaxErr.Offset]
+		line := 1 + bytes.Count(prefix, []byte("\n"))
+		column := len(prefix) - 1 - bytes.LastIndexByte(prefix, '\n')
+		return nil, fmt.Errorf("fail to unmarshal serviceConfig at line %d, column %d: %v", line, column, err)
+	}
+	if root == nil {
+		// JSON is YAML, whose parser keeps the positions of the values.
+		root, _ = parseYAML(data)
+	}
+	if node := errorNode(root, reflect.TypeOf(serviceConfig)); node != nil {
+		return nil, fmt.Errorf("fail to unmarshal serviceConfig at line %d, column %d: %v", node.Line, node.Column, err)
+	}
+	return nil, fmt.Errorf("fail to unmarshal serviceConfig: %v", err)
+}
+
+func unmarshalJSON(data []byte, msg proto.Message) error {
 	unmarshaler := &jsonpb.Unmarshaler{
 		AllowUnknownFields: true,
 		AnyResolver:        Resolver,
 	}
-	var serviceConfig confpb.Service
-	if err := unmarshaler.Unmarshal(config, &serviceConfig); err != nil {
-		return nil, fmt.Errorf("fail to unmarshal serviceConfig: %s", err)
+	return unmarshaler.Unmarshal(bytes.NewReader(data), msg)
+}
+
+type wellKnownType interface {
+	XXX_WellKnownType() string
+}
+
+// errorNode finds the node of the value which fails to unmarshal into the
+// proto message of type t, or nil. The nodes are walked along the fields of
+// the messages, and only the other values, such as the scalars and the
+// well-known types, are unmarshalled, each one on its own. The node of a
+// mapping value is its key.
+func errorNode(node *yaml.Node, t reflect.Type) *yaml.Node {
+	node = resolveAlias(node)
+	if node == nil || node.ShortTag() == "!!null" {
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return node
+	}
+	if w, ok := reflect.New(t).Interface().(wellKnownType); ok && w.XXX_WellKnownType() == "Any" {
+		return anyErrorNode(node, t)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], resolveAlias(node.Content[i+1])
+		fieldType, ok := messageFieldType(t, key.Value)
+		if !ok {
+			// Unknown fields are allowed.
+			continue
+		}
+		if msgType, ok := walkedMessageType(fieldType); ok {
+			if n := errorNode(value, msgType); n == value {
+				return key
+			} else if n != nil {
+				return n
+			}
+			continue
+		}
+		if fieldType.Kind() == reflect.Slice {
+			if msgType, ok := walkedMessageType(fieldType.Elem()); ok {
+				if value.ShortTag() == "!!null" {
+					continue
+				}
+				if value.Kind != yaml.SequenceNode {
+					return key
+				}
+				for _, item := range value.Content {
+					if n := errorNode(item, msgType); n != nil {
+						return n
+					}
+				}
+				continue
+			}
+		}
+		if !unmarshalsField(t, key.Value, value) {
+			return key
+		}
+	}
+	return nil
+}
+
+// anyErrorNode finds the node of the value which fails to unmarshal into the
+// Any of type t. The fields of a message are next to its "@type", which is
+// the node of an unknown type.
+func anyErrorNode(node *yaml.Node, t reflect.Type) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], resolveAlias(node.Content[i+1])
+		if key.Value != "@type" {
+			continue
+		}
+		msg, err := Resolver(value.Value)
+		if err != nil {
+			return key
+		}
+		if msgType, ok := walkedMessageType(reflect.TypeOf(msg)); ok {
+			return errorNode(node, msgType)
+		}
+		var buf bytes.Buffer
+		if writeJSON(&buf, node) != nil || unmarshalJSON(buf.Bytes(), reflect.New(t).Interface().(proto.Message)) != nil {
+			return key
+		}
+		return nil
+	}
+	return node
+}
+
+// messageFieldType returns the type of the field of the proto message of
+// type t, by its original or JSON name, the same way as jsonpb.
+func messageFieldType(t reflect.Type, name string) (reflect.Type, bool) {
+	props := proto.GetProperties(t)
+	for i := 0; i < t.NumField(); i++ {
+		prop := props.Prop[i]
+		if strings.HasPrefix(t.Field(i).Name, "XXX_") || prop.OrigName == "" {
+			continue
+		}
+		if prop.OrigName == name || prop.JSONName == name {
+			return t.Field(i).Type, true
+		}
+	}
+	for _, oneof := range props.OneofTypes {
+		if oneof.Prop.OrigName == name || oneof.Prop.JSONName == name {
+			return oneof.Type.Elem().Field(0).Type, true
+		}
+	}
+	return nil, false
+}
+
+// walkedMessageType returns the struct type of a proto message field whose
+// node is walked, which excludes the well-known types other than Any and the
+// messages with their own JSON unmarshaller.
+func walkedMessageType(t reflect.Type) (reflect.Type, bool) {
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, false
+	}
+	v := reflect.New(t.Elem()).Interface()
+	if _, ok := v.(proto.Message); !ok {
+		return nil, false
+	}
+	if _, ok := v.(jsonpb.JSONPBUnmarshaler); ok {
+		return nil, false
+	}
+	if w, ok := v.(wellKnownType); ok && w.XXX_WellKnownType() != "Any" {
+		return nil, false
+	}
+	return t.Elem(), true
+}
+
+// unmarshalsField returns whether the value unmarshals into the field of the
+// proto message of type t.
+func unmarshalsField(t reflect.Type, name string, value *yaml.Node) bool {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeJSONString(&buf, name)
+	buf.WriteByte(':')
+	if writeJSON(&buf, value) != nil {
+		return false
+	}
+	buf.WriteByte('}')
+	return unmarshalJSON(buf.Bytes(), reflect.New(t).Interface().(proto.Message)) == nil
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
 	}
-	return &serviceConfig, nil
+	return node
 }
 
 func ProtoToJson(msg proto.Message) (string, error) {
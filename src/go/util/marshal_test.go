@@ -0,0 +1,245 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	fakeYAMLServiceConfig = `
+name: bookstore.endpoints.project123.cloud.goog
+id: 2019-12-01r0
+apis:
+- name: endpoints.examples.bookstore.Bookstore
+  version: v1
+http:
+  rules:
+  - selector: endpoints.examples.bookstore.Bookstore.ListShelves
+    get: /v1/shelves
+backend:
+  rules:
+  - selector: endpoints.examples.bookstore.Bookstore.ListShelves
+    address: https://bookstore.run.app
+    deadline: 10.5
+source_info:
+  source_files:
+  - "@type": type.googleapis.com/google.api.servicemanagement.v1.ConfigFile
+    file_path: api_descriptor.pb
+    file_contents: CgRiYXNl
+    file_type: FILE_DESCRIPTOR_SET_PROTO
+`
+	fakeJSONServiceConfig = `{
+  "name": "bookstore.endpoints.project123.cloud.goog",
+  "id": "2019-12-01r0",
+  "apis": [
+    {
+      "name": "endpoints.examples.bookstore.Bookstore",
+      "version": "v1"
+    }
+  ],
+  "http": {
+    "rules": [
+      {
+        "selector": "endpoints.examples.bookstore.Bookstore.ListShelves",
+        "get": "/v1/shelves"
+      }
+    ]
+  },
+  "backend": {
+    "rules": [
+      {
+        "selector": "endpoints.examples.bookstore.Bookstore.ListShelves",
+        "address": "https://bookstore.run.app",
+        "deadline": 10.5
+      }
+    ]
+  },
+  "sourceInfo": {
+    "sourceFiles": [
+      {
+        "@type": "type.googleapis.com/google.api.servicemanagement.v1.ConfigFile",
+        "filePath": "api_descriptor.pb",
+        "fileContents": "CgRiYXNl",
+        "fileType": "FILE_DESCRIPTOR_SET_PROTO"
+      }
+    ]
+  }
+}`
+)
+
+func TestUnmarshalServiceConfigFile(t *testing.T) {
+	testData := []struct {
+		desc      string
+		path      string
+		config    string
+		wantError string
+	}{
+		{
+			desc:   "YAML by extension",
+			path:   "service.yaml",
+			config: fakeYAMLServiceConfig,
+		},
+		{
+			desc:   "YAML by the yml extension",
+			path:   "service.yml",
+			config: fakeYAMLServiceConfig,
+		},
+		{
+			desc:   "JSON by extension",
+			path:   "service.json",
+			config: fakeJSONServiceConfig,
+		},
+		{
+			desc:   "YAML sniffed from the content",
+			path:   "service",
+			config: fakeYAMLServiceConfig,
+		},
+		{
+			desc:   "JSON sniffed from the content",
+			path:   "service.conf",
+			config: "\n  " + fakeJSONServiceConfig,
+		},
+		{
+			desc:      "JSON is not parsed as YAML by its extension",
+			path:      "service.json",
+			config:    fakeYAMLServiceConfig,
+			wantError: "fail to unmarshal serviceConfig at line 2, column 2:",
+		},
+		{
+			desc:      "YAML syntax error",
+			path:      "service.yaml",
+			config:    strings.Replace(fakeYAMLServiceConfig, "  version: v1", "  version: v1\n    title: a", 1),
+			wantError: "fail to unmarshal serviceConfig: yaml: line 7:",
+		},
+		{
+			desc:      "invalid enum in YAML",
+			path:      "service.yaml",
+			config:    strings.Replace(fakeYAMLServiceConfig, "FILE_DESCRIPTOR_SET_PROTO", "DESCRIPTOR", 1),
+			wantError: "fail to unmarshal serviceConfig at line 21, column 5:",
+		},
+		{
+			desc:      "invalid number in YAML",
+			path:      "service.yaml",
+			config:    strings.Replace(fakeYAMLServiceConfig, "deadline: 10.5", "deadline: ten", 1),
+			wantError: "fail to unmarshal serviceConfig at line 15, column 5:",
+		},
+		{
+			desc:      "sequence instead of a string in YAML",
+			path:      "service.yaml",
+			config:    strings.Replace(fakeYAMLServiceConfig, "get: /v1/shelves", "get: [/v1/shelves]", 1),
+			wantError: "fail to unmarshal serviceConfig at line 10, column 5:",
+		},
+		{
+			desc:      "unknown Any type in YAML",
+			path:      "service.yaml",
+			config:    strings.Replace(fakeYAMLServiceConfig, "servicemanagement.v1.ConfigFile", "servicemanagement.v1.File", 1),
+			wantError: "fail to unmarshal serviceConfig at line 18, column 5:",
+		},
+		{
+			desc:      "invalid enum in JSON",
+			path:      "service.json",
+			config:    strings.Replace(fakeJSONServiceConfig, "FILE_DESCRIPTOR_SET_PROTO", "DESCRIPTOR", 1),
+			wantError: "fail to unmarshal serviceConfig at line 33, column 9:",
+		},
+		{
+			desc:      "JSON syntax error",
+			path:      "service.json",
+			config:    strings.Replace(fakeJSONServiceConfig, `"v1"`, `"v1",`, 1),
+			wantError: "fail to unmarshal serviceConfig at line 8, column 5:",
+		},
+	}
+
+	for _, tc := range testData {
+		got, err := UnmarshalServiceConfigFile(tc.path, []byte(tc.config))
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want: %v", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got error: %v", tc.desc, err)
+			continue
+		}
+
+		want, err := UnmarshalServiceConfig(strings.NewReader(fakeJSONServiceConfig))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotJson, _ := ProtoToJson(got)
+		wantJson, _ := ProtoToJson(want)
+		if err := JsonEqual(wantJson, gotJson); err != nil {
+			t.Errorf("Test (%s): %v", tc.desc, err)
+		}
+		if len(got.GetSourceInfo().GetSourceFiles()) != 1 {
+			t.Errorf("Test (%s): got source files: %v, want the typed ConfigFile", tc.desc, got.GetSourceInfo())
+		}
+	}
+}
+
+func TestYAMLToJSON(t *testing.T) {
+	testData := []struct {
+		desc      string
+		yaml      string
+		want      string
+		wantError string
+	}{
+		{
+			desc: "only null and booleans are not strings",
+			yaml: `
+null: ~
+bool: False
+version: 1.0
+deadline: 300
+list: [a, 1, true]
+`,
+			want: `{"null":null,"bool":false,"version":"1.0","deadline":"300","list":["a","1",true]}`,
+		},
+		{
+			desc: "aliases are resolved",
+			yaml: `
+default: &default
+  selector: "*"
+rules:
+  - *default
+`,
+			want: `{"default":{"selector":"*"},"rules":[{"selector":"*"}]}`,
+		},
+		{
+			desc:      "syntax error",
+			yaml:      "name: a\n  title: b\n",
+			wantError: "yaml: line 2:",
+		},
+	}
+
+	for _, tc := range testData {
+		got, err := YAMLToJSON([]byte(tc.yaml))
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): got error: %v, want: %v", tc.desc, err, tc.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test (%s): got error: %v", tc.desc, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("Test (%s): got: %s, want: %s", tc.desc, got, tc.want)
+		}
+	}
+}
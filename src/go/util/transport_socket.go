@@ -27,6 +27,11 @@ import (
 const (
 	defaultServerSslFilename = "server"
 	defaultClientSslFilename = "client"
+
+	// The names of the SDS secrets of the certificates in
+	// --ssl_server_cert_path and --ssl_client_cert_path.
+	ServerCertSecretName = "server_cert"
+	ClientCertSecretName = "client_cert"
 )
 
 var (
@@ -38,21 +43,47 @@ var (
 	}
 )
 
-// CreateUpstreamTransportSocket creates a TransportSocket for Upstream
-func CreateUpstreamTransportSocket(hostname, rootCertsPath, sslClientPath string, alpnProtocols []string) (*corepb.TransportSocket, error) {
-	if rootCertsPath == "" {
-		return nil, fmt.Errorf("root certs path cannot be empty.")
+// ServerCertFiles returns the certificate and private key files in the
+// --ssl_server_cert_path.
+func ServerCertFiles(sslServerPath string) (string, string) {
+	sslFileName := defaultServerSslFilename
+	// Backward compatible for ESPv1
+	if strings.Contains(sslServerPath, "/etc/nginx/ssl") {
+		sslFileName = "nginx"
 	}
+	return sslCertFiles(sslServerPath, sslFileName)
+}
 
+// ClientCertFiles returns the certificate and private key files in the
+// --ssl_client_cert_path.
+func ClientCertFiles(sslClientPath string) (string, string) {
 	sslFileName := defaultClientSslFilename
 	// Backward compatible for ESPv1
 	if strings.Contains(sslClientPath, "/etc/nginx/ssl") {
 		sslFileName = "backend"
 	}
+	return sslCertFiles(sslClientPath, sslFileName)
+}
 
-	common_tls, err := createCommonTlsContext(rootCertsPath, sslClientPath, sslFileName, "", "")
-	if err != nil {
-		return nil, err
+func sslCertFiles(sslPath, sslFileName string) (string, string) {
+	if !strings.HasSuffix(sslPath, "/") {
+		sslPath = fmt.Sprintf("%s/", sslPath)
+	}
+	return fmt.Sprintf("%s%s.crt", sslPath, sslFileName), fmt.Sprintf("%s%s.key", sslPath, sslFileName)
+}
+
+// CreateUpstreamTransportSocket creates a TransportSocket for Upstream.
+// If useSds is true, the client certificate is the SDS secret
+// ClientCertSecretName instead of the files in sslClientPath.
+func CreateUpstreamTransportSocket(hostname, rootCertsPath, sslClientPath string, alpnProtocols []string, useSds bool) (*corepb.TransportSocket, error) {
+	if rootCertsPath == "" {
+		return nil, fmt.Errorf("root certs path cannot be empty.")
+	}
+
+	common_tls := createCommonTlsContext(rootCertsPath, "", "")
+	if sslClientPath != "" {
+		certPath, keyPath := ClientCertFiles(sslClientPath)
+		addTlsCertificate(common_tls, certPath, keyPath, ClientCertSecretName, useSds)
 	}
 	if len(alpnProtocols) > 0 {
 		common_tls.AlpnProtocols = alpnProtocols
@@ -74,22 +105,17 @@ func CreateUpstreamTransportSocket(hostname, rootCertsPath, sslClientPath string
 	}, nil
 }
 
-// CreateDownstreamTransportSocket creates a TransportSocket for Downstream
-func CreateDownstreamTransportSocket(sslServerPath, sslMinimumProtocol, sslMaximumProtocol string) (*corepb.TransportSocket, error) {
+// CreateDownstreamTransportSocket creates a TransportSocket for Downstream.
+// If useSds is true, the server certificate is the SDS secret
+// ServerCertSecretName instead of the files in sslServerPath.
+func CreateDownstreamTransportSocket(sslServerPath, sslMinimumProtocol, sslMaximumProtocol string, useSds bool) (*corepb.TransportSocket, error) {
 	if sslServerPath == "" {
 		return nil, fmt.Errorf("SSL path cannot be empty.")
 	}
 
-	sslFileName := defaultServerSslFilename
-	// Backward compatible for ESPv1
-	if strings.Contains(sslServerPath, "/etc/nginx/ssl") {
-		sslFileName = "nginx"
-	}
-
-	common_tls, err := createCommonTlsContext("", sslServerPath, sslFileName, sslMinimumProtocol, sslMaximumProtocol)
-	if err != nil {
-		return nil, err
-	}
+	common_tls := createCommonTlsContext("", sslMinimumProtocol, sslMaximumProtocol)
+	certPath, keyPath := ServerCertFiles(sslServerPath)
+	addTlsCertificate(common_tls, certPath, keyPath, ServerCertSecretName, useSds)
 	common_tls.AlpnProtocols = []string{"h2", "http/1.1"}
 	tlsContext, err := ptypes.MarshalAny(&authpb.DownstreamTlsContext{
 		CommonTlsContext: common_tls,
@@ -106,30 +132,42 @@ func CreateDownstreamTransportSocket(sslServerPath, sslMinimumProtocol, sslMaxim
 	}, nil
 }
 
-func createCommonTlsContext(rootCertsPath, sslPath, sslFileName, sslMinimumProtocol, sslMaximumProtocol string) (*authpb.CommonTlsContext, error) {
-	common_tls := &authpb.CommonTlsContext{}
-	// Add TLS certificate
-	if sslPath != "" && sslFileName != "" {
-		if !strings.HasSuffix(sslPath, "/") {
-			sslPath = fmt.Sprintf("%s/", sslPath)
-		}
-
-		common_tls.TlsCertificates = []*authpb.TlsCertificate{
+// addTlsCertificate adds the certificate to the TLS context, either by its
+// files or by its SDS secret served over ADS.
+func addTlsCertificate(common_tls *authpb.CommonTlsContext, certPath, keyPath, secretName string, useSds bool) {
+	if useSds {
+		common_tls.TlsCertificateSdsSecretConfigs = []*authpb.SdsSecretConfig{
 			{
-				CertificateChain: &corepb.DataSource{
-					Specifier: &corepb.DataSource_Filename{
-						Filename: fmt.Sprintf("%s%s.crt", sslPath, sslFileName),
-					},
-				},
-				PrivateKey: &corepb.DataSource{
-					Specifier: &corepb.DataSource_Filename{
-						Filename: fmt.Sprintf("%s%s.key", sslPath, sslFileName),
+				Name: secretName,
+				SdsConfig: &corepb.ConfigSource{
+					ConfigSourceSpecifier: &corepb.ConfigSource_Ads{
+						Ads: &corepb.AggregatedConfigSource{},
 					},
 				},
 			},
 		}
+		return
 	}
 
+	common_tls.TlsCertificates = []*authpb.TlsCertificate{
+		{
+			CertificateChain: &corepb.DataSource{
+				Specifier: &corepb.DataSource_Filename{
+					Filename: certPath,
+				},
+			},
+			PrivateKey: &corepb.DataSource{
+				Specifier: &corepb.DataSource_Filename{
+					Filename: keyPath,
+				},
+			},
+		},
+	}
+}
+
+func createCommonTlsContext(rootCertsPath, sslMinimumProtocol, sslMaximumProtocol string) *authpb.CommonTlsContext {
+	common_tls := &authpb.CommonTlsContext{}
+
 	// Add Validation Context
 	if rootCertsPath != "" {
 		common_tls.ValidationContextType = &authpb.CommonTlsContext_ValidationContext{
@@ -152,5 +190,5 @@ func createCommonTlsContext(rootCertsPath, sslPath, sslFileName, sslMinimumProto
 			common_tls.TlsParams.TlsMaximumProtocolVersion = maxVersion
 		}
 	}
-	return common_tls, nil
+	return common_tls
 }
@@ -27,6 +27,7 @@ func TestCreateUpstreamTransportSocket(t *testing.T) {
 		rootCertsPath       string
 		sslBackendPath      string
 		alpnProtocols       []string
+		useSds              bool
 		wantTransportSocket string
 	}{
 		{
@@ -110,10 +111,39 @@ func TestCreateUpstreamTransportSocket(t *testing.T) {
 						},
 						"sni":"https://echo-http-12345-uc.a.run.app"}}`,
 		},
+		{
+			desc:           "Upstream Transport Socket for mTLS, with the client cert from SDS",
+			hostName:       "https://echo-http-12345-uc.a.run.app",
+			rootCertsPath:  "/etc/ssl/certs/ca-certificates.crt",
+			sslBackendPath: "/etc/endpoints/ssl",
+			alpnProtocols:  []string{"h2"},
+			useSds:         true,
+			wantTransportSocket: `{
+				"name":"envoy.transport_sockets.tls",
+				"typedConfig":{
+					"@type":"type.googleapis.com/envoy.api.v2.auth.UpstreamTlsContext",
+					"commonTlsContext":{
+						"alpnProtocols":["h2"],
+						"tlsCertificateSdsSecretConfigs":[
+							{
+								"name":"client_cert",
+								"sdsConfig":{
+									"ads":{}
+								}
+							}
+						],
+						"validationContext":{
+							"trustedCa":{
+								"filename":"/etc/ssl/certs/ca-certificates.crt"
+								}
+							}
+						},
+						"sni":"https://echo-http-12345-uc.a.run.app"}}`,
+		},
 	}
 
 	for i, tc := range testData {
-		gotTransportSocket, err := CreateUpstreamTransportSocket(tc.hostName, tc.rootCertsPath, tc.sslBackendPath, tc.alpnProtocols)
+		gotTransportSocket, err := CreateUpstreamTransportSocket(tc.hostName, tc.rootCertsPath, tc.sslBackendPath, tc.alpnProtocols, tc.useSds)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -134,6 +164,7 @@ func TestCreateDownstreamTransportSocket(t *testing.T) {
 		sslPath             string
 		sslMinimumProtocol  string
 		sslMaximumProtocol  string
+		useSds              bool
 		wantTransportSocket string
 	}{
 		{
@@ -219,10 +250,36 @@ func TestCreateDownstreamTransportSocket(t *testing.T) {
 				}
 			}`,
 		},
+		{
+			desc:               "Downstream Transport Socket for TLS, with the server cert from SDS",
+			sslPath:            "/etc/ssl/endpoints/",
+			sslMinimumProtocol: "TLSv1.2",
+			useSds:             true,
+			wantTransportSocket: `{
+				"name":"envoy.transport_sockets.tls",
+				"typedConfig":{
+					"@type":"type.googleapis.com/envoy.api.v2.auth.DownstreamTlsContext",
+					"commonTlsContext":{
+						"alpnProtocols":["h2","http/1.1"],
+						"tlsCertificateSdsSecretConfigs":[
+							{
+								"name":"server_cert",
+								"sdsConfig":{
+									"ads":{}
+								}
+							}
+						],
+						"tlsParams":{
+							"tlsMinimumProtocolVersion":"TLSv1_2"
+						}
+					}
+				}
+			}`,
+		},
 	}
 
 	for i, tc := range testData {
-		gotTransportSocket, err := CreateDownstreamTransportSocket(tc.sslPath, tc.sslMinimumProtocol, tc.sslMaximumProtocol)
+		gotTransportSocket, err := CreateDownstreamTransportSocket(tc.sslPath, tc.sslMinimumProtocol, tc.sslMaximumProtocol, tc.useSds)
 		if err != nil {
 			t.Fatal(err)
 		}
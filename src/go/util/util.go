@@ -45,6 +45,12 @@ const (
 	BackendAuth = "envoy.filters.http.backend_auth"
 	// BackendRouting filter.
 	BackendRouting = "envoy.filters.http.backend_routing"
+	// LocalRateLimit filter.
+	LocalRateLimit = "envoy.filters.http.local_rate_limit"
+	// RateLimitDescriptors filter.
+	RateLimitDescriptors = "envoy.filters.http.rate_limit_descriptors"
+	// RateLimit HTTP filter, which calls the rate limit service.
+	RateLimit = "envoy.rate_limit"
 	// GrpcStats filter name
 	GrpcStatsFilterName = "envoy.filters.http.grpc_stats"
 	// TLSTransportSocket is Envoy TLS Transport Socket name.
@@ -95,6 +101,9 @@ const (
 	// The service control server cluster name.
 	ServiceControlClusterName = "service-control-cluster"
 
+	// The rate limit service cluster name.
+	RateLimitServiceClusterName = "rate-limit-service-cluster"
+
 	// Platforms
 
 	GAEFlex = "GAE_FLEX(ESPv2)"
@@ -104,6 +113,10 @@ const (
 	// System Parameter Name
 	ApiKeyParameterName = "api_key"
 
+	// The operation of the generated health check method, which is the same
+	// for all the services.
+	HealthCheckOperation = "ESPv2.HealthCheck"
+
 	// Default response deadline used if user does not specify one in the BackendRule.
 	DefaultResponseDeadline = 15 * time.Second
 
@@ -121,6 +134,14 @@ const (
 	// Default api key locations
 	DefaultApiKeyQueryParamKey    = "key"
 	DefaultApiKeyQueryParamApiKey = "api_key"
+	DefaultApiKeyHeader           = "x-api-key"
+
+	// The request headers of the rate limit descriptors, set by the
+	// RateLimitDescriptors filter.
+	RateLimitOperationHeader  = "x-endpoint-api-rate-limit-operation"
+	RateLimitApiKeyHeader     = "x-endpoint-api-rate-limit-api-key"
+	RateLimitJwtIssuerHeader  = "x-endpoint-api-rate-limit-jwt-issuer"
+	RateLimitJwtSubjectHeader = "x-endpoint-api-rate-limit-jwt-subject"
 
 	// Strict Transport Security header key and value
 	HSTSHeaderKey   = "Strict-Transport-Security"
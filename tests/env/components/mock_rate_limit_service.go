@@ -0,0 +1,181 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/tests/env/platform"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+
+	ratelimitpb "github.com/envoyproxy/go-control-plane/envoy/api/v2/ratelimit"
+	rlspb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
+)
+
+// MockRateLimitService mocks the rate limit service called by the Envoy rate
+// limit filter over gRPC. It counts the hits of each descriptor, and a
+// descriptor is over the limit once its hits exceed the limit of its keys.
+type MockRateLimitService struct {
+	s                  *grpc.Server
+	lis                net.Listener
+	ch                 chan *rlspb.RateLimitRequest
+	count              *int32
+	getRequestsTimeout time.Duration
+
+	mu sync.Mutex
+	// The limits by the keys of the descriptors, joined by ",".
+	limits map[string]uint32
+	// The hits by the descriptors.
+	hits map[string]uint32
+	// The error returned instead of the responses, if any.
+	err error
+}
+
+// NewMockRateLimitService creates a new gRPC server of the rate limit service.
+func NewMockRateLimitService() *MockRateLimitService {
+	return &MockRateLimitService{
+		ch:                 make(chan *rlspb.RateLimitRequest, 100),
+		count:              new(int32),
+		getRequestsTimeout: defaultTimeout,
+		limits:             make(map[string]uint32),
+		hits:               make(map[string]uint32),
+	}
+}
+
+// Setup starts the server on a free port of the loopback address.
+func (m *MockRateLimitService) Setup() error {
+	lis, err := net.Listen("tcp", fmt.Sprintf("%v:0", platform.GetLoopbackAddress()))
+	if err != nil {
+		return fmt.Errorf("fail to listen for mock rate limit service, %v", err)
+	}
+	m.lis = lis
+	m.s = grpc.NewServer()
+	rlspb.RegisterRateLimitServiceServer(m.s, m)
+
+	glog.Infof("Start mock rate limit service on %v", lis.Addr())
+	go func() {
+		if err := m.s.Serve(lis); err != nil {
+			glog.Errorf("mock rate limit service stopped, %v", err)
+		}
+	}()
+	return nil
+}
+
+// StopAndWait stops the server.
+func (m *MockRateLimitService) StopAndWait() {
+	if m.s != nil {
+		m.s.Stop()
+	}
+}
+
+// GetURL returns the address of MockRateLimitService for
+// --rate_limit_service_address.
+func (m *MockRateLimitService) GetURL() string {
+	return "grpc://" + m.lis.Addr().String()
+}
+
+// SetLimit sets the hits allowed for each descriptor with the keys, in order.
+// The descriptors with other keys are never over the limit.
+func (m *MockRateLimitService) SetLimit(limit uint32, keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limits[strings.Join(keys, ",")] = limit
+}
+
+// SetError sets the error returned instead of the responses, such as an
+// Unavailable status. Nil restores the responses.
+func (m *MockRateLimitService) SetError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+// ShouldRateLimit implements the rate limit service.
+func (m *MockRateLimitService) ShouldRateLimit(ctx context.Context, req *rlspb.RateLimitRequest) (*rlspb.RateLimitResponse, error) {
+	glog.Infof("Mock rate limit service request: %v", req)
+	atomic.AddInt32(m.count, 1)
+	m.ch <- req
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	hitsAddend := req.GetHitsAddend()
+	if hitsAddend == 0 {
+		hitsAddend = 1
+	}
+	resp := &rlspb.RateLimitResponse{
+		OverallCode: rlspb.RateLimitResponse_OK,
+	}
+	for _, descriptor := range req.GetDescriptors() {
+		descriptorStatus := &rlspb.RateLimitResponse_DescriptorStatus{
+			Code: rlspb.RateLimitResponse_OK,
+		}
+		keys, key := descriptorKeys(req.GetDomain(), descriptor)
+		if limit, ok := m.limits[keys]; ok {
+			m.hits[key] += hitsAddend
+			if m.hits[key] > limit {
+				descriptorStatus.Code = rlspb.RateLimitResponse_OVER_LIMIT
+				resp.OverallCode = rlspb.RateLimitResponse_OVER_LIMIT
+			}
+		}
+		resp.Statuses = append(resp.Statuses, descriptorStatus)
+	}
+	return resp, nil
+}
+
+// descriptorKeys returns the keys of the descriptor joined by ",", and the
+// key of its hits in the domain.
+func descriptorKeys(domain string, descriptor *ratelimitpb.RateLimitDescriptor) (string, string) {
+	var keys, entries []string
+	for _, entry := range descriptor.GetEntries() {
+		keys = append(keys, entry.GetKey())
+		entries = append(entries, fmt.Sprintf("%s=%s", entry.GetKey(), entry.GetValue()))
+	}
+	return strings.Join(keys, ","), domain + "\n" + strings.Join(entries, "\n")
+}
+
+// GetRequestCount returns the number of the requests received.
+func (m *MockRateLimitService) GetRequestCount() int {
+	return int(atomic.LoadInt32(m.count))
+}
+
+// SetGetRequestsTimeout sets the timeout for GetRequests.
+func (m *MockRateLimitService) SetGetRequestsTimeout(timeout time.Duration) {
+	m.getRequestsTimeout = timeout
+}
+
+// GetRequests returns a slice of requests received.
+func (m *MockRateLimitService) GetRequests(n int) ([]*rlspb.RateLimitRequest, error) {
+	r := make([]*rlspb.RateLimitRequest, n)
+	for i := 0; i < n; i++ {
+		select {
+		case d := <-m.ch:
+			r[i] = d
+		case <-time.After(m.getRequestsTimeout):
+			return nil, fmt.Errorf("Timeout got %d, expected: %d", i, n)
+		}
+	}
+	return r, nil
+}
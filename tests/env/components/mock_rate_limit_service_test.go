@@ -0,0 +1,117 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	ratelimitpb "github.com/envoyproxy/go-control-plane/envoy/api/v2/ratelimit"
+	rlspb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
+)
+
+func makeRateLimitRequest(apiKey string) *rlspb.RateLimitRequest {
+	return &rlspb.RateLimitRequest{
+		Domain: "echo",
+		Descriptors: []*ratelimitpb.RateLimitDescriptor{
+			{
+				Entries: []*ratelimitpb.RateLimitDescriptor_Entry{
+					{Key: "operation", Value: "Echo"},
+				},
+			},
+			{
+				Entries: []*ratelimitpb.RateLimitDescriptor_Entry{
+					{Key: "operation", Value: "Echo"},
+					{Key: "api_key", Value: apiKey},
+				},
+			},
+		},
+	}
+}
+
+func TestMockRateLimitService(t *testing.T) {
+	s := NewMockRateLimitService()
+	if err := s.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopAndWait()
+	s.SetLimit(1, "operation", "api_key")
+
+	conn, err := grpc.Dial(s.lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("fail to dial mock rate limit service, %v", err)
+	}
+	defer conn.Close()
+	client := rlspb.NewRateLimitServiceClient(conn)
+
+	testData := []struct {
+		apiKey       string
+		wantCode     rlspb.RateLimitResponse_Code
+		wantStatuses []rlspb.RateLimitResponse_Code
+	}{
+		{
+			apiKey:       "key-a",
+			wantCode:     rlspb.RateLimitResponse_OK,
+			wantStatuses: []rlspb.RateLimitResponse_Code{rlspb.RateLimitResponse_OK, rlspb.RateLimitResponse_OK},
+		},
+		{
+			apiKey:       "key-a",
+			wantCode:     rlspb.RateLimitResponse_OVER_LIMIT,
+			wantStatuses: []rlspb.RateLimitResponse_Code{rlspb.RateLimitResponse_OK, rlspb.RateLimitResponse_OVER_LIMIT},
+		},
+		{
+			apiKey:       "key-b",
+			wantCode:     rlspb.RateLimitResponse_OK,
+			wantStatuses: []rlspb.RateLimitResponse_Code{rlspb.RateLimitResponse_OK, rlspb.RateLimitResponse_OK},
+		},
+	}
+	for i, tc := range testData {
+		resp, err := client.ShouldRateLimit(context.Background(), makeRateLimitRequest(tc.apiKey))
+		if err != nil {
+			t.Fatalf("Test #%d: fail to call ShouldRateLimit, %v", i, err)
+		}
+		if resp.GetOverallCode() != tc.wantCode {
+			t.Errorf("Test #%d: got overall code: %v, want: %v", i, resp.GetOverallCode(), tc.wantCode)
+		}
+		if len(resp.GetStatuses()) != len(tc.wantStatuses) {
+			t.Fatalf("Test #%d: got statuses: %v, want: %v", i, resp.GetStatuses(), tc.wantStatuses)
+		}
+		for j, status := range resp.GetStatuses() {
+			if status.GetCode() != tc.wantStatuses[j] {
+				t.Errorf("Test #%d: got code of descriptor %d: %v, want: %v", i, j, status.GetCode(), tc.wantStatuses[j])
+			}
+		}
+	}
+
+	reqs, err := s.GetRequests(len(testData))
+	if err != nil {
+		t.Fatalf("GetRequests failed with: %v", err)
+	}
+	if got := reqs[2].GetDescriptors()[1].GetEntries()[1].GetValue(); got != "key-b" {
+		t.Errorf("got api key of the last request: %v, want: key-b", got)
+	}
+	if s.GetRequestCount() != len(testData) {
+		t.Errorf("got request count: %d, want: %d", s.GetRequestCount(), len(testData))
+	}
+
+	// try to read it again
+	s.SetGetRequestsTimeout(500 * time.Millisecond)
+	if _, err := s.GetRequests(1); err == nil {
+		t.Errorf("Expected timeout error")
+	}
+}
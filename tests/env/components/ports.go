@@ -74,6 +74,7 @@ const (
 	TestMultiGrpcServices
 	TestPreflightCorsWithBasicPreset
 	TestPreflightRequestWithAllowCors
+	TestRateLimitService
 	TestReportGCPAttributes
 	TestServiceControlAccessToken
 	TestServiceControlAllHTTPMethod
@@ -71,6 +71,7 @@ type TestEnv struct {
 	envoyDrainTimeInSec             int
 	ServiceControlServer            *components.MockServiceCtrl
 	FakeStackdriverServer           *components.FakeTraceServer
+	MockRateLimitService            *components.MockRateLimitService
 	healthRegistry                  *components.HealthRegistry
 	FakeJwtService                  *components.FakeJwtService
 	skipHealthChecks                bool
@@ -248,6 +249,12 @@ func (e *TestEnv) SetupFakeTraceServer() {
 	e.FakeStackdriverServer = components.NewFakeStackdriver()
 }
 
+// SetupMockRateLimitService enables the rate limit filter, which calls a mock
+// rate limit service.
+func (e *TestEnv) SetupMockRateLimitService() {
+	e.MockRateLimitService = components.NewMockRateLimitService()
+}
+
 func (e *TestEnv) DisableHttp2ForHttpsBackend() {
 	e.disableHttp2ForHttpsBackend = true
 }
@@ -293,6 +300,13 @@ func (e *TestEnv) Setup(confArgs []string) error {
 		confArgs = append(confArgs, "--service_management_url="+e.MockServiceManagementServer.Start())
 	}
 
+	if e.MockRateLimitService != nil {
+		if err := e.MockRateLimitService.Setup(); err != nil {
+			return err
+		}
+		confArgs = append(confArgs, "--rate_limit_service_address="+e.MockRateLimitService.GetURL())
+	}
+
 	if !e.enableScNetworkFailOpen {
 		confArgs = append(confArgs, "--service_control_network_fail_open=false")
 	}
@@ -504,5 +518,9 @@ func (e *TestEnv) TearDown() {
 		e.FakeStackdriverServer.StopAndWait()
 	}
 
+	if e.MockRateLimitService != nil {
+		e.MockRateLimitService.StopAndWait()
+	}
+
 	glog.Infof("finish tearing down...")
 }
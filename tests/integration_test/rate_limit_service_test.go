@@ -0,0 +1,109 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integration_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/tests/endpoints/echo/client"
+	"github.com/GoogleCloudPlatform/esp-v2/tests/env"
+	"github.com/GoogleCloudPlatform/esp-v2/tests/env/platform"
+
+	comp "github.com/GoogleCloudPlatform/esp-v2/tests/env/components"
+)
+
+func TestRateLimitService(t *testing.T) {
+	t.Parallel()
+
+	configId := "test-config-id"
+	args := []string{"--service_config_id=" + configId,
+		"--rollout_strategy=fixed", "--rate_limit_domain=echo"}
+
+	s := env.NewTestEnv(comp.TestRateLimitService, platform.EchoSidecar)
+	s.SetupMockRateLimitService()
+	s.MockRateLimitService.SetLimit(1, "operation", "api_key")
+	defer s.TearDown()
+	if err := s.Setup(args); err != nil {
+		t.Fatalf("fail to setup test env, %v", err)
+	}
+
+	testData := []struct {
+		desc          string
+		apiKey        string
+		wantError     string
+		wantResp      string
+		wantOperation string
+	}{
+		{
+			desc:          "succeed, the first request of the api key is under the limit",
+			apiKey:        "key-a",
+			wantResp:      `{"message":"hello"}`,
+			wantOperation: "1.echo_api_endpoints_cloudesf_testing_cloud_goog.Echo",
+		},
+		{
+			desc:          "failed, the second request of the api key is over the limit",
+			apiKey:        "key-a",
+			wantError:     "429 Too Many Requests",
+			wantOperation: "1.echo_api_endpoints_cloudesf_testing_cloud_goog.Echo",
+		},
+		{
+			desc:          "succeed, the limit is per api key",
+			apiKey:        "key-b",
+			wantResp:      `{"message":"hello"}`,
+			wantOperation: "1.echo_api_endpoints_cloudesf_testing_cloud_goog.Echo",
+		},
+	}
+	for _, tc := range testData {
+		url := fmt.Sprintf("http://localhost:%v/echo?key=%v", s.Ports().ListenerPort, tc.apiKey)
+		resp, err := client.DoWithHeaders(url, "POST", `{"message":"hello"}`, nil)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test (%s): failed, expected error: %v, got: %v", tc.desc, tc.wantError, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("Test (%s): failed, %v", tc.desc, err)
+			}
+			if !strings.Contains(string(resp), tc.wantResp) {
+				t.Errorf("Test (%s): failed, expected: %s, got: %s", tc.desc, tc.wantResp, string(resp))
+			}
+		}
+
+		rlsRequests, err := s.MockRateLimitService.GetRequests(1)
+		if err != nil {
+			t.Fatalf("Test (%s): failed, GetRequests returns error: %v", tc.desc, err)
+		}
+		if got := rlsRequests[0].GetDomain(); got != "echo" {
+			t.Errorf("Test (%s): failed, expected domain: echo, got: %v", tc.desc, got)
+		}
+		want := map[string]string{
+			"operation": tc.wantOperation,
+			"api_key":   tc.apiKey,
+		}
+		got := make(map[string]string)
+		for _, descriptor := range rlsRequests[0].GetDescriptors() {
+			for _, entry := range descriptor.GetEntries() {
+				got[entry.GetKey()] = entry.GetValue()
+			}
+		}
+		for key, value := range want {
+			if got[key] != value {
+				t.Errorf("Test (%s): failed, expected descriptor entry %s: %s, got: %s", tc.desc, key, value, got[key])
+			}
+		}
+	}
+}